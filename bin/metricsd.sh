@@ -65,12 +65,18 @@ case "$1" in
         $0 start
         ;;
 
+    reload)
+        echo -n "Reloading configuration: "
+        kill -HUP $(cat ${SERVER_PID}) &> /dev/null
+        echo "Ok"
+        ;;
+
     chkconfig)
         exec ${SERVER} ${SERVER_ARGS} -test
         ;;
 
     *)
-        echo "Usage: $0 {start|stop|restart|stopkill|chkconfig}"
+        echo "Usage: $0 {start|stop|restart|reload|stopkill|chkconfig}"
         exit 1
     ;;
 esac
@@ -0,0 +1,490 @@
+// Package alerts implements threshold alerts on rolled up values.
+//
+// Alert rules are defined in the config file on a field of a writer, e.g.
+// "api.login.time percentiles.pct95 > 500 for 3 slices". Writers pass every
+// rolled up data item to the Engine, which tracks consecutive slices
+// matching the condition for each series. An alert fires once the condition
+// holds for the required number of slices, and is resolved by the first
+// slice not matching it. Fired and resolved alerts are sent to notifiers
+// (webhook, exec, smtp) in background.
+package alerts
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"metricsd/config"
+	"metricsd/logger"
+)
+
+// Number of write intervals after which firing alerts of series not updated
+// anymore are resolved.
+const ALERTS_STALE_INTERVALS = 3
+
+// Number of resolved alerts kept in history.
+const ALERTS_HISTORY_SIZE = 100
+
+// Max number of notifications waiting to be sent.
+const ALERTS_QUEUE_SIZE = 1000
+
+// Alert states.
+const (
+	FIRING   = "firing"
+	RESOLVED = "resolved"
+)
+
+// Rule is a parsed alert rule.
+type Rule struct {
+	Name      string
+	Source    string   // source pattern (see path.Match for the syntax)
+	Metric    string   // metric name pattern (see path.Match for the syntax)
+	Writer    string   // writer name, e.g. "percentiles"
+	Field     string   // field of the writer data, e.g. "pct95"
+	Operator  string   // comparison operator: >, >=, <, or <=
+	Threshold float64  // threshold (percents are converted to ratios)
+	Slices    int      // number of consecutive slices the condition should hold for
+	Notify    []string // names of notifiers (all notifiers if empty)
+	expr      string   // the original rule
+}
+
+// Alert is a fired (or resolved) alert of a series.
+type Alert struct {
+	Name      string  `json:"name"`      // alert rule name
+	Rule      string  `json:"rule"`      // alert rule condition
+	Source    string  `json:"source"`    // source of the series
+	Metric    string  `json:"metric"`    // metric name
+	Series    string  `json:"series"`    // metric name with tags
+	State     string  `json:"state"`     // firing or resolved
+	Value     float64 `json:"value"`     // the latest value of the field
+	Threshold float64 `json:"threshold"` // threshold of the rule
+	Since     int64   `json:"since"`     // time of the slice the alert fired at
+	Until     int64   `json:"until"`     // time the alert was resolved at (0 while firing)
+}
+
+// Observation is a rolled up value of a series.
+type Observation struct {
+	Writer string             // writer name
+	Source string             // source of the series
+	Metric string             // metric name
+	Series string             // metric name with tags
+	Time   int64              // time of the slice
+	Fields map[string]float64 // values of the writer data fields
+}
+
+// state tracks a rule condition for a single series.
+type state struct {
+	rule    *Rule
+	slices  int    // number of consecutive slices matching the condition
+	last    int64  // time of the last slice matching the condition
+	alert   *Alert // firing alert (nil if not fired)
+	updated int64  // time of the last update
+}
+
+// notification is an alert waiting to be sent to the notifiers.
+type notification struct {
+	alert     *Alert
+	notifiers []Notifier
+}
+
+// Engine evaluates alert rules against rolled up values, and sends fired
+// and resolved alerts to notifiers.
+type Engine struct {
+	log       logger.Logger
+	mutex     sync.Mutex
+	rules     []*Rule
+	notifiers map[string]Notifier
+	states    map[string]*state // by rule name, source, and series
+	changed   []*notification   // alerts fired or resolved since the last flush
+	resolved  []*Alert          // recently resolved alerts, the latest first
+	queue     chan *notification
+	done      chan bool
+}
+
+// ParseRule parses an alert rule condition in the
+//     <metric> <writer>.<field> <operator> <threshold>[%] [for <n> slices]
+// format, e.g. "api.login.time percentiles.pct95 > 500 for 3 slices", or
+// "api.login count.fail_ratio > 5%" (percents are converted to ratios).
+// The metric is a pattern (see path.Match for the syntax), operator is one
+// of >, >=, <, or <=. Alert fires after a single slice when the number of
+// slices is omitted.
+func ParseRule(name, source, expr string) (*Rule, os.Error) {
+	invalid := func(format string, v ...interface{}) (*Rule, os.Error) {
+		return nil, os.NewError(fmt.Sprintf("Alert %q rule %q is invalid: %s", name, expr, fmt.Sprintf(format, v...)))
+	}
+
+	words := strings.Fields(expr)
+	if len(words) != 4 && len(words) != 7 {
+		return invalid("expected \"<metric> <writer>.<field> <operator> <threshold> [for <n> slices]\"")
+	}
+	rule := &Rule{Name: name, Source: source, Metric: words[0], Operator: words[2], Slices: 1, expr: expr}
+	if _, err := path.Match(rule.Source, ""); err != nil {
+		return invalid("source pattern %q is invalid", rule.Source)
+	}
+	if _, err := path.Match(rule.Metric, ""); err != nil {
+		return invalid("metric pattern %q is invalid", rule.Metric)
+	}
+	field := strings.SplitN(words[1], ".", 2)
+	if len(field) != 2 || len(field[0]) == 0 || len(field[1]) == 0 {
+		return invalid("field %q should be in the <writer>.<field> format", words[1])
+	}
+	rule.Writer, rule.Field = field[0], field[1]
+	switch rule.Operator {
+	case ">", ">=", "<", "<=":
+	default:
+		return invalid("operator %q is unknown", rule.Operator)
+	}
+
+	threshold := words[3]
+	percents := strings.HasSuffix(threshold, "%")
+	if percents {
+		threshold = threshold[:len(threshold)-1]
+	}
+	var err os.Error
+	if rule.Threshold, err = strconv.Atof64(threshold); err != nil {
+		return invalid("threshold %q is not a number", words[3])
+	}
+	if percents {
+		rule.Threshold /= 100
+	}
+
+	if len(words) == 7 {
+		if words[4] != "for" || (words[6] != "slices" && words[6] != "slice") {
+			return invalid("expected \"for <n> slices\"")
+		}
+		if rule.Slices, err = strconv.Atoi(words[5]); err != nil || rule.Slices < 1 {
+			return invalid("number of slices %q should be positive", words[5])
+		}
+	}
+	return rule, nil
+}
+
+// String returns the rule condition.
+func (rule *Rule) String() string {
+	return rule.expr
+}
+
+// matches returns a value indicating whether the rule is defined for the
+// given writer and series.
+func (rule *Rule) matches(writer, source, metric string) bool {
+	if rule.Writer != writer {
+		return false
+	}
+	if matched, _ := path.Match(rule.Source, source); !matched {
+		return false
+	}
+	matched, _ := path.Match(rule.Metric, metric)
+	return matched
+}
+
+// holds returns a value indicating whether the value matches the condition.
+func (rule *Rule) holds(value float64) bool {
+	switch rule.Operator {
+	case ">":
+		return value > rule.Threshold
+	case ">=":
+		return value >= rule.Threshold
+	case "<":
+		return value < rule.Threshold
+	case "<=":
+		return value <= rule.Threshold
+	}
+	return false
+}
+
+// Load parses alert rules, and creates notifiers from the given config.
+func Load(alertConfigs []config.AlertConfig, notifierConfigs []config.NotifierConfig) (rules []*Rule, notifiers map[string]Notifier, err os.Error) {
+	notifiers = make(map[string]Notifier, len(notifierConfigs))
+	for _, notifierConfig := range notifierConfigs {
+		if _, found := notifiers[notifierConfig.Name]; found {
+			return nil, nil, os.NewError(fmt.Sprintf("Notifier %q is configured twice", notifierConfig.Name))
+		}
+		notifier, err := NewNotifier(notifierConfig.Type, notifierConfig.Options)
+		if err != nil {
+			return nil, nil, os.NewError(fmt.Sprintf("Notifier %q: %s", notifierConfig.Name, err))
+		}
+		notifiers[notifierConfig.Name] = notifier
+	}
+
+	names := make(map[string]bool, len(alertConfigs))
+	rules = make([]*Rule, 0, len(alertConfigs))
+	for _, alertConfig := range alertConfigs {
+		if names[alertConfig.Name] {
+			return nil, nil, os.NewError(fmt.Sprintf("Alert %q is configured twice", alertConfig.Name))
+		}
+		source := alertConfig.Source
+		if len(source) == 0 {
+			source = "all"
+		}
+		rule, err := ParseRule(alertConfig.Name, source, alertConfig.Rule)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, name := range alertConfig.Notify {
+			if _, found := notifiers[name]; !found {
+				return nil, nil, os.NewError(fmt.Sprintf("Notifier %q used in alert %q is not configured", name, alertConfig.Name))
+			}
+		}
+		rule.Notify = alertConfig.Notify
+		names[alertConfig.Name] = true
+		rules = append(rules, rule)
+	}
+	return
+}
+
+// New creates an alerts engine without rules, and starts sending
+// notifications in background.
+func New(log logger.Logger) *Engine {
+	engine := &Engine{
+		log:       log,
+		notifiers: make(map[string]Notifier),
+		states:    make(map[string]*state),
+		queue:     make(chan *notification, ALERTS_QUEUE_SIZE),
+		done:      make(chan bool),
+	}
+	go engine.run()
+	return engine
+}
+
+// Configure replaces alert rules and notifiers. States of rules which have
+// not been changed are kept, firing alerts of changed and removed rules are
+// resolved (and sent to their notifiers on the next Flush).
+func (engine *Engine) Configure(rules []*Rule, notifiers map[string]Notifier) {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+
+	current := make(map[string]*Rule, len(rules))
+	for _, rule := range rules {
+		current[rule.Name] = rule
+	}
+	now := time.Seconds()
+	for key, state := range engine.states {
+		rule, found := current[state.rule.Name]
+		if !found || rule.expr != state.rule.expr || rule.Source != state.rule.Source {
+			if state.alert != nil {
+				engine.resolve(state.alert, now)
+			}
+			engine.states[key] = nil, false
+			continue
+		}
+		state.rule = rule
+	}
+	engine.rules = rules
+	engine.notifiers = notifiers
+}
+
+// Watches returns a value indicating whether any rule is defined for the
+// given writer and series (used to skip data items without rules).
+func (engine *Engine) Watches(writer, source, metric string) bool {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+
+	for _, rule := range engine.rules {
+		if rule.matches(writer, source, metric) {
+			return true
+		}
+	}
+	return false
+}
+
+// Observe evaluates rules defined for the series against its rolled up
+// value. Values of each series should be observed in time order. Slices
+// are consecutive when they are at most config.SliceInterval apart, a gap
+// starts counting slices over. Alerts fired or resolved are sent to
+// notifiers on Flush.
+func (engine *Engine) Observe(observation *Observation) {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+
+	for _, rule := range engine.rules {
+		if !rule.matches(observation.Writer, observation.Source, observation.Metric) {
+			continue
+		}
+		value, found := observation.Fields[rule.Field]
+		if !found {
+			continue
+		}
+
+		key := rule.Name + "|" + observation.Source + "|" + observation.Series
+		s, found := engine.states[key]
+		if !rule.holds(value) {
+			if found {
+				if s.alert != nil {
+					s.alert.Value = value
+					engine.resolve(s.alert, observation.Time)
+				}
+				engine.states[key] = nil, false
+			}
+			continue
+		}
+
+		if !found {
+			s = &state{rule: rule}
+			engine.states[key] = s
+		} else if observation.Time-s.last > int64(config.SliceInterval) {
+			s.slices = 0
+		}
+		s.slices++
+		s.last = observation.Time
+		s.updated = time.Seconds()
+		if s.alert != nil {
+			s.alert.Value = value
+		} else if s.slices >= rule.Slices {
+			s.alert = &Alert{
+				Name:      rule.Name,
+				Rule:      rule.expr,
+				Source:    observation.Source,
+				Metric:    observation.Metric,
+				Series:    observation.Series,
+				State:     FIRING,
+				Value:     value,
+				Threshold: rule.Threshold,
+				Since:     observation.Time,
+			}
+			alert := *s.alert
+			engine.changed = append(engine.changed, &notification{alert: &alert, notifiers: engine.notifiersFor(rule.Name)})
+		}
+	}
+}
+
+// resolve marks the alert resolved at the given time, and adds it to the
+// history. Notifiers are selected by the current rules, so it should be
+// called before the rule of the alert is replaced. Should be called with
+// mutex locked.
+func (engine *Engine) resolve(alert *Alert, at int64) {
+	alert.State = RESOLVED
+	alert.Until = at
+	resolved := *alert
+	engine.changed = append(engine.changed, &notification{alert: &resolved, notifiers: engine.notifiersFor(alert.Name)})
+
+	engine.resolved = append([]*Alert{&resolved}, engine.resolved...)
+	if len(engine.resolved) > ALERTS_HISTORY_SIZE {
+		engine.resolved = engine.resolved[:ALERTS_HISTORY_SIZE]
+	}
+}
+
+// Flush resolves firing alerts of series which have not been updated for
+// ALERTS_STALE_INTERVALS write intervals, and sends alerts fired or resolved
+// since the previous flush to notifiers. Returns the sent alerts.
+func (engine *Engine) Flush() []*Alert {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+
+	now := time.Seconds()
+	stale := now - int64(ALERTS_STALE_INTERVALS*config.WriteInterval)
+	for key, s := range engine.states {
+		if s.updated < stale {
+			if s.alert != nil {
+				engine.resolve(s.alert, now)
+			}
+			engine.states[key] = nil, false
+		}
+	}
+
+	changed := make([]*Alert, len(engine.changed))
+	for i, n := range engine.changed {
+		alert := n.alert
+		changed[i] = alert
+		if alert.State == FIRING {
+			engine.log.Warn("Alert %s fired for %s@%s: %v (%s)", alert.Name, alert.Source, alert.Series, alert.Value, alert.Rule)
+		} else {
+			engine.log.Info("Alert %s resolved for %s@%s: %v", alert.Name, alert.Source, alert.Series, alert.Value)
+		}
+
+		if len(n.notifiers) == 0 {
+			continue
+		}
+		select {
+		case engine.queue <- n:
+		default:
+			engine.log.Warn("Dropped notification of alert %s for %s@%s: queue is full", alert.Name, alert.Source, alert.Series)
+		}
+	}
+	engine.changed = nil
+	return changed
+}
+
+// notifiersFor returns notifiers of the rule with the given name. Should be
+// called with mutex locked.
+func (engine *Engine) notifiersFor(name string) []Notifier {
+	for _, rule := range engine.rules {
+		if rule.Name != name {
+			continue
+		}
+		if len(rule.Notify) == 0 {
+			notifiers := make([]Notifier, 0, len(engine.notifiers))
+			for _, notifier := range engine.notifiers {
+				notifiers = append(notifiers, notifier)
+			}
+			return notifiers
+		}
+		notifiers := make([]Notifier, len(rule.Notify))
+		for i, name := range rule.Notify {
+			notifiers[i] = engine.notifiers[name]
+		}
+		return notifiers
+	}
+	return nil
+}
+
+// Firing returns alerts firing at the moment, sorted by name, source, and
+// series.
+func (engine *Engine) Firing() []*Alert {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+
+	alerts := make(alertList, 0, len(engine.states))
+	for _, s := range engine.states {
+		if s.alert != nil {
+			alert := *s.alert
+			alerts = append(alerts, &alert)
+		}
+	}
+	sort.Sort(alerts)
+	return alerts
+}
+
+// Resolved returns recently resolved alerts, the latest first.
+func (engine *Engine) Resolved() []*Alert {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+
+	return append([]*Alert(nil), engine.resolved...)
+}
+
+// Close sends queued notifications, and stops the engine.
+func (engine *Engine) Close() {
+	close(engine.queue)
+	<-engine.done
+}
+
+// run sends notifications until the engine is closed.
+func (engine *Engine) run() {
+	for n := range engine.queue {
+		for _, notifier := range n.notifiers {
+			if err := notifier.Notify(n.alert); err != nil {
+				engine.log.Error("Cannot send notification of alert %s for %s@%s: %s", n.alert.Name, n.alert.Source, n.alert.Series, err)
+			}
+		}
+	}
+	engine.done <- true
+}
+
+// alertList sorts alerts by name, source, and series.
+type alertList []*Alert
+
+func (alerts alertList) Len() int      { return len(alerts) }
+func (alerts alertList) Swap(i, j int) { alerts[i], alerts[j] = alerts[j], alerts[i] }
+func (alerts alertList) Less(i, j int) bool {
+	if alerts[i].Name != alerts[j].Name {
+		return alerts[i].Name < alerts[j].Name
+	}
+	if alerts[i].Source != alerts[j].Source {
+		return alerts[i].Source < alerts[j].Source
+	}
+	return alerts[i].Series < alerts[j].Series
+}
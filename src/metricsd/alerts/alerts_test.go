@@ -0,0 +1,240 @@
+package alerts
+
+import (
+	. "launchpad.net/gocheck"
+	"os"
+	"testing"
+	"metricsd/config"
+	"metricsd/logger"
+)
+
+// Hook up gocheck into the gotest runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type AlertsS struct {
+	engine   *Engine
+	notifier *recorder
+}
+
+var _ = Suite(&AlertsS{})
+
+// recorder is a notifier remembering sent alerts.
+type recorder struct {
+	alerts chan *Alert
+}
+
+func (r *recorder) Notify(alert *Alert) os.Error {
+	r.alerts <- alert
+	return nil
+}
+
+func (s *AlertsS) SetUpTest(c *C) {
+	s.engine = New(logger.NewConsoleLogger(logger.UNKNOWN))
+	s.notifier = &recorder{alerts: make(chan *Alert, 10)}
+}
+
+func (s *AlertsS) TearDownTest(c *C) {
+	s.engine.Close()
+}
+
+func (s *AlertsS) configure(c *C, expr string) {
+	rule, err := ParseRule("slow", "all", expr)
+	c.Assert(err, IsNil)
+	s.engine.Configure([]*Rule{rule}, map[string]Notifier{"test": s.notifier})
+}
+
+// observe observes the value of the field of api.login.time series.
+func (s *AlertsS) observe(time int64, writer, field string, value float64) {
+	s.engine.Observe(&Observation{
+		Writer: writer,
+		Source: "all",
+		Metric: "api.login.time",
+		Series: "api.login.time;dc=ams",
+		Time:   time,
+		Fields: map[string]float64{field: value},
+	})
+}
+
+func (s *AlertsS) TestParseRule(c *C) {
+	rule, err := ParseRule("slow", "web*", "api.*.time percentiles.pct95 >= 500 for 3 slices")
+	c.Assert(err, IsNil)
+	c.Check(rule.Source, Equals, "web*")
+	c.Check(rule.Metric, Equals, "api.*.time")
+	c.Check(rule.Writer, Equals, "percentiles")
+	c.Check(rule.Field, Equals, "pct95")
+	c.Check(rule.Operator, Equals, ">=")
+	c.Check(rule.Threshold, Equals, 500.0)
+	c.Check(rule.Slices, Equals, 3)
+
+	rule, err = ParseRule("errors", "all", "api.login count.fail_ratio > 5%")
+	c.Assert(err, IsNil)
+	c.Check(rule.Threshold, Equals, 0.05)
+	c.Check(rule.Slices, Equals, 1)
+}
+
+func (s *AlertsS) TestParseRuleInvalid(c *C) {
+	for _, expr := range []string{
+		"",
+		"api.login.time percentiles.pct95 > 500 for 3",
+		"api.login.time pct95 > 500",
+		"api.login.time percentiles. > 500",
+		"api.login.time percentiles.pct95 => 500",
+		"api.login.time percentiles.pct95 > fast",
+		"api.login.time percentiles.pct95 > 500 during 3 slices",
+		"api.login.time percentiles.pct95 > 500 for 0 slices",
+		"api.[login percentiles.pct95 > 500",
+	} {
+		if _, err := ParseRule("slow", "all", expr); err == nil {
+			c.Errorf("%q: expected error", expr)
+		}
+	}
+	_, err := ParseRule("slow", "[", "api.login.time percentiles.pct95 > 500")
+	c.Check(err, NotNil)
+}
+
+func (s *AlertsS) TestFiresAfterSlices(c *C) {
+	s.configure(c, "api.* percentiles.pct95 > 500 for 3 slices")
+	s.observe(10, "percentiles", "pct95", 600)
+	s.observe(20, "percentiles", "pct95", 700)
+	c.Check(len(s.engine.Flush()), Equals, 0)
+
+	s.observe(30, "percentiles", "pct95", 800)
+	fired := s.engine.Flush()
+	c.Assert(len(fired), Equals, 1)
+	c.Check(fired[0], DeepEquals, &Alert{
+		Name:      "slow",
+		Rule:      "api.* percentiles.pct95 > 500 for 3 slices",
+		Source:    "all",
+		Metric:    "api.login.time",
+		Series:    "api.login.time;dc=ams",
+		State:     FIRING,
+		Value:     800,
+		Threshold: 500,
+		Since:     30,
+	})
+	c.Check(<-s.notifier.alerts, DeepEquals, fired[0])
+
+	// Already firing
+	s.observe(40, "percentiles", "pct95", 900)
+	c.Check(len(s.engine.Flush()), Equals, 0)
+	firing := s.engine.Firing()
+	c.Assert(len(firing), Equals, 1)
+	c.Check(firing[0].Value, Equals, 900.0)
+}
+
+func (s *AlertsS) TestInterruptedSequenceDoesNotFire(c *C) {
+	s.configure(c, "api.* percentiles.pct95 > 500 for 2 slices")
+	s.observe(10, "percentiles", "pct95", 600)
+	s.observe(20, "percentiles", "pct95", 500)
+	s.observe(30, "percentiles", "pct95", 600)
+	s.observe(40, "quartiles", "q2", 600)
+	c.Check(len(s.engine.Flush()), Equals, 0)
+	c.Check(len(s.engine.Firing()), Equals, 0)
+}
+
+func (s *AlertsS) TestSequenceWithGapDoesNotFire(c *C) {
+	s.configure(c, "api.* percentiles.pct95 > 500 for 2 slices")
+	s.observe(10, "percentiles", "pct95", 600)
+	s.observe(10+int64(config.SliceInterval)*3, "percentiles", "pct95", 600)
+	c.Check(len(s.engine.Flush()), Equals, 0)
+	c.Check(len(s.engine.Firing()), Equals, 0)
+
+	s.observe(10+int64(config.SliceInterval)*4, "percentiles", "pct95", 600)
+	c.Check(len(s.engine.Flush()), Equals, 1)
+}
+
+func (s *AlertsS) TestResolves(c *C) {
+	s.configure(c, "api.login.time count.fail_ratio > 5%")
+	s.observe(10, "count", "fail_ratio", 0.1)
+	s.observe(20, "count", "fail_ratio", 0.01)
+	changed := s.engine.Flush()
+	c.Assert(len(changed), Equals, 2)
+	c.Check(changed[0].State, Equals, FIRING)
+	c.Check(changed[1].State, Equals, RESOLVED)
+	c.Check(changed[1].Since, Equals, int64(10))
+	c.Check(changed[1].Until, Equals, int64(20))
+	c.Check(changed[1].Value, Equals, 0.01)
+	c.Check((<-s.notifier.alerts).State, Equals, FIRING)
+	c.Check((<-s.notifier.alerts).State, Equals, RESOLVED)
+
+	c.Check(len(s.engine.Firing()), Equals, 0)
+	c.Check(s.engine.Resolved(), DeepEquals, []*Alert{changed[1]})
+}
+
+func (s *AlertsS) TestStaleAlertsAreResolved(c *C) {
+	s.configure(c, "api.login.time percentiles.pct95 > 500")
+	s.observe(10, "percentiles", "pct95", 600)
+	c.Check(len(s.engine.Flush()), Equals, 1)
+
+	for _, state := range s.engine.states {
+		state.updated -= int64(ALERTS_STALE_INTERVALS*config.WriteInterval) + 1
+	}
+	resolved := s.engine.Flush()
+	c.Assert(len(resolved), Equals, 1)
+	c.Check(resolved[0].State, Equals, RESOLVED)
+	c.Check(len(s.engine.states), Equals, 0)
+}
+
+func (s *AlertsS) TestWatches(c *C) {
+	s.configure(c, "api.* percentiles.pct95 > 500")
+	c.Check(s.engine.Watches("percentiles", "all", "api.login"), Equals, true)
+	c.Check(s.engine.Watches("percentiles", "web01", "api.login"), Equals, false)
+	c.Check(s.engine.Watches("percentiles", "all", "app.login"), Equals, false)
+	c.Check(s.engine.Watches("quartiles", "all", "api.login"), Equals, false)
+}
+
+func (s *AlertsS) TestConfigureKeepsStatesOfUnchangedRules(c *C) {
+	s.configure(c, "api.login.time percentiles.pct95 > 500")
+	s.observe(10, "percentiles", "pct95", 600)
+	s.engine.Flush()
+
+	s.configure(c, "api.login.time percentiles.pct95 > 500")
+	c.Check(len(s.engine.Firing()), Equals, 1)
+	s.configure(c, "api.login.time percentiles.pct95 > 1000")
+	c.Check(len(s.engine.Firing()), Equals, 0)
+}
+
+func (s *AlertsS) TestConfigureResolvesAlertsOfRemovedRules(c *C) {
+	s.configure(c, "api.login.time percentiles.pct95 > 500")
+	s.observe(10, "percentiles", "pct95", 600)
+	s.engine.Flush()
+	c.Check((<-s.notifier.alerts).State, Equals, FIRING)
+
+	s.engine.Configure(nil, map[string]Notifier{"test": s.notifier})
+	resolved := s.engine.Flush()
+	c.Assert(len(resolved), Equals, 1)
+	c.Check(resolved[0].State, Equals, RESOLVED)
+	c.Check(resolved[0].Name, Equals, "slow")
+	c.Check((<-s.notifier.alerts).State, Equals, RESOLVED)
+	c.Check(s.engine.Resolved(), DeepEquals, resolved)
+}
+
+func (s *AlertsS) TestNotifiersOfRule(c *C) {
+	other := &recorder{alerts: make(chan *Alert, 10)}
+	rule, err := ParseRule("slow", "all", "api.login.time percentiles.pct95 > 500")
+	c.Assert(err, IsNil)
+	rule.Notify = []string{"other"}
+	s.engine.Configure([]*Rule{rule}, map[string]Notifier{"test": s.notifier, "other": other})
+
+	s.observe(10, "percentiles", "pct95", 600)
+	s.engine.Flush()
+	c.Check((<-other.alerts).Name, Equals, "slow")
+	c.Check(len(s.notifier.alerts), Equals, 0)
+}
+
+func (s *AlertsS) TestLoad(c *C) {
+	rules, notifiers, err := Load(
+		[]config.AlertConfig{{Name: "slow", Rule: "api.login.time percentiles.pct95 > 500", Notify: []string{"ops"}}},
+		[]config.NotifierConfig{{Name: "ops", Type: "exec", Options: map[string]interface{}{"Command": "/bin/true"}}},
+	)
+	c.Assert(err, IsNil)
+	c.Check(len(rules), Equals, 1)
+	c.Check(rules[0].Source, Equals, "all")
+	c.Check(rules[0].Notify, DeepEquals, []string{"ops"})
+	c.Check(len(notifiers), Equals, 1)
+
+	_, _, err = Load([]config.AlertConfig{{Name: "slow", Rule: "api.login.time percentiles.pct95 > 500", Notify: []string{"ops"}}}, nil)
+	c.Check(err, NotNil)
+	_, _, err = Load(nil, []config.NotifierConfig{{Name: "ops", Type: "pager"}})
+	c.Check(err, NotNil)
+}
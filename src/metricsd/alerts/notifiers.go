@@ -0,0 +1,377 @@
+package alerts
+
+import (
+	"bytes"
+	"crypto/tls"
+	"exec"
+	"fmt"
+	"http"
+	"json"
+	"net"
+	"os"
+	"smtp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default time to send a notification in seconds (notifications are sent
+// one by one, so a hung notifier delays all of them).
+const DEFAULT_NOTIFIER_TIMEOUT = 10
+
+// Notifier sends fired and resolved alerts.
+type Notifier interface {
+	Notify(alert *Alert) os.Error
+}
+
+// NotifierFactory creates a new notifier with the given options (could be
+// nil).
+type NotifierFactory func(options map[string]interface{}) (Notifier, os.Error)
+
+// Registered notifier factories by notifier type
+var notifierFactories = make(map[string]NotifierFactory)
+
+func init() {
+	RegisterNotifier("webhook", newWebhook)
+	RegisterNotifier("exec", newExec)
+	RegisterNotifier("smtp", newSmtp)
+}
+
+// RegisterNotifier makes a notifier available by the provided type. Panics
+// if RegisterNotifier is called twice with the same type.
+func RegisterNotifier(kind string, factory NotifierFactory) {
+	if _, found := notifierFactories[kind]; found {
+		panic(fmt.Sprintf("Notifier %q is already registered", kind))
+	}
+	notifierFactories[kind] = factory
+}
+
+// NewNotifier creates a notifier registered by the given type.
+func NewNotifier(kind string, options map[string]interface{}) (Notifier, os.Error) {
+	factory, found := notifierFactories[kind]
+	if !found {
+		return nil, os.NewError(fmt.Sprintf("Notifier type %q is not registered", kind))
+	}
+	return factory(options)
+}
+
+/***** Webhook ****************************************************************/
+
+// Webhook posts alerts in JSON to the URL:
+//     {"name": "slow-logins", "rule": "api.login.time percentiles.pct95 > 500 for 3 slices",
+//      "source": "all", "metric": "api.login.time", "series": "api.login.time", "state": "firing", "value": 730.5,
+//      "threshold": 500, "since": 1318000030, "until": 0}
+type Webhook struct {
+	URL     string
+	Timeout int // timeout of connecting, and of each read and write in seconds
+}
+
+// newWebhook creates Webhook notifier with the given options:
+//     {"URL": "http://alerts.local/metricsd", "Timeout": 10}
+func newWebhook(options map[string]interface{}) (Notifier, os.Error) {
+	webhook := &Webhook{Timeout: DEFAULT_NOTIFIER_TIMEOUT}
+	if err := readOptions("webhook", options, map[string]interface{}{"URL": &webhook.URL, "Timeout": &webhook.Timeout}); err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(webhook.URL, "http://") && !strings.HasPrefix(webhook.URL, "https://") {
+		return nil, os.NewError(fmt.Sprintf("Notifier \"webhook\" URL should be an HTTP URL, got %q", webhook.URL))
+	}
+	return webhook, nil
+}
+
+// Notify posts the alert to the URL, responses other than 2xx are errors.
+func (webhook *Webhook) Notify(alert *Alert) os.Error {
+	data, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	u, err := http.ParseURL(webhook.URL)
+	if err != nil {
+		return err
+	}
+	address := u.Host
+	if !strings.Contains(address, ":") {
+		if u.Scheme == "https" {
+			address += ":443"
+		} else {
+			address += ":80"
+		}
+	}
+	conn, err := dial(address, webhook.Timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if u.Scheme == "https" {
+		secure := tls.Client(conn, &tls.Config{ServerName: address[:strings.LastIndex(address, ":")]})
+		if err = secure.Handshake(); err != nil {
+			return err
+		}
+		conn = secure
+	}
+
+	request, err := http.NewRequest("POST", webhook.URL, bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.ContentLength = int64(len(data))
+	request.Close = true
+	response, err := http.NewClientConn(conn, nil).Do(request)
+	// Connection is not reused, so it is not an error
+	if err != nil && err != http.ErrPersistEOF {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		return os.NewError(fmt.Sprintf("Webhook %s responded with %s", webhook.URL, response.Status))
+	}
+	return nil
+}
+
+/***** Exec *******************************************************************/
+
+// Exec runs a command for each alert. The alert is written to its standard
+// input in JSON (see Webhook), and passed in METRICSD_ALERT_NAME,
+// METRICSD_ALERT_STATE, METRICSD_ALERT_SOURCE, METRICSD_ALERT_SERIES,
+// METRICSD_ALERT_VALUE, and METRICSD_ALERT_THRESHOLD environment variables.
+type Exec struct {
+	Command string
+	Args    []string
+	Timeout int // seconds the command could run before it is killed
+}
+
+// newExec creates Exec notifier with the given options:
+//     {"Command": "/usr/local/bin/page", "Args": ["--team", "ops"], "Timeout": 10}
+func newExec(options map[string]interface{}) (Notifier, os.Error) {
+	notifier := &Exec{Timeout: DEFAULT_NOTIFIER_TIMEOUT}
+	if err := readOptions("exec", options, map[string]interface{}{"Command": &notifier.Command, "Args": &notifier.Args, "Timeout": &notifier.Timeout}); err != nil {
+		return nil, err
+	}
+	if len(notifier.Command) == 0 {
+		return nil, os.NewError("Notifier \"exec\" option \"Command\" is required")
+	}
+	return notifier, nil
+}
+
+// Notify runs the command, non-zero exit status is an error. The command is
+// killed when it runs longer than the timeout.
+func (notifier *Exec) Notify(alert *Alert) os.Error {
+	data, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(notifier.Command, notifier.Args...)
+	cmd.Stdin = bytes.NewBuffer(data)
+	cmd.Env = append(os.Environ(),
+		"METRICSD_ALERT_NAME="+alert.Name,
+		"METRICSD_ALERT_STATE="+alert.State,
+		"METRICSD_ALERT_SOURCE="+alert.Source,
+		"METRICSD_ALERT_SERIES="+alert.Series,
+		"METRICSD_ALERT_VALUE="+strconv.Ftoa64(alert.Value, 'g', -1),
+		"METRICSD_ALERT_THRESHOLD="+strconv.Ftoa64(alert.Threshold, 'g', -1),
+	)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err = cmd.Start(); err != nil {
+		return os.NewError(fmt.Sprintf("%s failed: %s", notifier.Command, err))
+	}
+
+	done := make(chan os.Error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(int64(notifier.Timeout) * 1e9):
+		cmd.Process.Kill()
+		<-done
+		err = os.NewError(fmt.Sprintf("killed after %d seconds", notifier.Timeout))
+	}
+	if err != nil {
+		return os.NewError(fmt.Sprintf("%s failed: %s %s", notifier.Command, err, bytes.TrimSpace(output.Bytes())))
+	}
+	return nil
+}
+
+/***** SMTP *******************************************************************/
+
+// Smtp sends alerts by email.
+type Smtp struct {
+	Address  string // host and port of the SMTP server
+	From     string
+	To       []string
+	Username string // PLAIN authentication is used when not empty
+	Password string
+	Timeout  int // timeout of connecting, and of each read and write in seconds
+}
+
+// newSmtp creates Smtp notifier with the given options:
+//     {"Address": "localhost:25", "From": "metricsd@example.com", "To": ["ops@example.com"],
+//      "Username": "metricsd", "Password": "secret", "Timeout": 10}
+func newSmtp(options map[string]interface{}) (Notifier, os.Error) {
+	notifier := &Smtp{Timeout: DEFAULT_NOTIFIER_TIMEOUT}
+	err := readOptions("smtp", options, map[string]interface{}{
+		"Address":  &notifier.Address,
+		"From":     &notifier.From,
+		"To":       &notifier.To,
+		"Username": &notifier.Username,
+		"Password": &notifier.Password,
+		"Timeout":  &notifier.Timeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(notifier.Address) == 0 || len(notifier.From) == 0 || len(notifier.To) == 0 {
+		return nil, os.NewError("Notifier \"smtp\" options \"Address\", \"From\", and \"To\" are required")
+	}
+	return notifier, nil
+}
+
+// Notify sends the alert to all recipients (the same way smtp.SendMail does
+// it, but with the timeout).
+func (notifier *Smtp) Notify(alert *Alert) os.Error {
+	conn, err := dial(notifier.Address, notifier.Timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	host := strings.SplitN(notifier.Address, ":", 2)[0]
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err = client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if len(notifier.Username) > 0 {
+		if ok, _ := client.Extension("AUTH"); ok {
+			if err = client.Auth(smtp.PlainAuth("", notifier.Username, notifier.Password, host)); err != nil {
+				return err
+			}
+		}
+	}
+	if err = client.Mail(notifier.From); err != nil {
+		return err
+	}
+	for _, to := range notifier.To {
+		if err = client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = writer.Write(message(notifier.From, notifier.To, alert)); err != nil {
+		return err
+	}
+	if err = writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// message returns the email message of the alert.
+func message(from string, to []string, alert *Alert) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&buf, "Subject: [metricsd] %s %s: %s@%s\r\n", strings.ToUpper(alert.State), alert.Name, alert.Source, alert.Series)
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&buf, "Alert:     %s\r\n", alert.Name)
+	fmt.Fprintf(&buf, "Rule:      %s\r\n", alert.Rule)
+	fmt.Fprintf(&buf, "Series:    %s@%s\r\n", alert.Source, alert.Series)
+	fmt.Fprintf(&buf, "State:     %s\r\n", alert.State)
+	fmt.Fprintf(&buf, "Value:     %v\r\n", alert.Value)
+	fmt.Fprintf(&buf, "Threshold: %v\r\n", alert.Threshold)
+	fmt.Fprintf(&buf, "Since:     %s\r\n", formatTime(alert.Since))
+	if alert.Until > 0 {
+		fmt.Fprintf(&buf, "Until:     %s\r\n", formatTime(alert.Until))
+	}
+	return buf.Bytes()
+}
+
+/***** Helper functions *******************************************************/
+
+// readOptions reads notifier options into targets (pointers to strings,
+// string slices, or positive integers) by option name. Unknown options and options of a wrong
+// type are errors.
+func readOptions(kind string, options map[string]interface{}, targets map[string]interface{}) os.Error {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := options[name]
+		switch target := targets[name].(type) {
+		case *string:
+			s, ok := value.(string)
+			if !ok {
+				return os.NewError(fmt.Sprintf("Notifier %q option %q should be a string, got %v", kind, name, value))
+			}
+			*target = s
+		case *[]string:
+			list, ok := value.([]interface{})
+			items := make([]string, len(list))
+			for i := 0; ok && i < len(list); i++ {
+				items[i], ok = list[i].(string)
+			}
+			if !ok {
+				return os.NewError(fmt.Sprintf("Notifier %q option %q should be a list of strings, got %v", kind, name, value))
+			}
+			*target = items
+		case *int:
+			n, ok := value.(float64)
+			if !ok || n < 1 || n != float64(int(n)) {
+				return os.NewError(fmt.Sprintf("Notifier %q option %q should be a positive integer, got %v", kind, name, value))
+			}
+			*target = int(n)
+		default:
+			return os.NewError(fmt.Sprintf("Notifier %q option %q is unknown", kind, name))
+		}
+	}
+	return nil
+}
+
+// dial connects to the TCP address, failing after the timeout in seconds.
+// Reads and writes of the connection fail after the timeout as well.
+// Connection established after the timeout is closed.
+func dial(address string, timeout int) (net.Conn, os.Error) {
+	type result struct {
+		conn net.Conn
+		err  os.Error
+	}
+	done := make(chan *result, 1)
+	go func() {
+		conn, err := net.Dial("tcp", address)
+		done <- &result{conn, err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return nil, r.err
+		}
+		r.conn.SetTimeout(int64(timeout) * 1e9)
+		return r.conn, nil
+	case <-time.After(int64(timeout) * 1e9):
+	}
+	go func() {
+		if r := <-done; r.conn != nil {
+			r.conn.Close()
+		}
+	}()
+	return nil, os.NewError(fmt.Sprintf("Connection to %s timed out after %d seconds", address, timeout))
+}
+
+// formatTime formats the time in seconds since epoch.
+func formatTime(seconds int64) string {
+	return time.SecondsToLocalTime(seconds).Format(time.RFC1123)
+}
@@ -0,0 +1,211 @@
+package alerts
+
+import (
+	. "launchpad.net/gocheck"
+	"bufio"
+	"fmt"
+	"http"
+	"http/httptest"
+	"io/ioutil"
+	"json"
+	"net"
+	"os"
+	"path"
+	"strings"
+)
+
+type NotifiersS struct{}
+
+var _ = Suite(&NotifiersS{})
+
+func testAlert() *Alert {
+	return &Alert{
+		Name:      "slow",
+		Rule:      "api.login.time percentiles.pct95 > 500",
+		Source:    "all",
+		Metric:    "api.login.time",
+		Series:    "api.login.time;dc=ams",
+		State:     FIRING,
+		Value:     730.5,
+		Threshold: 500,
+		Since:     1318000030,
+	}
+}
+
+func (s *NotifiersS) TestInvalidOptions(c *C) {
+	for _, test := range []struct {
+		kind    string
+		options map[string]interface{}
+	}{
+		{"webhook", nil},
+		{"webhook", map[string]interface{}{"URL": "ftp://alerts.local"}},
+		{"webhook", map[string]interface{}{"Url": "http://alerts.local"}},
+		{"exec", map[string]interface{}{"Args": []interface{}{"-v"}}},
+		{"exec", map[string]interface{}{"Command": "/bin/true", "Args": "-v"}},
+		{"exec", map[string]interface{}{"Command": "/bin/true", "Timeout": "10"}},
+		{"exec", map[string]interface{}{"Command": "/bin/true", "Timeout": 0.5}},
+		{"smtp", map[string]interface{}{"Address": "localhost:25", "From": "metricsd@example.com"}},
+		{"pager", nil},
+	} {
+		if _, err := NewNotifier(test.kind, test.options); err == nil {
+			c.Errorf("%s %v: expected error", test.kind, test.options)
+		}
+	}
+}
+
+func (s *NotifiersS) TestWebhook(c *C) {
+	received := make(chan *Alert, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		alert := &Alert{}
+		json.NewDecoder(r.Body).Decode(alert)
+		received <- alert
+	}))
+	defer server.Close()
+
+	notifier, err := NewNotifier("webhook", map[string]interface{}{"URL": server.URL})
+	c.Assert(err, IsNil)
+	c.Assert(notifier.Notify(testAlert()), IsNil)
+	c.Check(<-received, DeepEquals, testAlert())
+}
+
+func (s *NotifiersS) TestWebhookFails(c *C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+	}))
+	defer server.Close()
+
+	notifier, err := NewNotifier("webhook", map[string]interface{}{"URL": server.URL})
+	c.Assert(err, IsNil)
+	c.Check(notifier.Notify(testAlert()), NotNil)
+}
+
+func (s *NotifiersS) TestWebhookTimeout(c *C) {
+	// Connection is accepted, but the request is never answered
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer listener.Close()
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			ioutil.ReadAll(conn)
+			conn.Close()
+		}
+	}()
+
+	notifier, err := NewNotifier("webhook", map[string]interface{}{"URL": "http://" + listener.Addr().String() + "/", "Timeout": 1.0})
+	c.Assert(err, IsNil)
+	c.Check(notifier.Notify(testAlert()), NotNil)
+}
+
+func (s *NotifiersS) TestExec(c *C) {
+	dir, err := ioutil.TempDir("", "metricsd-alerts")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "alert")
+
+	notifier, err := NewNotifier("exec", map[string]interface{}{
+		"Command": "/bin/sh",
+		"Args":    []interface{}{"-c", `cat > "$0"; echo " $METRICSD_ALERT_NAME $METRICSD_ALERT_STATE $METRICSD_ALERT_VALUE" >> "$0"`, file},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(notifier.Notify(testAlert()), IsNil)
+
+	data, err := ioutil.ReadFile(file)
+	c.Assert(err, IsNil)
+	c.Check(strings.HasPrefix(string(data), `{"name":"slow",`), Equals, true)
+	c.Check(strings.HasSuffix(string(data), "} slow firing 730.5\n"), Equals, true)
+}
+
+func (s *NotifiersS) TestExecFails(c *C) {
+	notifier, err := NewNotifier("exec", map[string]interface{}{
+		"Command": "/bin/sh",
+		"Args":    []interface{}{"-c", "echo oops; exit 3"},
+	})
+	c.Assert(err, IsNil)
+	err = notifier.Notify(testAlert())
+	c.Assert(err, NotNil)
+	c.Check(strings.Contains(err.String(), "oops"), Equals, true)
+}
+
+func (s *NotifiersS) TestExecTimeout(c *C) {
+	notifier, err := NewNotifier("exec", map[string]interface{}{
+		"Command": "/bin/sh",
+		"Args":    []interface{}{"-c", "exec sleep 10"},
+		"Timeout": 1.0,
+	})
+	c.Assert(err, IsNil)
+	err = notifier.Notify(testAlert())
+	c.Assert(err, NotNil)
+	c.Check(strings.Contains(err.String(), "killed after 1 seconds"), Equals, true)
+}
+
+func (s *NotifiersS) TestSmtp(c *C) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer listener.Close()
+	transcript := make(chan string, 1)
+	go smtpServer(listener, transcript)
+
+	notifier, err := NewNotifier("smtp", map[string]interface{}{
+		"Address": listener.Addr().String(),
+		"From":    "metricsd@example.com",
+		"To":      []interface{}{"ops@example.com", "dev@example.com"},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(notifier.Notify(testAlert()), IsNil)
+
+	lines := <-transcript
+	for _, line := range []string{
+		"MAIL FROM:<metricsd@example.com>",
+		"RCPT TO:<ops@example.com>",
+		"RCPT TO:<dev@example.com>",
+		"Subject: [metricsd] FIRING slow: all@api.login.time;dc=ams",
+		"Value:     730.5",
+	} {
+		if !strings.Contains(lines, line+"\n") {
+			c.Errorf("Expected %q in SMTP session:\n%s", line, lines)
+		}
+	}
+}
+
+// smtpServer accepts a single SMTP session, and sends lines received from
+// the client to the transcript channel.
+func smtpServer(listener net.Listener, transcript chan<- string) {
+	conn, err := listener.Accept()
+	if err != nil {
+		transcript <- ""
+		return
+	}
+	defer conn.Close()
+
+	var lines []string
+	reader := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "220 localhost ESMTP\r\n")
+	data := false
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			break
+		}
+		line = strings.TrimRight(line, "\r\n")
+		lines = append(lines, line)
+		switch {
+		case data:
+			if line == "." {
+				data = false
+				fmt.Fprintf(conn, "250 OK\r\n")
+			}
+		case strings.HasPrefix(line, "EHLO") || strings.HasPrefix(line, "HELO"):
+			fmt.Fprintf(conn, "250 localhost\r\n")
+		case line == "DATA":
+			data = true
+			fmt.Fprintf(conn, "354 Go ahead\r\n")
+		case line == "QUIT":
+			fmt.Fprintf(conn, "221 Bye\r\n")
+			transcript <- strings.Join(lines, "\n") + "\n"
+			return
+		default:
+			fmt.Fprintf(conn, "250 OK\r\n")
+		}
+	}
+	transcript <- strings.Join(lines, "\n") + "\n"
+}
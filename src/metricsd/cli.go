@@ -7,23 +7,40 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"metricsd/alerts"
+	"metricsd/cluster"
 	"metricsd/config"
+	"metricsd/writers"
 )
 
 var (
 	configPath       = flag.String("config", config.DEFAULT_CONFIG_PATH, "Set the path to config file")
 	listenAddr       = flag.String("listen", config.DEFAULT_LISTEN, "Set the port (+optional address) to listen at")
+	listenTCPAddr    = flag.String("tcp", config.DEFAULT_LISTEN_TCP, "Set the port (+optional address) to listen at for TCP connections")
+	listenUnixPath   = flag.String("unix", config.DEFAULT_LISTEN_UNIX, "Set the path to Unix stream socket to listen at")
+	listenUnixgram   = flag.String("unixgram", config.DEFAULT_LISTEN_UNIXGRAM, "Set the path to Unix datagram socket to listen at")
+	listenGraphite   = flag.String("graphite", config.DEFAULT_LISTEN_GRAPHITE, "Set the port (+optional address) to listen at for Graphite plaintext protocol connections")
+	listenPickle     = flag.String("pickle", config.DEFAULT_LISTEN_PICKLE, "Set the port (+optional address) to listen at for Graphite pickle protocol connections")
+	maxPacketSize    = flag.Int("packet", config.DEFAULT_MAX_PACKET_SIZE, "Set the max size of a packet (or a line for stream sockets) in bytes")
 	dataPath         = flag.String("data", config.DEFAULT_DATA_DIR, "Set the data directory")
 	rootPath         = flag.String("root", config.DEFAULT_ROOT_DIR, "Set the root directory")
+	dashboardsPath   = flag.String("dashboards", config.DEFAULT_DASHBOARDS_DIR, "Set the dashboard definitions directory")
+	logPath          = flag.String("log", config.DEFAULT_LOG_FILE, "Set the log file (messages are written to console if empty)")
 	debugLevel       = flag.Int("debug", int(config.DEFAULT_SEVERITY), "Set the debug level, the lower - the more verbose (0-5)")
 	sliceInt         = flag.Int("slice", config.DEFAULT_SLICE_INTERVAL, "Set the slice interval in seconds")
 	writeInt         = flag.Int("write", config.DEFAULT_WRITE_INTERVAL, "Set the write interval in seconds")
+	sliceGrace       = flag.Int("grace", config.DEFAULT_SLICE_GRACE, "Set the number of seconds to wait for late events before slice is closed")
 	rrdUpdateThreads = flag.Int("threads", config.DEFAULT_RRD_UPDATE_THREADS, "Set the number of RRD update threads")
 	batchWrites      = flag.Bool("batch", config.DEFAULT_BATCH_WRITES, "Set the value indicating whether batch RRD updates should be used")
 	dnsLookup        = flag.Bool("lookup", config.DEFAULT_LOOKUP_DNS, "Set the value indicating whether reverse DNS lookup should be performed for sources")
+	clusterSelf      = flag.String("node", config.DEFAULT_CLUSTER_SELF, "Set the name of the current cluster node")
 	testAndExit      = flag.Bool("test", false, "Validate config file and exit")
+	rebalancePath    = flag.String("rebalance", "", "Move data files owned by other cluster nodes to the given directory and exit")
 )
 
+// Absolute path to the config file
+var configFile string
+
 func parseCommandLineArguments() {
 	flag.Parse()
 
@@ -33,29 +50,112 @@ func parseCommandLineArguments() {
 		fmt.Print(error)
 		os.Exit(1)
 	}
+	config.BinaryRoot = binaryRoot
 
 	// Make config file path absolute
-	cfgpath := *configPath
-	if !path.IsAbs(cfgpath) {
-		cfgpath = path.Join(binaryRoot, cfgpath)
+	configFile = config.AbsPath(*configPath)
+
+	// Load config from a config file (missing file is an error only when testing)
+	error = config.Load(configFile)
+	if _, missing := error.(*os.PathError); missing && !*testAndExit {
+		fmt.Printf("Config file does not exist or failed to read the file: %s. Original error: %s\n", configFile, error)
+	} else if error != nil {
+		exitWithConfigError(error)
+	}
+
+	applyCommandLineArguments()
+	if errors := config.Current().Validate(); len(errors) > 0 {
+		exitWithConfigError(errors)
 	}
 
-	// Load config from a config file
-	config.Load(cfgpath)
 	if *testAndExit {
+		if _, error = writers.Load(config.Writers, config.WriterRules); error != nil {
+			exitWithConfigError(error)
+		}
+		if _, _, error = alerts.Load(config.Alerts, config.Notifiers); error != nil {
+			exitWithConfigError(error)
+		}
+		fmt.Printf("Configuration is valid: %s\n", configFile)
 		os.Exit(0)
 	}
 
-	// Override options with values passed in command line arguments
-	// (but only if they have a value different from a default one)
+	if len(*rebalancePath) > 0 {
+		rebalanceAndExit(config.AbsPath(*rebalancePath))
+	}
+}
+
+// rebalanceAndExit moves data files owned by other cluster nodes to the
+// target directory (into a subdirectory for each node), and exits.
+func rebalanceAndExit(targetDir string) {
+	if len(config.ClusterNodes) == 0 {
+		fmt.Println("Cluster is not configured")
+		os.Exit(1)
+	}
+
+	ring := cluster.NewRing(clusterNodes())
+	moves, error := cluster.Rebalance(ring, ring.Find(config.ClusterSelf), config.DataDir, targetDir)
+	for _, move := range moves {
+		fmt.Printf("%s/%s -> %s\n", move.Source, move.File, move.Owner.Name)
+	}
+	if error != nil {
+		fmt.Printf("Rebalancing failed: %s\n", error)
+		os.Exit(1)
+	}
+	fmt.Printf("Moved %d files owned by other nodes to %s\n", len(moves), targetDir)
+	os.Exit(0)
+}
+
+// exitWithConfigError prints all problems found in configuration and exits
+// with non-zero status.
+func exitWithConfigError(error os.Error) {
+	fmt.Printf("Configuration is invalid: %s\n", configFile)
+	if errors, ok := error.(config.ValidationErrors); ok {
+		for _, e := range errors {
+			fmt.Printf("  %s\n", e)
+		}
+	} else {
+		fmt.Printf("  %s\n", error)
+	}
+	os.Exit(1)
+}
+
+// applyCommandLineArguments overrides options with values passed in command
+// line arguments (but only if they have a value different from a default
+// one), and makes paths absolute. Called after the config file is loaded or
+// reloaded.
+func applyCommandLineArguments() {
 	if *listenAddr != config.DEFAULT_LISTEN {
 		config.Listen = *listenAddr
 	}
+	if *listenTCPAddr != config.DEFAULT_LISTEN_TCP {
+		config.ListenTCP = *listenTCPAddr
+	}
+	if *listenUnixPath != config.DEFAULT_LISTEN_UNIX {
+		config.ListenUnix = *listenUnixPath
+	}
+	if *listenUnixgram != config.DEFAULT_LISTEN_UNIXGRAM {
+		config.ListenUnixgram = *listenUnixgram
+	}
+	if *listenGraphite != config.DEFAULT_LISTEN_GRAPHITE {
+		config.ListenGraphite = *listenGraphite
+	}
+	if *listenPickle != config.DEFAULT_LISTEN_PICKLE {
+		config.ListenPickle = *listenPickle
+	}
+	if *maxPacketSize != config.DEFAULT_MAX_PACKET_SIZE {
+		config.MaxPacketSize = *maxPacketSize
+	}
 	if *dataPath != config.DEFAULT_DATA_DIR {
-		config.DataDir = *dataPath
+		config.DataDir = config.AbsPath(*dataPath)
 	}
 	if *rootPath != config.DEFAULT_ROOT_DIR {
-		config.RootDir = *rootPath
+		config.RootDir = config.AbsPath(*rootPath)
+	}
+	if *dashboardsPath != config.DEFAULT_DASHBOARDS_DIR {
+		config.DashboardsDir = config.AbsPath(*dashboardsPath)
+	}
+	if *logPath != config.DEFAULT_LOG_FILE {
+		config.LogFile = config.AbsPath(*logPath)
 	}
 	if *debugLevel != int(config.DEFAULT_SEVERITY) {
 		config.LogLevel = *debugLevel
@@ -66,6 +166,9 @@ func parseCommandLineArguments() {
 	if *writeInt != config.DEFAULT_WRITE_INTERVAL {
 		config.WriteInterval = *writeInt
 	}
+	if *sliceGrace != config.DEFAULT_SLICE_GRACE {
+		config.SliceGrace = *sliceGrace
+	}
 	if *rrdUpdateThreads != config.DEFAULT_RRD_UPDATE_THREADS {
 		config.RrdUpdateThreads = *rrdUpdateThreads
 	}
@@ -75,15 +178,17 @@ func parseCommandLineArguments() {
 	if *dnsLookup != config.DEFAULT_LOOKUP_DNS {
 		config.LookupDns = *dnsLookup
 	}
-
-	// Make data directory path absolute
-	if !path.IsAbs(config.DataDir) {
-		config.DataDir = path.Join(binaryRoot, config.DataDir)
+	if *clusterSelf != config.DEFAULT_CLUSTER_SELF {
+		config.ClusterSelf = *clusterSelf
 	}
 
-	// Make root dir path absolute
-	if !path.IsAbs(config.RootDir) {
-		config.RootDir = path.Join(binaryRoot, config.RootDir)
+	// Make data, root, dashboards and spool directory paths from the config file absolute
+	config.DataDir = config.AbsPath(config.DataDir)
+	config.RootDir = config.AbsPath(config.RootDir)
+	config.DashboardsDir = config.AbsPath(config.DashboardsDir)
+	config.RelaySpoolDir = config.AbsPath(config.RelaySpoolDir)
+	if len(config.LogFile) > 0 {
+		config.LogFile = config.AbsPath(config.LogFile)
 	}
 }
 
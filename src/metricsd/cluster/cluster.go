@@ -0,0 +1,83 @@
+// Package cluster implements sharding of metrics across MetricsD nodes.
+//
+// Each node owns hash ranges of metric names on a consistent hash ring (see
+// Ring), so every RRD file is written by a single node. A node receiving an
+// event owned by another node routes it to the owner's TCP listener (events
+// are buffered and spooled by the relay package while the owner is not
+// available). Since all series of a metric are stored on the same node, the
+// "all" source and tag subsets are aggregated correctly. Membership is static
+// and defined in the config file, see Rebalance for moving data files when
+// nodes change.
+package cluster
+
+import (
+	"fmt"
+	"os"
+	"metricsd/relay"
+	"metricsd/types"
+)
+
+// Cluster routes events to their owner nodes.
+type Cluster struct {
+	ring   *Ring
+	self   *Node
+	relays map[string]*relay.Relay // by node name
+}
+
+// New creates a cluster of the given nodes, where self is the name of the
+// current node, and starts routing events to other nodes. Options are used
+// to create relays to other nodes (mode and upstreams are ignored).
+func New(nodes []*Node, self string, options relay.Options) (*Cluster, os.Error) {
+	ring := NewRing(nodes)
+	cluster := &Cluster{ring: ring, self: ring.Find(self), relays: make(map[string]*relay.Relay)}
+	if cluster.self == nil {
+		return nil, os.NewError(fmt.Sprintf("Node %q is not a member of the cluster", self))
+	}
+	options.Mode = relay.Raw
+	for _, node := range cluster.Peers() {
+		options.Upstreams = []string{node.Address}
+		cluster.relays[node.Name] = relay.New(options)
+	}
+	return cluster, nil
+}
+
+// Self returns the current node.
+func (cluster *Cluster) Self() *Node {
+	return cluster.self
+}
+
+// Peers returns all nodes except the current one.
+func (cluster *Cluster) Peers() []*Node {
+	peers := make([]*Node, 0, len(cluster.ring.nodes))
+	for _, node := range cluster.ring.nodes {
+		if node != cluster.self {
+			peers = append(peers, node)
+		}
+	}
+	return peers
+}
+
+// Owner returns the node owning the metric, and a value indicating whether
+// it is the current node.
+func (cluster *Cluster) Owner(metric string) (node *Node, local bool) {
+	node = cluster.ring.Owner(metric)
+	return node, node == cluster.self
+}
+
+// Route sends the event to its owner node. Returns true when the event is
+// owned by the current node and should be processed locally.
+func (cluster *Cluster) Route(event *types.Event) bool {
+	owner, local := cluster.Owner(event.Name)
+	if !local {
+		cluster.relays[owner.Name].Add(event)
+	}
+	return local
+}
+
+// Close stops routing events, events which have not been sent are written
+// to spool files.
+func (cluster *Cluster) Close() {
+	for _, forwarder := range cluster.relays {
+		forwarder.Close()
+	}
+}
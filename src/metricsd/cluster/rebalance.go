@@ -0,0 +1,67 @@
+package cluster
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// Move describes a data file owned by another node.
+type Move struct {
+	Source string // source directory name
+	File   string // data file name
+	Owner  *Node  // node owning the metric
+}
+
+// Plan returns data files of the data directory which are owned by other
+// nodes than self (after membership change).
+func Plan(ring *Ring, self *Node, dataDir string) ([]*Move, os.Error) {
+	sources, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	moves := make([]*Move, 0, 10)
+	for _, source := range sources {
+		if !source.IsDirectory() || strings.HasPrefix(source.Name, ".") {
+			continue
+		}
+		files, err := ioutil.ReadDir(path.Join(dataDir, source.Name))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			split := strings.LastIndex(file.Name, "-")
+			if file.IsDirectory() || !strings.HasSuffix(file.Name, ".rrd") || split < 0 {
+				continue
+			}
+			if owner := ring.Owner(file.Name[:split]); owner != self {
+				moves = append(moves, &Move{source.Name, file.Name, owner})
+			}
+		}
+	}
+	return moves, nil
+}
+
+// Rebalance moves data files owned by other nodes from the data directory to
+// the target directory, into a subdirectory for each owner node (e.g.
+// target/node2/source/metric-writer.rrd), so they could be copied to their
+// owners with external tools. Should be called when MetricsD is stopped.
+// Returns the list of moved files.
+func Rebalance(ring *Ring, self *Node, dataDir, targetDir string) ([]*Move, os.Error) {
+	moves, err := Plan(ring, self, dataDir)
+	if err != nil {
+		return nil, err
+	}
+	for i, move := range moves {
+		dir := path.Join(targetDir, move.Owner.Name, move.Source)
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return moves[:i], err
+		}
+		if err = os.Rename(path.Join(dataDir, move.Source, move.File), path.Join(dir, move.File)); err != nil {
+			return moves[:i], err
+		}
+	}
+	return moves, nil
+}
@@ -0,0 +1,48 @@
+package cluster
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+)
+
+func TestRebalanceMovesFilesOwnedByOtherNodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metricsd-cluster")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ring := NewRing(testNodes("node1", "node2"))
+	self := ring.Find("node1")
+	dataDir, targetDir := path.Join(dir, "data"), path.Join(dir, "rebalance")
+	os.MkdirAll(path.Join(dataDir, "all"), 0755)
+	local, remote := 0, 0
+	for i := 0; i < 20; i++ {
+		metric := "app.metric" + strconv.Itoa(i)
+		ioutil.WriteFile(path.Join(dataDir, "all", metric+",dc=ams-count.rrd"), []byte{}, 0644)
+		if ring.Owner(metric) == self {
+			local++
+		} else {
+			remote++
+		}
+	}
+
+	moves, err := Rebalance(ring, self, dataDir, targetDir)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if len(moves) != remote {
+		t.Errorf("Expected %d files to be moved, got %d", remote, len(moves))
+	}
+	for _, move := range moves {
+		if _, err := os.Stat(path.Join(targetDir, "node2", "all", move.File)); err != nil {
+			t.Errorf("Expected %s to be moved: %s", move.File, err)
+		}
+	}
+	if files, _ := ioutil.ReadDir(path.Join(dataDir, "all")); len(files) != local {
+		t.Errorf("Expected %d files to be kept, got %d", local, len(files))
+	}
+}
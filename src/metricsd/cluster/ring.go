@@ -0,0 +1,110 @@
+package cluster
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"strings"
+	"metricsd/types"
+)
+
+// Number of points each node has on the ring. The more points, the more
+// evenly metrics are distributed between nodes.
+const REPLICAS = 128
+
+// Node is a member of the cluster.
+type Node struct {
+	Name    string // unique name used to place the node on the ring
+	Address string // address of the TCP listener events are routed to
+	Web     string // address of the web interface reads are sent to
+}
+
+// Ring maps metric names to cluster nodes using consistent hashing, so when
+// a node is added or removed, only metrics of the ranges it owns (or will
+// own) move to other nodes.
+type Ring struct {
+	nodes  []*Node
+	points []uint32 // sorted hashes of node points
+	owners []*Node  // nodes owning points with the same index
+}
+
+type ringPoints Ring
+
+// Swap exchanges the elements at indexes i and j.
+func (ring *ringPoints) Swap(i, j int) {
+	ring.points[i], ring.points[j] = ring.points[j], ring.points[i]
+	ring.owners[i], ring.owners[j] = ring.owners[j], ring.owners[i]
+}
+
+// Len returns the number of elements in the list.
+func (ring *ringPoints) Len() int {
+	return len(ring.points)
+}
+
+// Less returns a value indicating whether the element at index i should sort
+// before the element at index j.
+func (ring *ringPoints) Less(i, j int) bool {
+	return ring.points[i] < ring.points[j] ||
+		(ring.points[i] == ring.points[j] && ring.owners[i].Name < ring.owners[j].Name)
+}
+
+// NewRing creates a ring of the given nodes. Positions of nodes depend only
+// on their names, so the order of nodes does not matter.
+func NewRing(nodes []*Node) *Ring {
+	ring := &Ring{
+		nodes:  nodes,
+		points: make([]uint32, 0, len(nodes)*REPLICAS),
+		owners: make([]*Node, 0, len(nodes)*REPLICAS),
+	}
+	for _, node := range nodes {
+		for i := 0; i < REPLICAS; i++ {
+			ring.points = append(ring.points, hash(node.Name+"#"+strconv.Itoa(i)))
+			ring.owners = append(ring.owners, node)
+		}
+	}
+	sort.Sort((*ringPoints)(ring))
+	return ring
+}
+
+// Nodes returns all nodes of the ring.
+func (ring *Ring) Nodes() []*Node {
+	return ring.nodes
+}
+
+// Owner returns the node owning the metric (tags are ignored, so all series
+// of the metric are stored on the same node). Event names and names of data
+// files map to the same owner (see MetricName). Returns nil for an empty ring.
+func (ring *Ring) Owner(metric string) *Node {
+	if len(ring.points) == 0 {
+		return nil
+	}
+	h := hash(MetricName(metric))
+	i := sort.Search(len(ring.points), func(i int) bool { return ring.points[i] >= h })
+	if i == len(ring.points) {
+		i = 0
+	}
+	return ring.owners[i]
+}
+
+// Find returns the node with the given name, nil if it is not found.
+func (ring *Ring) Find(name string) *Node {
+	for _, node := range ring.nodes {
+		if node.Name == name {
+			return node
+		}
+	}
+	return nil
+}
+
+// MetricName returns the metric name of the series name (without tags) the
+// data files are stored under (see types.StoredName).
+func MetricName(name string) string {
+	if idx := strings.Index(name, ","); idx >= 0 {
+		name = name[:idx]
+	}
+	return types.StoredName(name)
+}
+
+func hash(key string) uint32 {
+	return crc32.ChecksumIEEE([]byte(key))
+}
@@ -0,0 +1,87 @@
+package cluster
+
+import (
+	"strconv"
+	"testing"
+)
+
+func testNodes(names ...string) []*Node {
+	nodes := make([]*Node, len(names))
+	for i, name := range names {
+		nodes[i] = &Node{Name: name, Address: name + ":6311", Web: name + ":6311"}
+	}
+	return nodes
+}
+
+func TestOwnerDoesNotDependOnNodesOrder(t *testing.T) {
+	ring1 := NewRing(testNodes("node1", "node2", "node3"))
+	ring2 := NewRing(testNodes("node3", "node1", "node2"))
+	for i := 0; i < 1000; i++ {
+		metric := "app.metric" + strconv.Itoa(i)
+		if owner1, owner2 := ring1.Owner(metric), ring2.Owner(metric); owner1.Name != owner2.Name {
+			t.Fatalf("%s: expected the same owner, got %s and %s", metric, owner1.Name, owner2.Name)
+		}
+	}
+}
+
+func TestOwnerIgnoresTags(t *testing.T) {
+	ring := NewRing(testNodes("node1", "node2", "node3"))
+	for i := 0; i < 100; i++ {
+		metric := "app.metric" + strconv.Itoa(i)
+		if owner := ring.Owner(metric + ",dc=ams,role=api"); owner != ring.Owner(metric) {
+			t.Errorf("%s: expected tagged series to be owned by %s, got %s", metric, ring.Owner(metric).Name, owner.Name)
+		}
+	}
+}
+
+func TestOwnerUsesStoredName(t *testing.T) {
+	ring := NewRing(testNodes("node1", "node2", "node3"))
+	for i := 0; i < 100; i++ {
+		metric := "app.metric" + strconv.Itoa(i)
+		if owner := ring.Owner(metric + "_count"); owner != ring.Owner(metric+".status") {
+			t.Errorf("%s: expected _count events to be owned by the owner of .status files, got %s", metric, owner.Name)
+		}
+		if owner := ring.Owner(metric + "_time,dc=ams"); owner != ring.Owner(metric+".time") {
+			t.Errorf("%s: expected _time events to be owned by the owner of .time files, got %s", metric, owner.Name)
+		}
+	}
+}
+
+func TestOwnerOfEmptyRing(t *testing.T) {
+	if owner := NewRing(nil).Owner("app.metric"); owner != nil {
+		t.Errorf("Expected no owner, got %s", owner.Name)
+	}
+}
+
+func TestMetricsAreDistributedEvenly(t *testing.T) {
+	ring := NewRing(testNodes("node1", "node2", "node3", "node4"))
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		counts[ring.Owner("app.metric"+strconv.Itoa(i)).Name]++
+	}
+	for _, node := range ring.Nodes() {
+		if counts[node.Name] < 1500 || counts[node.Name] > 3500 {
+			t.Errorf("Expected about 2500 metrics owned by %s, got %d", node.Name, counts[node.Name])
+		}
+	}
+}
+
+func TestAddedNodeTakesMetricsOnlyFromOthers(t *testing.T) {
+	before := NewRing(testNodes("node1", "node2", "node3"))
+	after := NewRing(testNodes("node1", "node2", "node3", "node4"))
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		metric := "app.metric" + strconv.Itoa(i)
+		owner1, owner2 := before.Owner(metric), after.Owner(metric)
+		if owner1.Name == owner2.Name {
+			continue
+		}
+		if owner2.Name != "node4" {
+			t.Fatalf("%s: expected to be moved to node4, got %s", metric, owner2.Name)
+		}
+		moved++
+	}
+	if moved < 1500 || moved > 3500 {
+		t.Errorf("Expected about 2500 metrics to be moved, got %d", moved)
+	}
+}
@@ -3,94 +3,394 @@ package config
 
 import (
 	"fmt"
-	"json"
+	"io/ioutil"
 	"net"
 	"os"
+	"path"
+	"strings"
 	"metricsd/logger"
 )
 
 const (
 	DEFAULT_CONFIG_PATH        = "./metricsd.conf"
 	DEFAULT_LISTEN             = "0.0.0.0:6311"
+	DEFAULT_LISTEN_TCP         = ""
+	DEFAULT_LISTEN_UNIX        = ""
+	DEFAULT_LISTEN_UNIXGRAM    = ""
+	DEFAULT_LISTEN_GRAPHITE    = ""
+	DEFAULT_LISTEN_PICKLE      = ""
+	DEFAULT_MAX_PACKET_SIZE    = 1472
 	DEFAULT_DATA_DIR           = "./data"
 	DEFAULT_ROOT_DIR           = "."
+	DEFAULT_DASHBOARDS_DIR     = "./dashboards"
 	DEFAULT_SEVERITY           = logger.INFO
+	DEFAULT_LOG_FILE           = ""
+	DEFAULT_LOG_MAX_SIZE       = 0
+	DEFAULT_LOG_ROTATE         = 0
+	DEFAULT_LOG_KEEP           = 7
+	DEFAULT_LOG_FORMAT         = "text"
+	DEFAULT_LOG_SYSLOG         = false
 	DEFAULT_SLICE_INTERVAL     = 10
 	DEFAULT_WRITE_INTERVAL     = 60
+	DEFAULT_SLICE_GRACE        = 0
 	DEFAULT_RRD_UPDATE_THREADS = 1
 	DEFAULT_BATCH_WRITES       = false
 	DEFAULT_LOOKUP_DNS         = false
+	DEFAULT_SKETCH             = "none"
+	DEFAULT_SKETCH_ACCURACY    = 0.01
+	DEFAULT_SKETCH_THRESHOLD   = 1000
+	DEFAULT_RELAY_MODE         = "aggregate"
+	DEFAULT_RELAY_ONLY         = false
+	DEFAULT_RELAY_BUFFER_SIZE  = 100000
+	DEFAULT_RELAY_SPOOL_DIR    = "./spool"
+	DEFAULT_RELAY_SPOOL_SIZE   = 100
+	DEFAULT_CLUSTER_SELF       = ""
+	DEFAULT_CARBON_ADDRESS     = ""
+	DEFAULT_CARBON_BATCH_SIZE  = 500
+	DEFAULT_CARBON_QUEUE_SIZE  = 100000
 )
 
 var (
 	Listen           string        = DEFAULT_LISTEN             // port and address to listen at
+	ListenTCP        string        = DEFAULT_LISTEN_TCP         // port and address to listen at for TCP connections (disabled if empty)
+	ListenUnix       string        = DEFAULT_LISTEN_UNIX        // path to Unix stream socket (disabled if empty)
+	ListenUnixgram   string        = DEFAULT_LISTEN_UNIXGRAM    // path to Unix datagram socket (disabled if empty)
+	ListenGraphite   string        = DEFAULT_LISTEN_GRAPHITE    // port and address to listen at for Graphite plaintext protocol connections (disabled if empty)
+	ListenPickle     string        = DEFAULT_LISTEN_PICKLE      // port and address to listen at for Graphite pickle protocol connections (disabled if empty)
+	GraphiteSources  []string                                   // rules to extract sources from Graphite metric paths, e.g. "servers.{source}"
+	MaxPacketSize    int           = DEFAULT_MAX_PACKET_SIZE    // max size of a datagram packet (or a line in stream) in bytes
 	DataDir          string        = DEFAULT_DATA_DIR           // data directory
 	RootDir          string        = DEFAULT_ROOT_DIR           // root directory
+	DashboardsDir    string        = DEFAULT_DASHBOARDS_DIR     // dashboard definitions directory
 	LogLevel         int           = int(DEFAULT_SEVERITY)      // debug level, the lower - the more verbose (0-5)
+	LogFile          string        = DEFAULT_LOG_FILE           // log file (messages are written to console if empty)
+	LogMaxSize       int           = DEFAULT_LOG_MAX_SIZE       // max size of the log file in megabytes before rotation (0 to disable)
+	LogRotate        int           = DEFAULT_LOG_ROTATE         // log file rotation interval in seconds (0 to disable)
+	LogKeep          int           = DEFAULT_LOG_KEEP           // number of rotated log files to keep
+	LogFormat        string        = DEFAULT_LOG_FORMAT         // format of log messages (text or json)
+	LogSyslog        bool          = DEFAULT_LOG_SYSLOG         // value indicating whether messages should be written to syslog instead of console or log file
 	SliceInterval    int           = DEFAULT_SLICE_INTERVAL     // slice interval in seconds
 	WriteInterval    int           = DEFAULT_WRITE_INTERVAL     // write interval in seconds
+	SliceGrace       int           = DEFAULT_SLICE_GRACE        // number of seconds to wait for late events before slice is closed
 	RrdUpdateThreads int           = DEFAULT_RRD_UPDATE_THREADS // number of RRD update threads
 	BatchWrites      bool          = DEFAULT_BATCH_WRITES       // value indicating whether batch RRD updates should be used
 	LookupDns        bool          = DEFAULT_LOOKUP_DNS         // value indicating whether reverse DNS lookup should be performed for sources
+	Sketch           string        = DEFAULT_SKETCH             // sketch used by large sample sets of timers and untyped metrics (none or ddsketch)
+	SketchAccuracy   float64       = DEFAULT_SKETCH_ACCURACY    // relative accuracy of quantiles calculated from sketches
+	SketchThreshold  int           = DEFAULT_SKETCH_THRESHOLD   // number of values kept exactly before sample set is switched to a sketch
+	RelayUpstreams   []string                                   // addresses of upstream MetricsD instances to forward events to (relay is disabled if empty)
+	RelayMode        string        = DEFAULT_RELAY_MODE         // forward aggregated slices (aggregate) or every received event (raw)
+	RelayOnly        bool          = DEFAULT_RELAY_ONLY         // value indicating whether events should be forwarded only, without writing local data
+	RelayBufferSize  int           = DEFAULT_RELAY_BUFFER_SIZE  // max number of events kept in memory per upstream before spooling
+	RelaySpoolDir    string        = DEFAULT_RELAY_SPOOL_DIR    // directory for events which could not be sent to upstreams
+	RelaySpoolSize   int           = DEFAULT_RELAY_SPOOL_SIZE   // max size of the spool file per upstream in megabytes (0 to disable spooling)
+	ClusterNodes     []ClusterNode                              // nodes of the cluster metrics are sharded across (disabled if empty)
+	ClusterSelf      string        = DEFAULT_CLUSTER_SELF       // name of the current cluster node
+	CarbonAddress    string        = DEFAULT_CARBON_ADDRESS     // address of the Graphite-compatible backend rolled up values are sent to (disabled if empty)
+	CarbonBatchSize  int           = DEFAULT_CARBON_BATCH_SIZE  // max number of lines sent to Carbon in a single write
+	CarbonQueueSize  int           = DEFAULT_CARBON_QUEUE_SIZE  // max number of lines kept in memory while Carbon is not available
+	BinaryRoot       string                                     // MetricsD installation directory, relative paths are resolved against it
 	UDPAddress       *net.UDPAddr                               // address to listen at (for internal usage)
 	Logger           logger.Logger                              // logger instance
 )
 
-// Load loads configuration from a JSON file.
-func Load(path string) {
-	file, error := os.Open(path)
+var (
+	Writers     []WriterConfig   // writers to be created on startup (default writers if empty)
+	WriterRules []WriterRule     // rules to select writers by metric name
+	Alerts      []AlertConfig    // alert rules evaluated against rolled up values
+	Notifiers   []NotifierConfig // notifiers alerts are sent to
+)
+
+// WriterConfig describes a writer to be created on startup.
+type WriterConfig struct {
+	Name    string                 // name of the registered writer
+	Options map[string]interface{} // writer-specific options (could be nil)
+}
+
+// WriterRule selects writers used to aggregate metrics with names matching
+// the pattern (see path.Match for the syntax).
+type WriterRule struct {
+	Match   string   // metric name pattern, e.g. "*.time"
+	Writers []string // names of writers
+}
+
+// AlertConfig describes an alert rule.
+type AlertConfig struct {
+	Name   string   // unique alert name
+	Rule   string   // condition, e.g. "api.login.time percentiles.pct95 > 500 for 3 slices"
+	Source string   // source pattern (see path.Match for the syntax), default is "all"
+	Notify []string // names of notifiers (all notifiers if empty)
+}
+
+// NotifierConfig describes a notifier alerts are sent to.
+type NotifierConfig struct {
+	Name    string                 // unique notifier name used in alert rules
+	Type    string                 // notifier type: webhook, exec, or smtp
+	Options map[string]interface{} // notifier-specific options
+}
+
+// ClusterNode describes a member of the cluster.
+type ClusterNode struct {
+	Name    string // unique node name (metrics are assigned to nodes by names)
+	Address string // address of the TCP listener (ListenTCP) events are routed to
+	Web     string // address of the web interface (Listen) reads are sent to
+}
+
+// Load loads configuration from a JSON file. Returns *os.PathError when the
+// file could not be read, JSON syntax error, or ValidationErrors with all
+// problems found in the file. Configuration is not changed on error.
+func Load(path string) os.Error {
+	config, error := Read(path)
 	if error != nil {
-		fmt.Printf("Config file does not exist or failed to read the file: %s. Original error: %s\n", path, error)
-		return
+		return error
 	}
-	defer file.Close()
+	config.apply(false)
+	return nil
+}
 
-	config := make(map[string]interface{})
-	decoder := json.NewDecoder(file)
-	error = decoder.Decode(&config)
-	if error != nil {
-		fmt.Printf("Failed to parse config file: %s\n", error)
-		os.Exit(1)
+// Reload applies configuration read from the JSON file again (see Read), so
+// it could be checked before anything is changed. Options missing in the
+// file are reset to their default values. Options which could not be changed
+// without restart (listen addresses, data directory, slice settings, etc)
+// keep their current values, names of the changed ones are returned.
+func Reload(config *Config) (restartRequired []string) {
+	return config.apply(true)
+}
+
+// Current returns current configuration (including command line overrides).
+func Current() *Config {
+	return &Config{
+		Listen:           Listen,
+		ListenTCP:        ListenTCP,
+		ListenUnix:       ListenUnix,
+		ListenUnixgram:   ListenUnixgram,
+		ListenGraphite:   ListenGraphite,
+		ListenPickle:     ListenPickle,
+		GraphiteSources:  GraphiteSources,
+		MaxPacketSize:    MaxPacketSize,
+		DataDir:          DataDir,
+		DashboardsDir:    DashboardsDir,
+		LogLevel:         LogLevel,
+		LogFile:          LogFile,
+		LogMaxSize:       LogMaxSize,
+		LogRotate:        LogRotate,
+		LogKeep:          LogKeep,
+		LogFormat:        LogFormat,
+		LogSyslog:        LogSyslog,
+		SliceInterval:    SliceInterval,
+		WriteInterval:    WriteInterval,
+		SliceGrace:       SliceGrace,
+		RrdUpdateThreads: RrdUpdateThreads,
+		BatchWrites:      BatchWrites,
+		LookupDns:        LookupDns,
+		Sketch:           Sketch,
+		SketchAccuracy:   SketchAccuracy,
+		SketchThreshold:  SketchThreshold,
+		RelayUpstreams:   RelayUpstreams,
+		RelayMode:        RelayMode,
+		RelayOnly:        RelayOnly,
+		RelayBufferSize:  RelayBufferSize,
+		RelaySpoolDir:    RelaySpoolDir,
+		RelaySpoolSize:   RelaySpoolSize,
+		ClusterNodes:     ClusterNodes,
+		ClusterSelf:      ClusterSelf,
+		CarbonAddress:    CarbonAddress,
+		CarbonBatchSize:  CarbonBatchSize,
+		CarbonQueueSize:  CarbonQueueSize,
+		Writers:          Writers,
+		WriterRules:      WriterRules,
+		Alerts:           Alerts,
+		Notifiers:        Notifiers,
 	}
+}
 
-	if listen, found := config["Listen"]; found {
-		Listen = listen.(string)
+// AbsPath returns absolute path for the given one, relative paths are
+// resolved against BinaryRoot.
+func AbsPath(p string) string {
+	if path.IsAbs(p) {
+		return p
 	}
-	if dataDir, found := config["DataDir"]; found {
-		DataDir = dataDir.(string)
+	return path.Join(BinaryRoot, p)
+}
+
+// Read reads and validates the JSON config file. Returns *os.PathError when
+// the file could not be read, JSON syntax error, or ValidationErrors with all
+// problems found in the file. Current configuration is not changed.
+func Read(path string) (*Config, os.Error) {
+	data, error := ioutil.ReadFile(path)
+	if error != nil {
+		return nil, error
 	}
-	if logLevel, found := config["LogLevel"]; found {
-		LogLevel = (int)(logLevel.(float64))
+	return Parse(data)
+}
+
+// apply sets options to values read from the config file. When live is true,
+// options which require restart are not changed and names of the changed ones
+// are returned instead.
+func (config *Config) apply(live bool) []string {
+	options := &restartOptions{live: live}
+	options.setString("Listen", &Listen, config.Listen)
+	options.setString("ListenTCP", &ListenTCP, config.ListenTCP)
+	options.setString("ListenUnix", &ListenUnix, config.ListenUnix)
+	options.setString("ListenUnixgram", &ListenUnixgram, config.ListenUnixgram)
+	options.setString("ListenGraphite", &ListenGraphite, config.ListenGraphite)
+	options.setString("ListenPickle", &ListenPickle, config.ListenPickle)
+	options.setStrings("GraphiteSources", &GraphiteSources, config.GraphiteSources)
+	options.setInt("MaxPacketSize", &MaxPacketSize, config.MaxPacketSize)
+	options.setPath("DataDir", &DataDir, config.DataDir)
+	options.setInt("SliceInterval", &SliceInterval, config.SliceInterval)
+	options.setInt("SliceGrace", &SliceGrace, config.SliceGrace)
+	options.setInt("RrdUpdateThreads", &RrdUpdateThreads, config.RrdUpdateThreads)
+	options.setPath("LogFile", &LogFile, config.LogFile)
+	options.setInt("LogMaxSize", &LogMaxSize, config.LogMaxSize)
+	options.setInt("LogRotate", &LogRotate, config.LogRotate)
+	options.setInt("LogKeep", &LogKeep, config.LogKeep)
+	options.setString("LogFormat", &LogFormat, config.LogFormat)
+	options.setBool("LogSyslog", &LogSyslog, config.LogSyslog)
+	options.setStrings("RelayUpstreams", &RelayUpstreams, config.RelayUpstreams)
+	options.setString("RelayMode", &RelayMode, config.RelayMode)
+	options.setBool("RelayOnly", &RelayOnly, config.RelayOnly)
+	options.setInt("RelayBufferSize", &RelayBufferSize, config.RelayBufferSize)
+	options.setPath("RelaySpoolDir", &RelaySpoolDir, config.RelaySpoolDir)
+	options.setInt("RelaySpoolSize", &RelaySpoolSize, config.RelaySpoolSize)
+	options.setClusterNodes("ClusterNodes", &ClusterNodes, config.ClusterNodes)
+	options.setString("ClusterSelf", &ClusterSelf, config.ClusterSelf)
+	options.setString("CarbonAddress", &CarbonAddress, config.CarbonAddress)
+	options.setInt("CarbonBatchSize", &CarbonBatchSize, config.CarbonBatchSize)
+	options.setInt("CarbonQueueSize", &CarbonQueueSize, config.CarbonQueueSize)
+
+	DashboardsDir = config.DashboardsDir
+	if live {
+		DashboardsDir = AbsPath(DashboardsDir)
 	}
-	if sliceInterval, found := config["SliceInterval"]; found {
-		SliceInterval = (int)(sliceInterval.(float64))
+	LogLevel = config.LogLevel
+	WriteInterval = config.WriteInterval
+	BatchWrites = config.BatchWrites
+	LookupDns = config.LookupDns
+	Sketch = config.Sketch
+	SketchAccuracy = config.SketchAccuracy
+	SketchThreshold = config.SketchThreshold
+	Writers = config.Writers
+	WriterRules = config.WriterRules
+	Alerts = config.Alerts
+	Notifiers = config.Notifiers
+	return options.changed
+}
+
+// restartOptions sets options which could not be changed without restart.
+// In live mode options are not changed, but names of the options with new
+// values are collected.
+type restartOptions struct {
+	live    bool
+	changed []string
+}
+
+func (options *restartOptions) setString(name string, option *string, value string) {
+	if !options.live {
+		*option = value
+	} else if *option != value {
+		options.changed = append(options.changed, name)
 	}
-	if writeInterval, found := config["WriteInterval"]; found {
-		WriteInterval = (int)(writeInterval.(float64))
+}
+
+func (options *restartOptions) setInt(name string, option *int, value int) {
+	if !options.live {
+		*option = value
+	} else if *option != value {
+		options.changed = append(options.changed, name)
 	}
-	if rrdUpdateThreads, found := config["RrdUpdateThreads"]; found {
-		RrdUpdateThreads = (int)(rrdUpdateThreads.(float64))
+}
+
+func (options *restartOptions) setBool(name string, option *bool, value bool) {
+	if !options.live {
+		*option = value
+	} else if *option != value {
+		options.changed = append(options.changed, name)
 	}
-	if batchWrites, found := config["BatchWrites"]; found {
-		BatchWrites = batchWrites.(bool)
+}
+
+func (options *restartOptions) setStrings(name string, option *[]string, value []string) {
+	if !options.live {
+		*option = value
+	} else if strings.Join(*option, ",") != strings.Join(value, ",") {
+		options.changed = append(options.changed, name)
 	}
-	if lookupDns, found := config["LookupDns"]; found {
-		LookupDns = lookupDns.(bool)
+}
+
+func (options *restartOptions) setClusterNodes(name string, option *[]ClusterNode, value []ClusterNode) {
+	if !options.live {
+		*option = value
+	} else if fmt.Sprint(*option) != fmt.Sprint(value) {
+		options.changed = append(options.changed, name)
+	}
+}
+
+// setPath compares absolute paths in live mode (current value is already
+// absolute, empty paths are kept as is).
+func (options *restartOptions) setPath(name string, option *string, value string) {
+	if options.live && len(value) > 0 {
+		value = AbsPath(value)
 	}
+	options.setString(name, option, value)
 }
 
 // String returns a string representation of current configuration.
 func String() string {
 	return fmt.Sprintf(
-		"Configuration:\nListen: \t%s\nData dir:\t%s\nRoot dir:\t%s\nLog level:\t%s\nSlice interval:\t%d\nWrite interval:\t%d\nRRD threads:\t%d\nBatch writes:\t%t\nLookup DNS:\t%t\n",
+		"Configuration:\nListen: \t%s\nListen TCP:\t%s\nListen Unix:\t%s\nListen Unixgram:\t%s\nListen Graphite:\t%s\nListen pickle:\t%s\nGraphite sources:\t%s\nMax packet:\t%d\nData dir:\t%s\nRoot dir:\t%s\nDashboards dir:\t%s\nLog level:\t%s\nLog file:\t%s\nLog max size:\t%d\nLog rotate:\t%d\nLog keep:\t%d\nLog format:\t%s\nLog syslog:\t%t\nSlice interval:\t%d\nWrite interval:\t%d\nSlice grace:\t%d\nRRD threads:\t%d\nBatch writes:\t%t\nLookup DNS:\t%t\nSketch:\t%s\nSketch accuracy:\t%v\nSketch threshold:\t%d\nRelay upstreams:\t%s\nRelay mode:\t%s\nRelay only:\t%t\nRelay buffer:\t%d\nRelay spool dir:\t%s\nRelay spool size:\t%d\nCluster nodes:\t%d\nCluster self:\t%s\nCarbon address:\t%s\nCarbon batch:\t%d\nCarbon queue:\t%d\nWriters:\t%s\nWriter rules:\t%d\nAlerts:\t%d\nNotifiers:\t%d\n",
 		Listen,
+		ListenTCP,
+		ListenUnix,
+		ListenUnixgram,
+		ListenGraphite,
+		ListenPickle,
+		strings.Join(GraphiteSources, ", "),
+		MaxPacketSize,
 		DataDir,
 		RootDir,
+		DashboardsDir,
 		logger.Severity(LogLevel),
+		LogFile,
+		LogMaxSize,
+		LogRotate,
+		LogKeep,
+		LogFormat,
+		LogSyslog,
 		SliceInterval,
 		WriteInterval,
+		SliceGrace,
 		RrdUpdateThreads,
 		BatchWrites,
 		LookupDns,
+		Sketch,
+		SketchAccuracy,
+		SketchThreshold,
+		strings.Join(RelayUpstreams, ", "),
+		RelayMode,
+		RelayOnly,
+		RelayBufferSize,
+		RelaySpoolDir,
+		RelaySpoolSize,
+		len(ClusterNodes),
+		ClusterSelf,
+		CarbonAddress,
+		CarbonBatchSize,
+		CarbonQueueSize,
+		writerNames(),
+		len(WriterRules),
+		len(Alerts),
+		len(Notifiers),
 	)
 }
+
+// writerNames returns comma-separated list of configured writer names.
+func writerNames() string {
+	if len(Writers) == 0 {
+		return "default"
+	}
+	names := make([]string, len(Writers))
+	for i, writer := range Writers {
+		names[i] = writer.Name
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,129 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestParseDefaults(t *testing.T) {
+	config, err := Parse([]byte(`{}`))
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if config.Listen != DEFAULT_LISTEN || config.WriteInterval != DEFAULT_WRITE_INTERVAL || config.Writers != nil {
+		t.Errorf("Expected default configuration, got %v", config)
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	config, err := Parse([]byte(`{
+		"Listen": "127.0.0.1:6311", "MaxPacketSize": 8192, "LookupDns": true,
+		"SliceInterval": 5, "WriteInterval": 30,
+		"Sketch": "ddsketch", "SketchAccuracy": 0.02, "SketchThreshold": 100,
+		"ListenGraphite": ":2003", "GraphiteSources": ["servers.{source}"],
+		"RelayUpstreams": ["central:6311"], "RelayMode": "raw",
+		"ClusterNodes": [{"Name": "node1", "Address": "10.0.0.1:6312", "Web": "10.0.0.1:6311"}], "ClusterSelf": "node1",
+		"Writers": ["count", {"Name": "percentiles", "Options": {"Percentiles": [99]}}],
+		"WriterRules": [{"Match": "*.time", "Writers": ["percentiles"]}],
+		"Alerts": [{"Name": "slow-logins", "Rule": "api.login.time percentiles.pct95 > 500 for 3 slices", "Notify": ["ops"]}],
+		"Notifiers": [{"Name": "ops", "Type": "webhook", "Options": {"URL": "http://127.0.0.1/alerts"}}]
+	}`))
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if config.Listen != "127.0.0.1:6311" || config.MaxPacketSize != 8192 || !config.LookupDns {
+		t.Errorf("Expected options to be parsed, got %v", config)
+	}
+	if config.ListenGraphite != ":2003" || len(config.GraphiteSources) != 1 {
+		t.Errorf("Expected Graphite options to be parsed, got %s and %v", config.ListenGraphite, config.GraphiteSources)
+	}
+	if config.SliceInterval != 5 || config.WriteInterval != 30 {
+		t.Errorf("Expected intervals 5 and 30, got %d and %d", config.SliceInterval, config.WriteInterval)
+	}
+	if config.Sketch != "ddsketch" || config.SketchAccuracy != 0.02 || config.SketchThreshold != 100 {
+		t.Errorf("Expected sketch options to be parsed, got %s, %v, and %d", config.Sketch, config.SketchAccuracy, config.SketchThreshold)
+	}
+	if len(config.RelayUpstreams) != 1 || config.RelayUpstreams[0] != "central:6311" || config.RelayMode != "raw" {
+		t.Errorf("Expected relay options to be parsed, got %v and %s", config.RelayUpstreams, config.RelayMode)
+	}
+	if len(config.ClusterNodes) != 1 || config.ClusterNodes[0].Address != "10.0.0.1:6312" || config.ClusterSelf != "node1" {
+		t.Errorf("Expected cluster options to be parsed, got %v and %s", config.ClusterNodes, config.ClusterSelf)
+	}
+	if len(config.Writers) != 2 || config.Writers[1].Name != "percentiles" || config.Writers[1].Options == nil {
+		t.Errorf("Expected 2 writers, got %v", config.Writers)
+	}
+	if len(config.WriterRules) != 1 || config.WriterRules[0].Match != "*.time" {
+		t.Errorf("Expected 1 writer rule, got %v", config.WriterRules)
+	}
+	if len(config.Alerts) != 1 || config.Alerts[0].Source != "all" || len(config.Alerts[0].Notify) != 1 {
+		t.Errorf("Expected 1 alert of the all source, got %v", config.Alerts)
+	}
+	if len(config.Notifiers) != 1 || config.Notifiers[0].Type != "webhook" || config.Notifiers[0].Options["URL"] == nil {
+		t.Errorf("Expected 1 notifier, got %v", config.Notifiers)
+	}
+}
+
+func TestParseSyntaxError(t *testing.T) {
+	if _, err := Parse([]byte(`{"Listen": `)); err == nil {
+		t.Errorf("Expected syntax error")
+	} else if _, ok := err.(ValidationErrors); ok {
+		t.Errorf("Expected syntax error, got %s", err)
+	}
+}
+
+var invalidConfigs = []struct {
+	data    string
+	options []string // options with problems in the expected order
+}{
+	{`{"Listen": 6311}`, []string{"Listen"}},
+	{`{"LogLevel": "debug"}`, []string{"LogLevel"}},
+	{`{"SliceInterval": 2.5}`, []string{"SliceInterval"}},
+	{`{"BatchWrites": "yes"}`, []string{"BatchWrites"}},
+	{`{"Writers": "count"}`, []string{"Writers"}},
+	{`{"WriterRules": [{"Writers": ["count"]}]}`, []string{"WriterRules"}},
+	{`{"WriteInteval": 30, "Debug": 0}`, []string{"Debug", "WriteInteval"}},
+	{`{"Listen": ""}`, []string{"Listen"}},
+	{`{"GraphiteSources": ["servers.web01", "{source}"]}`, []string{"GraphiteSources"}},
+	{`{"MaxPacketSize": 0}`, []string{"MaxPacketSize"}},
+	{`{"LogLevel": 6}`, []string{"LogLevel"}},
+	{`{"LogFormat": "xml", "LogSyslog": 1}`, []string{"LogSyslog", "LogFormat"}},
+	{`{"SliceGrace": -1, "RrdUpdateThreads": 0}`, []string{"SliceGrace", "RrdUpdateThreads"}},
+	{`{"SliceInterval": 0}`, []string{"SliceInterval"}},
+	{`{"WriteInterval": 5}`, []string{"WriteInterval"}},
+	{`{"WriteInterval": 0}`, []string{"WriteInterval", "WriteInterval"}},
+	{`{"Sketch": "tdigest", "SketchAccuracy": 1, "SketchThreshold": -1}`, []string{"Sketch", "SketchAccuracy", "SketchThreshold"}},
+	{`{"SketchAccuracy": "1%"}`, []string{"SketchAccuracy"}},
+	{`{"RelayUpstreams": "central:6311"}`, []string{"RelayUpstreams"}},
+	{`{"RelayUpstreams": ["central:6311", 6311]}`, []string{"RelayUpstreams"}},
+	{`{"RelayMode": "sum", "RelayOnly": true}`, []string{"RelayMode", "RelayOnly"}},
+	{`{"RelayBufferSize": 0, "RelaySpoolSize": -1}`, []string{"RelayBufferSize", "RelaySpoolSize"}},
+	{`{"ClusterNodes": [{"Name": "node1", "Address": "10.0.0.1:6312"}], "ClusterSelf": "node1"}`, []string{"ClusterNodes", "ClusterSelf"}},
+	{`{"ClusterNodes": [{"Name": "node1", "Address": "a", "Web": "b"}, {"Name": "node1", "Address": "c", "Web": "d"}], "ClusterSelf": "node1"}`, []string{"ClusterNodes"}},
+	{`{"ClusterNodes": [{"Name": "node1", "Address": "a", "Web": "b"}], "ClusterSelf": "node2"}`, []string{"ClusterSelf"}},
+	{`{"ClusterSelf": "node1"}`, []string{"ClusterSelf"}},
+	{`{"CarbonBatchSize": 0, "CarbonQueueSize": -1}`, []string{"CarbonBatchSize", "CarbonQueueSize"}},
+	{`{"CarbonBatchSize": 1000, "CarbonQueueSize": 500}`, []string{"CarbonQueueSize"}},
+	{`{"Alerts": [{"Name": "slow"}], "Notifiers": {"Name": "ops"}}`, []string{"Alerts", "Notifiers"}},
+	{`{"Alerts": [{"Name": "a", "Rule": "x count.ok > 1", "Notify": ["ops"]}, {"Name": "a", "Rule": "y count.ok > 1"}]}`, []string{"Alerts", "Alerts"}},
+	{`{"Notifiers": [{"Name": "ops", "Type": "exec"}, {"Name": "ops", "Type": "smtp"}]}`, []string{"Notifiers"}},
+	{`{"Listen": false, "Unknown": 1, "WriteInterval": 5}`, []string{"Listen", "Unknown", "WriteInterval"}},
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, test := range invalidConfigs {
+		_, err := Parse([]byte(test.data))
+		errors, ok := err.(ValidationErrors)
+		if !ok {
+			t.Errorf("%s: expected validation errors, got %v", test.data, err)
+			continue
+		}
+		if len(errors) != len(test.options) {
+			t.Errorf("%s: expected %d errors, got %s", test.data, len(test.options), errors)
+			continue
+		}
+		for i, option := range test.options {
+			if errors[i].Option != option {
+				t.Errorf("%s: expected error %d for %s, got %s", test.data, i, option, errors[i])
+			}
+		}
+	}
+}
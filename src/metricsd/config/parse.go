@@ -0,0 +1,516 @@
+package config
+
+import (
+	"fmt"
+	"json"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"metricsd/logger"
+	"metricsd/parser"
+)
+
+// Config is a configuration stored in a config file.
+type Config struct {
+	Listen           string
+	ListenTCP        string
+	ListenUnix       string
+	ListenUnixgram   string
+	ListenGraphite   string
+	ListenPickle     string
+	GraphiteSources  []string
+	MaxPacketSize    int
+	DataDir          string
+	DashboardsDir    string
+	LogLevel         int
+	LogFile          string
+	LogMaxSize       int
+	LogRotate        int
+	LogKeep          int
+	LogFormat        string
+	LogSyslog        bool
+	SliceInterval    int
+	WriteInterval    int
+	SliceGrace       int
+	RrdUpdateThreads int
+	BatchWrites      bool
+	LookupDns        bool
+	Sketch           string
+	SketchAccuracy   float64
+	SketchThreshold  int
+	RelayUpstreams   []string
+	RelayMode        string
+	RelayOnly        bool
+	RelayBufferSize  int
+	RelaySpoolDir    string
+	RelaySpoolSize   int
+	ClusterNodes     []ClusterNode
+	ClusterSelf      string
+	CarbonAddress    string
+	CarbonBatchSize  int
+	CarbonQueueSize  int
+	Writers          []WriterConfig
+	WriterRules      []WriterRule
+	Alerts           []AlertConfig
+	Notifiers        []NotifierConfig
+}
+
+// Default returns configuration with default values of all options.
+func Default() *Config {
+	return &Config{
+		Listen:           DEFAULT_LISTEN,
+		ListenTCP:        DEFAULT_LISTEN_TCP,
+		ListenUnix:       DEFAULT_LISTEN_UNIX,
+		ListenUnixgram:   DEFAULT_LISTEN_UNIXGRAM,
+		ListenGraphite:   DEFAULT_LISTEN_GRAPHITE,
+		ListenPickle:     DEFAULT_LISTEN_PICKLE,
+		MaxPacketSize:    DEFAULT_MAX_PACKET_SIZE,
+		DataDir:          DEFAULT_DATA_DIR,
+		DashboardsDir:    DEFAULT_DASHBOARDS_DIR,
+		LogLevel:         int(DEFAULT_SEVERITY),
+		LogFile:          DEFAULT_LOG_FILE,
+		LogMaxSize:       DEFAULT_LOG_MAX_SIZE,
+		LogRotate:        DEFAULT_LOG_ROTATE,
+		LogKeep:          DEFAULT_LOG_KEEP,
+		LogFormat:        DEFAULT_LOG_FORMAT,
+		LogSyslog:        DEFAULT_LOG_SYSLOG,
+		SliceInterval:    DEFAULT_SLICE_INTERVAL,
+		WriteInterval:    DEFAULT_WRITE_INTERVAL,
+		SliceGrace:       DEFAULT_SLICE_GRACE,
+		RrdUpdateThreads: DEFAULT_RRD_UPDATE_THREADS,
+		BatchWrites:      DEFAULT_BATCH_WRITES,
+		LookupDns:        DEFAULT_LOOKUP_DNS,
+		Sketch:           DEFAULT_SKETCH,
+		SketchAccuracy:   DEFAULT_SKETCH_ACCURACY,
+		SketchThreshold:  DEFAULT_SKETCH_THRESHOLD,
+		RelayMode:        DEFAULT_RELAY_MODE,
+		RelayOnly:        DEFAULT_RELAY_ONLY,
+		RelayBufferSize:  DEFAULT_RELAY_BUFFER_SIZE,
+		RelaySpoolDir:    DEFAULT_RELAY_SPOOL_DIR,
+		RelaySpoolSize:   DEFAULT_RELAY_SPOOL_SIZE,
+		ClusterSelf:      DEFAULT_CLUSTER_SELF,
+		CarbonAddress:    DEFAULT_CARBON_ADDRESS,
+		CarbonBatchSize:  DEFAULT_CARBON_BATCH_SIZE,
+		CarbonQueueSize:  DEFAULT_CARBON_QUEUE_SIZE,
+	}
+}
+
+// ValidationError describes a problem with a config option.
+type ValidationError struct {
+	Option  string // option name
+	Message string
+}
+
+func (error *ValidationError) String() string {
+	return fmt.Sprintf("%s: %s", error.Option, error.Message)
+}
+
+// ValidationErrors is a list of all problems found in configuration.
+type ValidationErrors []*ValidationError
+
+func (errors ValidationErrors) String() string {
+	messages := make([]string, len(errors))
+	for i, error := range errors {
+		messages[i] = error.String()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Parse parses configuration in JSON format, options missing in the data have
+// default values. Returns ValidationErrors with all problems found: unknown
+// options, options of a wrong type, and options with invalid values.
+func Parse(data []byte) (*Config, os.Error) {
+	values := make(map[string]interface{})
+	if error := json.Unmarshal(data, &values); error != nil {
+		return nil, error
+	}
+
+	config := Default()
+	v := &validator{values: values, known: make(map[string]bool)}
+	v.readString("Listen", &config.Listen)
+	v.readString("ListenTCP", &config.ListenTCP)
+	v.readString("ListenUnix", &config.ListenUnix)
+	v.readString("ListenUnixgram", &config.ListenUnixgram)
+	v.readString("ListenGraphite", &config.ListenGraphite)
+	v.readString("ListenPickle", &config.ListenPickle)
+	v.readStrings("GraphiteSources", &config.GraphiteSources)
+	v.readInt("MaxPacketSize", &config.MaxPacketSize)
+	v.readString("DataDir", &config.DataDir)
+	v.readString("DashboardsDir", &config.DashboardsDir)
+	v.readInt("LogLevel", &config.LogLevel)
+	v.readString("LogFile", &config.LogFile)
+	v.readInt("LogMaxSize", &config.LogMaxSize)
+	v.readInt("LogRotate", &config.LogRotate)
+	v.readInt("LogKeep", &config.LogKeep)
+	v.readString("LogFormat", &config.LogFormat)
+	v.readBool("LogSyslog", &config.LogSyslog)
+	v.readInt("SliceInterval", &config.SliceInterval)
+	v.readInt("WriteInterval", &config.WriteInterval)
+	v.readInt("SliceGrace", &config.SliceGrace)
+	v.readInt("RrdUpdateThreads", &config.RrdUpdateThreads)
+	v.readBool("BatchWrites", &config.BatchWrites)
+	v.readBool("LookupDns", &config.LookupDns)
+	v.readString("Sketch", &config.Sketch)
+	v.readFloat("SketchAccuracy", &config.SketchAccuracy)
+	v.readInt("SketchThreshold", &config.SketchThreshold)
+	v.readStrings("RelayUpstreams", &config.RelayUpstreams)
+	v.readString("RelayMode", &config.RelayMode)
+	v.readBool("RelayOnly", &config.RelayOnly)
+	v.readInt("RelayBufferSize", &config.RelayBufferSize)
+	v.readString("RelaySpoolDir", &config.RelaySpoolDir)
+	v.readInt("RelaySpoolSize", &config.RelaySpoolSize)
+	if value, found := v.value("ClusterNodes"); found {
+		var error os.Error
+		if config.ClusterNodes, error = parseClusterNodes(value); error != nil {
+			v.add("ClusterNodes", error.String())
+		}
+	}
+	v.readString("ClusterSelf", &config.ClusterSelf)
+	v.readString("CarbonAddress", &config.CarbonAddress)
+	v.readInt("CarbonBatchSize", &config.CarbonBatchSize)
+	v.readInt("CarbonQueueSize", &config.CarbonQueueSize)
+	if value, found := v.value("Writers"); found {
+		var error os.Error
+		if config.Writers, error = parseWriters(value); error != nil {
+			v.add("Writers", error.String())
+		}
+	}
+	if value, found := v.value("WriterRules"); found {
+		var error os.Error
+		if config.WriterRules, error = parseWriterRules(value); error != nil {
+			v.add("WriterRules", error.String())
+		}
+	}
+	if value, found := v.value("Alerts"); found {
+		var error os.Error
+		if config.Alerts, error = parseAlerts(value); error != nil {
+			v.add("Alerts", error.String())
+		}
+	}
+	if value, found := v.value("Notifiers"); found {
+		var error os.Error
+		if config.Notifiers, error = parseNotifiers(value); error != nil {
+			v.add("Notifiers", error.String())
+		}
+	}
+	v.unknown()
+
+	errors := append(v.errors, config.Validate()...)
+	if len(errors) > 0 {
+		return nil, errors
+	}
+	return config, nil
+}
+
+// Validate checks values of options, returns all problems found (nil when
+// configuration is valid).
+func (config *Config) Validate() (errors ValidationErrors) {
+	check := func(valid bool, option, format string, v ...interface{}) {
+		if !valid {
+			errors = append(errors, &ValidationError{option, fmt.Sprintf(format, v...)})
+		}
+	}
+	check(len(config.Listen) > 0, "Listen", "should not be empty")
+	for _, pattern := range config.GraphiteSources {
+		_, error := parser.NewGraphiteRule(pattern)
+		check(error == nil, "GraphiteSources", "%s", error)
+	}
+	check(config.MaxPacketSize > 0 && config.MaxPacketSize <= 65535, "MaxPacketSize", "should be between 1 and 65535, got %d", config.MaxPacketSize)
+	check(len(config.DataDir) > 0, "DataDir", "should not be empty")
+	check(config.LogLevel >= int(logger.DEBUG) && config.LogLevel <= int(logger.UNKNOWN), "LogLevel", "should be between %d and %d, got %d", logger.DEBUG, logger.UNKNOWN, config.LogLevel)
+	check(config.LogMaxSize >= 0, "LogMaxSize", "should not be negative, got %d", config.LogMaxSize)
+	check(config.LogRotate >= 0, "LogRotate", "should not be negative, got %d", config.LogRotate)
+	check(config.LogKeep >= 0, "LogKeep", "should not be negative, got %d", config.LogKeep)
+	check(config.LogFormat == "text" || config.LogFormat == "json", "LogFormat", "should be text or json, got %q", config.LogFormat)
+	check(config.SliceInterval > 0, "SliceInterval", "should be positive, got %d", config.SliceInterval)
+	check(config.WriteInterval > 0, "WriteInterval", "should be positive, got %d", config.WriteInterval)
+	check(config.WriteInterval >= config.SliceInterval, "WriteInterval", "should not be less than SliceInterval (%d), got %d", config.SliceInterval, config.WriteInterval)
+	check(config.SliceGrace >= 0, "SliceGrace", "should not be negative, got %d", config.SliceGrace)
+	check(config.RrdUpdateThreads > 0, "RrdUpdateThreads", "should be positive, got %d", config.RrdUpdateThreads)
+	check(config.Sketch == "none" || config.Sketch == "ddsketch", "Sketch", "should be none or ddsketch, got %q", config.Sketch)
+	check(config.SketchAccuracy > 0 && config.SketchAccuracy < 1, "SketchAccuracy", "should be greater than 0 and less than 1, got %v", config.SketchAccuracy)
+	check(config.SketchThreshold >= 0, "SketchThreshold", "should not be negative, got %d", config.SketchThreshold)
+	for _, upstream := range config.RelayUpstreams {
+		check(len(upstream) > 0, "RelayUpstreams", "should not contain empty addresses")
+	}
+	check(config.RelayMode == "aggregate" || config.RelayMode == "raw", "RelayMode", "should be aggregate or raw, got %q", config.RelayMode)
+	check(!config.RelayOnly || len(config.RelayUpstreams) > 0, "RelayOnly", "requires RelayUpstreams")
+	check(config.RelayBufferSize > 0, "RelayBufferSize", "should be positive, got %d", config.RelayBufferSize)
+	check(config.RelaySpoolSize >= 0, "RelaySpoolSize", "should not be negative, got %d", config.RelaySpoolSize)
+	names := make(map[string]bool, len(config.ClusterNodes))
+	for _, node := range config.ClusterNodes {
+		check(!names[node.Name], "ClusterNodes", "node %q is defined more than once", node.Name)
+		names[node.Name] = true
+	}
+	if len(config.ClusterNodes) > 0 {
+		check(names[config.ClusterSelf], "ClusterSelf", "should be a name of one of ClusterNodes, got %q", config.ClusterSelf)
+	} else {
+		check(len(config.ClusterSelf) == 0, "ClusterSelf", "requires ClusterNodes")
+	}
+	check(config.CarbonBatchSize > 0, "CarbonBatchSize", "should be positive, got %d", config.CarbonBatchSize)
+	check(config.CarbonQueueSize >= config.CarbonBatchSize, "CarbonQueueSize", "should not be less than CarbonBatchSize (%d), got %d", config.CarbonBatchSize, config.CarbonQueueSize)
+	notifiers := make(map[string]bool, len(config.Notifiers))
+	for _, notifier := range config.Notifiers {
+		check(!notifiers[notifier.Name], "Notifiers", "notifier %q is defined more than once", notifier.Name)
+		notifiers[notifier.Name] = true
+	}
+	alerts := make(map[string]bool, len(config.Alerts))
+	for _, alert := range config.Alerts {
+		check(!alerts[alert.Name], "Alerts", "alert %q is defined more than once", alert.Name)
+		alerts[alert.Name] = true
+		for _, name := range alert.Notify {
+			check(notifiers[name], "Alerts", "notifier %q used in alert %q is not defined", name, alert.Name)
+		}
+	}
+	return
+}
+
+// validator reads options of the expected types from the decoded JSON object,
+// and collects all problems found.
+type validator struct {
+	values map[string]interface{}
+	known  map[string]bool // options read so far
+	errors ValidationErrors
+}
+
+func (v *validator) add(option, message string) {
+	v.errors = append(v.errors, &ValidationError{option, message})
+}
+
+func (v *validator) value(option string) (value interface{}, found bool) {
+	v.known[option] = true
+	value, found = v.values[option]
+	return
+}
+
+func (v *validator) readString(option string, target *string) {
+	if value, found := v.value(option); found {
+		if s, ok := value.(string); ok {
+			*target = s
+		} else {
+			v.add(option, fmt.Sprintf("should be a string, got %v", value))
+		}
+	}
+}
+
+func (v *validator) readInt(option string, target *int) {
+	if value, found := v.value(option); found {
+		if f, ok := value.(float64); ok && f == math.Floor(f) {
+			*target = int(f)
+		} else {
+			v.add(option, fmt.Sprintf("should be an integer, got %v", value))
+		}
+	}
+}
+
+func (v *validator) readFloat(option string, target *float64) {
+	if value, found := v.value(option); found {
+		if f, ok := value.(float64); ok {
+			*target = f
+		} else {
+			v.add(option, fmt.Sprintf("should be a number, got %v", value))
+		}
+	}
+}
+
+func (v *validator) readBool(option string, target *bool) {
+	if value, found := v.value(option); found {
+		if b, ok := value.(bool); ok {
+			*target = b
+		} else {
+			v.add(option, fmt.Sprintf("should be true or false, got %v", value))
+		}
+	}
+}
+
+func (v *validator) readStrings(option string, target *[]string) {
+	if value, found := v.value(option); found {
+		list, ok := value.([]interface{})
+		items := make([]string, len(list))
+		for i := 0; ok && i < len(list); i++ {
+			items[i], ok = list[i].(string)
+		}
+		if ok {
+			*target = items
+		} else {
+			v.add(option, fmt.Sprintf("should be a list of strings, got %v", value))
+		}
+	}
+}
+
+// unknown reports options which have not been read.
+func (v *validator) unknown() {
+	names := make([]string, 0, len(v.values))
+	for name := range v.values {
+		if !v.known[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		v.add(name, "unknown option")
+	}
+}
+
+// parseWriters parses the list of writers, each of them is either a name
+// ("count") or an object with name and options ({"Name": "count", "Options": {}}).
+func parseWriters(value interface{}) ([]WriterConfig, os.Error) {
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, os.NewError("Writers should be a list")
+	}
+	writers := make([]WriterConfig, 0, len(list))
+	for _, item := range list {
+		switch writer := item.(type) {
+		case string:
+			writers = append(writers, WriterConfig{Name: writer})
+		case map[string]interface{}:
+			name, ok := writer["Name"].(string)
+			if !ok {
+				return nil, os.NewError(fmt.Sprintf("Writer name is missing: %v", writer))
+			}
+			var options map[string]interface{}
+			if opts, found := writer["Options"]; found {
+				if options, ok = opts.(map[string]interface{}); !ok {
+					return nil, os.NewError(fmt.Sprintf("Writer options should be an object: %v", writer))
+				}
+			}
+			writers = append(writers, WriterConfig{Name: name, Options: options})
+		default:
+			return nil, os.NewError(fmt.Sprintf("Writer is invalid: %v", item))
+		}
+	}
+	return writers, nil
+}
+
+// parseWriterRules parses the list of writer rules in the
+// {"Match": "*.time", "Writers": ["percentiles"]} format.
+func parseWriterRules(value interface{}) ([]WriterRule, os.Error) {
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, os.NewError("WriterRules should be a list")
+	}
+	rules := make([]WriterRule, 0, len(list))
+	for _, item := range list {
+		rule, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, os.NewError(fmt.Sprintf("Writer rule is invalid: %v", item))
+		}
+		match, ok := rule["Match"].(string)
+		if !ok {
+			return nil, os.NewError(fmt.Sprintf("Writer rule pattern is missing: %v", item))
+		}
+		names, ok := rule["Writers"].([]interface{})
+		if !ok {
+			return nil, os.NewError(fmt.Sprintf("Writer rule writers should be a list: %v", item))
+		}
+		writers := make([]string, len(names))
+		for i, name := range names {
+			if writers[i], ok = name.(string); !ok {
+				return nil, os.NewError(fmt.Sprintf("Writer rule writers should be a list of names: %v", item))
+			}
+		}
+		rules = append(rules, WriterRule{Match: match, Writers: writers})
+	}
+	return rules, nil
+}
+
+// parseClusterNodes parses the list of cluster nodes in the
+// {"Name": "node1", "Address": "10.0.0.1:6311", "Web": "10.0.0.1:6311"} format.
+func parseClusterNodes(value interface{}) ([]ClusterNode, os.Error) {
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, os.NewError("ClusterNodes should be a list")
+	}
+	nodes := make([]ClusterNode, 0, len(list))
+	for _, item := range list {
+		node, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, os.NewError(fmt.Sprintf("Cluster node is invalid: %v", item))
+		}
+		var fields [3]string
+		for i, field := range []string{"Name", "Address", "Web"} {
+			if fields[i], ok = node[field].(string); !ok || len(fields[i]) == 0 {
+				return nil, os.NewError(fmt.Sprintf("Cluster node %s is missing: %v", strings.ToLower(field), item))
+			}
+		}
+		nodes = append(nodes, ClusterNode{Name: fields[0], Address: fields[1], Web: fields[2]})
+	}
+	return nodes, nil
+}
+
+// parseAlerts parses the list of alert rules in the {"Name": "slow-logins",
+// "Rule": "api.login.time percentiles.pct95 > 500 for 3 slices",
+// "Source": "all", "Notify": ["ops"]} format (source and notifiers are
+// optional).
+func parseAlerts(value interface{}) ([]AlertConfig, os.Error) {
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, os.NewError("Alerts should be a list")
+	}
+	alerts := make([]AlertConfig, 0, len(list))
+	for _, item := range list {
+		alert, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, os.NewError(fmt.Sprintf("Alert is invalid: %v", item))
+		}
+		var fields [2]string
+		for i, field := range []string{"Name", "Rule"} {
+			if fields[i], ok = alert[field].(string); !ok || len(fields[i]) == 0 {
+				return nil, os.NewError(fmt.Sprintf("Alert %s is missing: %v", strings.ToLower(field), item))
+			}
+		}
+		source := "all"
+		if value, found := alert["Source"]; found {
+			if source, ok = value.(string); !ok || len(source) == 0 {
+				return nil, os.NewError(fmt.Sprintf("Alert source should be a non-empty string: %v", item))
+			}
+		}
+		var notify []string
+		if value, found := alert["Notify"]; found {
+			names, ok := value.([]interface{})
+			if !ok {
+				return nil, os.NewError(fmt.Sprintf("Alert notifiers should be a list: %v", item))
+			}
+			notify = make([]string, len(names))
+			for i, name := range names {
+				if notify[i], ok = name.(string); !ok {
+					return nil, os.NewError(fmt.Sprintf("Alert notifiers should be a list of names: %v", item))
+				}
+			}
+		}
+		alerts = append(alerts, AlertConfig{Name: fields[0], Rule: fields[1], Source: source, Notify: notify})
+	}
+	return alerts, nil
+}
+
+// parseNotifiers parses the list of notifiers in the {"Name": "ops",
+// "Type": "webhook", "Options": {"URL": "http://alerts.local/metricsd"}} format.
+func parseNotifiers(value interface{}) ([]NotifierConfig, os.Error) {
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, os.NewError("Notifiers should be a list")
+	}
+	notifiers := make([]NotifierConfig, 0, len(list))
+	for _, item := range list {
+		notifier, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, os.NewError(fmt.Sprintf("Notifier is invalid: %v", item))
+		}
+		var fields [2]string
+		for i, field := range []string{"Name", "Type"} {
+			if fields[i], ok = notifier[field].(string); !ok || len(fields[i]) == 0 {
+				return nil, os.NewError(fmt.Sprintf("Notifier %s is missing: %v", strings.ToLower(field), item))
+			}
+		}
+		var options map[string]interface{}
+		if opts, found := notifier["Options"]; found {
+			if options, ok = opts.(map[string]interface{}); !ok {
+				return nil, os.NewError(fmt.Sprintf("Notifier options should be an object: %v", item))
+			}
+		}
+		notifiers = append(notifiers, NotifierConfig{Name: fields[0], Type: fields[1], Options: options})
+	}
+	return notifiers, nil
+}
@@ -0,0 +1,553 @@
+// Package graph renders time series graphs as PNG and SVG images. Layout
+// follows the one used by RRDTool: title on top, vertical label and value
+// axis on the left, time axis at the bottom followed by the legend.
+package graph
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Graph describes a graph to render.
+type Graph struct {
+	Title         string
+	VerticalLabel string
+	Start, End    int64   // time range
+	Width, Height int     // size of the graph area in pixels
+	Dark          bool    // use dark color scheme
+	LowerLimit    float64 // lower limit of the value axis, NaN to autoscale
+	Series        []*Series
+	Legend        []*LegendItem
+}
+
+// Data is a list of values with the given interval between them, value i
+// covers the interval from Start + i*Step to Start + (i+1)*Step.
+type Data struct {
+	Values []float64
+	Start  int64
+	Step   int64
+}
+
+// Series is data drawn as an area or a line.
+type Series struct {
+	Data  *Data
+	Color string // RRGGBB
+	Area  bool   // fill the area between the line and zero
+	Width int    // line width in pixels
+}
+
+// LegendItem is a line of the legend. Items without a color are comments.
+type LegendItem struct {
+	Color string
+	Label string
+	Stats []Stat
+}
+
+// Stat is a named value displayed in the legend.
+type Stat struct {
+	Name  string
+	Value float64
+}
+
+// NewGraph creates a graph with the default settings.
+func NewGraph(title string, start, end int64, width, height int) *Graph {
+	return &Graph{
+		Title:      title,
+		Start:      start,
+		End:        end,
+		Width:      width,
+		Height:     height,
+		LowerLimit: math.NaN(),
+	}
+}
+
+// AddArea adds data drawn as an area.
+func (g *Graph) AddArea(data *Data, color string) {
+	g.Series = append(g.Series, &Series{Data: data, Color: color, Area: true})
+}
+
+// AddLine adds data drawn as a line.
+func (g *Graph) AddLine(data *Data, color string, width int) {
+	g.Series = append(g.Series, &Series{Data: data, Color: color, Width: width})
+}
+
+// AddLegend adds a line to the legend.
+func (g *Graph) AddLegend(color, label string, stats ...Stat) {
+	g.Legend = append(g.Legend, &LegendItem{Color: color, Label: label, Stats: stats})
+}
+
+// RenderPNG renders the graph as a PNG image.
+func (g *Graph) RenderPNG(w io.Writer) os.Error {
+	l, err := g.layout()
+	if err != nil {
+		return err
+	}
+	c := newPngCanvas(l.width, l.height)
+	g.draw(c, l)
+	return c.encode(w)
+}
+
+// RenderSVG renders the graph as an SVG image.
+func (g *Graph) RenderSVG(w io.Writer) os.Error {
+	l, err := g.layout()
+	if err != nil {
+		return err
+	}
+	c := newSvgCanvas(l.width, l.height)
+	g.draw(c, l)
+	return c.encode(w)
+}
+
+/***** Layout *****************************************************************/
+
+// Font metrics in pixels.
+const (
+	charWidth  = 6 // glyph width with spacing
+	charHeight = 7
+	lineHeight = 12
+)
+
+// Layout margins in pixels.
+const (
+	padding     = 10
+	titleHeight = 24
+	axisHeight  = 18
+	rightMargin = 20
+)
+
+// Axis tick intervals in seconds with corresponding label formats.
+var timeTicks = []struct {
+	interval int64
+	format   string
+}{
+	{60, "15:04"},
+	{300, "15:04"},
+	{600, "15:04"},
+	{1800, "15:04"},
+	{3600, "15:04"},
+	{3 * 3600, "15:04"},
+	{6 * 3600, "15:04"},
+	{12 * 3600, "Jan 02 15:04"},
+	{86400, "Jan 02"},
+	{2 * 86400, "Jan 02"},
+	{7 * 86400, "Jan 02"},
+	{14 * 86400, "Jan 02"},
+	{30 * 86400, "Jan 2006"},
+	{91 * 86400, "Jan 2006"},
+	{365 * 86400, "2006"},
+}
+
+type color struct {
+	r, g, b uint8
+}
+
+type point struct {
+	x, y int
+}
+
+type alignment int
+
+const (
+	alignLeft alignment = iota
+	alignCenter
+	alignRight
+)
+
+type colorScheme struct {
+	back, canvas, font, grid, axis color
+}
+
+var (
+	lightScheme = colorScheme{
+		back:   color{0xF0, 0xF0, 0xF0},
+		canvas: color{0xFF, 0xFF, 0xFF},
+		font:   color{0x00, 0x00, 0x00},
+		grid:   color{0xDD, 0xDD, 0xDD},
+		axis:   color{0x80, 0x80, 0x80},
+	}
+	darkScheme = colorScheme{
+		back:   color{0x22, 0x22, 0x22},
+		canvas: color{0x00, 0x00, 0x00},
+		font:   color{0xEE, 0xEE, 0xEE},
+		grid:   color{0x33, 0x33, 0x33},
+		axis:   color{0x80, 0x80, 0x80},
+	}
+)
+
+// canvas is a surface graphs are drawn on.
+type canvas interface {
+	rect(x, y, w, h int, c color)
+	polyline(points []point, c color, width int)
+	area(points []point, base int, c color)
+	text(x, y int, s string, c color, align alignment, vertical bool)
+}
+
+type layout struct {
+	width, height int // size of the image
+	left, top     int // position of the graph area
+	min, max      float64
+	valueTicks    []float64
+	valueStep     float64
+	timeTicks     []int64
+	timeFormat    string
+}
+
+func (g *Graph) layout() (*layout, os.Error) {
+	if g.Start >= g.End {
+		return nil, os.NewError(fmt.Sprintf("start (%d) should be less than end (%d)", g.Start, g.End))
+	}
+	if g.Width < 10 || g.Height < 10 {
+		return nil, os.NewError(fmt.Sprintf("graph size %dx%d is too small", g.Width, g.Height))
+	}
+
+	l := &layout{}
+	l.min, l.max = g.valueRange()
+	l.valueTicks, l.valueStep = valueTicks(l.min, l.max, g.Height/lineHeight/2)
+	l.min, l.max = l.valueTicks[0], l.valueTicks[len(l.valueTicks)-1]
+	l.timeTicks, l.timeFormat = timeTicksFor(g.Start, g.End, g.Width)
+
+	labelWidth := 0
+	for _, v := range l.valueTicks {
+		if width := textWidth(formatTick(v, l.valueStep)); width > labelWidth {
+			labelWidth = width
+		}
+	}
+	l.left = padding + labelWidth + padding/2
+	if len(g.VerticalLabel) > 0 {
+		l.left += charHeight + padding/2
+	}
+	l.top = titleHeight
+	l.width = l.left + g.Width + rightMargin
+	l.height = l.top + g.Height + axisHeight + len(g.Legend)*lineHeight + padding
+	return l, nil
+}
+
+// valueRange returns minimum and maximum values of the graph.
+func (g *Graph) valueRange() (min, max float64) {
+	min, max = math.Inf(1), math.Inf(-1)
+	for _, series := range g.Series {
+		for _, v := range series.Data.Values {
+			if math.IsNaN(v) {
+				continue
+			}
+			if v < min {
+				min = v
+			}
+			if v > max {
+				max = v
+			}
+		}
+		// Areas are always filled from zero
+		if series.Area {
+			if min > 0 {
+				min = 0
+			}
+			if max < 0 {
+				max = 0
+			}
+		}
+	}
+	if !math.IsNaN(g.LowerLimit) && (min > g.LowerLimit || math.IsInf(min, 1)) {
+		min = g.LowerLimit
+	}
+	if math.IsInf(min, 1) {
+		min, max = 0, 1
+	}
+	if math.IsInf(max, -1) || max <= min {
+		max = min + 1
+	}
+	return
+}
+
+// valueTicks returns ticks for the value axis covering the given range,
+// with "nice" step between them (1, 2 or 5 multiplied by a power of 10).
+func valueTicks(min, max float64, count int) (ticks []float64, step float64) {
+	if count < 1 {
+		count = 1
+	}
+	magnitude := math.Pow(10, math.Floor(math.Log10((max-min)/float64(count))))
+	for _, m := range []float64{1, 2, 5, 10} {
+		step = magnitude * m
+		if (max-min)/step <= float64(count) {
+			break
+		}
+	}
+	first, last := math.Floor(min/step), math.Ceil(max/step)
+	for i := first; i <= last; i++ {
+		ticks = append(ticks, i*step)
+	}
+	return
+}
+
+// timeTicksFor returns ticks for the time axis and the format of their labels.
+func timeTicksFor(start, end int64, width int) (ticks []int64, format string) {
+	maxTicks := int64(width / 70)
+	if maxTicks < 1 {
+		maxTicks = 1
+	}
+	interval := timeTicks[len(timeTicks)-1].interval
+	format = timeTicks[len(timeTicks)-1].format
+	for _, tick := range timeTicks {
+		if (end-start)/tick.interval <= maxTicks {
+			interval, format = tick.interval, tick.format
+			break
+		}
+	}
+
+	// Align ticks to the local time
+	offset := int64(time.SecondsToLocalTime(start).ZoneOffset)
+	for t := start - (start+offset)%interval; t <= end; t += interval {
+		if t >= start {
+			ticks = append(ticks, t)
+		}
+	}
+	return
+}
+
+/***** Drawing ****************************************************************/
+
+func (g *Graph) draw(c canvas, l *layout) {
+	scheme := lightScheme
+	if g.Dark {
+		scheme = darkScheme
+	}
+
+	c.rect(0, 0, l.width, l.height, scheme.back)
+	c.rect(l.left, l.top, g.Width, g.Height, scheme.canvas)
+
+	// Grid
+	for _, v := range l.valueTicks {
+		y := g.y(l, v)
+		c.polyline([]point{{l.left, y}, {l.left + g.Width - 1, y}}, scheme.grid, 1)
+		c.text(l.left-padding/2, y-charHeight/2, formatTick(v, l.valueStep), scheme.font, alignRight, false)
+	}
+	for _, t := range l.timeTicks {
+		x := g.x(l, t)
+		c.polyline([]point{{x, l.top}, {x, l.top + g.Height - 1}}, scheme.grid, 1)
+		label := time.SecondsToLocalTime(t).Format(l.timeFormat)
+		c.text(x, l.top+g.Height+padding/2, label, scheme.font, alignCenter, false)
+	}
+
+	// Series
+	for _, series := range g.Series {
+		col := parseColor(series.Color)
+		for _, segment := range g.segments(l, series) {
+			if series.Area {
+				c.area(segment, g.y(l, 0), col)
+			} else {
+				c.polyline(segment, col, series.Width)
+			}
+		}
+	}
+
+	// Axes
+	c.polyline([]point{{l.left, l.top + g.Height - 1}, {l.left + g.Width - 1, l.top + g.Height - 1}}, scheme.axis, 1)
+	c.polyline([]point{{l.left, l.top}, {l.left, l.top + g.Height - 1}}, scheme.axis, 1)
+
+	// Labels
+	c.text(l.width/2, (titleHeight-charHeight)/2, g.Title, scheme.font, alignCenter, false)
+	if len(g.VerticalLabel) > 0 {
+		c.text(padding, l.top+g.Height/2, g.VerticalLabel, scheme.font, alignCenter, true)
+	}
+
+	// Legend
+	labelWidth := 0
+	for _, item := range g.Legend {
+		if len(item.Color) > 0 && len(item.Label) > labelWidth {
+			labelWidth = len(item.Label)
+		}
+	}
+	y := l.top + g.Height + axisHeight
+	for _, item := range g.Legend {
+		text := item.Label
+		x := padding
+		if len(item.Color) > 0 {
+			c.rect(x, y, charHeight, charHeight, parseColor(item.Color))
+			x += charHeight + charWidth
+			text += spaces(labelWidth - len(item.Label))
+		}
+		for _, stat := range item.Stats {
+			text += fmt.Sprintf("  %s: %s", stat.Name, FormatValue(stat.Value))
+		}
+		c.text(x, y, text, scheme.font, alignLeft, false)
+		y += lineHeight
+	}
+}
+
+// segments splits the series into lists of points with known values.
+func (g *Graph) segments(l *layout, series *Series) (segments [][]point) {
+	var segment []point
+	for px := 0; px < g.Width; px++ {
+		// Middle of the pixel
+		t := g.Start + (int64(2*px+1)*(g.End-g.Start))/int64(2*g.Width)
+		v := series.Data.At(t)
+		if math.IsNaN(v) {
+			if len(segment) > 0 {
+				segments = append(segments, segment)
+				segment = nil
+			}
+			continue
+		}
+		segment = append(segment, point{l.left + px, g.y(l, v)})
+	}
+	if len(segment) > 0 {
+		segments = append(segments, segment)
+	}
+	return
+}
+
+// x returns horizontal position of the given time.
+func (g *Graph) x(l *layout, t int64) int {
+	return l.left + int((t-g.Start)*int64(g.Width-1)/(g.End-g.Start))
+}
+
+// y returns vertical position of the given value, clamped to the graph area.
+func (g *Graph) y(l *layout, v float64) int {
+	if v < l.min {
+		v = l.min
+	} else if v > l.max {
+		v = l.max
+	}
+	return l.top + g.Height - 1 - int(math.Floor((v-l.min)/(l.max-l.min)*float64(g.Height-1)+0.5))
+}
+
+/***** Data *******************************************************************/
+
+// At returns value at the given time, NaN if it is unknown.
+func (d *Data) At(t int64) float64 {
+	if d.Step > 0 && t >= d.Start {
+		if i := (t - d.Start) / d.Step; i < int64(len(d.Values)) {
+			return d.Values[i]
+		}
+	}
+	return math.NaN()
+}
+
+// Negate returns data with all values negated.
+func (d *Data) Negate() *Data {
+	values := make([]float64, len(d.Values))
+	for i, v := range d.Values {
+		values[i] = -v
+	}
+	return &Data{Values: values, Start: d.Start, Step: d.Step}
+}
+
+// Last returns the last known value.
+func (d *Data) Last() float64 {
+	for i := len(d.Values) - 1; i >= 0; i-- {
+		if !math.IsNaN(d.Values[i]) {
+			return d.Values[i]
+		}
+	}
+	return math.NaN()
+}
+
+// Average returns the average of known values.
+func (d *Data) Average() float64 {
+	sum, count := 0.0, 0
+	for _, v := range d.Values {
+		if !math.IsNaN(v) {
+			sum += v
+			count++
+		}
+	}
+	if count == 0 {
+		return math.NaN()
+	}
+	return sum / float64(count)
+}
+
+// Minimum returns the lowest known value.
+func (d *Data) Minimum() float64 {
+	return d.reduce(func(a, b float64) bool { return a < b })
+}
+
+// Maximum returns the highest known value.
+func (d *Data) Maximum() float64 {
+	return d.reduce(func(a, b float64) bool { return a > b })
+}
+
+func (d *Data) reduce(better func(a, b float64) bool) float64 {
+	result := math.NaN()
+	for _, v := range d.Values {
+		if !math.IsNaN(v) && (math.IsNaN(result) || better(v, result)) {
+			result = v
+		}
+	}
+	return result
+}
+
+/***** Helper functions *******************************************************/
+
+// SI prefixes for 10^-18 to 10^18.
+var siPrefixes = []string{"a", "f", "p", "n", "u", "m", "", "k", "M", "G", "T", "P", "E"}
+
+// scale returns the value scaled to the [1, 1000) range and its SI prefix.
+func scale(v float64) (float64, string) {
+	if v == 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+		return v, ""
+	}
+	exp := int(math.Floor(math.Log10(math.Fabs(v)) / 3))
+	if exp < -6 {
+		exp = -6
+	} else if exp > 6 {
+		exp = 6
+	}
+	return v / math.Pow(1000, float64(exp)), siPrefixes[exp+6]
+}
+
+// FormatValue formats the value for the legend using SI prefixes
+// (e.g. 1234.5 is "1.23 k").
+func FormatValue(v float64) string {
+	if math.IsNaN(v) {
+		return "nan"
+	}
+	scaled, prefix := scale(v)
+	if len(prefix) == 0 {
+		return fmt.Sprintf("%.2f", scaled)
+	}
+	return fmt.Sprintf("%.2f %s", scaled, prefix)
+}
+
+// formatTick formats a value axis label, step is the interval between ticks.
+func formatTick(v, step float64) string {
+	magnitude := math.Fabs(v)
+	if magnitude < step {
+		magnitude = step
+	}
+	scaled, prefix := scale(magnitude)
+	factor := scaled / magnitude
+	precision := 0
+	for s := step * factor; precision < 3 && math.Fabs(s-math.Floor(s+0.5)) > 1e-9; s *= 10 {
+		precision++
+	}
+	return strconv.Ftoa64(v*factor, 'f', precision) + prefix
+}
+
+// parseColor parses a color in the RRGGBB format, invalid colors are black.
+func parseColor(s string) color {
+	n, err := strconv.Btoui64(s, 16)
+	if err != nil || len(s) != 6 {
+		return color{}
+	}
+	return color{uint8(n >> 16), uint8(n >> 8), uint8(n)}
+}
+
+func textWidth(s string) int {
+	if len(s) == 0 {
+		return 0
+	}
+	return len(s)*charWidth - 1
+}
+
+func spaces(n int) string {
+	s := ""
+	for i := 0; i < n; i++ {
+		s += " "
+	}
+	return s
+}
@@ -0,0 +1,149 @@
+package graph
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"math"
+	. "launchpad.net/gocheck"
+	"strings"
+	"testing"
+)
+
+// Hook up gocheck into the gotest runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type GraphS struct{}
+
+var _ = Suite(&GraphS{})
+
+func (s *GraphS) TestValueTicks(c *C) {
+	ticks, step := valueTicks(0, 97, 5)
+	c.Check(fmt.Sprint(ticks), Equals, "[0 20 40 60 80 100]")
+	c.Check(step, Equals, float64(20))
+
+	ticks, step = valueTicks(-0.3, 0.42, 4)
+	c.Check(fmt.Sprint(ticks), Equals, "[-0.4 -0.2 0 0.2 0.4 0.6000000000000001]")
+	c.Check(step, Equals, 0.2)
+}
+
+func (s *GraphS) TestValueRange(c *C) {
+	g := NewGraph("", 0, 100, 100, 100)
+	min, max := g.valueRange()
+	c.Check(min, Equals, float64(0))
+	c.Check(max, Equals, float64(1))
+
+	g.AddLine(&Data{[]float64{5, math.NaN(), 10}, 0, 10}, "000000", 1)
+	min, max = g.valueRange()
+	c.Check(min, Equals, float64(5))
+	c.Check(max, Equals, float64(10))
+
+	g.LowerLimit = 0
+	min, max = g.valueRange()
+	c.Check(min, Equals, float64(0))
+
+	g.AddArea(&Data{[]float64{-3}, 0, 10}, "000000")
+	min, max = g.valueRange()
+	c.Check(min, Equals, float64(-3))
+	c.Check(max, Equals, float64(10))
+}
+
+func (s *GraphS) TestData(c *C) {
+	data := &Data{[]float64{math.NaN(), 4, -2, 1, math.NaN()}, 1000, 10}
+	c.Check(data.Last(), Equals, float64(1))
+	c.Check(data.Average(), Equals, float64(1))
+	c.Check(data.Minimum(), Equals, float64(-2))
+	c.Check(data.Maximum(), Equals, float64(4))
+	c.Check(data.At(1019), Equals, float64(4))
+	c.Check(data.At(1020), Equals, float64(-2))
+	c.Check(math.IsNaN(data.At(999)), Equals, true)
+	c.Check(math.IsNaN(data.At(1050)), Equals, true)
+	c.Check(fmt.Sprint(data.Negate().Values), Equals, "[NaN -4 2 -1 NaN]")
+
+	empty := &Data{[]float64{math.NaN()}, 1000, 10}
+	c.Check(math.IsNaN(empty.Last()), Equals, true)
+	c.Check(math.IsNaN(empty.Average()), Equals, true)
+	c.Check(math.IsNaN(empty.Maximum()), Equals, true)
+}
+
+func (s *GraphS) TestFormatValue(c *C) {
+	c.Check(FormatValue(0), Equals, "0.00")
+	c.Check(FormatValue(12.345), Equals, "12.35")
+	c.Check(FormatValue(1234.5), Equals, "1.23 k")
+	c.Check(FormatValue(-2500000), Equals, "-2.50 M")
+	c.Check(FormatValue(0.0123), Equals, "12.30 m")
+	c.Check(FormatValue(math.NaN()), Equals, "nan")
+}
+
+func (s *GraphS) TestFormatTick(c *C) {
+	c.Check(formatTick(0, 500), Equals, "0")
+	c.Check(formatTick(500, 500), Equals, "500")
+	c.Check(formatTick(1500, 500), Equals, "1.5k")
+	c.Check(formatTick(2000, 1000), Equals, "2k")
+	c.Check(formatTick(0.25, 0.05), Equals, "250m")
+}
+
+func (s *GraphS) TestParseColor(c *C) {
+	c.Check(parseColor("FF897C"), Equals, color{0xFF, 0x89, 0x7C})
+	c.Check(parseColor("FF897"), Equals, color{})
+	c.Check(parseColor("invalid"), Equals, color{})
+	c.Check(parseColor("157419").String(), Equals, "#157419")
+}
+
+func (s *GraphS) TestSegments(c *C) {
+	g := NewGraph("", 1000, 1040, 40, 10)
+	l := &layout{left: 10, top: 20, min: 0, max: 9}
+	series := &Series{Data: &Data{[]float64{0, math.NaN(), 9, 9}, 1000, 10}}
+	segments := g.segments(l, series)
+	c.Assert(len(segments), Equals, 2)
+	c.Check(len(segments[0]), Equals, 10)
+	c.Check(segments[0][0], Equals, point{10, 29})
+	c.Check(len(segments[1]), Equals, 20)
+	c.Check(segments[1][0], Equals, point{30, 20})
+}
+
+func (s *GraphS) TestRenderPNG(c *C) {
+	g := testGraph()
+	var buf bytes.Buffer
+	c.Assert(g.RenderPNG(&buf), IsNil)
+
+	img, err := png.Decode(&buf)
+	c.Assert(err, IsNil)
+	l, _ := g.layout()
+	c.Check(img.Bounds().Dx(), Equals, l.width)
+	c.Check(img.Bounds().Dy(), Equals, l.height)
+}
+
+func (s *GraphS) TestRenderSVG(c *C) {
+	g := testGraph()
+	g.Dark = true
+	var buf bytes.Buffer
+	c.Assert(g.RenderSVG(&buf), IsNil)
+
+	svg := buf.String()
+	c.Check(strings.HasPrefix(svg, "<?xml"), Equals, true)
+	c.Check(strings.Contains(svg, "fill=\"#222222\""), Equals, true)
+	c.Check(strings.Contains(svg, "fill=\"#00CF00\""), Equals, true)
+	c.Check(strings.Contains(svg, "stroke=\"#157419\""), Equals, true)
+	c.Check(strings.Contains(svg, ">requests &lt;all&gt;</text>"), Equals, true)
+	c.Check(strings.Contains(svg, "transform=\"rotate(-90"), Equals, true)
+	c.Check(strings.Contains(svg, ">Success  Current: 3.00</text>"), Equals, true)
+}
+
+func (s *GraphS) TestRenderInvalidGraph(c *C) {
+	var buf bytes.Buffer
+	g := NewGraph("", 1000, 1000, 100, 100)
+	c.Check(g.RenderPNG(&buf).String(), Equals, "start (1000) should be less than end (1000)")
+	g = NewGraph("", 1000, 2000, 5, 100)
+	c.Check(g.RenderSVG(&buf).String(), Equals, "graph size 5x100 is too small")
+}
+
+func testGraph() *Graph {
+	g := NewGraph("requests <all>", 1000, 1600, 200, 100)
+	g.VerticalLabel = "per second"
+	data := &Data{[]float64{1, 2, math.NaN(), 3}, 1000, 150}
+	g.AddArea(data, "00CF00")
+	g.AddLine(data, "157419", 1)
+	g.AddLegend("00CF00", "Success", Stat{"Current", 3})
+	return g
+}
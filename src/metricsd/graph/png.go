@@ -0,0 +1,122 @@
+package graph
+
+import (
+	"image"
+	"image/png"
+	"io"
+	"os"
+)
+
+// pngCanvas draws graphs on an RGBA image using the bitmap font.
+type pngCanvas struct {
+	image *image.RGBA
+}
+
+func newPngCanvas(width, height int) *pngCanvas {
+	return &pngCanvas{image: image.NewRGBA(width, height)}
+}
+
+func (c *pngCanvas) encode(w io.Writer) os.Error {
+	return png.Encode(w, c.image)
+}
+
+func (c *pngCanvas) set(x, y int, col color) {
+	c.image.Set(x, y, image.RGBAColor{col.r, col.g, col.b, 0xFF})
+}
+
+func (c *pngCanvas) rect(x, y, w, h int, col color) {
+	for py := y; py < y+h; py++ {
+		for px := x; px < x+w; px++ {
+			c.set(px, py, col)
+		}
+	}
+}
+
+func (c *pngCanvas) polyline(points []point, col color, width int) {
+	if len(points) == 1 {
+		c.rect(points[0].x, points[0].y, 1, width, col)
+		return
+	}
+	for i := 1; i < len(points); i++ {
+		c.line(points[i-1], points[i], col, width)
+	}
+}
+
+// line draws a line using Bresenham's algorithm, wide lines are drawn
+// by repeating the line below the first one.
+func (c *pngCanvas) line(from, to point, col color, width int) {
+	dx, dy := abs(to.x-from.x), -abs(to.y-from.y)
+	sx, sy := 1, 1
+	if from.x > to.x {
+		sx = -1
+	}
+	if from.y > to.y {
+		sy = -1
+	}
+	err := dx + dy
+	x, y := from.x, from.y
+	for {
+		c.rect(x, y, 1, width, col)
+		if x == to.x && y == to.y {
+			break
+		}
+		e2 := 2 * err
+		if e2 >= dy {
+			err += dy
+			x += sx
+		}
+		if e2 <= dx {
+			err += dx
+			y += sy
+		}
+	}
+}
+
+func (c *pngCanvas) area(points []point, base int, col color) {
+	for _, p := range points {
+		from, to := p.y, base
+		if from > to {
+			from, to = to, from
+		}
+		c.rect(p.x, from, 1, to-from+1, col)
+	}
+}
+
+func (c *pngCanvas) text(x, y int, s string, col color, align alignment, vertical bool) {
+	switch align {
+	case alignCenter:
+		if vertical {
+			y += textWidth(s) / 2
+		} else {
+			x -= textWidth(s) / 2
+		}
+	case alignRight:
+		x -= textWidth(s)
+	}
+	for i := 0; i < len(s); i++ {
+		ch := int(s[i]) - ' '
+		if ch < 0 || ch >= len(font) {
+			ch = '?' - ' '
+		}
+		for column, bits := range font[ch] {
+			for row := 0; row < charHeight; row++ {
+				if bits&(1<<uint(row)) == 0 {
+					continue
+				}
+				if vertical {
+					// Rotated counterclockwise, reads from bottom to top
+					c.set(x+row, y-i*charWidth-column, col)
+				} else {
+					c.set(x+i*charWidth+column, y+row, col)
+				}
+			}
+		}
+	}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
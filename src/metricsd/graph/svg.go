@@ -0,0 +1,88 @@
+package graph
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// svgCanvas draws graphs as SVG elements.
+type svgCanvas struct {
+	width, height int
+	buf           bytes.Buffer
+}
+
+func newSvgCanvas(width, height int) *svgCanvas {
+	return &svgCanvas{width: width, height: height}
+}
+
+func (c *svgCanvas) encode(w io.Writer) os.Error {
+	_, err := fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n"+
+		"<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" viewBox=\"0 0 %d %d\" "+
+		"font-family=\"monospace\" font-size=\"10px\">\n%s</svg>\n",
+		c.width, c.height, c.width, c.height, c.buf.String())
+	return err
+}
+
+func (c *svgCanvas) rect(x, y, w, h int, col color) {
+	fmt.Fprintf(&c.buf, "<rect x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" fill=\"%s\"/>\n", x, y, w, h, col)
+}
+
+func (c *svgCanvas) polyline(points []point, col color, width int) {
+	if len(points) == 1 {
+		c.rect(points[0].x, points[0].y, 1, width, col)
+		return
+	}
+	// Pixel centers, so one pixel wide lines are sharp
+	fmt.Fprintf(&c.buf, "<path d=\"M%s\" fill=\"none\" stroke=\"%s\" stroke-width=\"%d\"/>\n",
+		svgPath(points, 0.5), col, width)
+}
+
+func (c *svgCanvas) area(points []point, base int, col color) {
+	first, last := points[0], points[len(points)-1]
+	fmt.Fprintf(&c.buf, "<path d=\"M%d %d L%s L%d %d Z\" fill=\"%s\"/>\n",
+		first.x, base, svgPath(points, 0), last.x+1, base, col)
+}
+
+func (c *svgCanvas) text(x, y int, s string, col color, align alignment, vertical bool) {
+	anchor := "start"
+	switch align {
+	case alignCenter:
+		anchor = "middle"
+	case alignRight:
+		anchor = "end"
+	}
+	// Text is positioned by the baseline
+	transform := ""
+	if vertical {
+		x += charHeight
+		transform = fmt.Sprintf(" transform=\"rotate(-90 %d %d)\"", x, y)
+	} else {
+		y += charHeight
+	}
+	fmt.Fprintf(&c.buf, "<text x=\"%d\" y=\"%d\" fill=\"%s\" text-anchor=\"%s\"%s>%s</text>\n",
+		x, y, col, anchor, transform, escape(s))
+}
+
+// String returns the color in the #RRGGBB format.
+func (col color) String() string {
+	return fmt.Sprintf("#%02X%02X%02X", col.r, col.g, col.b)
+}
+
+// svgPath returns coordinates of the points for the path data attribute.
+func svgPath(points []point, offset float64) string {
+	coords := make([]string, len(points))
+	for i, p := range points {
+		coords[i] = fmt.Sprintf("%v %v", float64(p.x)+offset, float64(p.y)+offset)
+	}
+	return strings.Join(coords, " L")
+}
+
+func escape(s string) string {
+	s = strings.Replace(s, "&", "&amp;", -1)
+	s = strings.Replace(s, "<", "&lt;", -1)
+	s = strings.Replace(s, ">", "&gt;", -1)
+	return strings.Replace(s, "\"", "&quot;", -1)
+}
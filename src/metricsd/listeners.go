@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+	"metricsd/config"
+)
+
+// Max size of a Graphite pickle protocol batch in bytes.
+const MAX_PICKLE_SIZE = 1048576
+
+// startListeners starts listeners for all configured sockets, and returns
+// the number of started Go routines (each of them waits for a quit signal).
+func startListeners(quit <-chan bool) (count int) {
+	go listenPacket("udp", config.UDPAddress.String(), quit)
+	count++
+	if len(config.ListenUnixgram) > 0 {
+		go listenPacket("unixgram", config.ListenUnixgram, quit)
+		count++
+	}
+	if len(config.ListenTCP) > 0 {
+		go listenStream("tcp", config.ListenTCP, handleStream, quit)
+		count++
+	}
+	if len(config.ListenUnix) > 0 {
+		go listenStream("unix", config.ListenUnix, handleStream, quit)
+		count++
+	}
+	if len(config.ListenGraphite) > 0 {
+		go listenStream("tcp", config.ListenGraphite, handleGraphite, quit)
+		count++
+	}
+	if len(config.ListenPickle) > 0 {
+		go listenStream("tcp", config.ListenPickle, handleGraphitePickle, quit)
+		count++
+	}
+	return
+}
+
+// listenPacket receives events from a datagram socket (UDP or Unix datagram
+// socket). Every packet could contain several events.
+func listenPacket(network, address string, quit <-chan bool) {
+	log.Debug("Starting %s listener on %s", network, address)
+
+	if network == "unixgram" {
+		removeStaleSocket(address)
+		defer os.Remove(address)
+	}
+
+	// Listen for requests
+	listener, error := net.ListenPacket(network, address)
+	if error != nil {
+		log.Fatal("Cannot listen on %s %s: %s", network, address, error)
+		os.Exit(1)
+	}
+	listenerBound()
+	// Ensure listener will be closed on return
+	defer listener.Close()
+
+	// Timeout is 0.1 second
+	listener.SetTimeout(1e8)
+	listener.SetReadTimeout(1e8)
+
+	// One extra byte is used to detect truncated packets
+	data := make([]byte, config.MaxPacketSize+1)
+	for {
+		select {
+		case <-quit:
+			log.Debug("Shutting down %s listener...", network)
+			return
+		default:
+			n, addr, error := listener.ReadFrom(data)
+			if error != nil {
+				if addr != nil {
+					log.Debug("Cannot read %s packet from %s: %s\n", network, addr, error)
+				}
+				continue
+			}
+			if n > config.MaxPacketSize {
+				atomic.AddInt64(&truncatedPackets, 1)
+				log.Warn("Dropped %s packet from %s: larger than %d bytes (see MaxPacketSize)", network, addr, config.MaxPacketSize)
+				continue
+			}
+			process(addr, string(data[0:n]))
+		}
+	}
+}
+
+// listenStream accepts connections on a stream socket (TCP or Unix stream
+// socket), each connection is read by the given handler.
+func listenStream(network, address string, handler func(network string, conn net.Conn), quit <-chan bool) {
+	log.Debug("Starting %s listener on %s", network, address)
+
+	if network == "unix" {
+		removeStaleSocket(address)
+		defer os.Remove(address)
+	}
+
+	listener, error := net.Listen(network, address)
+	if error != nil {
+		log.Fatal("Cannot listen on %s %s: %s", network, address, error)
+		os.Exit(1)
+	}
+	listenerBound()
+
+	stopped := make(chan bool, 1)
+	go func() {
+		for {
+			conn, error := listener.Accept()
+			if error != nil {
+				select {
+				case <-stopped:
+					return
+				default:
+				}
+				log.Debug("Cannot accept %s connection: %s", network, error)
+				time.Sleep(1e8)
+				continue
+			}
+			go handler(network, conn)
+		}
+	}()
+
+	<-quit
+	log.Debug("Shutting down %s listener...", network)
+	stopped <- true
+	listener.Close()
+}
+
+// handleStream reads newline delimited events from the given connection until
+// it is closed by client. Every line could contain several events separated
+// by ";".
+func handleStream(network string, conn net.Conn) {
+	readLines(network, conn, process)
+}
+
+// handleGraphite reads events in the Graphite plaintext protocol format from
+// the given connection until it is closed by client.
+func handleGraphite(network string, conn net.Conn) {
+	readLines(network, conn, processGraphite)
+}
+
+// handleGraphitePickle reads batches of events in the Graphite pickle protocol
+// format from the given connection until it is closed by client. Each batch
+// is prefixed with its length (4-byte big-endian integer).
+func handleGraphitePickle(network string, conn net.Conn) {
+	defer conn.Close()
+
+	addr := conn.RemoteAddr()
+	header := make([]byte, 4)
+	for {
+		if _, error := io.ReadFull(conn, header); error != nil {
+			if error != os.EOF {
+				log.Debug("Cannot read %s pickle from %s: %s", network, addr, error)
+			}
+			return
+		}
+		size := binary.BigEndian.Uint32(header)
+		if size > MAX_PICKLE_SIZE {
+			atomic.AddInt64(&truncatedPackets, 1)
+			log.Warn("Closed %s connection from %s: pickle is larger than %d bytes", network, addr, MAX_PICKLE_SIZE)
+			return
+		}
+		data := make([]byte, size)
+		if _, error := io.ReadFull(conn, data); error != nil {
+			log.Debug("Cannot read %s pickle from %s: %s", network, addr, error)
+			return
+		}
+		processGraphitePickle(addr, data)
+	}
+}
+
+// readLines reads lines from the given connection until it is closed by
+// client, and passes each of them to the given function.
+func readLines(network string, conn net.Conn, f func(addr net.Addr, buf string)) {
+	defer conn.Close()
+
+	reader, error := bufio.NewReaderSize(conn, config.MaxPacketSize)
+	if error != nil {
+		log.Error("Cannot read from %s connection: %s", network, error)
+		return
+	}
+
+	addr := conn.RemoteAddr()
+	for {
+		line, isPrefix, error := reader.ReadLine()
+		if error != nil {
+			if error != os.EOF {
+				log.Debug("Cannot read %s line from %s: %s", network, addr, error)
+			}
+			return
+		}
+		if isPrefix {
+			atomic.AddInt64(&truncatedPackets, 1)
+			log.Warn("Dropped %s line from %s: longer than %d bytes (see MaxPacketSize)", network, addr, config.MaxPacketSize)
+			// Skip the rest of the line
+			for isPrefix && error == nil {
+				_, isPrefix, error = reader.ReadLine()
+			}
+			continue
+		}
+		if len(line) > 0 {
+			f(addr, string(line))
+		}
+	}
+}
+
+// removeStaleSocket removes Unix socket file left from the previous run.
+// Exits when the path exists, but is not a socket (e.g. a mistyped path of a
+// regular file).
+func removeStaleSocket(path string) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return
+	}
+	if !fi.IsSocket() {
+		log.Fatal("Cannot listen on %s: file exists and is not a socket", path)
+		os.Exit(1)
+	}
+	log.Warn("Removing stale socket %s", path)
+	os.Remove(path)
+}
@@ -0,0 +1,127 @@
+package logger
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileLogger writes messages to a file, which is rotated when it reaches the
+// maximum size or at the end of each rotation interval. Rotated files are
+// renamed to path.1, path.2, etc (the larger number - the older file).
+type FileLogger struct {
+	*base
+	path     string
+	maxSize  int64 // max file size in bytes (0 to disable)
+	interval int64 // rotation interval in seconds (0 to disable)
+	keep     int   // number of rotated files to keep
+	mutex    sync.Mutex
+	file     *os.File
+	size     int64 // current file size
+	rotateAt int64 // time of the next rotation by interval
+}
+
+// NewFileLogger creates a logger writing to the file at path. Rotation by time
+// happens at multiples of the interval since epoch (e.g. at midnight UTC when
+// the interval is 86400).
+func NewFileLogger(logLevel Severity, path string, maxSize, interval int64, keep int) (*FileLogger, os.Error) {
+	logger := &FileLogger{path: path, maxSize: maxSize, interval: interval, keep: keep}
+	logger.base = newBase(logLevel)
+	logger.base.addFunc = logger.write
+	logger.base.reopenFunc = logger.reopen
+	if err := logger.open(); err != nil {
+		return nil, err
+	}
+	return logger, nil
+}
+
+// reopen closes and opens the log file again, should be called after the file
+// is moved by external tools (e.g. logrotate).
+func (logger *FileLogger) reopen() os.Error {
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+
+	logger.close()
+	return logger.open()
+}
+
+func (logger *FileLogger) write(severity Severity, component, message string) {
+	now := time.Seconds()
+	line := logger.formatLine(now, severity, component, message)
+
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+
+	if logger.file != nil && logger.shouldRotate(now, int64(len(line))) {
+		if err := logger.rotate(); err != nil {
+			os.Stderr.WriteString(logger.formatLine(now, ERROR, "logger", fmt.Sprintf("Failed to rotate log file %s: %s", logger.path, err)))
+		}
+	}
+	if logger.file == nil {
+		// Failed to open the file, do not lose the message
+		os.Stderr.WriteString(line)
+		return
+	}
+	n, _ := logger.file.WriteString(line)
+	logger.size += int64(n)
+}
+
+func (logger *FileLogger) shouldRotate(now, length int64) bool {
+	return (logger.maxSize > 0 && logger.size > 0 && logger.size+length > logger.maxSize) ||
+		(logger.interval > 0 && now >= logger.rotateAt)
+}
+
+// rotate renames the current file to path.1 (shifting older files), removes
+// files above the limit, and opens a new file. The file is reopened even if
+// renaming failed.
+func (logger *FileLogger) rotate() (err os.Error) {
+	logger.close()
+	if logger.keep <= 0 {
+		err = os.Remove(logger.path)
+	}
+	for i := logger.keep; i > 0 && err == nil; i-- {
+		src := logger.path
+		if i > 1 {
+			src = fmt.Sprintf("%s.%d", logger.path, i-1)
+		}
+		if _, statErr := os.Stat(src); statErr == nil {
+			err = os.Rename(src, fmt.Sprintf("%s.%d", logger.path, i))
+		}
+	}
+	if openErr := logger.open(); openErr != nil {
+		return openErr
+	}
+	return
+}
+
+func (logger *FileLogger) open() os.Error {
+	file, err := os.OpenFile(logger.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	logger.file = file
+	logger.size = fi.Size
+	if logger.interval > 0 {
+		// Existing file is rotated if it has been written in a previous interval
+		since := time.Seconds()
+		if fi.Size > 0 {
+			since = fi.Mtime_ns / 1e9
+		}
+		logger.rotateAt = (since/logger.interval + 1) * logger.interval
+	}
+	return nil
+}
+
+func (logger *FileLogger) close() {
+	if logger.file != nil {
+		logger.file.Close()
+		logger.file = nil
+	}
+}
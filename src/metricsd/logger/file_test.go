@@ -0,0 +1,110 @@
+package logger
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func tempLogFile(t *testing.T) (dir, file string) {
+	dir, err := ioutil.TempDir("", "metricsd-logger")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	return dir, path.Join(dir, "metricsd.log")
+}
+
+func readLogFile(t *testing.T, file string) string {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	return string(data)
+}
+
+func TestFileLoggerWrite(t *testing.T) {
+	dir, file := tempLogFile(t)
+	defer os.RemoveAll(dir)
+
+	logger, err := NewFileLogger(INFO, file, 0, 0, 1)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	logger.Debug("hidden")
+	logger.Info("message %d", 1)
+	logger.Error("message %d", 2)
+
+	lines := strings.Split(strings.TrimSpace(readLogFile(t, file)), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], " I message 1") || !strings.HasSuffix(lines[1], " E message 2") {
+		t.Errorf("Expected 2 messages, got %q", lines)
+	}
+}
+
+func TestFileLoggerRotateBySize(t *testing.T) {
+	dir, file := tempLogFile(t)
+	defer os.RemoveAll(dir)
+
+	// Each message is 32 bytes long, so only one fits in a file
+	logger, err := NewFileLogger(INFO, file, 50, 0, 2)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	for i := 1; i <= 4; i++ {
+		logger.Info("message %d", i)
+	}
+
+	for i, name := range []string{file, file + ".1", file + ".2"} {
+		expected := " I message " + strconv.Itoa(4-i) + "\n"
+		if content := readLogFile(t, name); !strings.HasSuffix(content, expected) || len(content) != 32 {
+			t.Errorf("Expected %s to contain %q, got %q", name, expected, content)
+		}
+	}
+	if _, err := os.Stat(file + ".3"); err == nil {
+		t.Errorf("Expected only 2 rotated files to be kept")
+	}
+}
+
+func TestFileLoggerRotateByTime(t *testing.T) {
+	dir, file := tempLogFile(t)
+	defer os.RemoveAll(dir)
+
+	logger, err := NewFileLogger(INFO, file, 0, 3600, 0)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	logger.Info("message 1")
+	logger.rotateAt = 0
+	logger.Info("message 2")
+
+	if content := readLogFile(t, file); !strings.HasSuffix(content, " I message 2\n") || strings.Contains(content, "message 1") {
+		t.Errorf("Expected file to be rotated, got %q", content)
+	}
+	if _, err := os.Stat(file + ".1"); err == nil {
+		t.Errorf("Expected rotated file to be removed")
+	}
+}
+
+func TestFileLoggerReopen(t *testing.T) {
+	dir, file := tempLogFile(t)
+	defer os.RemoveAll(dir)
+
+	logger, err := NewFileLogger(INFO, file, 0, 0, 1)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	logger.Info("message 1")
+	if err = os.Rename(file, file+".moved"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err = logger.Reopen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	logger.Info("message 2")
+
+	if content := readLogFile(t, file); !strings.HasSuffix(content, " I message 2\n") || strings.Contains(content, "message 1") {
+		t.Errorf("Expected messages to be written to a new file, got %q", content)
+	}
+}
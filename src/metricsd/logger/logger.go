@@ -2,7 +2,10 @@ package logger
 
 import (
 	"fmt"
+	"json"
 	"log"
+	"os"
+	"time"
 )
 
 type Severity byte
@@ -34,6 +37,34 @@ func (severity Severity) String() string {
 	return "U"
 }
 
+// Name returns the full name of the severity.
+func (severity Severity) Name() string {
+	switch severity {
+	case DEBUG:
+		return "DEBUG"
+	case INFO:
+		return "INFO"
+	case WARN:
+		return "WARN"
+	case ERROR:
+		return "ERROR"
+	case FATAL:
+		return "FATAL"
+	}
+	return "UNKNOWN"
+}
+
+// Format of log messages.
+type Format byte
+
+const (
+	TEXT Format = iota // 2011/10/18 12:00:00 I [component] message
+	JSON               // {"time":"2011-10-18T12:00:00Z","severity":"INFO","component":"metricsd","message":"message"}
+)
+
+// Component of messages logged without component.
+const DEFAULT_COMPONENT = "metricsd"
+
 type Logger interface {
 	Debug(format string, v ...interface{})
 	Info(format string, v ...interface{})
@@ -41,11 +72,27 @@ type Logger interface {
 	Error(format string, v ...interface{})
 	Fatal(format string, v ...interface{})
 	Unknown(format string, v ...interface{})
+	SetLogLevel(logLevel Severity)
+	WithComponent(component string) Logger
+	Reopen() os.Error
 }
 
 type base struct {
-	LogLevel Severity
-	addFunc  func(severity Severity, format string, v ...interface{})
+	*output          // shared with loggers of other components
+	component string // component added to messages (could be empty)
+}
+
+// output writes messages, all its fields are shared between loggers of
+// different components.
+type output struct {
+	LogLevel   Severity
+	Format     Format
+	addFunc    func(severity Severity, component, message string)
+	reopenFunc func() os.Error
+}
+
+func newBase(logLevel Severity) *base {
+	return &base{output: &output{LogLevel: logLevel}}
 }
 
 func (logger *base) Debug(format string, v ...interface{}) {
@@ -72,15 +119,61 @@ func (logger *base) Unknown(format string, v ...interface{}) {
 	logger.Add(UNKNOWN, format, v...)
 }
 
+// SetLogLevel changes the minimum severity of messages to be logged (for
+// loggers of all components).
+func (logger *base) SetLogLevel(logLevel Severity) {
+	logger.LogLevel = logLevel
+}
+
+// WithComponent returns a logger which adds the component name to messages
+// (e.g. "web"), and writes them to the same output.
+func (logger *base) WithComponent(component string) Logger {
+	return &base{output: logger.output, component: component}
+}
+
+// Reopen reopens the output (log file or syslog connection), does nothing
+// for console.
+func (logger *base) Reopen() os.Error {
+	if logger.reopenFunc == nil {
+		return nil
+	}
+	return logger.reopenFunc()
+}
+
 func (logger *base) Add(severity Severity, format string, v ...interface{}) {
-	if logger.addFunc == nil {
+	if logger.output == nil || logger.addFunc == nil {
 		log.Panic("Tried to use base logger, which has no ability to output. Use descendants instead!")
 	}
 
 	if severity < logger.LogLevel {
 		return
 	}
-	logger.addFunc(severity, format, v...)
+	logger.addFunc(severity, logger.component, fmt.Sprintf(format, v...))
+}
+
+// formatLine returns the message formatted as a line of the log file.
+func (output *output) formatLine(t int64, severity Severity, component, message string) string {
+	if output.Format == JSON {
+		return formatJSON(time.SecondsToUTC(t).Format(time.RFC3339), severity, component, message) + "\n"
+	}
+	if len(component) > 0 {
+		message = "[" + component + "] " + message
+	}
+	return fmt.Sprintf("%s %s %s\n", time.SecondsToLocalTime(t).Format("2006/01/02 15:04:05"), severity, message)
+}
+
+// formatJSON returns the message as a JSON object.
+func formatJSON(t string, severity Severity, component, message string) string {
+	if len(component) == 0 {
+		component = DEFAULT_COMPONENT
+	}
+	data, _ := json.Marshal(struct {
+		Time      string `json:"time"`
+		Severity  string `json:"severity"`
+		Component string `json:"component"`
+		Message   string `json:"message"`
+	}{t, severity.Name(), component, message})
+	return string(data)
 }
 
 /******************************************************************************/
@@ -89,13 +182,12 @@ type ConsoleLogger struct {
 	*base
 }
 
+// NewConsoleLogger creates a logger writing to the standard error.
 func NewConsoleLogger(logLevel Severity) *ConsoleLogger {
 	logger := &ConsoleLogger{}
-	logger.base = &base{}
-	logger.base.LogLevel = logLevel
-	logger.base.addFunc = func(severity Severity, format string, v ...interface{}) {
-		format = fmt.Sprintf("%s %s", severity, format)
-		log.Printf(format, v...)
+	logger.base = newBase(logLevel)
+	logger.base.addFunc = func(severity Severity, component, message string) {
+		os.Stderr.WriteString(logger.formatLine(time.Seconds(), severity, component, message))
 	}
 	return logger
 }
@@ -0,0 +1,50 @@
+package logger
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFormatLineText(t *testing.T) {
+	output := &output{Format: TEXT}
+	if line := output.formatLine(0, INFO, "", "message"); !strings.HasSuffix(line, " I message\n") {
+		t.Errorf("Expected message without component, got %q", line)
+	}
+	if line := output.formatLine(0, WARN, "web", "message"); !strings.HasSuffix(line, " W [web] message\n") {
+		t.Errorf("Expected message with component, got %q", line)
+	}
+}
+
+func TestFormatLineJSON(t *testing.T) {
+	output := &output{Format: JSON}
+	expected := `{"time":"1970-01-01T00:00:00Z","severity":"INFO","component":"metricsd","message":"message"}` + "\n"
+	if line := output.formatLine(0, INFO, "", "message"); line != expected {
+		t.Errorf("Expected %q, got %q", expected, line)
+	}
+	expected = `{"time":"2011-10-18T12:00:00Z","severity":"ERROR","component":"web","message":"\"quoted\"\n"}` + "\n"
+	if line := output.formatLine(1318939200, ERROR, "web", "\"quoted\"\n"); line != expected {
+		t.Errorf("Expected %q, got %q", expected, line)
+	}
+}
+
+func TestWithComponent(t *testing.T) {
+	dir, file := tempLogFile(t)
+	defer os.RemoveAll(dir)
+
+	logger, err := NewFileLogger(INFO, file, 0, 0, 1)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	logger.Format = JSON
+	web := logger.WithComponent("web")
+	web.Info("message 1")
+	logger.SetLogLevel(WARN)
+	web.Info("hidden")
+	web.Warn("message 2")
+
+	lines := strings.Split(strings.TrimSpace(readLogFile(t, file)), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], `"severity":"INFO","component":"web","message":"message 1"}`) || !strings.HasSuffix(lines[1], `"severity":"WARN","component":"web","message":"message 2"}`) {
+		t.Errorf("Expected 2 messages of the web component, got %q", lines)
+	}
+}
@@ -0,0 +1,80 @@
+package logger
+
+import (
+	"os"
+	"sync"
+	"syslog"
+	"time"
+)
+
+// SyslogLogger writes messages to the local syslog daemon (through the Unix
+// socket, e.g. /dev/log).
+type SyslogLogger struct {
+	*base
+	tag    string
+	mutex  sync.Mutex
+	writer *syslog.Writer
+}
+
+// NewSyslogLogger creates a logger writing messages with the given tag
+// (program name) to syslog.
+func NewSyslogLogger(logLevel Severity, tag string) (*SyslogLogger, os.Error) {
+	logger := &SyslogLogger{tag: tag}
+	logger.base = newBase(logLevel)
+	logger.base.addFunc = logger.write
+	logger.base.reopenFunc = logger.reopen
+	if err := logger.reopen(); err != nil {
+		return nil, err
+	}
+	return logger, nil
+}
+
+// reopen connects to syslog again (e.g. after syslog daemon is restarted).
+func (logger *SyslogLogger) reopen() os.Error {
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+
+	if logger.writer != nil {
+		logger.writer.Close()
+		logger.writer = nil
+	}
+	writer, err := syslog.New(syslog.LOG_INFO, logger.tag)
+	if err != nil {
+		return err
+	}
+	logger.writer = writer
+	return nil
+}
+
+func (logger *SyslogLogger) write(severity Severity, component, message string) {
+	// Syslog adds time and priority to messages
+	text := message
+	if logger.Format == JSON {
+		text = formatJSON(time.SecondsToUTC(time.Seconds()).Format(time.RFC3339), severity, component, message)
+	} else if len(component) > 0 {
+		text = "[" + component + "] " + message
+	}
+
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+
+	err := os.NewError("not connected")
+	if logger.writer != nil {
+		switch severity {
+		case DEBUG:
+			err = logger.writer.Debug(text)
+		case INFO:
+			err = logger.writer.Info(text)
+		case WARN:
+			err = logger.writer.Warning(text)
+		case FATAL:
+			err = logger.writer.Crit(text)
+		default:
+			err = logger.writer.Err(text)
+		}
+	}
+	if err != nil {
+		// Syslog is not available, do not lose the message
+		os.Stderr.WriteString(logger.formatLine(time.Seconds(), severity, component, message))
+	}
+}
@@ -1,15 +1,21 @@
 package main
 
 import (
+	"fmt"
 	"net"
 	"os"
 	"os/signal"
+	"path"
 	"runtime"
+	"sync"
 	"sync/atomic"
 	"time"
+	"metricsd/alerts"
+	"metricsd/cluster"
 	"metricsd/config"
 	"metricsd/logger"
 	"metricsd/parser"
+	"metricsd/relay"
 	"metricsd/writers"
 	"metricsd/stdlib"
 	"metricsd/types"
@@ -17,18 +23,30 @@ import (
 )
 
 var (
-	log                 logger.Logger     /* Logger instance */
-	hostLookupCache     map[string]string /* DNS names cache */
-	timeline            *types.Timeline   /* Timeline */
-	eventsReceived      int64             /* Events received */
-	totalEventsReceived int64             /* Total Events received */
-	bytesReceived       int64             /* Bytes sent */
-	totalBytesReceived  int64             /* Total bytes sent */
-	activeWriters       []writers.Writer  /* The list of active writers */
+	log                 logger.Logger          /* Logger instance */
+	hostLookupCache     map[string]string      /* DNS names cache */
+	hostLookupMutex     sync.Mutex             /* DNS names cache lock (listeners run in parallel) */
+	timeline            *types.Timeline        /* Timeline */
+	eventsReceived      int64                  /* Events received */
+	totalEventsReceived int64                  /* Total Events received */
+	bytesReceived       int64                  /* Bytes sent */
+	totalBytesReceived  int64                  /* Total bytes sent */
+	invalidEvents       map[string]int64       /* Total events which could not be parsed, by reason */
+	invalidEventsMutex  sync.Mutex             /* Invalid events lock (listeners run in parallel) */
+	truncatedPackets    int64                  /* Total packets (or lines) dropped because they are too large */
+	dnsErrors           int64                  /* Total failed reverse DNS lookups */
+	activeWriters       []writers.Writer       /* The list of active writers */
+	activeWritersMutex  sync.RWMutex           /* Active writers lock (replaced on reload) */
+	reloaded            chan bool              /* Notifies dumper about reloaded configuration */
+	forwarder           *relay.Relay           /* Relay to upstream instances (nil if disabled) */
+	shards              *cluster.Cluster       /* Cluster metrics are sharded across (nil if disabled) */
+	carbon              *writers.Carbon        /* Graphite-compatible backend rolled up values are sent to (nil if disabled) */
+	graphiteRules       []*parser.GraphiteRule /* Rules to extract sources from Graphite metric paths */
+	alerting            *alerts.Engine         /* Alert rules evaluated against rolled up values */
 )
 
-const (
-	runningProcesses = 3
+var (
+	runningProcesses int /* Number of background processes waiting for quit signal */
 )
 
 func main() {
@@ -40,17 +58,14 @@ func main() {
 	// (and then will shut himself down).
 	quit := make(chan bool)
 
-	// Active writers
-	activeWriters = []writers.Writer{
-		&writers.Count{},
-		&writers.Quartiles{},
-		&writers.Percentiles{},
-	}
-
 	// Start background Go routines
-	go listen(quit)
+	listenersStarted = startListeners(quit)
+	runningProcesses = listenersStarted + 2
 	go stats(quit)
-	go dumper(activeWriters, quit)
+	go dumper(quit)
+	web.ReloadConfig = reload
+	web.Readiness = readiness
+	web.Status = currentStatus
 	go web.Start()
 
 	// Handle signals
@@ -58,11 +73,17 @@ func main() {
 }
 
 func initialize() {
+	startedAt = time.Seconds()
+
 	// Initialize options parser
 	parseCommandLineArguments()
 
 	// Create logger
-	config.Logger = logger.NewConsoleLogger(logger.Severity(config.LogLevel))
+	var error os.Error
+	if config.Logger, error = createLogger(); error != nil {
+		fmt.Printf("Cannot create logger: %s\n", error)
+		os.Exit(1)
+	}
 	log = config.Logger
 	log.Debug("%s", config.String())
 
@@ -79,175 +100,466 @@ func initialize() {
 	}
 	config.UDPAddress = address
 
+	// Compile rules to extract sources from Graphite metric paths (already validated)
+	graphiteRules = make([]*parser.GraphiteRule, len(config.GraphiteSources))
+	for i, pattern := range config.GraphiteSources {
+		graphiteRules[i], _ = parser.NewGraphiteRule(pattern)
+	}
+
+	// Create active writers (each metric is aggregated by writers selected by rules or its type)
+	if activeWriters, error = writers.Load(config.Writers, config.WriterRules); error != nil {
+		log.Fatal("Cannot configure writers: %s", error)
+		os.Exit(1)
+	}
+
+	// Send rolled up values to a Graphite-compatible backend in addition to RRD files
+	if len(config.CarbonAddress) > 0 {
+		carbon = writers.NewCarbon(config.CarbonAddress, config.CarbonBatchSize, config.CarbonQueueSize, config.Logger.WithComponent("carbon"))
+		writers.SetCarbon(carbon)
+	}
+
+	// Evaluate alert rules against rolled up values
+	alerting = alerts.New(config.Logger.WithComponent("alerts"))
+	rules, notifiers, error := alerts.Load(config.Alerts, config.Notifiers)
+	if error != nil {
+		log.Fatal("Cannot configure alerts: %s", error)
+		os.Exit(1)
+	}
+	alerting.Configure(rules, notifiers)
+	writers.SetAlerts(alerting)
+	web.Alerts = alerting
+
 	// Initialize slices structure
-	timeline = types.NewTimeline(config.SliceInterval)
+	timeline = types.NewTimeline(config.SliceInterval, config.SliceGrace)
+	configureSketch()
 
-	// Initialize host lookup cache
-	if config.LookupDns {
-		hostLookupCache = make(map[string]string)
+	// Start forwarding events to upstream instances
+	if len(config.RelayUpstreams) > 0 {
+		forwarder = relay.New(relayOptions("relay"))
+	}
+
+	// Join the cluster, events owned by other nodes are routed to them
+	if len(config.ClusterNodes) > 0 {
+		if shards, error = cluster.New(clusterNodes(), config.ClusterSelf, relayOptions("cluster")); error != nil {
+			log.Fatal("Cannot join the cluster: %s", error)
+			os.Exit(1)
+		}
+		web.Cluster = shards
 	}
 
+	// Initialize host lookup cache (DNS lookup could be enabled on reload)
+	hostLookupCache = make(map[string]string)
+	invalidEvents = make(map[string]int64)
+	reloaded = make(chan bool, 1)
+
 	// Disable memory profiling to prevent panics reporting
 	runtime.MemProfileRate = 0
 }
 
+// createLogger creates logger writing to syslog, log file, or console
+// (depending on LogSyslog and LogFile options) in the configured format.
+func createLogger() (logger.Logger, os.Error) {
+	severity := logger.Severity(config.LogLevel)
+	format := logger.TEXT
+	if config.LogFormat == "json" {
+		format = logger.JSON
+	}
+
+	if config.LogSyslog {
+		syslogLogger, error := logger.NewSyslogLogger(severity, "metricsd")
+		if error != nil {
+			return nil, error
+		}
+		syslogLogger.Format = format
+		return syslogLogger, nil
+	}
+	if len(config.LogFile) > 0 {
+		logDir, _ := path.Split(config.LogFile)
+		os.MkdirAll(logDir, 0755)
+		fileLogger, error := logger.NewFileLogger(severity, config.LogFile, int64(config.LogMaxSize)*1024*1024, int64(config.LogRotate), config.LogKeep)
+		if error != nil {
+			return nil, error
+		}
+		fileLogger.Format = format
+		return fileLogger, nil
+	}
+	consoleLogger := logger.NewConsoleLogger(severity)
+	consoleLogger.Format = format
+	return consoleLogger, nil
+}
+
+// configureSketch makes large sample sets of new slices switch to sketches
+// when enabled in configuration.
+func configureSketch() {
+	if config.Sketch == "ddsketch" {
+		timeline.SetSketch(config.SketchAccuracy, config.SketchThreshold)
+	} else {
+		timeline.SetSketch(0, 0)
+	}
+}
+
+// relayOptions returns options of relays to upstream instances (or other
+// cluster nodes), messages are logged with the given component name.
+func relayOptions(component string) relay.Options {
+	mode := relay.Aggregate
+	if config.RelayMode == "raw" {
+		mode = relay.Raw
+	}
+	return relay.Options{
+		Mode:       mode,
+		Upstreams:  config.RelayUpstreams,
+		Interval:   config.SliceInterval,
+		Grace:      config.SliceGrace,
+		BufferSize: config.RelayBufferSize,
+		SpoolDir:   config.RelaySpoolDir,
+		SpoolSize:  int64(config.RelaySpoolSize) * 1024 * 1024,
+		Logger:     config.Logger.WithComponent(component),
+	}
+}
+
+// clusterNodes returns nodes of the cluster defined in configuration.
+func clusterNodes() []*cluster.Node {
+	nodes := make([]*cluster.Node, len(config.ClusterNodes))
+	for i, node := range config.ClusterNodes {
+		nodes[i] = &cluster.Node{Name: node.Name, Address: node.Address, Web: node.Web}
+	}
+	return nodes
+}
+
 func handleSignals(quit chan<- bool) {
 	for sig := range signal.Incoming {
 		var usig = sig.(os.UnixSignal)
-		if usig == os.SIGHUP || usig == os.SIGINT || usig == os.SIGTERM {
+		switch usig {
+		case os.SIGHUP:
 			log.Warn("Received signal: %s", sig)
-			if usig == os.SIGINT || usig == os.SIGTERM {
-				log.Warn("Shutting down everything...")
-				// We have several background processes, so wait for all of them
-				for i := 1; i <= runningProcesses; i++ {
-					log.Debug("... waiting for process %d of %d", i, runningProcesses)
-					quit <- true
-				}
-				log.Warn("... done!")
+			reload()
+		case os.SIGUSR1:
+			log.Warn("Received signal: %s", sig)
+			if error := log.Reopen(); error != nil {
+				log.Error("Cannot reopen log file: %s", error)
+			}
+		case os.SIGUSR2:
+			log.Warn("Received signal: %s", sig)
+			rollupSlices(currentWriters(), true)
+		case os.SIGINT, os.SIGTERM:
+			log.Warn("Received signal: %s", sig)
+			log.Warn("Shutting down everything...")
+			// We have several background processes, so wait for all of them
+			for i := 1; i <= runningProcesses; i++ {
+				log.Debug("... waiting for process %d of %d", i, runningProcesses)
+				quit <- true
 			}
-			rollupSlices(activeWriters, true)
-			if usig == os.SIGINT || usig == os.SIGTERM {
-				return
+			log.Warn("... done!")
+			rollupSlices(currentWriters(), true)
+			if forwarder != nil {
+				forwarder.Close()
 			}
+			if shards != nil {
+				shards.Close()
+			}
+			if carbon != nil {
+				carbon.Close()
+			}
+			alerting.Close()
+			return
 		}
 	}
 }
 
-/***** Go routines ************************************************************/
-
-func listen(quit <-chan bool) {
-	log.Debug("Starting listener on %s", config.UDPAddress)
-
-	// Listen for requests
-	listener, error := net.ListenUDP("udp", config.UDPAddress)
+// reload reloads the config file and applies options which could be changed
+// without restart: log level, sketches (for new slices), writers and writer
+// rules, alerts and notifiers, DNS lookup, write interval, batch writes and
+// dashboards directory. Changes of other options are logged and ignored.
+func reload() os.Error {
+	log.Info("Reloading configuration from %s", configFile)
+	parsed, error := config.Read(configFile)
 	if error != nil {
-		log.Fatal("Cannot listen: %s", error)
-		os.Exit(1)
+		log.Error("Cannot reload configuration: %s", error)
+		return error
 	}
-	// Ensure listener will be closed on return
-	defer listener.Close()
 
-	// Timeout is 0.1 second
-	listener.SetTimeout(1e8)
-	listener.SetReadTimeout(1e8)
+	// Nothing is changed unless writers and alerts could be configured as well
+	loaded, error := writers.Load(parsed.Writers, parsed.WriterRules)
+	if error != nil {
+		log.Error("Cannot configure writers, keeping the current configuration: %s", error)
+		return error
+	}
+	rules, notifiers, error := alerts.Load(parsed.Alerts, parsed.Notifiers)
+	if error != nil {
+		log.Error("Cannot configure alerts, keeping the current configuration: %s", error)
+		return error
+	}
 
-	data := make([]byte, 256)
-	for {
-		select {
-		case <-quit:
-			log.Debug("Shutting down listener...")
-			return
-		default:
-			n, addr, error := listener.ReadFromUDP(data)
-			if error != nil {
-				if addr != nil {
-					log.Debug("Cannot read UDP from %s: %s\n", addr, error)
-				}
-				continue
-			}
-			process(addr, string(data[0:n]))
-		}
+	restartRequired := config.Reload(parsed)
+	applyCommandLineArguments()
+	for _, name := range restartRequired {
+		log.Warn("%s is changed in the config file, but it could not be applied without restart", name)
+	}
+	log.SetLogLevel(logger.Severity(config.LogLevel))
+	configureSketch()
+
+	activeWritersMutex.Lock()
+	activeWriters = loaded
+	activeWritersMutex.Unlock()
+	alerting.Configure(rules, notifiers)
+
+	// Forget resolved host names, they could be changed since last lookup
+	hostLookupMutex.Lock()
+	hostLookupCache = make(map[string]string)
+	hostLookupMutex.Unlock()
+
+	// Restart dumper ticker with the new write interval
+	select {
+	case reloaded <- true:
+	default:
 	}
+
+	log.Info("Configuration reloaded")
+	log.Debug("%s", config.String())
+	return nil
 }
 
+/***** Go routines ************************************************************/
+
 func stats(quit <-chan bool) {
 	ticker := time.NewTicker(1e9)
 	defer ticker.Stop()
 
+	var lateEvents, futureEvents, mismatchedEvents, truncated, failedLookups int64
+	invalid := make(map[string]int64)
+	rrdStats := make(map[string]writers.RrdStats)
 	for {
 		select {
 		case <-quit:
 			log.Debug("Shutting down stats...")
 			return
 		case <-ticker.C:
-			timeline.Add(types.NewEvent("all", "metricsd.events.count", int(eventsReceived)))
-			timeline.Add(types.NewEvent("all", "metricsd.traffic_in", int(bytesReceived)))
-			timeline.Add(types.NewEvent("all", "metricsd.memory.used", int(runtime.MemStats.Alloc/1024)))
-			timeline.Add(types.NewEvent("all", "metricsd.memory.system", int(runtime.MemStats.Sys/1024)))
+			// Counters are reset by subtracting the taken values, so increments
+			// made by listeners meanwhile are not lost
+			events := atomic.AddInt64(&eventsReceived, 0)
+			atomic.AddInt64(&eventsReceived, -events)
+			bytes := atomic.AddInt64(&bytesReceived, 0)
+			atomic.AddInt64(&bytesReceived, -bytes)
+			addStats("metricsd.events.count", float64(events))
+			addStats("metricsd.traffic_in", float64(bytes))
+			addStats("metricsd.memory.used", float64(runtime.MemStats.Alloc)/1024)
+			addStats("metricsd.memory.system", float64(runtime.MemStats.Sys)/1024)
+
+			// Events dropped by timeline (reported as a difference since the last tick)
+			late, future, mismatched := timeline.LateEvents(), timeline.FutureEvents(), timeline.MismatchedEvents()
+			addStats("metricsd.events.late", float64(late-lateEvents))
+			addStats("metricsd.events.future", float64(future-futureEvents))
+			addStats("metricsd.events.mismatched", float64(mismatched-mismatchedEvents))
+			if late > lateEvents || future > futureEvents || mismatched > mismatchedEvents {
+				log.Debug("Dropped %d late, %d future, and %d mismatched type events", late-lateEvents, future-futureEvents, mismatched-mismatchedEvents)
+			}
+			lateEvents, futureEvents, mismatchedEvents = late, future, mismatched
 
-			log.Debug("Processed %d events (%d bytes)", eventsReceived, bytesReceived)
+			// Events which could not be parsed (by reason), truncated packets, and failed DNS lookups
+			invalidEventsMutex.Lock()
+			for reason, count := range invalidEvents {
+				addStats("metricsd.events.invalid."+reason, float64(count-invalid[reason]))
+				invalid[reason] = count
+			}
+			invalidEventsMutex.Unlock()
+			current := atomic.AddInt64(&truncatedPackets, 0)
+			addStats("metricsd.packets.truncated", float64(current-truncated))
+			truncated = current
+			current = atomic.AddInt64(&dnsErrors, 0)
+			addStats("metricsd.dns.errors", float64(current-failedLookups))
+			failedLookups = current
+
+			// Average RRD update time (in milliseconds) and failed updates of each writer
+			for name, stats := range writers.UpdateStats() {
+				previous := rrdStats[name]
+				if updates := stats.Updates - previous.Updates; updates > 0 {
+					addStats("metricsd.rrd."+name+".time", float64(stats.Time-previous.Time)/float64(updates)/1e6)
+				}
+				addStats("metricsd.rrd."+name+".errors", float64(stats.Errors-previous.Errors))
+				rrdStats[name] = stats
+			}
+			addStats("metricsd.rrd.queue", float64(writers.QueueLength()))
+			addStats("metricsd.sample_sets", float64(timeline.SampleSets()))
 
-			eventsReceived = 0
-			bytesReceived = 0
+			log.Debug("Processed %d events (%d bytes)", events, bytes)
 		}
 	}
 }
 
-func dumper(activeWriters []writers.Writer, quit <-chan bool) {
-	ticker := time.NewTicker(int64(config.WriteInterval) * 1e9)
-	defer ticker.Stop()
+func dumper(quit <-chan bool) {
+	writeInterval := config.WriteInterval
+	ticker := time.NewTicker(int64(writeInterval) * 1e9)
+	// Aggregated events are forwarded on each slice, so upstream receives
+	// them before its slices are closed
+	relayTicker := time.NewTicker(int64(config.SliceInterval) * 1e9)
+	defer func() {
+		ticker.Stop()
+		relayTicker.Stop()
+	}()
 
 	for {
 		select {
 		case <-quit:
 			log.Debug("Shutting down dumper...")
 			return
+		case <-reloaded:
+			if config.WriteInterval != writeInterval {
+				log.Debug("Write interval changed from %d to %d seconds", writeInterval, config.WriteInterval)
+				writeInterval = config.WriteInterval
+				ticker.Stop()
+				ticker = time.NewTicker(int64(writeInterval) * 1e9)
+			}
 		case <-ticker.C:
-			rollupSlices(activeWriters, false)
+			rollupSlices(currentWriters(), false)
+		case <-relayTicker.C:
+			if forwarder != nil {
+				forwarder.Flush(false)
+			}
 		}
 	}
 }
 
 /***** Helper functions *******************************************************/
 
-func process(addr *net.UDPAddr, buf string) {
+func process(addr net.Addr, buf string) {
 	atomic.AddInt64(&bytesReceived, int64(len(buf)))
 	atomic.AddInt64(&totalBytesReceived, int64(len(buf)))
 	parser.Parse(buf, func(event *types.Event, err os.Error) {
-		if err == nil {
-			if event.Source == "" {
-				event.Source = lookupHost(addr)
-			}
-			timeline.Add(event)
-			atomic.AddInt64(&eventsReceived, 1)
-			atomic.AddInt64(&totalEventsReceived, 1)
-		} else {
-			log.Debug("Error while parsing an event: %s", err)
-		}
+		addEvent(addr, event, err)
 	})
 }
 
-func lookupHost(addr *net.UDPAddr) (hostname string) {
-	ip := addr.IP.String()
+// processGraphite processes events in the Graphite plaintext protocol format.
+func processGraphite(addr net.Addr, buf string) {
+	atomic.AddInt64(&bytesReceived, int64(len(buf)))
+	atomic.AddInt64(&totalBytesReceived, int64(len(buf)))
+	parser.ParseGraphite(buf, graphiteRules, func(event *types.Event, err os.Error) {
+		addEvent(addr, event, err)
+	})
+}
+
+// processGraphitePickle processes a batch of events in the Graphite pickle
+// protocol format.
+func processGraphitePickle(addr net.Addr, data []byte) {
+	atomic.AddInt64(&bytesReceived, int64(len(data)))
+	atomic.AddInt64(&totalBytesReceived, int64(len(data)))
+	parser.ParseGraphitePickle(data, graphiteRules, func(event *types.Event, err os.Error) {
+		addEvent(addr, event, err)
+	})
+}
+
+// addEvent adds the parsed event received from the given address (or logs
+// the parsing error). Events without source get the host name of the address.
+func addEvent(addr net.Addr, event *types.Event, err os.Error) {
+	if err != nil {
+		log.Debug("Error while parsing an event: %s", err)
+		reason := "unknown"
+		if error, ok := err.(*parser.ParseError); ok {
+			reason = error.Reason
+		}
+		invalidEventsMutex.Lock()
+		invalidEvents[reason]++
+		invalidEventsMutex.Unlock()
+		return
+	}
+	if event.Source == "" {
+		event.Source = lookupHost(addr)
+	}
+	if forwarder != nil {
+		forwarder.Add(event)
+	}
+	local := shards == nil || shards.Route(event)
+	if config.RelayOnly || !local || timeline.Add(event) {
+		atomic.AddInt64(&eventsReceived, 1)
+		atomic.AddInt64(&totalEventsReceived, 1)
+	}
+}
+
+// addStats adds an event of MetricsD stats to the timeline. In cluster mode
+// it is routed to the owner node, so stats of all nodes are aggregated there.
+func addStats(name string, value float64) {
+	event := types.NewEvent("all", name, value)
+	if shards == nil || shards.Route(event) {
+		timeline.Add(event)
+	}
+}
+
+func lookupHost(addr net.Addr) (hostname string) {
+	var ip string
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP.String()
+	case *net.TCPAddr:
+		ip = a.IP.String()
+	default:
+		// Unix domain sockets are used by local agents
+		ip = "127.0.0.1"
+	}
 	if !config.LookupDns {
 		return ip
 	}
 
 	// Do we have resolved this address before?
-	if _, found := hostLookupCache[ip]; found {
-		return hostLookupCache[ip]
+	hostLookupMutex.Lock()
+	hostname, found := hostLookupCache[ip]
+	hostLookupMutex.Unlock()
+	if found {
+		return hostname
 	}
 
-	// Try to lookup
+	// Try to lookup (without the lock, so a slow lookup does not block
+	// other listeners)
 	hostname, error := stdlib.GetRemoteHostName(ip)
 	if error != nil {
 		log.Debug("Error while resolving host name %s: %s", addr, error)
+		atomic.AddInt64(&dnsErrors, 1)
 		return ip
 	}
 	// Cache the lookup result
+	hostLookupMutex.Lock()
 	hostLookupCache[ip] = hostname
+	hostLookupMutex.Unlock()
 
 	return
 }
 
+// currentWriters returns the list of active writers.
+func currentWriters() []writers.Writer {
+	activeWritersMutex.RLock()
+	defer activeWritersMutex.RUnlock()
+
+	return activeWriters
+}
+
 func rollupSlices(activeWriters []writers.Writer, force bool) {
 	log.Debug("Rolling up timeline")
 	startTime := time.Nanoseconds()
 
+	if forwarder != nil {
+		forwarder.Flush(force)
+	}
 	if config.BatchWrites {
 		closedSampleSets := timeline.ExtractClosedSampleSets(force)
 		for _, writer := range activeWriters {
-			writers.BatchRollup(writer, closedSampleSets)
+			writers.BatchRollup(writer, writers.Select(writer, closedSampleSets))
 		}
 	} else {
 		closedSlices := timeline.ExtractClosedSlices(force)
 		for _, slice := range closedSlices {
 			for _, set := range slice.Sets {
 				for _, writer := range activeWriters {
-					writers.Rollup(writer, set)
+					if writers.Accepts(writer, set) {
+						writers.Rollup(writer, set)
+					}
 				}
 			}
 		}
 	}
-	log.Debug("... timeline rolled up, took %v seconds", float64(time.Nanoseconds()-startTime)/1e9)
+	// Send alerts fired or resolved by rolled up values
+	alerting.Flush()
+
+	duration := time.Nanoseconds() - startTime
+	addStats("metricsd.rollup.time", float64(duration)/1e6)
+	rollupFinished(duration)
+	log.Debug("... timeline rolled up, took %v seconds", float64(duration)/1e9)
 }
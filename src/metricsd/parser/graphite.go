@@ -0,0 +1,225 @@
+package parser
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"metricsd/types"
+)
+
+// GraphiteRule extracts the event source from a segment of the Graphite
+// metric path. Pattern is a dot-separated list of segments matching the
+// beginning of the path: literal segments should be equal, "*" matches any
+// segment, and "{source}" matches the source segment, which is removed from
+// the metric name. For example, "servers.{source}" maps "servers.web01.cpu"
+// to the "servers.cpu" metric of the "web01" source.
+type GraphiteRule struct {
+	segments []string
+	source   int // index of the source segment
+}
+
+// NewGraphiteRule creates a rule with the given pattern.
+func NewGraphiteRule(pattern string) (*GraphiteRule, os.Error) {
+	rule := &GraphiteRule{segments: strings.Split(pattern, "."), source: -1}
+	for i, segment := range rule.segments {
+		switch {
+		case segment == "{source}":
+			if rule.source >= 0 {
+				return nil, os.NewError(fmt.Sprintf("Source segment is specified more than once: %q", pattern))
+			}
+			rule.source = i
+		case len(segment) == 0 || (segment != "*" && !validateMetric(segment)):
+			return nil, os.NewError(fmt.Sprintf("Segment %q is invalid: %q", segment, pattern))
+		}
+	}
+	if rule.source < 0 {
+		return nil, os.NewError(fmt.Sprintf("Source segment {source} is missing: %q", pattern))
+	}
+	return rule, nil
+}
+
+// match returns the source and the path without the source segment when
+// the path matches the rule.
+func (rule *GraphiteRule) match(segments []string) (source string, path []string, ok bool) {
+	if len(segments) < len(rule.segments) {
+		return "", nil, false
+	}
+	for i, segment := range rule.segments {
+		if i != rule.source && segment != "*" && segment != segments[i] {
+			return "", nil, false
+		}
+	}
+	path = make([]string, 0, len(segments)-1)
+	path = append(path, segments[:rule.source]...)
+	path = append(path, segments[rule.source+1:]...)
+	// Source could not be the whole metric name
+	if len(path) == 0 {
+		return "", nil, false
+	}
+	return segments[rule.source], path, true
+}
+
+// ParseGraphite parses events in the Graphite plaintext protocol format, one
+// event per line:
+//     path[;tag=value...] value timestamp
+// Source is extracted from the path by the first matching rule (see
+// GraphiteRule), timestamp is in seconds since epoch (-1 or N for the current
+// time). Events are gauges. Invokes the given function for each line like
+// Parse, and returns number of successfully processed events.
+func ParseGraphite(buf string, rules []*GraphiteRule, f func(event *types.Event, err os.Error)) int {
+	var count int
+	for _, line := range strings.Split(buf, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if event, err := parseGraphiteLine(line, rules); err != nil {
+			f(nil, err)
+		} else {
+			f(event, nil)
+			count += 1
+		}
+	}
+	return count
+}
+
+// ParseGraphitePickle parses a batch of events in the Graphite pickle
+// protocol format (a payload without the length header), which is a pickled
+// list of (path, (timestamp, value)) tuples, as sent by carbon-relay. Invokes
+// the given function for each event like Parse, and returns number of
+// successfully processed events.
+func ParseGraphitePickle(data []byte, rules []*GraphiteRule, f func(event *types.Event, err os.Error)) int {
+	value, err := unpickle(data)
+	if err != nil {
+		f(nil, parseError("pickle", "Pickle is invalid: %s", err))
+		return 0
+	}
+	list, ok := pickleItems(value)
+	if !ok {
+		f(nil, parseError("pickle", "Pickle is invalid: list of metrics expected"))
+		return 0
+	}
+
+	var count int
+	for _, item := range list {
+		if event, err := pickledEvent(item, rules); err != nil {
+			f(nil, err)
+		} else {
+			f(event, nil)
+			count += 1
+		}
+	}
+	return count
+}
+
+/***** Helper functions *******************************************************/
+
+// parseGraphiteLine parses a single line of the plaintext protocol.
+func parseGraphiteLine(line string, rules []*GraphiteRule) (*types.Event, os.Error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return nil, parseError("format", "Graphite event format is invalid (event=%q)", line)
+	}
+
+	value, error := strconv.Atof64(fields[1])
+	if error != nil {
+		return nil, parseError("value", "Metric value %q is invalid (event=%q)", fields[1], line)
+	}
+
+	var timestamp int64
+	if fields[2] != "-1" && fields[2] != "N" {
+		t, error := strconv.Atof64(fields[2])
+		if error != nil || t <= 0 {
+			return nil, parseError("timestamp", "Timestamp %q is invalid (event=%q)", fields[2], line)
+		}
+		timestamp = int64(t)
+	}
+
+	event, error := graphiteEvent(fields[0], value, timestamp, rules)
+	if error != nil {
+		return nil, parseError(error.(*ParseError).Reason, "%s (event=%q)", error, line)
+	}
+	return event, nil
+}
+
+// pickledEvent returns event for the unpickled (path, (timestamp, value))
+// tuple.
+func pickledEvent(item interface{}, rules []*GraphiteRule) (*types.Event, os.Error) {
+	metric, ok := pickleItems(item)
+	if !ok || len(metric) != 2 {
+		return nil, parseError("pickle", "Pickled metric is invalid: %v", item)
+	}
+	path, ok := metric[0].(string)
+	if !ok {
+		return nil, parseError("pickle", "Pickled metric path is invalid: %v", item)
+	}
+	point, ok := pickleItems(metric[1])
+	if !ok || len(point) != 2 {
+		return nil, parseError("pickle", "Pickled datapoint is invalid: %v", item)
+	}
+	timestamp, ok := pickleNumber(point[0])
+	if !ok {
+		return nil, parseError("pickle", "Pickled timestamp is invalid: %v", item)
+	}
+	value, ok := pickleNumber(point[1])
+	if !ok {
+		return nil, parseError("pickle", "Pickled metric value is invalid: %v", item)
+	}
+
+	if timestamp < 0 {
+		timestamp = 0
+	}
+	event, err := graphiteEvent(path, value, int64(timestamp), rules)
+	if err != nil {
+		return nil, parseError(err.(*ParseError).Reason, "%s (metric=%q)", err, path)
+	}
+	return event, nil
+}
+
+// graphiteEvent returns event for the Graphite metric path. Characters not
+// allowed in metric names are replaced with underscores.
+func graphiteEvent(path string, value float64, timestamp int64, rules []*GraphiteRule) (*types.Event, os.Error) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil, parseError("value", "Metric value %v is invalid", value)
+	}
+
+	// Tagged series: path;tag1=value1;tag2=value2
+	var tags types.Tags
+	if idx := strings.Index(path, ";"); idx >= 0 {
+		var err os.Error
+		if tags, err = ParseTags(strings.Replace(path[idx+1:], ";", ",", -1)); err != nil {
+			return nil, parseError("tags", "%s", err)
+		}
+		path = path[:idx]
+	}
+
+	segments := strings.Split(strings.Map(graphiteRune, path), ".")
+	for _, segment := range segments {
+		if len(segment) == 0 {
+			return nil, parseError("name", "Metric path %q is invalid", path)
+		}
+	}
+
+	var source string
+	for _, rule := range rules {
+		if s, p, ok := rule.match(segments); ok {
+			source, segments = s, p
+			break
+		}
+	}
+
+	event := types.NewTypedEvent(source, strings.Join(segments, "."), value, types.Gauge)
+	event.Tags = tags
+	event.Time = timestamp
+	return event, nil
+}
+
+// graphiteRune replaces characters not allowed in metric names.
+func graphiteRune(rune int) int {
+	if rune == '.' || validateMetric(string(rune)) {
+		return rune
+	}
+	return '_'
+}
@@ -0,0 +1,128 @@
+package parser
+
+import (
+	"os"
+	"testing"
+	"metricsd/types"
+)
+
+func gaugeEvent(source, name string, value float64, timestamp int64) *types.Event {
+	return timedEvent(types.NewTypedEvent(source, name, value, types.Gauge), timestamp)
+}
+
+var graphiteTests = []struct {
+	buf    string
+	events []*types.Event // nil for invalid events
+}{
+	{"servers.web01.cpu 1.5 1318000000", []*types.Event{gaugeEvent("web01", "servers.cpu", 1.5, 1318000000)}},
+	{"servers.web01.cpu 1.5 1318000000.75\n", []*types.Event{gaugeEvent("web01", "servers.cpu", 1.5, 1318000000)}},
+	{"servers.web01.cpu 1 -1", []*types.Event{gaugeEvent("web01", "servers.cpu", 1, 0)}},
+	{"servers.web01 1 N", []*types.Event{gaugeEvent("web01", "servers", 1, 0)}},
+	{"hosts.db01.disk.sda 5 1318000000", []*types.Event{gaugeEvent("db01", "hosts.disk.sda", 5, 1318000000)}},
+	{"app.requests 42 1318000000", []*types.Event{gaugeEvent("", "app.requests", 42, 1318000000)}},
+	{"app.requests;dc=ams;role=api 42 1318000000", []*types.Event{
+		taggedEvent(gaugeEvent("", "app.requests", 42, 1318000000), "dc", "ams", "role", "api"),
+	}},
+	{"app.disk:/var 1 1318000000", []*types.Event{gaugeEvent("", "app.disk__var", 1, 1318000000)}},
+	{"a 1 1318000000\r\nb 2 1318000010\n\n", []*types.Event{gaugeEvent("", "a", 1, 1318000000), gaugeEvent("", "b", 2, 1318000010)}},
+	{"app.requests 42", []*types.Event{nil}},
+	{"app.requests forty 1318000000", []*types.Event{nil}},
+	{"app.requests nan 1318000000", []*types.Event{nil}},
+	{"app.requests 1 yesterday", []*types.Event{nil}},
+	{"app..requests 1 1318000000", []*types.Event{nil}},
+	{"app.requests;dc 1 1318000000", []*types.Event{nil}},
+}
+
+func graphiteRules(t *testing.T) []*GraphiteRule {
+	rules := make([]*GraphiteRule, 0, 2)
+	for _, pattern := range []string{"servers.{source}", "hosts.{source}.*"} {
+		rule, err := NewGraphiteRule(pattern)
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+func checkGraphiteEvents(t *testing.T, buf string, expected, events []*types.Event) {
+	if len(events) != len(expected) {
+		t.Errorf("%q: expected %d events, got %d", buf, len(expected), len(events))
+		return
+	}
+	for i, event := range events {
+		if expected[i] == nil || event == nil {
+			if expected[i] != event {
+				t.Errorf("%q: expected %v, got %v", buf, expected[i], event)
+			}
+			continue
+		}
+		if event.Source != expected[i].Source || event.Name != expected[i].Name || event.Value != expected[i].Value ||
+			event.Type != expected[i].Type || event.Time != expected[i].Time || event.Tags.String() != expected[i].Tags.String() {
+			t.Errorf("%q: expected %v, got %v", buf, expected[i], event)
+		}
+	}
+}
+
+func TestParseGraphite(t *testing.T) {
+	rules := graphiteRules(t)
+	for _, test := range graphiteTests {
+		events := make([]*types.Event, 0, len(test.events))
+		ParseGraphite(test.buf, rules, func(event *types.Event, err os.Error) {
+			events = append(events, event)
+		})
+		checkGraphiteEvents(t, test.buf, test.events, events)
+	}
+}
+
+func TestNewGraphiteRule(t *testing.T) {
+	for _, pattern := range []string{"servers.web01", "{source}.{source}", "servers..{source}", "servers.{source}.c:d"} {
+		if _, err := NewGraphiteRule(pattern); err == nil {
+			t.Errorf("%q: expected error", pattern)
+		}
+	}
+}
+
+var pickleTests = []struct {
+	name string
+	data string
+}{
+	{"protocol 0", "(lp0\n(Vservers.web01.cpu\np1\n(I1318000000\nF1.5\ntp2\ntp3\na(Vapp.requests;dc=ams\np4\n(I1318000010\nI42\ntp5\ntp6\na."},
+	{"protocol 2", "\x80\x02]q\x00(X\x11\x00\x00\x00servers.web01.cpuq\x01J\x80\x15\x8fNG?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03X\x13\x00\x00\x00app.requests;dc=amsq\x04J\x8a\x15\x8fNK*\x86q\x05\x86q\x06e."},
+}
+
+func TestParseGraphitePickle(t *testing.T) {
+	rules := graphiteRules(t)
+	expected := []*types.Event{
+		gaugeEvent("web01", "servers.cpu", 1.5, 1318000000),
+		taggedEvent(gaugeEvent("", "app.requests", 42, 1318000010), "dc", "ams"),
+	}
+	for _, test := range pickleTests {
+		events := make([]*types.Event, 0, 2)
+		count := ParseGraphitePickle([]byte(test.data), rules, func(event *types.Event, err os.Error) {
+			if err != nil {
+				t.Errorf("%s: %s", test.name, err)
+			}
+			events = append(events, event)
+		})
+		if count != 2 {
+			t.Errorf("%s: expected 2 events, got %d", test.name, count)
+		}
+		checkGraphiteEvents(t, test.name, expected, events)
+	}
+}
+
+func TestParseGraphitePickleRejectsObjects(t *testing.T) {
+	// pickle.dumps(os.system) and a truncated list
+	for _, data := range []string{"cposix\nsystem\np0\n.", "\x80\x02]q\x00(X\x11\x00\x00"} {
+		var error os.Error
+		count := ParseGraphitePickle([]byte(data), nil, func(event *types.Event, err os.Error) {
+			error = err
+		})
+		if count != 0 || error == nil {
+			t.Errorf("%q: expected error", data)
+		} else if error.(*ParseError).Reason != "pickle" {
+			t.Errorf("%q: expected pickle error, got %s", data, error.(*ParseError).Reason)
+		}
+	}
+}
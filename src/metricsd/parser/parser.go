@@ -1,14 +1,29 @@
 // The parser package implements MetricsD protocol events parsing.
 //
 // Basicly, event format is:
-//     [source@]metric:value[;event]
-// where source is the event source, metric and value - metric's name and value,
+//     [source@]metric[,key=value...]:value[|type[|@rate]][;event]
+// where source is the event source, metric and value - metric's name and value
+// (integer or floating-point number), key=value pairs are optional metric tags,
 // and event is another event in the same format (you can send several metrics
-// updates in the same package).
+// updates in the same package). Events could be separated by a newline as well.
+//
+// Optional type and rate make the format compatible with StatsD clients:
+//     metric:value|c[|@rate]  - counter, value is divided by the sample rate
+//     metric:value|ms[|@rate] - timer (|h is accepted as a synonym)
+//     metric:value|g          - gauge
+//     metric:member|s         - set, member could be an arbitrary string
+// Events without type are untyped, and aggregated by all legacy writers.
+//
+// Any event could carry a timestamp (in seconds since epoch) in the last
+// field, e.g. metric:value|T1318000000 or metric:value|c|@0.1|T1318000000,
+// otherwise the time it has been received at is used.
 package parser
 
 import (
+	"bytes"
 	"fmt"
+	"hash/crc32"
+	"math"
 	"os"
 	"strconv"
 	"strings"
@@ -21,12 +36,12 @@ import (
 // processed events.
 //
 // For example:
-//     parser.Parse("app01@user_login:1;response_time:154;hello", func(msg *event, err os.Error) {
+//     parser.Parse("app01@user_login:1;response_time:154|ms;hello", func(msg *event, err os.Error) {
 //         fmt.Printf("event=%v, Error=%v", msg, err)
 //     })
 // will invoke the given callback three times:
 //     msg = &Event { Source: "app01", Name: "user_login",    Value: 1 },  err = nil
-//     msg = &Event { Source: "",      Name: "response_time", Value: 154}, err = nil
+//     msg = &Event { Source: "",      Name: "response_time", Value: 154, Type: Timer }, err = nil
 //     msg = nil, err = os.Error (err.ToString() == "Event format is invalid: hello")
 //
 // Return value for this example will be 2.
@@ -36,54 +51,233 @@ func Parse(buf string, f func(event *types.Event, err os.Error)) int {
 	// Process multiple metrics in a single event
 	var msg string
 	for str := buf; str != ""; {
-		if idx := strings.Index(str, ";"); idx >= 0 {
+		if idx := strings.IndexAny(str, ";\n"); idx >= 0 {
 			msg, str = str[:idx], str[idx+1:]
 		} else {
 			msg, str = str, str[:0]
 		}
 
-		var source, name, svalue string
+		// Skip empty lines (e.g. trailing newline in StatsD packets)
+		if len(msg) == 0 || msg == "\r" {
+			continue
+		}
+
+		if event, err := parseEvent(msg, buf); err != nil {
+			f(nil, err)
+		} else {
+			f(event, nil)
+			count += 1
+		}
+	}
+	return count
+}
+
+// Format returns the event in the protocol format, so it could be parsed back
+// with Parse: [source@]metric[,key=value...]:value[|type][|Ttimestamp]. Set
+// members are formatted as their hashes marked with "#" (#2083503798), so
+// they are not hashed again when parsed.
+func Format(event *types.Event) string {
+	var buf bytes.Buffer
+	if len(event.Source) > 0 {
+		buf.WriteString(event.Source)
+		buf.WriteByte('@')
+	}
+	buf.WriteString(event.Name)
+	if len(event.Tags) > 0 {
+		buf.WriteByte(',')
+		buf.WriteString(event.Tags.String())
+	}
+	buf.WriteByte(':')
+	if event.Type == types.Set {
+		buf.WriteByte('#')
+		buf.WriteString(strconv.Uitoa64(uint64(event.Value)))
+	} else {
+		buf.WriteString(strconv.Ftoa64(event.Value, 'g', -1))
+	}
+	if name := metricTypeNames[event.Type]; len(name) > 0 {
+		buf.WriteByte('|')
+		buf.WriteString(name)
+	}
+	if event.Time > 0 {
+		buf.WriteString("|T")
+		buf.WriteString(strconv.Itoa64(event.Time))
+	}
+	return buf.String()
+}
+
+// ParseError describes an event which could not be parsed.
+type ParseError struct {
+	// What is wrong with the event: "format", "source", "name", "tags",
+	// "type", "rate", "timestamp", "value", or "pickle".
+	Reason string
+	// Error message (including the event).
+	Message string
+}
+
+func (error *ParseError) String() string {
+	return error.Message
+}
+
+/***** Helper functions *******************************************************/
+
+// parseError returns ParseError with the given reason and formatted message.
+func parseError(reason, format string, v ...interface{}) os.Error {
+	return &ParseError{Reason: reason, Message: fmt.Sprintf(format, v...)}
+}
+
+// parseEvent parses a single event in the
+// [source@]metric[,key=value...]:value[|type][|@rate][|Ttimestamp] format. The whole buffer is used in error messages only.
+func parseEvent(msg, buf string) (event *types.Event, err os.Error) {
+	var source, name, svalue string
+	var tags types.Tags
+
+	// Retrieve the metric name (and source, if present)
+	if idx := strings.Index(msg, ":"); idx >= 0 {
+		name, svalue = msg[:idx], strings.TrimRight(msg[idx+1:], "\r")
 
 		// Check if the event contains a source name
-		if idx := strings.Index(msg, "@"); idx >= 0 {
-			source, msg = msg[:idx], msg[idx+1:]
+		if idx := strings.Index(name, "@"); idx >= 0 {
+			source, name = name[:idx], name[idx+1:]
 
 			if !validateMetric(source) {
-				f(nil, os.NewError(fmt.Sprintf("Source is invalid: %q (event=%q)", source, buf)))
-				continue
+				return nil, parseError("source", "Source is invalid: %q (event=%q)", source, buf)
 			}
 		}
 
-		// Retrieve the metric name
-		if idx := strings.Index(msg, ":"); idx >= 0 {
-			name, svalue = msg[:idx], msg[idx+1:]
+		// Split metric tags
+		var stags string
+		tagged := false
+		if idx := strings.Index(name, ","); idx >= 0 {
+			name, stags, tagged = name[:idx], name[idx+1:], true
+		}
 
-			if !validateMetric(name) {
-				f(nil, os.NewError(fmt.Sprintf("Metric name is invalid: %q (event=%q)", name, buf)))
-				continue
+		if !validateMetric(name) {
+			return nil, parseError("name", "Metric name is invalid: %q (event=%q)", name, buf)
+		}
+		if len(name) == 0 {
+			return nil, parseError("name", "Metric name is empty (event=%q)", buf)
+		}
+		if tagged {
+			if tags, err = ParseTags(stags); err != nil {
+				return nil, parseError("tags", "%s (event=%q)", err, buf)
 			}
-			if len(name) == 0 {
-				f(nil, os.NewError(fmt.Sprintf("Metric name is empty (event=%q)", buf)))
-				continue
+		}
+	} else {
+		return nil, parseError("format", "Event format is invalid (event=%q)", buf)
+	}
+
+	// Split StatsD type, sample rate, and timestamp
+	var stype string
+	var fields []string
+	if idx := strings.Index(svalue, "|"); idx >= 0 {
+		fields = strings.Split(svalue[idx+1:], "|")
+		svalue = svalue[:idx]
+		// Type is optional for events with timestamp (metric:value|T1318000000)
+		if !strings.HasPrefix(fields[0], "T") {
+			stype, fields = fields[0], fields[1:]
+		}
+	}
+
+	metricType, found := metricTypes[stype]
+	if !found {
+		return nil, parseError("type", "Metric type %q is invalid (event=%q)", stype, buf)
+	}
+
+	rate := 1.0
+	var timestamp int64
+	for _, field := range fields {
+		var error os.Error
+		switch {
+		case strings.HasPrefix(field, "@"):
+			if rate, error = strconv.Atof64(field[1:]); error != nil || !(rate > 0 && rate <= 1) {
+				return nil, parseError("rate", "Sample rate %q is invalid (event=%q)", field, buf)
 			}
-		} else {
-			f(nil, os.NewError(fmt.Sprintf("Event format is invalid (event=%q)", buf)))
-			continue
+		case strings.HasPrefix(field, "T"):
+			if timestamp, error = strconv.Atoi64(field[1:]); error != nil || timestamp <= 0 {
+				return nil, parseError("timestamp", "Timestamp %q is invalid (event=%q)", field, buf)
+			}
+		default:
+			return nil, parseError("rate", "Sample rate %q is invalid (event=%q)", field, buf)
 		}
+	}
 
-		// Parse the value
-		if value, error := strconv.Atoi(svalue); error != nil {
-			f(nil, os.NewError(fmt.Sprintf("Metric value %q is invalid (event=%q)", svalue, buf)))
-			continue
-		} else {
-			f(types.NewEvent(source, name, value), nil)
-			count += 1
+	// Set members are arbitrary strings, only their uniqueness matters
+	if metricType == types.Set {
+		if len(svalue) == 0 {
+			return nil, parseError("value", "Metric value %q is invalid (event=%q)", svalue, buf)
 		}
+		event = types.NewTypedEvent(source, name, setMember(svalue), metricType)
+		event.Tags = tags
+		event.Time = timestamp
+		return event, nil
 	}
-	return count
+
+	// Parse the value
+	value, error := strconv.Atof64(svalue)
+	if error != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil, parseError("value", "Metric value %q is invalid (event=%q)", svalue, buf)
+	}
+	// Counters are scaled by the sample rate to estimate the real value
+	if metricType == types.Counter {
+		value /= rate
+	}
+	event = types.NewTypedEvent(source, name, value, metricType)
+	event.Tags = tags
+	event.Time = timestamp
+	return event, nil
 }
 
-/***** Helper functions *******************************************************/
+// setMember returns the hash of the set member. Members already hashed by
+// Format (#2083503798, e.g. forwarded by relays) are kept as is.
+func setMember(member string) float64 {
+	if strings.HasPrefix(member, "#") {
+		if hash, err := strconv.Atoui64(member[1:]); err == nil && hash <= math.MaxUint32 {
+			return float64(hash)
+		}
+	}
+	return float64(crc32.ChecksumIEEE([]byte(member)))
+}
+
+// ParseTags parses a list of tags in key1=value1,key2=value2 format. Keys and
+// values should be valid metric names, each key could be specified only once.
+// Returned tags are sorted by key.
+func ParseTags(buf string) (tags types.Tags, err os.Error) {
+	parts := strings.Split(buf, ",")
+	tags = make(types.Tags, 0, len(parts))
+	for _, part := range parts {
+		idx := strings.Index(part, "=")
+		if idx <= 0 || idx == len(part)-1 {
+			return nil, os.NewError(fmt.Sprintf("Tag is invalid: %q", part))
+		}
+		key, value := part[:idx], part[idx+1:]
+		if !validateMetric(key) || !validateMetric(value) {
+			return nil, os.NewError(fmt.Sprintf("Tag is invalid: %q", part))
+		}
+		if _, found := tags.Get(key); found {
+			return nil, os.NewError(fmt.Sprintf("Tag is duplicated: %q", key))
+		}
+		tags = append(tags, types.Tag{Key: key, Value: value})
+	}
+	return types.NewTags(tags...), nil
+}
+
+// metricTypes maps StatsD metric type names to metric types.
+var metricTypes = map[string]types.MetricType{
+	"":   types.Untyped,
+	"c":  types.Counter,
+	"ms": types.Timer,
+	"h":  types.Timer,
+	"g":  types.Gauge,
+	"s":  types.Set,
+}
+
+// metricTypeNames maps metric types to StatsD metric type names.
+var metricTypeNames = map[types.MetricType]string{
+	types.Counter: "c",
+	types.Timer:   "ms",
+	types.Gauge:   "g",
+	types.Set:     "s",
+}
 
 func validateMetric(name string) bool {
 	for _, rune := range name {
@@ -33,6 +33,12 @@ var parseTests = []eventTest{
 	{"app01@metric:10", []testEntry{
 		{types.NewEvent("app01", "metric", 10), nil},
 	}},
+	{"response_time:12.75", []testEntry{
+		{types.NewEvent("", "response_time", 12.75), nil},
+	}},
+	{"traffic_in:8589934592", []testEntry{
+		{types.NewEvent("", "traffic_in", 8589934592), nil},
+	}},
 
 	// Invalid events with single metric
 	{":10", []testEntry{
@@ -50,6 +56,9 @@ var parseTests = []eventTest{
 	{"app01@metric:hello", []testEntry{
 		{nil, os.NewError("Metric value \"hello\" is invalid (event=\"app01@metric:hello\")")},
 	}},
+	{"app01@metric:NaN", []testEntry{
+		{nil, os.NewError("Metric value \"NaN\" is invalid (event=\"app01@metric:NaN\")")},
+	}},
 
 	// Valid events with multiple metrics
 	{"metric1:10;metric2:20", []testEntry{
@@ -65,6 +74,94 @@ var parseTests = []eventTest{
 		{types.NewEvent("app02", "metric2", 20), nil},
 	}},
 
+	// StatsD events
+	{"requests:1|c", []testEntry{
+		{types.NewTypedEvent("", "requests", 1, types.Counter), nil},
+	}},
+	{"requests:2|c|@0.1", []testEntry{
+		{types.NewTypedEvent("", "requests", 20, types.Counter), nil},
+	}},
+	{"app01@response_time:12.5|ms|@0.5", []testEntry{
+		{types.NewTypedEvent("app01", "response_time", 12.5, types.Timer), nil},
+	}},
+	{"response_time:320|h", []testEntry{
+		{types.NewTypedEvent("", "response_time", 320, types.Timer), nil},
+	}},
+	{"queue.size:42|g", []testEntry{
+		{types.NewTypedEvent("", "queue.size", 42, types.Gauge), nil},
+	}},
+	{"users.online:user42|s", []testEntry{
+		{types.NewTypedEvent("", "users.online", 2083503798, types.Set), nil},
+	}},
+	{"requests:1|c\nresponse_time:154|ms\n", []testEntry{
+		{types.NewTypedEvent("", "requests", 1, types.Counter), nil},
+		{types.NewTypedEvent("", "response_time", 154, types.Timer), nil},
+	}},
+
+	// Invalid StatsD events
+	{"requests:1|x", []testEntry{
+		{nil, os.NewError("Metric type \"x\" is invalid (event=\"requests:1|x\")")},
+	}},
+	{"requests:1|c|0.1", []testEntry{
+		{nil, os.NewError("Sample rate \"0.1\" is invalid (event=\"requests:1|c|0.1\")")},
+	}},
+	{"requests:1|c|@0", []testEntry{
+		{nil, os.NewError("Sample rate \"@0\" is invalid (event=\"requests:1|c|@0\")")},
+	}},
+	{"requests:1|c|@1.5", []testEntry{
+		{nil, os.NewError("Sample rate \"@1.5\" is invalid (event=\"requests:1|c|@1.5\")")},
+	}},
+	{"users.online:#2083503798|s\nusers.online:#user42|s\nusers.online:#4294967296|s", []testEntry{
+		{types.NewTypedEvent("", "users.online", 2083503798, types.Set), nil},
+		{types.NewTypedEvent("", "users.online", 2933187434, types.Set), nil},
+		{types.NewTypedEvent("", "users.online", 1437706685, types.Set), nil},
+	}},
+	{"users.online:|s", []testEntry{
+		{nil, os.NewError("Metric value \"\" is invalid (event=\"users.online:|s\")")},
+	}},
+
+	// Events with timestamps
+	{"metric:10|T1318000000", []testEntry{
+		{timedEvent(types.NewEvent("", "metric", 10), 1318000000), nil},
+	}},
+	{"requests:1|c|@0.5|T1318000000", []testEntry{
+		{timedEvent(types.NewTypedEvent("", "requests", 2, types.Counter), 1318000000), nil},
+	}},
+	{"response_time:15|ms|T1318000000", []testEntry{
+		{timedEvent(types.NewTypedEvent("", "response_time", 15, types.Timer), 1318000000), nil},
+	}},
+	{"metric:10|Tnow", []testEntry{
+		{nil, os.NewError("Timestamp \"Tnow\" is invalid (event=\"metric:10|Tnow\")")},
+	}},
+	{"metric:10|T-5", []testEntry{
+		{nil, os.NewError("Timestamp \"T-5\" is invalid (event=\"metric:10|T-5\")")},
+	}},
+
+	// Tagged events
+	{"metric,dc=ams,role=api:153", []testEntry{
+		{taggedEvent(types.NewEvent("", "metric", 153), "dc", "ams", "role", "api"), nil},
+	}},
+	{"app01@metric,role=api,dc=ams:1|c", []testEntry{
+		{taggedEvent(types.NewTypedEvent("app01", "metric", 1, types.Counter), "dc", "ams", "role", "api"), nil},
+	}},
+
+	// Invalid tagged events
+	{"metric,:10", []testEntry{
+		{nil, os.NewError("Tag is invalid: \"\" (event=\"metric,:10\")")},
+	}},
+	{"metric,dc:10", []testEntry{
+		{nil, os.NewError("Tag is invalid: \"dc\" (event=\"metric,dc:10\")")},
+	}},
+	{"metric,dc=:10", []testEntry{
+		{nil, os.NewError("Tag is invalid: \"dc=\" (event=\"metric,dc=:10\")")},
+	}},
+	{"metric,dc=a!:10", []testEntry{
+		{nil, os.NewError("Tag is invalid: \"dc=a!\" (event=\"metric,dc=a!:10\")")},
+	}},
+	{"metric,dc=ams,dc=sjc:10", []testEntry{
+		{nil, os.NewError("Tag is duplicated: \"dc\" (event=\"metric,dc=ams,dc=sjc:10\")")},
+	}},
+
 	// Semi-valid events (multiple metrics, some are invalid)
 	{"metric1:10;metric2:", []testEntry{
 		{types.NewEvent("", "metric1", 10), nil},
@@ -72,6 +169,18 @@ var parseTests = []eventTest{
 	}},
 }
 
+func taggedEvent(event *types.Event, tags ...string) *types.Event {
+	for idx := 0; idx < len(tags); idx += 2 {
+		event.Tags = append(event.Tags, types.Tag{Key: tags[idx], Value: tags[idx+1]})
+	}
+	return event
+}
+
+func timedEvent(event *types.Event, timestamp int64) *types.Event {
+	event.Time = timestamp
+	return event
+}
+
 func TestParse(t *testing.T) {
 	for _, test := range parseTests {
 		var idx = 0
@@ -89,7 +198,7 @@ func TestParse(t *testing.T) {
 			if err != nil && expected.err == nil {
 				t.Errorf("Expected no error, got error %q (buf=%q, idx=%d)", err, test.buf, idx)
 			}
-			if err != expected.err {
+			if err != nil && expected.err != nil && err.String() != expected.err.String() {
 				t.Errorf("Expected error %q, got error %q (buf=%q, idx=%d)", expected.err, err, test.buf, idx)
 			}
 			if err == nil {
@@ -109,7 +218,16 @@ func TestParse(t *testing.T) {
 						t.Errorf("Expected event name %q, got %q (buf=%q, idx=%d)", expected.event.Name, event.Name, test.buf, idx)
 					}
 					if event.Value != expected.event.Value {
-						t.Errorf("Expected event value %q, got %q (buf=%q, idx=%d)", expected.event.Value, event.Name, test.buf, idx)
+						t.Errorf("Expected event value %v, got %v (buf=%q, idx=%d)", expected.event.Value, event.Value, test.buf, idx)
+					}
+					if event.Tags.String() != expected.event.Tags.String() {
+						t.Errorf("Expected event tags %q, got %q (buf=%q, idx=%d)", expected.event.Tags, event.Tags, test.buf, idx)
+					}
+					if event.Time != expected.event.Time {
+						t.Errorf("Expected event time %d, got %d (buf=%q, idx=%d)", expected.event.Time, event.Time, test.buf, idx)
+					}
+					if event.Type != expected.event.Type {
+						t.Errorf("Expected event type %s, got %s (buf=%q, idx=%d)", expected.event.Type, event.Type, test.buf, idx)
 					}
 				}
 			}
@@ -128,6 +246,64 @@ func TestParse(t *testing.T) {
 	}
 }
 
+var errorReasonTests = []struct {
+	buf    string
+	reason string
+}{
+	{"metric", "format"},
+	{"ap p@metric:1", "source"},
+	{"me tric:1", "name"},
+	{":1", "name"},
+	{"metric,dc:1", "tags"},
+	{"metric:1|x", "type"},
+	{"metric:1|c|@2", "rate"},
+	{"metric:1|T0", "timestamp"},
+	{"metric:one", "value"},
+}
+
+func TestParseErrorReasons(t *testing.T) {
+	for _, test := range errorReasonTests {
+		Parse(test.buf, func(event *types.Event, err os.Error) {
+			if error, ok := err.(*ParseError); !ok || error.Reason != test.reason {
+				t.Errorf("Expected error with reason %q, got %v (buf=%q)", test.reason, err, test.buf)
+			}
+		})
+	}
+}
+
+var formatTests = []struct {
+	event *types.Event
+	buf   string
+}{
+	{types.NewEvent("", "metric", 10), "metric:10"},
+	{types.NewEvent("app01", "group.metric", -1.5), "app01@group.metric:-1.5"},
+	{types.NewTypedEvent("", "requests", 1000000, types.Counter), "requests:1e+06|c"},
+	{types.NewTypedEvent("", "response_time", 154, types.Timer), "response_time:154|ms"},
+	{types.NewTypedEvent("", "memory", 1.25, types.Gauge), "memory:1.25|g"},
+	{types.NewTypedEvent("", "users", 3141592653, types.Set), "users:#3141592653|s"},
+	{&types.Event{Source: "app01", Name: "time", Value: 12.75, Type: types.Timer, Time: 1318000000, Tags: types.NewTags(types.Tag{Key: "dc", Value: "ams"}, types.Tag{Key: "api", Value: "v1"})},
+		"app01@time,api=v1,dc=ams:12.75|ms|T1318000000"},
+	{&types.Event{Name: "metric", Value: 1, Time: 1318000000}, "metric:1|T1318000000"},
+}
+
+func TestFormat(t *testing.T) {
+	for _, test := range formatTests {
+		buf := Format(test.event)
+		if buf != test.buf {
+			t.Errorf("Expected %q, got %q", test.buf, buf)
+			continue
+		}
+		// Formatted events are parsed back (set members are not hashed again)
+		Parse(buf, func(event *types.Event, err os.Error) {
+			if err != nil {
+				t.Errorf("Error: %s", err)
+			} else if event.String() != test.event.String() || event.Time != test.event.Time {
+				t.Errorf("Expected %s, got %s (buf=%q)", test.event, event, buf)
+			}
+		})
+	}
+}
+
 func BenchmarkParse(b *testing.B) {
 	b.StopTimer()
 	buf := "app01@group.metric:10;app02@group.metric:2;group.metric:2"
@@ -0,0 +1,420 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Python pickle opcodes supported by unpickle.
+const (
+	pickleMark            = '('
+	pickleStop            = '.'
+	picklePop             = '0'
+	picklePopMark         = '1'
+	pickleNone            = 'N'
+	pickleInt             = 'I'
+	pickleBinInt          = 'J'
+	pickleBinInt1         = 'K'
+	pickleBinInt2         = 'M'
+	pickleLong            = 'L'
+	pickleLong1           = 0x8a
+	pickleFloat           = 'F'
+	pickleBinFloat        = 'G'
+	pickleString          = 'S'
+	pickleBinString       = 'T'
+	pickleShortBinString  = 'U'
+	pickleUnicode         = 'V'
+	pickleBinUnicode      = 'X'
+	pickleShortBinUnicode = 0x8c
+	pickleBinBytes        = 'B'
+	pickleShortBinBytes   = 'C'
+	pickleEmptyList       = ']'
+	pickleList            = 'l'
+	pickleAppend          = 'a'
+	pickleAppends         = 'e'
+	pickleEmptyTuple      = ')'
+	pickleTuple           = 't'
+	pickleTuple1          = 0x85
+	pickleTuple2          = 0x86
+	pickleTuple3          = 0x87
+	pickleNewTrue         = 0x88
+	pickleNewFalse        = 0x89
+	pickleProto           = 0x80
+	pickleFrame           = 0x95
+	picklePut             = 'p'
+	pickleBinPut          = 'q'
+	pickleLongBinPut      = 'r'
+	pickleMemoize         = 0x94
+	pickleGet             = 'g'
+	pickleBinGet          = 'h'
+	pickleLongBinGet      = 'j'
+)
+
+// pickleMarker is pushed to the stack by the MARK opcode.
+type pickleMarker struct{}
+
+// unpickle decodes data in Python pickle format (protocols 0-4). Only lists,
+// tuples, strings, numbers, booleans, and None are supported: lists are
+// returned as *[]interface{}, tuples as []interface{}, integers as int64.
+// Opcodes creating arbitrary objects are rejected, so it is safe to decode
+// data received from the network.
+func unpickle(data []byte) (interface{}, os.Error) {
+	u := &unpickler{data: data, memo: make(map[int64]interface{})}
+	for {
+		if u.pos >= len(u.data) {
+			return nil, os.NewError("unexpected end of data")
+		}
+		op := u.data[u.pos]
+		u.pos++
+		if op == pickleStop {
+			return u.pop()
+		}
+		if err := u.execute(op); err != nil {
+			return nil, err
+		}
+	}
+	panic("unreachable")
+}
+
+type unpickler struct {
+	data  []byte
+	pos   int
+	stack []interface{}
+	memo  map[int64]interface{}
+}
+
+func (u *unpickler) execute(op byte) os.Error {
+	switch op {
+	case pickleProto:
+		_, err := u.read(1)
+		return err
+	case pickleFrame:
+		_, err := u.read(8)
+		return err
+	case pickleMark:
+		u.push(pickleMarker{})
+	case picklePop:
+		_, err := u.pop()
+		return err
+	case picklePopMark:
+		_, err := u.popMark()
+		return err
+	case pickleNone:
+		u.push(nil)
+	case pickleNewTrue:
+		u.push(true)
+	case pickleNewFalse:
+		u.push(false)
+	case pickleInt:
+		line, err := u.readLine()
+		if err != nil {
+			return err
+		}
+		// Protocol 0 booleans
+		switch line {
+		case "00":
+			u.push(false)
+		case "01":
+			u.push(true)
+		default:
+			return u.pushInt(line)
+		}
+	case pickleLong:
+		line, err := u.readLine()
+		if err != nil {
+			return err
+		}
+		return u.pushInt(strings.TrimRight(line, "L"))
+	case pickleBinInt:
+		b, err := u.read(4)
+		if err != nil {
+			return err
+		}
+		u.push(int64(int32(binary.LittleEndian.Uint32(b))))
+	case pickleBinInt1:
+		b, err := u.read(1)
+		if err != nil {
+			return err
+		}
+		u.push(int64(b[0]))
+	case pickleBinInt2:
+		b, err := u.read(2)
+		if err != nil {
+			return err
+		}
+		u.push(int64(binary.LittleEndian.Uint16(b)))
+	case pickleLong1:
+		b, err := u.readCounted(1)
+		if err != nil {
+			return err
+		}
+		if len(b) > 8 {
+			return os.NewError("long integer is too large")
+		}
+		var value int64
+		for i := len(b) - 1; i >= 0; i-- {
+			value = value<<8 | int64(b[i])
+		}
+		// Two's complement: extend the sign bit
+		if len(b) > 0 && len(b) < 8 && b[len(b)-1]&0x80 != 0 {
+			value -= 1 << uint(8*len(b))
+		}
+		u.push(value)
+	case pickleFloat:
+		line, err := u.readLine()
+		if err != nil {
+			return err
+		}
+		value, err := strconv.Atof64(line)
+		if err != nil {
+			return os.NewError(fmt.Sprintf("float %q is invalid", line))
+		}
+		u.push(value)
+	case pickleBinFloat:
+		b, err := u.read(8)
+		if err != nil {
+			return err
+		}
+		u.push(math.Float64frombits(binary.BigEndian.Uint64(b)))
+	case pickleString, pickleUnicode:
+		line, err := u.readLine()
+		if err != nil {
+			return err
+		}
+		// Protocol 0 strings are quoted, only simple ones are supported
+		if op == pickleString {
+			if len(line) < 2 || (line[0] != '\'' && line[0] != '"') || line[len(line)-1] != line[0] {
+				return os.NewError(fmt.Sprintf("string %s is invalid", line))
+			}
+			line = line[1 : len(line)-1]
+		}
+		u.push(line)
+	case pickleShortBinString, pickleShortBinUnicode, pickleShortBinBytes:
+		b, err := u.readCounted(1)
+		if err != nil {
+			return err
+		}
+		u.push(string(b))
+	case pickleBinString, pickleBinUnicode, pickleBinBytes:
+		b, err := u.readCounted(4)
+		if err != nil {
+			return err
+		}
+		u.push(string(b))
+	case pickleEmptyList:
+		u.push(&[]interface{}{})
+	case pickleList:
+		items, err := u.popMark()
+		if err != nil {
+			return err
+		}
+		u.push(&items)
+	case pickleAppend, pickleAppends:
+		var items []interface{}
+		if op == pickleAppend {
+			item, err := u.pop()
+			if err != nil {
+				return err
+			}
+			items = []interface{}{item}
+		} else {
+			var err os.Error
+			if items, err = u.popMark(); err != nil {
+				return err
+			}
+		}
+		top, err := u.top()
+		if err != nil {
+			return err
+		}
+		list, ok := top.(*[]interface{})
+		if !ok {
+			return os.NewError("append to a non-list")
+		}
+		*list = append(*list, items...)
+	case pickleEmptyTuple:
+		u.push([]interface{}{})
+	case pickleTuple:
+		items, err := u.popMark()
+		if err != nil {
+			return err
+		}
+		u.push(items)
+	case pickleTuple1, pickleTuple2, pickleTuple3:
+		n := int(op-pickleTuple1) + 1
+		if len(u.stack) < n {
+			return os.NewError("stack underflow")
+		}
+		items := make([]interface{}, n)
+		copy(items, u.stack[len(u.stack)-n:])
+		u.stack = u.stack[:len(u.stack)-n]
+		for _, item := range items {
+			if _, ok := item.(pickleMarker); ok {
+				return os.NewError("unexpected mark")
+			}
+		}
+		u.push(items)
+	case picklePut, pickleBinPut, pickleLongBinPut, pickleMemoize:
+		var index int64
+		switch op {
+		case pickleMemoize:
+			index = int64(len(u.memo))
+		default:
+			var err os.Error
+			if index, err = u.readIndex(op == picklePut, op == pickleLongBinPut); err != nil {
+				return err
+			}
+		}
+		top, err := u.top()
+		if err != nil {
+			return err
+		}
+		u.memo[index] = top
+	case pickleGet, pickleBinGet, pickleLongBinGet:
+		index, err := u.readIndex(op == pickleGet, op == pickleLongBinGet)
+		if err != nil {
+			return err
+		}
+		value, found := u.memo[index]
+		if !found {
+			return os.NewError(fmt.Sprintf("memo %d is not found", index))
+		}
+		u.push(value)
+	default:
+		return os.NewError(fmt.Sprintf("opcode 0x%02x is not supported", op))
+	}
+	return nil
+}
+
+func (u *unpickler) push(value interface{}) {
+	u.stack = append(u.stack, value)
+}
+
+func (u *unpickler) pushInt(s string) os.Error {
+	value, err := strconv.Atoi64(s)
+	if err != nil {
+		return os.NewError(fmt.Sprintf("integer %q is invalid", s))
+	}
+	u.push(value)
+	return nil
+}
+
+func (u *unpickler) top() (interface{}, os.Error) {
+	if len(u.stack) == 0 {
+		return nil, os.NewError("stack underflow")
+	}
+	return u.stack[len(u.stack)-1], nil
+}
+
+func (u *unpickler) pop() (interface{}, os.Error) {
+	value, err := u.top()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := value.(pickleMarker); ok {
+		return nil, os.NewError("unexpected mark")
+	}
+	u.stack = u.stack[:len(u.stack)-1]
+	return value, nil
+}
+
+// popMark pops all items pushed after the last mark, and the mark itself.
+func (u *unpickler) popMark() ([]interface{}, os.Error) {
+	for i := len(u.stack) - 1; i >= 0; i-- {
+		if _, ok := u.stack[i].(pickleMarker); ok {
+			items := make([]interface{}, len(u.stack)-i-1)
+			copy(items, u.stack[i+1:])
+			u.stack = u.stack[:i]
+			return items, nil
+		}
+	}
+	return nil, os.NewError("mark is not found")
+}
+
+func (u *unpickler) read(n int) ([]byte, os.Error) {
+	// Compared with the remaining length, so huge counts do not overflow
+	if n < 0 || n > len(u.data)-u.pos {
+		return nil, os.NewError("unexpected end of data")
+	}
+	b := u.data[u.pos : u.pos+n]
+	u.pos += n
+	return b, nil
+}
+
+// readCounted reads bytes prefixed with their little-endian length of the
+// given size (1 or 4 bytes).
+func (u *unpickler) readCounted(size int) ([]byte, os.Error) {
+	b, err := u.read(size)
+	if err != nil {
+		return nil, err
+	}
+	n := int(b[0])
+	if size == 4 {
+		n = int(binary.LittleEndian.Uint32(b))
+	}
+	return u.read(n)
+}
+
+func (u *unpickler) readLine() (string, os.Error) {
+	idx := bytes.IndexByte(u.data[u.pos:], '\n')
+	if idx < 0 {
+		return "", os.NewError("unexpected end of data")
+	}
+	line := string(u.data[u.pos : u.pos+idx])
+	u.pos += idx + 1
+	return line, nil
+}
+
+// readIndex reads memo index as a text line, 4-byte or 1-byte integer.
+func (u *unpickler) readIndex(text, long bool) (int64, os.Error) {
+	switch {
+	case text:
+		line, err := u.readLine()
+		if err != nil {
+			return 0, err
+		}
+		index, err := strconv.Atoi64(line)
+		if err != nil {
+			return 0, os.NewError(fmt.Sprintf("memo index %q is invalid", line))
+		}
+		return index, nil
+	case long:
+		b, err := u.read(4)
+		if err != nil {
+			return 0, err
+		}
+		return int64(binary.LittleEndian.Uint32(b)), nil
+	}
+	b, err := u.read(1)
+	if err != nil {
+		return 0, err
+	}
+	return int64(b[0]), nil
+}
+
+// pickleItems returns items of the unpickled list or tuple.
+func pickleItems(value interface{}) ([]interface{}, bool) {
+	switch items := value.(type) {
+	case []interface{}:
+		return items, true
+	case *[]interface{}:
+		return *items, true
+	}
+	return nil, false
+}
+
+// pickleNumber returns the unpickled integer or float as a float.
+func pickleNumber(value interface{}) (float64, bool) {
+	switch number := value.(type) {
+	case int64:
+		return float64(number), true
+	case float64:
+		return number, true
+	}
+	return 0, false
+}
@@ -0,0 +1,156 @@
+package parser
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// tryUnpickle calls unpickle, and returns a panic as an error, so malformed
+// data crashing the unpickler fails the test instead of the test binary.
+func tryUnpickle(data string) (value interface{}, err os.Error, panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = os.NewError(fmt.Sprint("panic: ", r))
+			panicked = true
+		}
+	}()
+	value, err = unpickle([]byte(data))
+	return
+}
+
+var unpickleTests = []struct {
+	name     string
+	data     string
+	expected interface{}
+}{
+	{"none", "N.", nil},
+	{"booleans", "\x88\x89\x86.", []interface{}{true, false}},
+	{"protocol 0 booleans", "(I01\nI00\nt.", []interface{}{true, false}},
+	{"binint", "J\xff\xff\xff\xff.", int64(-1)},
+	{"binint1", "K\xff.", int64(255)},
+	{"binint2", "M\xff\xff.", int64(65535)},
+	{"long", "L-42L\n.", int64(-42)},
+	{"long1 zero", "\x8a\x00.", int64(0)},
+	{"long1 positive", "\x8a\x01\x7f.", int64(127)},
+	{"long1 negative byte", "\x8a\x01\xff.", int64(-1)},
+	{"long1 positive with sign byte", "\x8a\x02\x80\x00.", int64(128)},
+	{"long1 negative short", "\x8a\x02\x00\x80.", int64(-32768)},
+	{"long1 negative 3 bytes", "\x8a\x03\xfe\xff\xff.", int64(-2)},
+	{"long1 max", "\x8a\x08\xff\xff\xff\xff\xff\xff\xff\x7f.", int64(9223372036854775807)},
+	{"long1 min", "\x8a\x08\x00\x00\x00\x00\x00\x00\x00\x80.", int64(-9223372036854775808)},
+	{"long1 negative 8 bytes", "\x8a\x08\xff\xff\xff\xff\xff\xff\xff\xff.", int64(-1)},
+	{"binfloat", "G?\xf8\x00\x00\x00\x00\x00\x00.", 1.5},
+	{"string", "S'abc'\n.", "abc"},
+	{"binstring", "T\x03\x00\x00\x00abc.", "abc"},
+	{"empty binstring", "T\x00\x00\x00\x00.", ""},
+	{"short binunicode", "\x8c\x03abc.", "abc"},
+	{"list", "(K\x01K\x02l.", &[]interface{}{int64(1), int64(2)}},
+	{"appends", "]K\x01a(K\x02K\x03e.", &[]interface{}{int64(1), int64(2), int64(3)}},
+	{"tuple3", "K\x01K\x02K\x03\x87.", []interface{}{int64(1), int64(2), int64(3)}},
+	{"pop", "K\x01K\x020.", int64(1)},
+	{"pop mark", "K\x01(K\x02K\x031.", int64(1)},
+	{"memo", "K\x01q\x00h\x00\x86.", []interface{}{int64(1), int64(1)}},
+	{"memoize", "\x80\x04\x95\x00\x00\x00\x00\x00\x00\x00\x00K\x07\x94h\x00\x86.", []interface{}{int64(7), int64(7)}},
+}
+
+func TestUnpickle(t *testing.T) {
+	for _, test := range unpickleTests {
+		value, err, _ := tryUnpickle(test.data)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if !reflect.DeepEqual(value, test.expected) {
+			t.Errorf("%s: expected %#v, got %#v", test.name, test.expected, value)
+		}
+	}
+}
+
+var unpickleErrorTests = []struct {
+	name string
+	data string
+}{
+	// Truncated input
+	{"empty", ""},
+	{"no stop", "N"},
+	{"truncated proto", "\x80"},
+	{"truncated frame", "\x95\x01\x00"},
+	{"truncated binint", "J\x01\x02"},
+	{"truncated binint1", "K"},
+	{"truncated binint2", "M\x01"},
+	{"truncated long1 length", "\x8a"},
+	{"truncated long1", "\x8a\x02\xff"},
+	{"truncated binfloat", "G?\xf8"},
+	{"truncated int line", "I12"},
+	{"truncated string line", "S'abc'"},
+	{"truncated binstring length", "T\x03\x00"},
+	{"truncated binstring", "T\x03\x00\x00\x00ab"},
+	{"truncated short binstring", "U\x03ab"},
+	{"truncated list", "\x80\x02]q\x00(X\x11\x00\x00"},
+
+	// Stack underflow
+	{"stop on empty stack", "."},
+	{"tuple1 underflow", "\x85."},
+	{"tuple2 underflow", "K\x01\x86."},
+	{"tuple3 underflow", "K\x01K\x02\x87."},
+	{"append underflow", "a."},
+	{"append without list", "K\x01a."},
+	{"append to non-list", "K\x01K\x02a."},
+	{"appends to non-list", "K\x01(K\x02e."},
+	{"pop underflow", "0."},
+	{"pop to empty stack", "K\x010."},
+	{"put underflow", "q\x00."},
+	{"memoize underflow", "\x94."},
+
+	// MARK misuse
+	{"stop on mark", "(."},
+	{"tuple without mark", "K\x01t."},
+	{"list without mark", "K\x01l."},
+	{"appends without mark", "]K\x01e."},
+	{"pop mark without mark", "K\x011."},
+	{"tuple1 of mark", "(\x85."},
+	{"tuple2 with mark", "K\x01(\x86."},
+	{"tuple3 with mark", "(K\x01K\x02\x87."},
+	{"append mark", "](a."},
+	{"pop mark with pop", "(0."},
+	{"memoized mark", "(p0\ng0\n."},
+
+	// LONG1 wider than 64 bits
+	{"long1 too large", "\x8a\x09\x00\x00\x00\x00\x00\x00\x00\x00\x01."},
+
+	// Bad memo GET indexes
+	{"get not found", "g0\n."},
+	{"get invalid index", "gx\n."},
+	{"get negative index", "K\x01p0\ng-1\n."},
+	{"binget not found", "K\x01q\x00h\x01."},
+	{"long binget not found", "K\x01r\x00\x00\x00\x00j\xff\xff\xff\xff."},
+	{"truncated binget", "K\x01q\x00h"},
+	{"truncated long binget", "K\x01q\x00j\x00\x00"},
+	{"put invalid index", "K\x01pabc\n."},
+
+	// Oversized BINSTRING lengths
+	{"binstring max length", "T\xff\xff\xff\xffabc."},
+	{"binstring negative int32 length", "T\x00\x00\x00\x80abc."},
+	{"binstring max int32 length", "T\xff\xff\xff\x7fabc."},
+	{"binunicode oversized", "X\x10\x00\x00\x00abc."},
+	{"binbytes oversized", "B\x04\x00\x00\x00abc"},
+	{"short binstring oversized", "U\xffabc."},
+	{"short binbytes oversized", "C\x04abc"},
+	{"short binunicode oversized", "\x8c\x10abc."},
+
+	// Unsupported opcodes
+	{"global", "cposix\nsystem\np0\n."},
+	{"reduce", "N(tR."},
+}
+
+func TestUnpickleErrors(t *testing.T) {
+	for _, test := range unpickleErrorTests {
+		value, err, panicked := tryUnpickle(test.data)
+		switch {
+		case panicked:
+			t.Errorf("%s: %s", test.name, err)
+		case err == nil:
+			t.Errorf("%s: expected error, got %#v", test.name, value)
+		}
+	}
+}
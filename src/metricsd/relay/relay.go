@@ -0,0 +1,173 @@
+// Package relay implements forwarding of events to upstream MetricsD
+// instances, e.g. from edge hosts to a central one for cluster-wide views.
+//
+// Events are sent over TCP in the protocol format (one event per line) with
+// timestamps, so upstream places them into the slices they belong to. Each
+// upstream receives all events. When upstream is not available, events are
+// buffered in memory, and then written to a spool file on disk, which is sent
+// when the connection is restored. Note that upstream drops events for slices
+// which are already closed, so its SliceGrace limits how old events could be.
+package relay
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"time"
+	"metricsd/logger"
+	"metricsd/parser"
+	"metricsd/types"
+)
+
+// Mode defines how events are forwarded.
+type Mode byte
+
+const (
+	Aggregate Mode = iota // sample sets are pre-aggregated, and forwarded when their intervals are closed
+	Raw                   // events are forwarded as they are received
+)
+
+// Options of the relay.
+type Options struct {
+	Mode       Mode
+	Upstreams  []string      // addresses of TCP listeners of upstream instances
+	Interval   int           // aggregation interval in seconds
+	Grace      int           // number of seconds to wait for late events before interval is closed
+	BufferSize int           // max number of events buffered in memory for each upstream
+	SpoolDir   string        // directory to store spool files in
+	SpoolSize  int64         // max size of the spool file of each upstream in bytes
+	Logger     logger.Logger // logger instance
+}
+
+// Relay forwards events to upstream instances.
+type Relay struct {
+	mode      Mode
+	interval  int64
+	grace     int64
+	upstreams []*upstream
+	mutex     sync.Mutex
+	sets      map[string]*types.SampleSet // aggregated sample sets by interval and series
+	// Function returning current time in seconds (could be replaced in tests).
+	now func() int64
+}
+
+// New creates a relay, and starts sending events to upstreams.
+func New(options Options) *Relay {
+	relay := &Relay{
+		mode:     options.Mode,
+		interval: int64(options.Interval),
+		grace:    int64(options.Grace),
+		sets:     make(map[string]*types.SampleSet),
+		now:      time.Seconds,
+	}
+	os.MkdirAll(options.SpoolDir, 0755)
+	for _, address := range options.Upstreams {
+		upstream := newUpstream(address, options.BufferSize, options.SpoolDir, options.SpoolSize, options.Logger)
+		relay.upstreams = append(relay.upstreams, upstream)
+		go upstream.run()
+	}
+	return relay
+}
+
+// Add forwards the event (or adds it to the aggregated sample set). Events
+// without timestamp are stamped with the current time.
+func (relay *Relay) Add(event *types.Event) {
+	t := event.Time
+	if t == 0 {
+		t = relay.now()
+	}
+
+	if relay.mode == Raw {
+		stamped := *event
+		stamped.Time = t
+		relay.enqueue([]string{parser.Format(&stamped)})
+		return
+	}
+
+	t -= t % relay.interval
+	key := strconv.Itoa64(t) + " " + event.Source + "@" + event.Name + "," + event.Tags.String() + "|" + event.Type.String()
+
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+
+	set, found := relay.sets[key]
+	if !found {
+		set = types.NewTypedSampleSet(t, event.Source, event.Name, event.Type)
+		set.Tags = event.Tags
+		relay.sets[key] = set
+	}
+	set.Add(event.Value)
+}
+
+// Flush forwards aggregated sample sets of closed intervals (all of them when
+// force is true). Should be called periodically, e.g. on each write.
+func (relay *Relay) Flush(force bool) {
+	closed := relay.now() - relay.grace
+
+	relay.mutex.Lock()
+	sets := make([]*types.SampleSet, 0, len(relay.sets))
+	for key, set := range relay.sets {
+		if force || set.Time+relay.interval <= closed {
+			sets = append(sets, set)
+			relay.sets[key] = nil, false
+		}
+	}
+	relay.mutex.Unlock()
+
+	if len(sets) == 0 {
+		return
+	}
+	types.SortSampleSets(sets)
+	lines := make([]string, 0, len(sets))
+	for _, set := range sets {
+		lines = append(lines, aggregate(set)...)
+	}
+	relay.enqueue(lines)
+}
+
+// Close forwards all aggregated sample sets, stops sending events, and writes
+// events which have not been sent to spool files.
+func (relay *Relay) Close() {
+	relay.Flush(true)
+	for _, upstream := range relay.upstreams {
+		upstream.stop()
+	}
+}
+
+func (relay *Relay) enqueue(lines []string) {
+	for _, upstream := range relay.upstreams {
+		upstream.enqueue(lines)
+	}
+}
+
+// aggregate returns events representing the sample set: counters are summed,
+// the last value of a gauge is used, set members are deduplicated, and all
+// values of timers and untyped metrics are kept (they are needed to calculate
+// quartiles and percentiles upstream).
+func aggregate(set *types.SampleSet) []string {
+	event := &types.Event{Source: set.Source, Name: set.Name, Type: set.Type, Tags: set.Tags, Time: set.Time}
+	switch set.Type {
+	case types.Counter:
+		for _, value := range set.Values {
+			event.Value += value
+		}
+		return []string{parser.Format(event)}
+	case types.Gauge:
+		event.Value = set.Values[len(set.Values)-1]
+		return []string{parser.Format(event)}
+	}
+
+	lines := make([]string, 0, len(set.Values))
+	seen := make(map[float64]bool)
+	for _, value := range set.Values {
+		if set.Type == types.Set {
+			if seen[value] {
+				continue
+			}
+			seen[value] = true
+		}
+		event.Value = value
+		lines = append(lines, parser.Format(event))
+	}
+	return lines
+}
@@ -0,0 +1,154 @@
+package relay
+
+import (
+	. "launchpad.net/gocheck"
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"metricsd/logger"
+	"metricsd/types"
+)
+
+// Hook up gocheck into the gotest runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type RelayS struct {
+	dir      string
+	listener net.Listener
+}
+
+var _ = Suite(&RelayS{})
+
+func (s *RelayS) SetUpTest(c *C) {
+	var err os.Error
+	s.dir, err = ioutil.TempDir("", "metricsd-relay")
+	c.Assert(err, IsNil)
+	s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+}
+
+func (s *RelayS) TearDownTest(c *C) {
+	s.listener.Close()
+	os.RemoveAll(s.dir)
+}
+
+func (s *RelayS) upstream(bufferSize int, spoolSize int64) *upstream {
+	return newUpstream(s.listener.Addr().String(), bufferSize, s.dir, spoolSize, logger.NewConsoleLogger(logger.UNKNOWN))
+}
+
+// receive accepts the upstream connection and reads count lines from it.
+func (s *RelayS) receive(c *C, count int) (lines []string) {
+	conn, err := s.listener.Accept()
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	for i := 0; i < count; i++ {
+		line, err := reader.ReadString('\n')
+		c.Assert(err, IsNil)
+		lines = append(lines, strings.TrimRight(line, "\n"))
+	}
+	return
+}
+
+func (s *RelayS) TestAggregateCounter(c *C) {
+	set := types.NewTypedSampleSet(1318000000, "app01", "requests", types.Counter)
+	set.Add(1)
+	set.Add(2.5)
+	c.Check(aggregate(set), DeepEquals, []string{"app01@requests:3.5|c|T1318000000"})
+}
+
+func (s *RelayS) TestAggregateGauge(c *C) {
+	set := types.NewTypedSampleSet(1318000000, "app01", "memory", types.Gauge)
+	set.Add(10)
+	set.Add(5)
+	c.Check(aggregate(set), DeepEquals, []string{"app01@memory:5|g|T1318000000"})
+}
+
+func (s *RelayS) TestAggregateSetDeduplicatesMembers(c *C) {
+	set := types.NewTypedSampleSet(1318000000, "app01", "users", types.Set)
+	set.Add(1)
+	set.Add(2)
+	set.Add(1)
+	c.Check(aggregate(set), DeepEquals, []string{"app01@users:#1|s|T1318000000", "app01@users:#2|s|T1318000000"})
+}
+
+func (s *RelayS) TestAggregateTimerKeepsAllValues(c *C) {
+	set := types.NewTypedSampleSet(1318000000, "app01", "time", types.Timer)
+	set.Tags = types.NewTags(types.Tag{Key: "dc", Value: "ams"})
+	set.Add(10)
+	set.Add(10)
+	c.Check(aggregate(set), DeepEquals, []string{"app01@time,dc=ams:10|ms|T1318000000", "app01@time,dc=ams:10|ms|T1318000000"})
+}
+
+func (s *RelayS) TestFlushForwardsClosedIntervals(c *C) {
+	target := s.upstream(100, 1024)
+	relay := &Relay{mode: Aggregate, interval: 10, grace: 5, upstreams: []*upstream{target}, sets: make(map[string]*types.SampleSet)}
+	relay.now = func() int64 { return 1318000012 }
+
+	relay.Add(types.NewTypedEvent("app01", "requests", 1, types.Counter))
+	relay.Add(&types.Event{Source: "app01", Name: "requests", Value: 2, Type: types.Counter, Time: 1318000005})
+	relay.Add(&types.Event{Source: "app01", Name: "requests", Value: 3, Type: types.Counter, Time: 1317999995})
+
+	relay.now = func() int64 { return 1318000016 }
+	relay.Flush(false)
+	c.Check(target.buffer, DeepEquals, []string{"app01@requests:3|c|T1317999990", "app01@requests:2|c|T1318000000"})
+
+	relay.Flush(true)
+	c.Check(target.buffer[2:], DeepEquals, []string{"app01@requests:1|c|T1318000010"})
+}
+
+func (s *RelayS) TestRawModeForwardsEventsWithTimestamp(c *C) {
+	target := s.upstream(100, 1024)
+	relay := &Relay{mode: Raw, interval: 10, upstreams: []*upstream{target}, sets: make(map[string]*types.SampleSet)}
+	relay.now = func() int64 { return 1318000012 }
+
+	relay.Add(types.NewEvent("app01", "metric", 1))
+	relay.Add(types.NewTypedEvent("app01", "metric", 2, types.Timer))
+	c.Check(target.buffer, DeepEquals, []string{"app01@metric:1|T1318000012", "app01@metric:2|ms|T1318000012"})
+}
+
+func (s *RelayS) TestSendSpoolsOverflowAndSendsItFirst(c *C) {
+	target := s.upstream(4, 1024)
+	target.enqueue([]string{"m:1", "m:2", "m:3"})
+	target.enqueue([]string{"m:4", "m:5"})
+	c.Check(target.buffer, DeepEquals, []string{"m:4", "m:5"})
+
+	spooled, err := ioutil.ReadFile(target.spoolPath)
+	c.Assert(err, IsNil)
+	c.Check(string(spooled), Equals, "m:1\nm:2\nm:3\n")
+
+	target.send()
+	defer target.sender.Close()
+	c.Check(s.receive(c, 5), DeepEquals, []string{"m:1", "m:2", "m:3", "m:4", "m:5"})
+	c.Check(len(target.buffer), Equals, 0)
+	_, err = os.Stat(target.spoolPath)
+	c.Check(err, NotNil)
+}
+
+func (s *RelayS) TestSpoolDropsEventsWhenFull(c *C) {
+	target := s.upstream(2, 8)
+	target.enqueue([]string{"m:1", "m:2", "m:3"})
+	target.enqueue([]string{"m:4", "m:5", "m:6"})
+	c.Check(target.dropped, Equals, int64(3))
+
+	spooled, err := ioutil.ReadFile(target.spoolPath)
+	c.Assert(err, IsNil)
+	c.Check(string(spooled), Equals, "m:1\nm:2\n")
+}
+
+func (s *RelayS) TestFailedConnectionIsRetriedLater(c *C) {
+	target := s.upstream(100, 1024)
+	s.listener.Close()
+	target.enqueue([]string{"m:1"})
+	target.send()
+	c.Check(target.sender.Connected(), Equals, false)
+	c.Check(target.buffer, DeepEquals, []string{"m:1"})
+
+	target.send()
+	c.Check(target.sender.Connected(), Equals, false)
+	c.Check(target.buffer, DeepEquals, []string{"m:1"})
+}
@@ -0,0 +1,189 @@
+package relay
+
+import (
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+	"metricsd/logger"
+	"metricsd/sender"
+)
+
+// upstream sends events to an upstream instance. Events are buffered in
+// memory, and written to the spool file when the buffer is full (or when
+// relay is stopped). Spooled events are sent first when connection is
+// established.
+type upstream struct {
+	address    string
+	bufferSize int
+	spoolPath  string
+	spoolSize  int64
+	log        logger.Logger
+	mutex      sync.Mutex
+	buffer     []string // events waiting to be sent
+	dropped    int64    // number of events dropped because spool file is full
+	wake       chan bool
+	quit       chan bool
+	done       chan bool
+	sender     *sender.Sender // used by the sending Go routine only
+}
+
+func newUpstream(address string, bufferSize int, spoolDir string, spoolSize int64, log logger.Logger) *upstream {
+	name := strings.Map(func(rune int) int {
+		if rune == ':' || rune == '/' {
+			return '_'
+		}
+		return rune
+	}, address)
+	return &upstream{
+		address:    address,
+		bufferSize: bufferSize,
+		spoolPath:  path.Join(spoolDir, name+".spool"),
+		spoolSize:  spoolSize,
+		log:        log,
+		wake:       make(chan bool, 1),
+		quit:       make(chan bool),
+		done:       make(chan bool),
+		sender:     sender.New("upstream "+address, address, log),
+	}
+}
+
+// enqueue adds events to the buffer. When the buffer is full, older half of
+// it is written to the spool file.
+func (upstream *upstream) enqueue(lines []string) {
+	upstream.mutex.Lock()
+	upstream.buffer = append(upstream.buffer, lines...)
+	if len(upstream.buffer) > upstream.bufferSize {
+		upstream.spoolBuffer(len(upstream.buffer) - upstream.bufferSize/2)
+	}
+	upstream.mutex.Unlock()
+
+	select {
+	case upstream.wake <- true:
+	default:
+	}
+}
+
+// run sends events until the upstream is stopped.
+func (upstream *upstream) run() {
+	ticker := time.NewTicker(1e9)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-upstream.quit:
+			// Do not wait for connection on shutdown
+			if upstream.sender.Connected() {
+				upstream.send()
+			}
+			upstream.mutex.Lock()
+			upstream.spoolBuffer(len(upstream.buffer))
+			upstream.mutex.Unlock()
+			upstream.sender.Close()
+			upstream.done <- true
+			return
+		case <-upstream.wake:
+		case <-ticker.C:
+		}
+		upstream.send()
+	}
+}
+
+// stop stops sending events, and waits until buffered events are spooled.
+func (upstream *upstream) stop() {
+	upstream.quit <- true
+	<-upstream.done
+}
+
+// send sends spooled and buffered events (connecting to upstream if needed).
+func (upstream *upstream) send() {
+	if !upstream.sender.Connect() || !upstream.sendSpool() {
+		return
+	}
+
+	upstream.mutex.Lock()
+	lines := upstream.buffer
+	upstream.buffer = nil
+	upstream.mutex.Unlock()
+	if len(lines) == 0 {
+		return
+	}
+
+	if err := upstream.sender.Send(lines); err != nil {
+		// Events could be sent partially, so they are sent again (upstream
+		// could receive some of them twice)
+		upstream.mutex.Lock()
+		upstream.buffer = append(lines, upstream.buffer...)
+		if len(upstream.buffer) > upstream.bufferSize {
+			upstream.spoolBuffer(len(upstream.buffer) - upstream.bufferSize/2)
+		}
+		upstream.mutex.Unlock()
+	}
+}
+
+// sendSpool sends events from the spool file. The file is renamed before
+// sending, so new events could be spooled meanwhile (renamed file is sent
+// first next time if sending fails). Returns a value indicating whether all
+// spooled events have been sent.
+func (upstream *upstream) sendSpool() bool {
+	sending := upstream.spoolPath + ".sending"
+	if _, err := os.Stat(sending); err != nil {
+		upstream.mutex.Lock()
+		err = os.Rename(upstream.spoolPath, sending)
+		upstream.mutex.Unlock()
+		if err != nil {
+			// Nothing has been spooled
+			return true
+		}
+	}
+
+	file, err := os.Open(sending)
+	if err != nil {
+		upstream.log.Error("Cannot read spool file for upstream %s: %s", upstream.address, err)
+		return false
+	}
+	err = upstream.sender.Copy(file)
+	file.Close()
+	if err != nil {
+		return false
+	}
+	upstream.log.Info("Sent spooled events to upstream %s", upstream.address)
+	if err = os.Remove(sending); err != nil {
+		upstream.log.Error("Cannot remove sent spool file for upstream %s: %s", upstream.address, err)
+		return false
+	}
+	return true
+}
+
+// spoolBuffer writes count oldest events from the buffer to the spool file.
+// Events are dropped when spool file is too large. Should be called with
+// mutex locked.
+func (upstream *upstream) spoolBuffer(count int) {
+	if count <= 0 {
+		return
+	}
+	lines := upstream.buffer[:count]
+	upstream.buffer = append([]string(nil), upstream.buffer[count:]...)
+
+	data := strings.Join(lines, "\n") + "\n"
+	var size int64
+	if fi, err := os.Stat(upstream.spoolPath); err == nil {
+		size = fi.Size
+	}
+	if size+int64(len(data)) > upstream.spoolSize {
+		upstream.dropped += int64(len(lines))
+		upstream.log.Warn("Dropped %d events for upstream %s: spool file is full (%d events dropped in total)", len(lines), upstream.address, upstream.dropped)
+		return
+	}
+
+	file, err := os.OpenFile(upstream.spoolPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err == nil {
+		_, err = file.WriteString(data)
+		file.Close()
+	}
+	if err != nil {
+		upstream.dropped += int64(len(lines))
+		upstream.log.Error("Dropped %d events for upstream %s: cannot write spool file: %s", len(lines), upstream.address, err)
+	}
+}
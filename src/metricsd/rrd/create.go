@@ -0,0 +1,197 @@
+package rrd
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Supported data source types.
+var dsTypes = map[string]bool{
+	"GAUGE":    true,
+	"COUNTER":  true,
+	"DERIVE":   true,
+	"ABSOLUTE": true,
+}
+
+// Supported consolidation functions.
+var consolidationFunctions = map[string]bool{
+	"AVERAGE": true,
+	"MIN":     true,
+	"MAX":     true,
+	"LAST":    true,
+}
+
+// Create creates a new RRD file with the given step (in seconds) and start
+// time (the time of the first allowed update minus one second). Data sources
+// and archives are defined in the RRDTool syntax:
+//     DS:name:GAUGE|COUNTER|DERIVE|ABSOLUTE:heartbeat:min|U:max|U
+//     RRA:AVERAGE|MIN|MAX|LAST:xff:steps:rows
+func Create(filename string, step, start int64, args []string) os.Error {
+	if step < 1 {
+		return os.NewError(fmt.Sprintf("step %d is invalid", step))
+	}
+
+	h := &header{version: version, step: step, lastUpdate: start}
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "DS:"):
+			ds, err := parseDataSource(arg)
+			if err != nil {
+				return err
+			}
+			if h.dataSourceIndex(ds.Name) >= 0 {
+				return os.NewError(fmt.Sprintf("duplicate DS name: %s", ds.Name))
+			}
+			h.dataSources = append(h.dataSources, ds)
+		case strings.HasPrefix(arg, "RRA:"):
+			archive, err := parseArchive(arg)
+			if err != nil {
+				return err
+			}
+			h.archives = append(h.archives, archive)
+		default:
+			return os.NewError(fmt.Sprintf("can't parse argument '%s'", arg))
+		}
+	}
+	if len(h.dataSources) == 0 {
+		return os.NewError("you must define at least one Data Source")
+	}
+	if len(h.archives) == 0 {
+		return os.NewError("you must define at least one Round Robin Archive")
+	}
+
+	h.dsParams = make([][10]unival, len(h.dataSources))
+	h.rraParams = make([][10]unival, len(h.archives))
+
+	// Primary data points are unknown until the first update
+	h.pdpPreps = make([]*pdpPrep, len(h.dataSources))
+	for i := range h.pdpPreps {
+		pdp := &pdpPrep{lastDs: unknownString}
+		pdp.scratch[pdpUnknownSeconds].setCount(start % step)
+		pdp.scratch[pdpValue].setValue(0)
+		h.pdpPreps[i] = pdp
+	}
+
+	// Consolidated data points are aligned to the multiple of their steps
+	h.cdpPreps = make([]*cdpPrep, 0, len(h.archives)*len(h.dataSources))
+	for _, archive := range h.archives {
+		for _ = range h.dataSources {
+			cdp := &cdpPrep{}
+			cdp.scratch[cdpValue].setValue(math.NaN())
+			cdp.scratch[cdpUnknownPdps].setCount(((start - start%step) % (step * archive.Steps)) / step)
+			cdp.scratch[cdpPrimaryValue].setValue(math.NaN())
+			cdp.scratch[cdpSecondaryValue].setValue(math.NaN())
+			h.cdpPreps = append(h.cdpPreps, cdp)
+		}
+	}
+
+	h.rraPtrs = make([]int64, len(h.archives))
+	for i, archive := range h.archives {
+		h.rraPtrs[i] = archive.Rows - 1
+	}
+
+	lock := lockFile(filename)
+	lock.Lock()
+	defer lock.Unlock()
+
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err = file.Write(h.marshal()); err != nil {
+		return err
+	}
+
+	// All rows are unknown
+	row := make([]float64, len(h.dataSources))
+	for i := range row {
+		row[i] = math.NaN()
+	}
+	rowBuf := make([]byte, len(row)*valueSize)
+	putValues(rowBuf, row)
+	for _, archive := range h.archives {
+		rows := make([]byte, 0, archive.Rows*int64(len(rowBuf)))
+		for i := int64(0); i < archive.Rows; i++ {
+			rows = append(rows, rowBuf...)
+		}
+		if _, err = file.Write(rows); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseDataSource parses data source definition
+// (DS:name:type:heartbeat:min:max).
+func parseDataSource(arg string) (*DataSource, os.Error) {
+	parts := strings.Split(arg, ":")
+	if len(parts) != 6 {
+		return nil, os.NewError(fmt.Sprintf("invalid DS format: %s", arg))
+	}
+	ds := &DataSource{Name: parts[1], Type: parts[2]}
+	if len(ds.Name) == 0 || len(ds.Name) >= dsNameSize || !validDataSourceName(ds.Name) {
+		return nil, os.NewError(fmt.Sprintf("invalid DS name: %s", ds.Name))
+	}
+	if !dsTypes[ds.Type] {
+		return nil, os.NewError(fmt.Sprintf("unsupported DS type: %s", ds.Type))
+	}
+	var err os.Error
+	if ds.Heartbeat, err = strconv.Atoi64(parts[3]); err != nil || ds.Heartbeat < 1 {
+		return nil, os.NewError(fmt.Sprintf("invalid DS heartbeat: %s", parts[3]))
+	}
+	if ds.Min, err = parseLimit(parts[4]); err != nil {
+		return nil, os.NewError(fmt.Sprintf("invalid DS min: %s", parts[4]))
+	}
+	if ds.Max, err = parseLimit(parts[5]); err != nil {
+		return nil, os.NewError(fmt.Sprintf("invalid DS max: %s", parts[5]))
+	}
+	if ds.Min >= ds.Max {
+		return nil, os.NewError(fmt.Sprintf("min must be less than max in DS definition: %s", arg))
+	}
+	return ds, nil
+}
+
+// parseArchive parses archive definition (RRA:cf:xff:steps:rows).
+func parseArchive(arg string) (*Archive, os.Error) {
+	parts := strings.Split(arg, ":")
+	if len(parts) != 5 {
+		return nil, os.NewError(fmt.Sprintf("invalid RRA format: %s", arg))
+	}
+	archive := &Archive{CF: parts[1]}
+	if !consolidationFunctions[archive.CF] {
+		return nil, os.NewError(fmt.Sprintf("unsupported consolidation function: %s", archive.CF))
+	}
+	var err os.Error
+	if archive.Xff, err = strconv.Atof64(parts[2]); err != nil || archive.Xff < 0 || archive.Xff >= 1 {
+		return nil, os.NewError(fmt.Sprintf("invalid xff: must be between 0 and 1: %s", parts[2]))
+	}
+	if archive.Steps, err = strconv.Atoi64(parts[3]); err != nil || archive.Steps < 1 {
+		return nil, os.NewError(fmt.Sprintf("invalid step count: %s", parts[3]))
+	}
+	if archive.Rows, err = strconv.Atoi64(parts[4]); err != nil || archive.Rows < 1 {
+		return nil, os.NewError(fmt.Sprintf("invalid row count: %s", parts[4]))
+	}
+	return archive, nil
+}
+
+// parseLimit parses data source limit, "U" means no limit.
+func parseLimit(value string) (float64, os.Error) {
+	if value == unknownString {
+		return math.NaN(), nil
+	}
+	return strconv.Atof64(value)
+}
+
+func validDataSourceName(name string) bool {
+	for _, rune := range name {
+		if !(('0' <= rune && rune <= '9') || ('a' <= rune && rune <= 'z') || ('A' <= rune && rune <= 'Z') || rune == '_') {
+			return false
+		}
+	}
+	return true
+}
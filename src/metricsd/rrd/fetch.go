@@ -0,0 +1,170 @@
+package rrd
+
+import (
+	"fmt"
+	"math"
+	"os"
+)
+
+// Max number of rows Fetch returns (enough to fetch the largest archives
+// created by writers as a whole).
+const MaxFetchRows = 100000
+
+// Info describes the structure of an RRD file.
+type Info struct {
+	Step        int64 // primary data point interval in seconds
+	LastUpdate  int64 // time of the last update
+	DataSources []*DataSource
+	Archives    []*Archive
+}
+
+// FetchResult contains values fetched from an RRD file.
+type FetchResult struct {
+	Start, End  int64    // time range (aligned to step)
+	Step        int64    // interval between rows in seconds
+	DataSources []string // data source names
+	// Rows of values for each data source. Row i contains values for the
+	// interval ending at Start + (i+1)*Step, unknown values are NaN.
+	Values [][]float64
+}
+
+// GetInfo returns the structure of the given RRD file.
+func GetInfo(filename string) (*Info, os.Error) {
+	lock := lockFile(filename)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	h, err := readHeader(file)
+	if err != nil {
+		return nil, err
+	}
+	return &Info{Step: h.step, LastUpdate: h.lastUpdate, DataSources: h.dataSources, Archives: h.archives}, nil
+}
+
+// Fetch fetches consolidated values for the given time range from the
+// archive with the given consolidation function. Archive is selected the
+// same way RRDTool does it: the one covering the whole time range with the
+// step closest to requested one, or the one covering the most of the range
+// if there are no archives covering it completely. Time ranges of more than
+// MaxFetchRows rows of the selected archive are rejected.
+func Fetch(filename, cf string, start, end, step int64) (*FetchResult, os.Error) {
+	if start >= end {
+		return nil, os.NewError(fmt.Sprintf("start (%d) should be less than end (%d)", start, end))
+	}
+
+	lock := lockFile(filename)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	h, err := readHeader(file)
+	if err != nil {
+		return nil, err
+	}
+
+	rra := h.chooseArchive(cf, start, end, step)
+	if rra < 0 {
+		return nil, os.NewError(fmt.Sprintf("the RRD does not contain an RRA matching the chosen CF %s", cf))
+	}
+	archive := h.archives[rra]
+
+	// Align time range to the archive step
+	step = h.step * archive.Steps
+	start -= start % step
+	if end%step != 0 {
+		end += step - end%step
+	}
+	rows := (end - start) / step
+	if rows > MaxFetchRows {
+		return nil, os.NewError(fmt.Sprintf("time range from %d to %d contains %d rows of %d seconds, at most %d rows could be fetched", start, end, rows, step, MaxFetchRows))
+	}
+
+	result := &FetchResult{Start: start, End: end, Step: step}
+	result.DataSources = make([]string, len(h.dataSources))
+	for i, ds := range h.dataSources {
+		result.DataSources[i] = ds.Name
+	}
+
+	// Read the whole archive
+	dsCount := int64(len(h.dataSources))
+	data := make([]byte, archive.Rows*dsCount*valueSize)
+	if _, err = file.ReadAt(data, h.archiveOffset(rra)); err != nil {
+		return nil, err
+	}
+
+	// The current row contains the CDP ending at rraEnd
+	rraEnd := h.lastUpdate - h.lastUpdate%step
+	rraStart := rraEnd - step*(archive.Rows-1)
+	ptr := h.rraPtrs[rra]
+
+	result.Values = make([][]float64, rows)
+	for i := int64(0); i < rows; i++ {
+		row := make([]float64, dsCount)
+		t := start + (i+1)*step
+		if t < rraStart || t > rraEnd {
+			for j := range row {
+				row[j] = math.NaN()
+			}
+		} else {
+			index := (ptr - (rraEnd-t)/step + archive.Rows) % archive.Rows
+			offset := index * dsCount * valueSize
+			for j := range row {
+				row[j] = math.Float64frombits(byteOrder.Uint64(data[offset+int64(j)*valueSize:]))
+			}
+		}
+		result.Values[i] = row
+	}
+	return result, nil
+}
+
+// chooseArchive returns index of the archive to fetch the given time range
+// from, or -1 if there are no archives with the given consolidation function.
+func (h *header) chooseArchive(cf string, start, end, step int64) int {
+	bestFull, bestPart := -1, -1
+	var bestFullStepDiff, bestPartStepDiff, bestMatch int64
+	for i, archive := range h.archives {
+		if archive.CF != cf {
+			continue
+		}
+		archiveStep := h.step * archive.Steps
+		calEnd := h.lastUpdate - h.lastUpdate%archiveStep
+		calStart := calEnd - archiveStep*archive.Rows
+		stepDiff := abs(step - archiveStep)
+
+		if calStart <= start {
+			if bestFull < 0 || stepDiff < bestFullStepDiff {
+				bestFull, bestFullStepDiff = i, stepDiff
+			}
+		} else {
+			match := end - start
+			if calStart > start {
+				match -= calStart - start
+			}
+			if bestPart < 0 || bestMatch < match || (bestMatch == match && stepDiff < bestPartStepDiff) {
+				bestPart, bestMatch, bestPartStepDiff = i, match, stepDiff
+			}
+		}
+	}
+	if bestFull >= 0 {
+		return bestFull
+	}
+	return bestPart
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,379 @@
+// The rrd package implements round-robin database files compatible with
+// RRDTool (file format versions 0001-0003 as written on 64-bit little-endian
+// platforms), so files created by librrd could be updated and fetched, and
+// vice versa.
+//
+// Supported data source types are GAUGE, COUNTER, DERIVE, and ABSOLUTE,
+// supported consolidation functions are AVERAGE, MIN, MAX, and LAST.
+// Data points are consolidated the same way RRDTool does it (see
+// rrdtool-create(1) and rrdtool-update(1) for details).
+package rrd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"hash/crc32"
+	"sync"
+)
+
+// Sizes of the file format structures.
+const (
+	statHeadSize = 128
+	dsDefSize    = 120
+	rraDefSize   = 120
+	pdpPrepSize  = 112
+	cdpPrepSize  = 80
+	rraPtrSize   = 8
+	valueSize    = 8
+)
+
+// Sizes of the string fields.
+const (
+	dsNameSize = 20
+	dstSize    = 20
+	cfNameSize = 20
+	lastDsSize = 30
+)
+
+// Limits of the number of data sources and archives (files with more of
+// them are considered corrupt).
+const (
+	maxDataSources = 1024
+	maxArchives    = 1024
+)
+
+// Indexes of the parameters (unival par[] and scratch[] arrays).
+const (
+	dsHeartbeat = 0 // ds_def.par[DS_mrhb_cnt]
+	dsMin       = 1 // ds_def.par[DS_min_val]
+	dsMax       = 2 // ds_def.par[DS_max_val]
+
+	rraXff = 0 // rra_def.par[RRA_cdp_xff_val]
+
+	pdpUnknownSeconds = 0 // pdp_prep.scratch[PDP_unkn_sec_cnt]
+	pdpValue          = 1 // pdp_prep.scratch[PDP_val]
+
+	cdpValue          = 0 // cdp_prep.scratch[CDP_val]
+	cdpUnknownPdps    = 1 // cdp_prep.scratch[CDP_unkn_pdp_cnt]
+	cdpPrimaryValue   = 8 // cdp_prep.scratch[CDP_primary_val]
+	cdpSecondaryValue = 9 // cdp_prep.scratch[CDP_secondary_val]
+)
+
+const (
+	cookie        = "RRD"
+	version       = "0003"
+	floatCookie   = 8.642135e130
+	unknownString = "U"
+)
+
+var (
+	// Byte order of the files (files are not portable between platforms)
+	byteOrder = binary.LittleEndian
+	// Locks for files (writers and readers could access the same file from
+	// different Go routines)
+	fileLocks [64]sync.RWMutex
+)
+
+// DataSource describes a data source (a column) of the database.
+type DataSource struct {
+	Name      string
+	Type      string  // GAUGE, COUNTER, DERIVE, or ABSOLUTE
+	Heartbeat int64   // max number of seconds between updates before the value is unknown
+	Min, Max  float64 // allowed range of values (NaN if not limited)
+}
+
+// Archive describes a round-robin archive (RRA) of the database.
+type Archive struct {
+	CF    string  // consolidation function: AVERAGE, MIN, MAX, or LAST
+	Xff   float64 // part of unknown primary data points allowed in a consolidated one
+	Steps int64   // number of primary data points in a consolidated data point
+	Rows  int64   // number of consolidated data points stored
+}
+
+// unival is a parameter value, which could be either an integer, or a
+// floating point number (interpretation depends on the parameter).
+type unival [8]byte
+
+func (v *unival) count() int64       { return int64(byteOrder.Uint64(v[:])) }
+func (v *unival) setCount(n int64)   { byteOrder.PutUint64(v[:], uint64(n)) }
+func (v *unival) value() float64     { return math.Float64frombits(byteOrder.Uint64(v[:])) }
+func (v *unival) setValue(f float64) { byteOrder.PutUint64(v[:], math.Float64bits(f)) }
+
+// pdpPrep stores the state of the primary data point being built.
+type pdpPrep struct {
+	lastDs  string
+	scratch [10]unival
+}
+
+// cdpPrep stores the state of the consolidated data point being built.
+type cdpPrep struct {
+	scratch [10]unival
+}
+
+// header is the in-memory representation of everything stored before data
+// rows in the file.
+type header struct {
+	version     string
+	step        int64
+	dataSources []*DataSource
+	dsParams    [][10]unival // original data source parameters (preserved on write)
+	archives    []*Archive
+	rraParams   [][10]unival // original archive parameters (preserved on write)
+	lastUpdate  int64
+	lastUsec    int64
+	pdpPreps    []*pdpPrep
+	cdpPreps    []*cdpPrep // rra_cnt * ds_cnt entries, grouped by archive
+	rraPtrs     []int64
+}
+
+// size returns size of the header in bytes.
+func (h *header) size() int64 {
+	dsCount, rraCount := int64(len(h.dataSources)), int64(len(h.archives))
+	return statHeadSize + dsCount*dsDefSize + rraCount*rraDefSize + h.liveHeadSize() +
+		dsCount*pdpPrepSize + rraCount*dsCount*cdpPrepSize + rraCount*rraPtrSize
+}
+
+// liveHeadSize returns size of the live head structure (it has no
+// microseconds field before version 0003).
+func (h *header) liveHeadSize() int64 {
+	if h.version < "0003" {
+		return 8
+	}
+	return 16
+}
+
+// archiveOffset returns offset of the first row of the given archive.
+func (h *header) archiveOffset(rra int) int64 {
+	offset := h.size()
+	for _, archive := range h.archives[:rra] {
+		offset += archive.Rows * int64(len(h.dataSources)) * valueSize
+	}
+	return offset
+}
+
+// dataSourceIndex returns index of the data source with the given name, or -1.
+func (h *header) dataSourceIndex(name string) int {
+	for i, ds := range h.dataSources {
+		if ds.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// marshal serializes the header.
+func (h *header) marshal() []byte {
+	buf := make([]byte, h.size())
+	dsCount, rraCount := len(h.dataSources), len(h.archives)
+
+	// stat_head
+	copy(buf[0:4], cookie)
+	copy(buf[4:9], h.version)
+	byteOrder.PutUint64(buf[16:24], math.Float64bits(floatCookie))
+	byteOrder.PutUint64(buf[24:32], uint64(dsCount))
+	byteOrder.PutUint64(buf[32:40], uint64(rraCount))
+	byteOrder.PutUint64(buf[40:48], uint64(h.step))
+	offset := statHeadSize
+
+	// ds_def
+	for i, ds := range h.dataSources {
+		copy(buf[offset:offset+dsNameSize], ds.Name)
+		copy(buf[offset+dsNameSize:offset+dsNameSize+dstSize], ds.Type)
+		params := h.dsParams[i]
+		params[dsHeartbeat].setCount(ds.Heartbeat)
+		params[dsMin].setValue(ds.Min)
+		params[dsMax].setValue(ds.Max)
+		putUnivals(buf[offset+dsNameSize+dstSize:], params[:])
+		offset += dsDefSize
+	}
+
+	// rra_def
+	for i, archive := range h.archives {
+		copy(buf[offset:offset+cfNameSize], archive.CF)
+		byteOrder.PutUint64(buf[offset+24:offset+32], uint64(archive.Rows))
+		byteOrder.PutUint64(buf[offset+32:offset+40], uint64(archive.Steps))
+		params := h.rraParams[i]
+		params[rraXff].setValue(archive.Xff)
+		putUnivals(buf[offset+40:], params[:])
+		offset += rraDefSize
+	}
+
+	// live_head
+	byteOrder.PutUint64(buf[offset:offset+8], uint64(h.lastUpdate))
+	if h.liveHeadSize() > 8 {
+		byteOrder.PutUint64(buf[offset+8:offset+16], uint64(h.lastUsec))
+	}
+	offset += int(h.liveHeadSize())
+
+	// pdp_prep
+	for _, pdp := range h.pdpPreps {
+		copy(buf[offset:offset+lastDsSize], pdp.lastDs)
+		putUnivals(buf[offset+32:], pdp.scratch[:])
+		offset += pdpPrepSize
+	}
+
+	// cdp_prep
+	for _, cdp := range h.cdpPreps {
+		putUnivals(buf[offset:], cdp.scratch[:])
+		offset += cdpPrepSize
+	}
+
+	// rra_ptr
+	for _, ptr := range h.rraPtrs {
+		byteOrder.PutUint64(buf[offset:offset+8], uint64(ptr))
+		offset += rraPtrSize
+	}
+	return buf
+}
+
+// readHeader reads and validates the header of the given file.
+func readHeader(file *os.File) (h *header, err os.Error) {
+	statHead := make([]byte, statHeadSize)
+	if _, err = file.ReadAt(statHead, 0); err != nil {
+		return nil, err
+	}
+	if cString(statHead[0:4]) != cookie {
+		return nil, os.NewError(fmt.Sprintf("%s is not an RRD file", file.Name()))
+	}
+	h = &header{version: cString(statHead[4:9])}
+	if h.version < "0001" || h.version > "0003" {
+		return nil, os.NewError(fmt.Sprintf("%s: RRD file version %s is not supported", file.Name(), h.version))
+	}
+	if math.Float64frombits(byteOrder.Uint64(statHead[16:24])) != floatCookie {
+		return nil, os.NewError(fmt.Sprintf("%s: RRD file was created on incompatible platform", file.Name()))
+	}
+	dsCount64, rraCount64 := byteOrder.Uint64(statHead[24:32]), byteOrder.Uint64(statHead[32:40])
+	if dsCount64 < 1 || dsCount64 > maxDataSources || rraCount64 < 1 || rraCount64 > maxArchives {
+		return nil, os.NewError(fmt.Sprintf("%s: RRD file is corrupt (%d data sources, %d archives)", file.Name(), dsCount64, rraCount64))
+	}
+	dsCount, rraCount := int(dsCount64), int(rraCount64)
+	h.step = int64(byteOrder.Uint64(statHead[40:48]))
+	if h.step < 1 {
+		return nil, os.NewError(fmt.Sprintf("%s: RRD file is corrupt (step is %d)", file.Name(), h.step))
+	}
+	h.dataSources = make([]*DataSource, dsCount)
+	h.archives = make([]*Archive, rraCount)
+
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if h.size() > fi.Size {
+		return nil, os.NewError(fmt.Sprintf("%s: RRD file is truncated", file.Name()))
+	}
+	buf := make([]byte, h.size()-statHeadSize)
+	if _, err = file.ReadAt(buf, statHeadSize); err != nil {
+		return nil, err
+	}
+	offset := 0
+
+	// ds_def
+	h.dsParams = make([][10]unival, dsCount)
+	for i := range h.dataSources {
+		getUnivals(buf[offset+dsNameSize+dstSize:], h.dsParams[i][:])
+		h.dataSources[i] = &DataSource{
+			Name:      cString(buf[offset : offset+dsNameSize]),
+			Type:      cString(buf[offset+dsNameSize : offset+dsNameSize+dstSize]),
+			Heartbeat: h.dsParams[i][dsHeartbeat].count(),
+			Min:       h.dsParams[i][dsMin].value(),
+			Max:       h.dsParams[i][dsMax].value(),
+		}
+		if _, found := dsTypes[h.dataSources[i].Type]; !found {
+			return nil, os.NewError(fmt.Sprintf("%s: data source type %s is not supported", file.Name(), h.dataSources[i].Type))
+		}
+		offset += dsDefSize
+	}
+
+	// rra_def
+	h.rraParams = make([][10]unival, rraCount)
+	for i := range h.archives {
+		getUnivals(buf[offset+40:], h.rraParams[i][:])
+		h.archives[i] = &Archive{
+			CF:    cString(buf[offset : offset+cfNameSize]),
+			Rows:  int64(byteOrder.Uint64(buf[offset+24 : offset+32])),
+			Steps: int64(byteOrder.Uint64(buf[offset+32 : offset+40])),
+			Xff:   h.rraParams[i][rraXff].value(),
+		}
+		if _, found := consolidationFunctions[h.archives[i].CF]; !found {
+			return nil, os.NewError(fmt.Sprintf("%s: consolidation function %s is not supported", file.Name(), h.archives[i].CF))
+		}
+		// Rows are limited by the file size before multiplying them
+		if h.archives[i].Rows < 1 || h.archives[i].Rows > fi.Size || h.archives[i].Steps < 1 {
+			return nil, os.NewError(fmt.Sprintf("%s: RRD file is corrupt (archive %d has %d rows of %d steps)", file.Name(), i, h.archives[i].Rows, h.archives[i].Steps))
+		}
+		offset += rraDefSize
+	}
+	if h.archiveOffset(rraCount) > fi.Size {
+		return nil, os.NewError(fmt.Sprintf("%s: RRD file is truncated", file.Name()))
+	}
+
+	// live_head
+	h.lastUpdate = int64(byteOrder.Uint64(buf[offset : offset+8]))
+	if h.liveHeadSize() > 8 {
+		h.lastUsec = int64(byteOrder.Uint64(buf[offset+8 : offset+16]))
+	}
+	offset += int(h.liveHeadSize())
+
+	// pdp_prep
+	h.pdpPreps = make([]*pdpPrep, dsCount)
+	for i := range h.pdpPreps {
+		h.pdpPreps[i] = &pdpPrep{lastDs: cString(buf[offset : offset+lastDsSize])}
+		getUnivals(buf[offset+32:], h.pdpPreps[i].scratch[:])
+		offset += pdpPrepSize
+	}
+
+	// cdp_prep
+	h.cdpPreps = make([]*cdpPrep, rraCount*dsCount)
+	for i := range h.cdpPreps {
+		h.cdpPreps[i] = &cdpPrep{}
+		getUnivals(buf[offset:], h.cdpPreps[i].scratch[:])
+		offset += cdpPrepSize
+	}
+
+	// rra_ptr
+	h.rraPtrs = make([]int64, rraCount)
+	for i := range h.rraPtrs {
+		h.rraPtrs[i] = int64(byteOrder.Uint64(buf[offset : offset+8]))
+		if h.rraPtrs[i] < 0 || h.rraPtrs[i] >= h.archives[i].Rows {
+			return nil, os.NewError(fmt.Sprintf("%s: RRD file is corrupt (archive %d pointer is %d)", file.Name(), i, h.rraPtrs[i]))
+		}
+		offset += rraPtrSize
+	}
+	return h, nil
+}
+
+// lockFile returns the lock used to synchronize access to the given file.
+func lockFile(path string) *sync.RWMutex {
+	return &fileLocks[crc32.ChecksumIEEE([]byte(path))%uint32(len(fileLocks))]
+}
+
+// cString returns a string stored in a zero-terminated byte array.
+func cString(buf []byte) string {
+	for i, b := range buf {
+		if b == 0 {
+			return string(buf[:i])
+		}
+	}
+	return string(buf)
+}
+
+func putUnivals(buf []byte, values []unival) {
+	for i, value := range values {
+		copy(buf[i*8:i*8+8], value[:])
+	}
+}
+
+func getUnivals(buf []byte, values []unival) {
+	for i := range values {
+		copy(values[i][:], buf[i*8:i*8+8])
+	}
+}
+
+// putValues serializes a row of values.
+func putValues(buf []byte, values []float64) {
+	for i, value := range values {
+		byteOrder.PutUint64(buf[i*valueSize:], math.Float64bits(value))
+	}
+}
@@ -0,0 +1,201 @@
+package rrd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	. "launchpad.net/gocheck"
+	"testing"
+)
+
+// Hook up gocheck into the gotest runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type RrdS struct {
+	dir  string
+	file string
+}
+
+var _ = Suite(&RrdS{})
+
+func (s *RrdS) SetUpTest(c *C) {
+	dir, err := ioutil.TempDir("", "metricsd-rrd")
+	c.Assert(err, IsNil)
+	s.dir = dir
+	s.file = dir + "/test.rrd"
+}
+
+func (s *RrdS) TearDownTest(c *C) {
+	os.RemoveAll(s.dir)
+}
+
+func (s *RrdS) TestCreateFileLayout(c *C) {
+	err := Create(s.file, 10, 1000, []string{"DS:value:GAUGE:600:0:U", "RRA:AVERAGE:0.5:1:5"})
+	c.Assert(err, IsNil)
+
+	buf, err := ioutil.ReadFile(s.file)
+	c.Assert(err, IsNil)
+	// stat_head + ds_def + rra_def + live_head + pdp_prep + cdp_prep + rra_ptr + rows
+	c.Assert(len(buf), Equals, 128+120+120+16+112+80+8+5*8)
+
+	le := binary.LittleEndian
+	c.Check(string(buf[0:4]), Equals, "RRD\x00")
+	c.Check(string(buf[4:9]), Equals, "0003\x00")
+	c.Check(math.Float64frombits(le.Uint64(buf[16:])), Equals, 8.642135e130)
+	c.Check(le.Uint64(buf[24:]), Equals, uint64(1))  // ds_cnt
+	c.Check(le.Uint64(buf[32:]), Equals, uint64(1))  // rra_cnt
+	c.Check(le.Uint64(buf[40:]), Equals, uint64(10)) // pdp_step
+	c.Check(cString(buf[128:148]), Equals, "value")
+	c.Check(cString(buf[148:168]), Equals, "GAUGE")
+	c.Check(le.Uint64(buf[168:]), Equals, uint64(600))                      // heartbeat
+	c.Check(math.Float64frombits(le.Uint64(buf[176:])), Equals, float64(0)) // min
+	c.Check(math.IsNaN(math.Float64frombits(le.Uint64(buf[184:]))), Equals, true)
+	c.Check(cString(buf[248:268]), Equals, "AVERAGE")
+	c.Check(le.Uint64(buf[272:]), Equals, uint64(5))                          // row_cnt
+	c.Check(le.Uint64(buf[280:]), Equals, uint64(1))                          // pdp_cnt
+	c.Check(math.Float64frombits(le.Uint64(buf[288:])), Equals, float64(0.5)) // xff
+	c.Check(le.Uint64(buf[368:]), Equals, uint64(1000))                       // last_up
+	c.Check(cString(buf[384:414]), Equals, "U")                               // last_ds
+	c.Check(le.Uint64(buf[576:]), Equals, uint64(4))                          // cur_row
+	c.Check(math.IsNaN(math.Float64frombits(le.Uint64(buf[584:]))), Equals, true)
+}
+
+func (s *RrdS) TestCreateWithInvalidArguments(c *C) {
+	c.Check(Create(s.file, 10, 1000, []string{"RRA:AVERAGE:0.5:1:5"}).String(), Equals, "you must define at least one Data Source")
+	c.Check(Create(s.file, 10, 1000, []string{"DS:value:GAUGE:600:0:U"}).String(), Equals, "you must define at least one Round Robin Archive")
+	c.Check(Create(s.file, 10, 1000, []string{"DS:value:GAUGE:600:0"}).String(), Equals, "invalid DS format: DS:value:GAUGE:600:0")
+	c.Check(Create(s.file, 10, 1000, []string{"DS:value:COMPUTE:600:0:U"}).String(), Equals, "unsupported DS type: COMPUTE")
+	c.Check(Create(s.file, 10, 1000, []string{"DS:value:GAUGE:600:0:U", "RRA:HWPREDICT:0.5:1:5"}).String(), Equals, "unsupported consolidation function: HWPREDICT")
+}
+
+func (s *RrdS) TestGetInfo(c *C) {
+	c.Assert(Create(s.file, 10, 1000, []string{"DS:ok:ABSOLUTE:600:0:U", "DS:fail:GAUGE:300:U:100", "RRA:MAX:0.5:6:10"}), IsNil)
+
+	info, err := GetInfo(s.file)
+	c.Assert(err, IsNil)
+	c.Check(info.Step, Equals, int64(10))
+	c.Check(info.LastUpdate, Equals, int64(1000))
+	c.Assert(len(info.DataSources), Equals, 2)
+	c.Check(info.DataSources[1].Name, Equals, "fail")
+	c.Check(info.DataSources[1].Type, Equals, "GAUGE")
+	c.Check(info.DataSources[1].Heartbeat, Equals, int64(300))
+	c.Check(math.IsNaN(info.DataSources[1].Min), Equals, true)
+	c.Check(info.DataSources[1].Max, Equals, float64(100))
+	c.Assert(len(info.Archives), Equals, 1)
+	c.Check(*info.Archives[0], Equals, Archive{CF: "MAX", Xff: 0.5, Steps: 6, Rows: 10})
+}
+
+func (s *RrdS) TestUpdateAndFetch(c *C) {
+	c.Assert(Create(s.file, 10, 1000, []string{"DS:value:GAUGE:600:U:U", "RRA:AVERAGE:0.5:1:10", "RRA:MAX:0.5:2:10"}), IsNil)
+	c.Assert(Update(s.file, "value", []string{"1010:1", "1020:2", "1030:3", "1040:4"}), IsNil)
+
+	result, err := Fetch(s.file, "AVERAGE", 1000, 1040, 10)
+	c.Assert(err, IsNil)
+	c.Check(result.Start, Equals, int64(1000))
+	c.Check(result.End, Equals, int64(1040))
+	c.Check(result.Step, Equals, int64(10))
+	c.Check(result.DataSources[0], Equals, "value")
+	c.Check(values(result, 0), Equals, "[1 2 3 4]")
+
+	result, err = Fetch(s.file, "MAX", 1000, 1040, 20)
+	c.Assert(err, IsNil)
+	c.Check(result.Step, Equals, int64(20))
+	c.Check(values(result, 0), Equals, "[2 4]")
+
+	// Time range is not covered by archive
+	result, err = Fetch(s.file, "AVERAGE", 1020, 1060, 10)
+	c.Assert(err, IsNil)
+	c.Check(values(result, 0), Equals, "[3 4 NaN NaN]")
+
+	// Time range is too long
+	_, err = Fetch(s.file, "AVERAGE", 1000, 1000+10*(MaxFetchRows+1), 10)
+	c.Check(err, NotNil)
+}
+
+func (s *RrdS) TestUpdateBetweenSteps(c *C) {
+	c.Assert(Create(s.file, 10, 1000, []string{"DS:value:GAUGE:600:U:U", "RRA:AVERAGE:0.5:1:10"}), IsNil)
+	c.Assert(Update(s.file, "", []string{"1005:10", "1015:20"}), IsNil)
+
+	result, err := Fetch(s.file, "AVERAGE", 1000, 1010, 10)
+	c.Assert(err, IsNil)
+	c.Check(values(result, 0), Equals, "[15]")
+}
+
+func (s *RrdS) TestUpdateAbsoluteAndUnknownValues(c *C) {
+	c.Assert(Create(s.file, 10, 1000, []string{"DS:ok:ABSOLUTE:600:0:U", "DS:fail:ABSOLUTE:600:0:U", "RRA:AVERAGE:0.5:1:10"}), IsNil)
+	// Template order differs from the file order, missing values are unknown
+	c.Assert(Update(s.file, "fail:ok", []string{"1010:5:50", "1020:U:100"}), IsNil)
+	c.Assert(Update(s.file, "ok", []string{"1030:-10"}), IsNil)
+
+	result, err := Fetch(s.file, "AVERAGE", 1000, 1030, 10)
+	c.Assert(err, IsNil)
+	c.Check(values(result, 0), Equals, "[5 10 NaN]")
+	c.Check(values(result, 1), Equals, "[0.5 NaN NaN]")
+}
+
+func (s *RrdS) TestUpdateHeartbeat(c *C) {
+	c.Assert(Create(s.file, 10, 1000, []string{"DS:value:GAUGE:15:U:U", "RRA:LAST:0.5:1:10"}), IsNil)
+	c.Assert(Update(s.file, "value", []string{"1010:1", "1030:3", "1040:4"}), IsNil)
+
+	result, err := Fetch(s.file, "LAST", 1000, 1040, 10)
+	c.Assert(err, IsNil)
+	c.Check(values(result, 0), Equals, "[1 NaN NaN 4]")
+}
+
+func (s *RrdS) TestUpdateErrors(c *C) {
+	c.Assert(Create(s.file, 10, 1000, []string{"DS:value:GAUGE:600:U:U", "RRA:AVERAGE:0.5:1:10"}), IsNil)
+
+	err := Update(s.file, "value:unknown", []string{"1010:1:2"})
+	c.Assert(err, NotNil)
+	dsErr, ok := err.(*UnknownDataSourceError)
+	c.Assert(ok, Equals, true)
+	c.Check(dsErr.Name, Equals, "unknown")
+
+	c.Check(Update(s.file, "value", []string{"1000:1"}).String(), Equals, "illegal attempt to update using time 1000 when last update time is 1000 (minimum one second step)")
+	c.Check(Update(s.file, "value", []string{"1010:1:2"}).String(), Equals, "expected 1 data source readings (got 2) from 1010:1:2")
+	c.Check(Update(s.file, "value", []string{"1010:abc"}).String(), Equals, "not a simple number: 'abc'")
+}
+
+func (s *RrdS) TestReadInvalidFile(c *C) {
+	c.Assert(ioutil.WriteFile(s.file, make([]byte, 200), 0644), IsNil)
+	_, err := GetInfo(s.file)
+	c.Check(err.String(), Equals, s.file+" is not an RRD file")
+}
+
+func (s *RrdS) TestReadCorruptFile(c *C) {
+	c.Assert(Create(s.file, 10, 1000, []string{"DS:value:GAUGE:600:U:U", "RRA:AVERAGE:0.5:1:10"}), IsNil)
+	data, err := ioutil.ReadFile(s.file)
+	c.Assert(err, IsNil)
+
+	// Huge number of data sources
+	corrupt := append([]byte(nil), data...)
+	binary.LittleEndian.PutUint64(corrupt[24:], 1<<40)
+	c.Assert(ioutil.WriteFile(s.file, corrupt, 0644), IsNil)
+	_, err = GetInfo(s.file)
+	c.Check(err.String(), Equals, s.file+": RRD file is corrupt (1099511627776 data sources, 1 archives)")
+
+	// Truncated archive
+	c.Assert(ioutil.WriteFile(s.file, data[:len(data)-8], 0644), IsNil)
+	_, err = Fetch(s.file, "AVERAGE", 1000, 1040, 10)
+	c.Check(err.String(), Equals, s.file+": RRD file is truncated")
+	c.Check(Update(s.file, "value", []string{"1010:1"}), NotNil)
+
+	// Truncated header
+	c.Assert(ioutil.WriteFile(s.file, data[:200], 0644), IsNil)
+	_, err = GetInfo(s.file)
+	c.Check(err.String(), Equals, s.file+": RRD file is truncated")
+}
+
+// values returns string representation of values of the given data source.
+func values(result *FetchResult, ds int) string {
+	str := "["
+	for i, row := range result.Values {
+		if i > 0 {
+			str += " "
+		}
+		str += fmt.Sprint(row[ds])
+	}
+	return str + "]"
+}
@@ -0,0 +1,384 @@
+package rrd
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UnknownDataSourceError is returned by Update when the template refers to a
+// data source which does not exist in the file.
+type UnknownDataSourceError struct {
+	File string
+	Name string
+}
+
+// String returns the error message.
+func (e *UnknownDataSourceError) String() string {
+	return fmt.Sprintf("unknown DS name '%s' in %s", e.Name, e.File)
+}
+
+// Update updates the RRD file with the given values. Template lists data
+// sources separated by ":" in the order values are specified (all data
+// sources in the file order when empty), data sources missing in the
+// template are updated with unknown values. Each argument is in the
+// timestamp:value[:value...] format, where timestamp could be "N" for the
+// current time, and value could be "U" for unknown values.
+func Update(filename, template string, args []string) os.Error {
+	lock := lockFile(filename)
+	lock.Lock()
+	defer lock.Unlock()
+
+	file, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	h, err := readHeader(file)
+	if err != nil {
+		return err
+	}
+
+	// Map template to data source indexes
+	var indexes []int
+	if len(template) == 0 {
+		indexes = make([]int, len(h.dataSources))
+		for i := range indexes {
+			indexes[i] = i
+		}
+	} else {
+		names := strings.Split(template, ":")
+		indexes = make([]int, len(names))
+		for i, name := range names {
+			if indexes[i] = h.dataSourceIndex(name); indexes[i] < 0 {
+				return &UnknownDataSourceError{File: filename, Name: name}
+			}
+		}
+	}
+
+	values := make([]string, len(h.dataSources))
+	for _, arg := range args {
+		fields := strings.Split(arg, ":")
+		if len(fields) != len(indexes)+1 {
+			err = os.NewError(fmt.Sprintf("expected %d data source readings (got %d) from %s", len(indexes), len(fields)-1, arg))
+			break
+		}
+
+		var timestamp int64
+		if fields[0] == "N" {
+			timestamp = time.Seconds()
+		} else if timestamp, err = strconv.Atoi64(fields[0]); err != nil {
+			err = os.NewError(fmt.Sprintf("cannot parse timestamp in %s", arg))
+			break
+		}
+		if timestamp <= h.lastUpdate {
+			err = os.NewError(fmt.Sprintf("illegal attempt to update using time %d when last update time is %d (minimum one second step)", timestamp, h.lastUpdate))
+			break
+		}
+
+		for i := range values {
+			values[i] = unknownString
+		}
+		for i, index := range indexes {
+			values[index] = fields[i+1]
+		}
+		if err = h.update(file, timestamp, values); err != nil {
+			break
+		}
+	}
+
+	// Save the state even when some of the updates failed
+	if _, werr := file.WriteAt(h.marshal(), 0); werr != nil {
+		return werr
+	}
+	return err
+}
+
+// update processes a single update: calculates primary data points (PDPs)
+// for each data source, consolidates them into consolidated data points
+// (CDPs) for each archive, and writes completed CDPs into archives.
+func (h *header) update(file *os.File, timestamp int64, values []string) os.Error {
+	step := h.step
+	interval := float64(timestamp-h.lastUpdate) - float64(h.lastUsec)/1e6
+
+	// Start of the PDP being processed, and of the PDP the update belongs to
+	procPdpSt := h.lastUpdate - h.lastUpdate%step
+	occuPdpSt := timestamp - timestamp%step
+	var preInt, postInt float64
+	if occuPdpSt > procPdpSt {
+		preInt = float64(occuPdpSt-h.lastUpdate) - float64(h.lastUsec)/1e6
+		postInt = float64(timestamp % step)
+	} else {
+		preInt = interval
+	}
+
+	// Values accumulated since the last update
+	pdpNew := make([]float64, len(h.dataSources))
+	for i, ds := range h.dataSources {
+		pdp := h.pdpPreps[i]
+		pdpNew[i] = math.NaN()
+		if values[i] != unknownString && interval <= float64(ds.Heartbeat) {
+			value, err := strconv.Atof64(values[i])
+			if err != nil {
+				return os.NewError(fmt.Sprintf("not a simple number: '%s'", values[i]))
+			}
+			switch ds.Type {
+			case "COUNTER", "DERIVE":
+				if last, err := strconv.Atof64(pdp.lastDs); err == nil {
+					pdpNew[i] = value - last
+					if ds.Type == "COUNTER" && pdpNew[i] < 0 {
+						// Counter overflow (32 or 64 bits)
+						pdpNew[i] += 4294967296.0
+						if pdpNew[i] < 0 {
+							pdpNew[i] += 18446744069414584320.0
+						}
+					}
+				}
+			case "ABSOLUTE":
+				pdpNew[i] = value
+			case "GAUGE":
+				pdpNew[i] = value * interval
+			}
+			// Values out of the allowed range are unknown
+			rate := pdpNew[i] / interval
+			if !math.IsNaN(rate) && ((!math.IsNaN(ds.Max) && rate > ds.Max) || (!math.IsNaN(ds.Min) && rate < ds.Min)) {
+				pdpNew[i] = math.NaN()
+			}
+		}
+		if len(values[i]) >= lastDsSize {
+			pdp.lastDs = values[i][:lastDsSize-1]
+		} else {
+			pdp.lastDs = values[i]
+		}
+	}
+
+	if occuPdpSt <= procPdpSt {
+		// Still in the same PDP, accumulate values
+		for i, pdp := range h.pdpPreps {
+			if math.IsNaN(pdpNew[i]) {
+				pdp.scratch[pdpUnknownSeconds].setCount(pdp.scratch[pdpUnknownSeconds].count() + int64(math.Floor(interval)))
+			} else {
+				pdp.scratch[pdpValue].setValue(pdp.scratch[pdpValue].value() + pdpNew[i])
+			}
+		}
+	} else {
+		pdpTemp := h.processPdps(interval, preInt, postInt, float64(occuPdpSt-procPdpSt), pdpNew)
+		elapsedPdpSt := occuPdpSt/step - procPdpSt/step
+		for rra, archive := range h.archives {
+			stepCount := h.updateCdps(rra, archive, pdpTemp, elapsedPdpSt, procPdpSt/step)
+			if err := h.writeRows(file, rra, archive, stepCount); err != nil {
+				return err
+			}
+		}
+	}
+
+	h.lastUpdate = timestamp
+	h.lastUsec = 0
+	return nil
+}
+
+// processPdps completes PDPs, returns their values (rates), and starts the
+// next PDP with the rest of the update interval.
+func (h *header) processPdps(interval, preInt, postInt, diffPdpSt float64, pdpNew []float64) []float64 {
+	pdpTemp := make([]float64, len(h.dataSources))
+	for i, ds := range h.dataSources {
+		pdp := h.pdpPreps[i]
+
+		var preUnknown float64
+		if math.IsNaN(pdpNew[i]) {
+			preUnknown = preInt
+		} else {
+			pdp.scratch[pdpValue].setValue(pdp.scratch[pdpValue].value() + pdpNew[i]/interval*preInt)
+		}
+
+		// PDP is unknown if heartbeat is exceeded, or more than a half of
+		// the step is unknown
+		unknownSeconds := float64(pdp.scratch[pdpUnknownSeconds].count())
+		if interval > float64(ds.Heartbeat) || float64(h.step)/2 < unknownSeconds {
+			pdpTemp[i] = math.NaN()
+		} else {
+			pdpTemp[i] = pdp.scratch[pdpValue].value() / (diffPdpSt - unknownSeconds - preUnknown)
+		}
+
+		if math.IsNaN(pdpNew[i]) {
+			pdp.scratch[pdpUnknownSeconds].setCount(int64(math.Floor(postInt)))
+			pdp.scratch[pdpValue].setValue(0)
+		} else {
+			pdp.scratch[pdpUnknownSeconds].setCount(0)
+			pdp.scratch[pdpValue].setValue(pdpNew[i] / interval * postInt)
+		}
+	}
+	return pdpTemp
+}
+
+// updateCdps consolidates completed PDPs into CDPs of the given archive, and
+// returns the number of completed CDPs (rows to be written).
+func (h *header) updateCdps(rra int, archive *Archive, pdpTemp []float64, elapsedPdpSt, procPdpCount int64) (stepCount int64) {
+	// Number of PDPs needed to complete the current CDP
+	startPdpOffset := archive.Steps - procPdpCount%archive.Steps
+	if startPdpOffset <= elapsedPdpSt {
+		stepCount = (elapsedPdpSt-startPdpOffset)/archive.Steps + 1
+	}
+
+	for i, value := range pdpTemp {
+		scratch := &h.cdpPreps[rra*len(h.dataSources)+i].scratch
+
+		// Nothing to consolidate if there is one PDP per CDP
+		if archive.Steps == 1 {
+			scratch[cdpPrimaryValue].setValue(value)
+			scratch[cdpSecondaryValue].setValue(value)
+			continue
+		}
+
+		if stepCount > 0 {
+			// The first row contains the CDP being built, the rest are
+			// filled with the current PDP value
+			if math.IsNaN(value) {
+				scratch[cdpUnknownPdps].setCount(scratch[cdpUnknownPdps].count() + startPdpOffset)
+				scratch[cdpSecondaryValue].setValue(math.NaN())
+			} else {
+				scratch[cdpSecondaryValue].setValue(value)
+			}
+
+			if float64(scratch[cdpUnknownPdps].count()) > float64(archive.Steps)*archive.Xff {
+				scratch[cdpPrimaryValue].setValue(math.NaN())
+			} else {
+				scratch[cdpPrimaryValue].setValue(primaryCdpValue(archive, scratch[cdpValue].value(), value, startPdpOffset, scratch[cdpUnknownPdps].count()))
+			}
+
+			// Start the next CDP with PDPs left
+			pdpIntoCdp := (elapsedPdpSt - startPdpOffset) % archive.Steps
+			scratch[cdpValue].setValue(carryOverCdpValue(archive, value, pdpIntoCdp))
+			if math.IsNaN(value) {
+				scratch[cdpUnknownPdps].setCount(pdpIntoCdp)
+			} else {
+				scratch[cdpUnknownPdps].setCount(0)
+			}
+		} else {
+			cdp := scratch[cdpValue].value()
+			switch {
+			case math.IsNaN(value):
+				scratch[cdpUnknownPdps].setCount(scratch[cdpUnknownPdps].count() + elapsedPdpSt)
+			case math.IsNaN(cdp) && archive.CF == "AVERAGE":
+				scratch[cdpValue].setValue(value * float64(elapsedPdpSt))
+			case math.IsNaN(cdp):
+				scratch[cdpValue].setValue(value)
+			default:
+				scratch[cdpValue].setValue(accumulateCdpValue(archive, cdp, value, elapsedPdpSt))
+			}
+		}
+	}
+	return
+}
+
+// writeRows writes completed CDPs into the archive: the first row contains
+// the primary value, all the rest - the secondary one.
+func (h *header) writeRows(file *os.File, rra int, archive *Archive, stepCount int64) os.Error {
+	if stepCount == 0 {
+		return nil
+	}
+
+	dsCount := len(h.dataSources)
+	primary := make([]float64, dsCount)
+	secondary := make([]float64, dsCount)
+	for i := range h.dataSources {
+		scratch := &h.cdpPreps[rra*dsCount+i].scratch
+		primary[i] = scratch[cdpPrimaryValue].value()
+		secondary[i] = scratch[cdpSecondaryValue].value()
+	}
+
+	buf := make([]byte, dsCount*valueSize)
+	offset := h.archiveOffset(rra)
+	ptr := h.rraPtrs[rra]
+
+	// Rows overwritten by the same update are skipped
+	var first int64
+	if stepCount > archive.Rows {
+		first = stepCount - archive.Rows
+		ptr = (ptr + first) % archive.Rows
+	}
+	for k := first; k < stepCount; k++ {
+		ptr = (ptr + 1) % archive.Rows
+		if k == 0 {
+			putValues(buf, primary)
+		} else {
+			putValues(buf, secondary)
+		}
+		if _, err := file.WriteAt(buf, offset+ptr*int64(len(buf))); err != nil {
+			return err
+		}
+	}
+	h.rraPtrs[rra] = ptr
+	return nil
+}
+
+// primaryCdpValue returns the value of the completed CDP.
+func primaryCdpValue(archive *Archive, cdp, value float64, startPdpOffset, unknownPdps int64) float64 {
+	switch archive.CF {
+	case "AVERAGE":
+		return (ifNaN(cdp, 0) + ifNaN(value, 0)*float64(startPdpOffset)) / float64(archive.Steps-unknownPdps)
+	case "MAX":
+		return max(ifNaN(cdp, math.Inf(-1)), ifNaN(value, math.Inf(-1)))
+	case "MIN":
+		return min(ifNaN(cdp, math.Inf(1)), ifNaN(value, math.Inf(1)))
+	}
+	return value
+}
+
+// carryOverCdpValue returns the initial value of the next CDP containing
+// the given number of PDPs.
+func carryOverCdpValue(archive *Archive, value float64, pdpIntoCdp int64) float64 {
+	if pdpIntoCdp == 0 || math.IsNaN(value) {
+		switch archive.CF {
+		case "AVERAGE":
+			return 0
+		case "MAX":
+			return math.Inf(-1)
+		case "MIN":
+			return math.Inf(1)
+		}
+		return math.NaN()
+	}
+	if archive.CF == "AVERAGE" {
+		return value * float64(pdpIntoCdp)
+	}
+	return value
+}
+
+// accumulateCdpValue adds PDPs to the CDP being built.
+func accumulateCdpValue(archive *Archive, cdp, value float64, elapsedPdpSt int64) float64 {
+	switch archive.CF {
+	case "AVERAGE":
+		return cdp + value*float64(elapsedPdpSt)
+	case "MAX":
+		return max(cdp, value)
+	case "MIN":
+		return min(cdp, value)
+	}
+	return value
+}
+
+func ifNaN(value, def float64) float64 {
+	if math.IsNaN(value) {
+		return def
+	}
+	return value
+}
+
+func max(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func min(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,115 @@
+// Package sender implements sending lines of text over TCP (to a Carbon
+// backend, or to an upstream MetricsD instance). When the remote side is not
+// available, connection attempts are delayed, and the delay is doubled after
+// each failure.
+package sender
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"time"
+	"metricsd/logger"
+)
+
+// Delays between connection attempts (in seconds), doubled after each failure.
+const (
+	MIN_RETRY_DELAY = 1
+	MAX_RETRY_DELAY = 60
+)
+
+// Write timeout in nanoseconds.
+const WRITE_TIMEOUT = 10e9
+
+// Sender sends lines to a TCP address. It is not safe for concurrent use, so
+// it should be used by a single sending Go routine.
+type Sender struct {
+	name    string // name of the remote side used in log messages
+	address string
+	log     logger.Logger
+	conn    net.Conn
+	retryAt int64 // time of the next connection attempt
+	backoff int64 // current delay between connection attempts
+}
+
+// New creates a sender to the given address. Name is used in log messages,
+// e.g. "Carbon 127.0.0.1:2003".
+func New(name, address string, log logger.Logger) *Sender {
+	return &Sender{name: name, address: address, log: log}
+}
+
+// Connected returns a value indicating whether the connection is established.
+func (sender *Sender) Connected() bool {
+	return sender.conn != nil
+}
+
+// Connect connects to the address, unless already connected or the previous
+// attempt failed recently. Returns a value indicating whether the sender is
+// connected.
+func (sender *Sender) Connect() bool {
+	if sender.conn != nil {
+		return true
+	}
+	if time.Seconds() < sender.retryAt {
+		return false
+	}
+	conn, err := net.Dial("tcp", sender.address)
+	if err != nil {
+		sender.fail(err)
+		return false
+	}
+	conn.SetWriteTimeout(WRITE_TIMEOUT)
+	sender.conn = conn
+	sender.log.Info("Connected to %s", sender.name)
+	return true
+}
+
+// Send writes lines to the connection (should be connected), each line is
+// terminated with a newline. When writing fails, the connection is closed,
+// and lines could have been sent partially.
+func (sender *Sender) Send(lines []string) os.Error {
+	writer := bufio.NewWriter(sender.conn)
+	for _, line := range lines {
+		writer.WriteString(line)
+		writer.WriteByte('\n')
+	}
+	if err := writer.Flush(); err != nil {
+		sender.fail(err)
+		return err
+	}
+	sender.backoff = 0
+	return nil
+}
+
+// Copy writes the contents of the reader (lines already terminated with
+// newlines) to the connection (should be connected). When writing fails,
+// the connection is closed.
+func (sender *Sender) Copy(reader io.Reader) os.Error {
+	if _, err := io.Copy(sender.conn, reader); err != nil {
+		sender.fail(err)
+		return err
+	}
+	return nil
+}
+
+// Close closes the connection (if connected).
+func (sender *Sender) Close() {
+	if sender.conn != nil {
+		sender.conn.Close()
+		sender.conn = nil
+	}
+}
+
+// fail closes the connection, and schedules the next connection attempt.
+func (sender *Sender) fail(err os.Error) {
+	sender.Close()
+	sender.backoff *= 2
+	if sender.backoff < MIN_RETRY_DELAY {
+		sender.backoff = MIN_RETRY_DELAY
+	} else if sender.backoff > MAX_RETRY_DELAY {
+		sender.backoff = MAX_RETRY_DELAY
+	}
+	sender.retryAt = time.Seconds() + sender.backoff
+	sender.log.Warn("%s is not available, retrying in %d seconds: %s", sender.name, sender.backoff, err)
+}
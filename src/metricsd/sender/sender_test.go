@@ -0,0 +1,85 @@
+package sender
+
+import (
+	. "launchpad.net/gocheck"
+	"bufio"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"metricsd/logger"
+)
+
+// Hook up gocheck into the gotest runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type SenderS struct {
+	listener net.Listener
+}
+
+var _ = Suite(&SenderS{})
+
+func (s *SenderS) SetUpTest(c *C) {
+	var err os.Error
+	s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+}
+
+func (s *SenderS) TearDownTest(c *C) {
+	s.listener.Close()
+}
+
+func (s *SenderS) sender() *Sender {
+	address := s.listener.Addr().String()
+	return New("test "+address, address, logger.NewConsoleLogger(logger.UNKNOWN))
+}
+
+// receive accepts the connection and reads count lines from it.
+func (s *SenderS) receive(c *C, count int) (lines []string) {
+	conn, err := s.listener.Accept()
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	for i := 0; i < count; i++ {
+		line, err := reader.ReadString('\n')
+		c.Assert(err, IsNil)
+		lines = append(lines, strings.TrimRight(line, "\n"))
+	}
+	return
+}
+
+func (s *SenderS) TestSendAndCopy(c *C) {
+	sender := s.sender()
+	defer sender.Close()
+
+	c.Assert(sender.Connect(), Equals, true)
+	c.Check(sender.Connected(), Equals, true)
+	c.Check(sender.Copy(strings.NewReader("a\nb\n")), IsNil)
+	c.Check(sender.Send([]string{"c", "d"}), IsNil)
+	c.Check(s.receive(c, 4), DeepEquals, []string{"a", "b", "c", "d"})
+}
+
+func (s *SenderS) TestFailedConnectionIsRetriedLater(c *C) {
+	sender := s.sender()
+	s.listener.Close()
+	c.Check(sender.Connect(), Equals, false)
+	c.Check(sender.Connected(), Equals, false)
+	c.Check(sender.backoff, Equals, int64(MIN_RETRY_DELAY))
+	c.Check(sender.retryAt > 0, Equals, true)
+
+	// The next attempt is delayed
+	c.Check(sender.Connect(), Equals, false)
+	c.Check(sender.backoff, Equals, int64(MIN_RETRY_DELAY))
+}
+
+func (s *SenderS) TestBackoffIsDoubled(c *C) {
+	sender := s.sender()
+	for i := 0; i < 10; i++ {
+		sender.fail(os.NewError("test"))
+	}
+	c.Check(sender.backoff, Equals, int64(MAX_RETRY_DELAY))
+	sender.backoff = 4
+	sender.fail(os.NewError("test"))
+	c.Check(sender.backoff, Equals, int64(8))
+}
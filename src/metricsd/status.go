@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+	"metricsd/config"
+	"metricsd/writers"
+)
+
+// MetricsD version reported at /status.
+const VERSION = "0.7.0-dev"
+
+var (
+	startedAt          int64      /* Time MetricsD was started at */
+	listenersStarted   int        /* Number of started listeners */
+	listenersBound     int64      /* Number of listeners bound to their addresses */
+	lastRollupTime     int64      /* Time the last rollup finished at (0 if none) */
+	lastRollupDuration int64      /* Duration of the last rollup in nanoseconds */
+	lastRollupMutex    sync.Mutex /* Last rollup lock (written by dumper, read by web server) */
+)
+
+// statusRollup describes the last rollup.
+type statusRollup struct {
+	Time     int64   `json:"time"`     // time the rollup finished at (0 if none)
+	Duration float64 `json:"duration"` // duration of the rollup in seconds
+}
+
+// statusWriter describes RRD updates of a writer since start.
+type statusWriter struct {
+	Updates int64 `json:"updates"`
+	Errors  int64 `json:"errors"`
+}
+
+// status is the state of MetricsD returned at /status.
+type status struct {
+	Version    string                  `json:"version"`
+	Uptime     int64                   `json:"uptime"` // in seconds
+	Ready      bool                    `json:"ready"`
+	Problems   []string                `json:"problems"`
+	Config     *config.Config          `json:"config"`
+	Events     int64                   `json:"events"` // total events received
+	Bytes      int64                   `json:"bytes"`  // total bytes received
+	LastRollup statusRollup            `json:"last_rollup"`
+	Writers    map[string]statusWriter `json:"writers"`
+}
+
+// listenerBound should be called by each listener once it is bound to its
+// address.
+func listenerBound() {
+	atomic.AddInt64(&listenersBound, 1)
+}
+
+// rollupFinished records the time and the duration (in nanoseconds) of the
+// last rollup.
+func rollupFinished(duration int64) {
+	lastRollupMutex.Lock()
+	defer lastRollupMutex.Unlock()
+
+	lastRollupTime = time.Seconds()
+	lastRollupDuration = duration
+}
+
+// lastRollup returns the time and the duration of the last rollup.
+func lastRollup() (finished, duration int64) {
+	lastRollupMutex.Lock()
+	defer lastRollupMutex.Unlock()
+
+	return lastRollupTime, lastRollupDuration
+}
+
+// readiness returns the list of problems preventing MetricsD from processing
+// events: not all listeners are bound, the data directory is not writable, or
+// rollups are falling behind (the last one finished more than two write
+// intervals ago, or took longer than the write interval). Empty when ready.
+func readiness() (problems []string) {
+	if bound := atomic.AddInt64(&listenersBound, 0); bound < int64(listenersStarted) {
+		problems = append(problems, fmt.Sprintf("Only %d of %d listeners are bound", bound, listenersStarted))
+	}
+	if !config.RelayOnly {
+		if error := checkWritable(config.DataDir); error != nil {
+			problems = append(problems, fmt.Sprintf("Data directory %s is not writable: %s", config.DataDir, error))
+		}
+	}
+
+	finished, duration := lastRollup()
+	since := finished
+	if since == 0 {
+		since = startedAt
+	}
+	interval := int64(config.WriteInterval)
+	if elapsed := time.Seconds() - since; elapsed > 2*interval {
+		problems = append(problems, fmt.Sprintf("Slices were not rolled up for %d seconds (write interval is %d seconds)", elapsed, interval))
+	}
+	if duration > interval*1e9 {
+		problems = append(problems, fmt.Sprintf("The last rollup took %v seconds (write interval is %d seconds)", float64(duration)/1e9, interval))
+	}
+	return
+}
+
+// checkWritable creates and removes a temporary file in the given directory.
+func checkWritable(dir string) os.Error {
+	file, error := ioutil.TempFile(dir, ".readyz")
+	if error != nil {
+		return error
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// publicConfig returns current configuration with notifier options omitted,
+// as they could contain credentials (SMTP passwords, webhook tokens).
+func publicConfig() *config.Config {
+	current := config.Current()
+	notifiers := make([]config.NotifierConfig, len(current.Notifiers))
+	for i, notifier := range current.Notifiers {
+		notifiers[i] = config.NotifierConfig{Name: notifier.Name, Type: notifier.Type}
+	}
+	current.Notifiers = notifiers
+	return current
+}
+
+// currentStatus returns the state of MetricsD: version, uptime, current
+// configuration, totals of received events and bytes, the last rollup, and
+// RRD update errors of each writer.
+func currentStatus() interface{} {
+	problems := readiness()
+	if problems == nil {
+		problems = []string{}
+	}
+	finished, duration := lastRollup()
+	result := &status{
+		Version:    VERSION,
+		Uptime:     time.Seconds() - startedAt,
+		Ready:      len(problems) == 0,
+		Problems:   problems,
+		Config:     publicConfig(),
+		Events:     atomic.AddInt64(&totalEventsReceived, 0),
+		Bytes:      atomic.AddInt64(&totalBytesReceived, 0),
+		LastRollup: statusRollup{Time: finished, Duration: float64(duration) / 1e9},
+		Writers:    make(map[string]statusWriter),
+	}
+	for name, stats := range writers.UpdateStats() {
+		result.Writers[name] = statusWriter{Updates: stats.Updates, Errors: stats.Errors}
+	}
+	return result
+}
@@ -19,6 +19,12 @@
 // metric for different sources will be stored in different sample sets. There is
 // a special sample set, which source name is "all", where all values from all
 // sources for a given metric are stored (useful to build summary stats for a metric).
+// Metrics could have tags (key=value pairs); tagged events are stored in sample
+// sets for the full list of tags, for every single tag, and for the metric without
+// tags, so it is possible to filter and aggregate series by any tag.
+// Large sample sets of timers and untyped metrics could be switched to a Sketch
+// (see Timeline.SetSketch), which bounds memory used by a sample set, so that
+// quantiles are calculated with a known relative error.
 //
 // There are two primary tasks could be done using this package:
 //
@@ -2,31 +2,82 @@ package types
 
 import (
 	"fmt"
+	"strings"
 )
 
-type MetricValue int
+// MetricType defines how values of a metric should be aggregated.
+type MetricType byte
+
+const (
+	Untyped MetricType = iota // legacy metric:value events
+	Counter                   // StatsD counter (name:value|c)
+	Timer                     // StatsD timer (name:value|ms)
+	Gauge                     // StatsD gauge (name:value|g)
+	Set                       // StatsD set (name:value|s)
+)
+
+// String returns the name of the metric type.
+func (metricType MetricType) String() string {
+	switch metricType {
+	case Untyped:
+		return "untyped"
+	case Counter:
+		return "counter"
+	case Timer:
+		return "timer"
+	case Gauge:
+		return "gauge"
+	case Set:
+		return "set"
+	}
+	return "unknown"
+}
+
+// StoredName returns the name data files of the metric are stored under:
+// "$" groups are replaced with dots, "_time" and "_count" suffixes with
+// ".time" and ".status" (legacy metric names).
+func StoredName(name string) string {
+	name = strings.Replace(name, "$", ".", -1)
+	if strings.HasSuffix(name, "_time") {
+		name = name[0:len(name)-len("_time")] + ".time"
+	}
+	if strings.HasSuffix(name, "_count") {
+		name = name[0:len(name)-len("_count")] + ".status"
+	}
+	return name
+}
 
 // A Event contains information about the event.
 type Event struct {
-	Source string // event source (IP address, DNS name, or custom string)
-	Name   string // metric's name
-	Value  int    // metric's value
+	Source string     // event source (IP address, DNS name, or custom string)
+	Name   string     // metric's name
+	Value  float64    // metric's value
+	Type   MetricType // metric's type
+	Tags   Tags       // metric's tags (sorted by key)
+	Time   int64      // event timestamp in seconds (0 means current time)
 }
 
-// NewEvent returns a new Event with the given source, name, and value.
-func NewEvent(source string, name string, value int) *Event {
+// NewEvent returns a new untyped Event with the given source, name, and value.
+func NewEvent(source string, name string, value float64) *Event {
 	return &Event{Source: source, Name: name, Value: value}
 }
 
+// NewTypedEvent returns a new Event with the given source, name, value, and type.
+func NewTypedEvent(source string, name string, value float64, metricType MetricType) *Event {
+	return &Event{Source: source, Name: name, Value: value, Type: metricType}
+}
+
 // String converts an instance of event struct to string.
 func (event *Event) String() string {
 	if event == nil {
 		return "Event[nil]"
 	}
 	return fmt.Sprintf(
-		"Event[source=%s, name=%s, value=%d]",
+		"Event[source=%s, name=%s, value=%v, type=%s, tags=%s]",
 		event.Source,
 		event.Name,
 		event.Value,
+		event.Type,
+		event.Tags,
 	)
 }
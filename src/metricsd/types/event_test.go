@@ -12,10 +12,34 @@ func (s *EventS) TestNewEvent(c *C) {
 	event := NewEvent("src", "msg", 10)
 	c.Check(event.Source, Equals, "src")
 	c.Check(event.Name, Equals, "msg")
-	c.Check(event.Value, Equals, 10)
+	c.Check(event.Value, Equals, 10.0)
 }
 
 func (s *EventS) TestEventString(c *C) {
 	event := NewEvent("src", "msg", 10)
-	c.Check(event.String(), Equals, "Event[source=src, name=msg, value=10]")
+	c.Check(event.String(), Equals, "Event[source=src, name=msg, value=10, type=untyped, tags=]")
+}
+
+func (s *EventS) TestEventStringWithFractionalValue(c *C) {
+	event := NewEvent("src", "msg", 12.75)
+	c.Check(event.String(), Equals, "Event[source=src, name=msg, value=12.75, type=untyped, tags=]")
+}
+
+func (s *EventS) TestNewTypedEvent(c *C) {
+	event := NewTypedEvent("src", "msg", 0.5, Timer)
+	c.Check(event.Value, Equals, 0.5)
+	c.Check(event.Type, Equals, Timer)
+	c.Check(event.String(), Equals, "Event[source=src, name=msg, value=0.5, type=timer, tags=]")
+}
+
+func (s *EventS) TestTaggedEventString(c *C) {
+	event := NewEvent("src", "msg", 10)
+	event.Tags = NewTags(Tag{"role", "api"}, Tag{"dc", "ams"})
+	c.Check(event.String(), Equals, "Event[source=src, name=msg, value=10, type=untyped, tags=dc=ams,role=api]")
+}
+
+func (s *EventS) TestStoredName(c *C) {
+	c.Check(StoredName("app.requests"), Equals, "app.requests")
+	c.Check(StoredName("app$login_count"), Equals, "app.login.status")
+	c.Check(StoredName("app.login_time"), Equals, "app.login.time")
 }
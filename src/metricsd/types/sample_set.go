@@ -8,7 +8,16 @@ type SampleSet struct {
 	Time   int64
 	Source string
 	Name   string
-	Values []int
+	Type   MetricType
+	Tags   Tags
+	Values []float64
+	// Sketch of values when the sample set is too large to keep them all (see
+	// UseSketch), Values are empty then.
+	Sketch *Sketch
+	// Relative accuracy of the sketch (sketch is not used when zero).
+	sketchAccuracy float64
+	// Number of values kept exactly before switching to the sketch.
+	sketchThreshold int
 }
 
 func NewSampleSet(time int64, source, name string) *SampleSet {
@@ -16,26 +25,80 @@ func NewSampleSet(time int64, source, name string) *SampleSet {
 		Time:   time,
 		Source: source,
 		Name:   name,
-		Values: make([]int, 0, 8),
+		Values: make([]float64, 0, 8),
 	}
 }
 
-func (set *SampleSet) Add(value int) {
+// NewTypedSampleSet returns a new SampleSet for a metric of the given type.
+func NewTypedSampleSet(time int64, source, name string, metricType MetricType) *SampleSet {
+	set := NewSampleSet(time, source, name)
+	set.Type = metricType
+	return set
+}
+
+// FullName returns the metric name with tags appended (name,key=value,...),
+// which identifies the series the sample set belongs to.
+func (set *SampleSet) FullName() string {
+	if len(set.Tags) == 0 {
+		return set.Name
+	}
+	return set.Name + "," + set.Tags.String()
+}
+
+// UseSketch makes the sample set switch to a sketch with the given relative
+// accuracy once it has more than threshold values (right away when threshold
+// is zero). Values added so far are moved to the sketch.
+func (set *SampleSet) UseSketch(accuracy float64, threshold int) {
+	set.sketchAccuracy = accuracy
+	set.sketchThreshold = threshold
+	set.checkSketch()
+}
+
+func (set *SampleSet) Add(value float64) {
+	if set.Sketch != nil {
+		set.Sketch.Add(value)
+		return
+	}
 	set.Values = append(set.Values, value)
+	set.checkSketch()
+}
+
+// Count returns number of values in the sample set.
+func (set *SampleSet) Count() int {
+	if set.Sketch != nil {
+		return int(set.Sketch.Count())
+	}
+	return len(set.Values)
+}
+
+// checkSketch moves values to the sketch when the threshold is exceeded.
+func (set *SampleSet) checkSketch() {
+	if set.Sketch != nil || set.sketchAccuracy <= 0 || len(set.Values) <= set.sketchThreshold {
+		return
+	}
+	set.Sketch = NewSketch(set.sketchAccuracy)
+	for _, value := range set.Values {
+		set.Sketch.Add(value)
+	}
+	set.Values = nil
 }
 
 func (set *SampleSet) Less(setToCompare *SampleSet) bool {
-	return set.Source < setToCompare.Source ||
-		(set.Source == setToCompare.Source && set.Name < setToCompare.Name) ||
-		(set.Source == setToCompare.Source && set.Name == setToCompare.Name && set.Time < setToCompare.Time)
+	if set.Source != setToCompare.Source {
+		return set.Source < setToCompare.Source
+	}
+	name, nameToCompare := set.FullName(), setToCompare.FullName()
+	return name < nameToCompare || (name == nameToCompare && set.Time < setToCompare.Time)
 }
 
 func (set *SampleSet) String() string {
 	return fmt.Sprintf(
-		"SampleSet[source=%s, name=%s, time=%d, size=%d]",
+		"SampleSet[source=%s, name=%s, type=%s, time=%d, size=%d, sketch=%t]",
 		set.Source,
-		set.Name,
+		set.FullName(),
+		set.Type,
 		set.Time,
-		len(set.Values),
+		set.Count(),
+		set.Sketch != nil,
 	)
 }
@@ -9,13 +9,52 @@ type SampleSetS struct{}
 
 var _ = Suite(&SampleSetS{})
 
+func (s *SampleSetS) TestFullName(c *C) {
+	ss := NewSampleSet(10, "src", "metric")
+	c.Check(ss.FullName(), Equals, "metric")
+	ss.Tags = NewTags(Tag{"role", "api"}, Tag{"dc", "ams"})
+	c.Check(ss.FullName(), Equals, "metric,dc=ams,role=api")
+}
+
+func (s *SampleSetS) TestLessComparesTags(c *C) {
+	untagged := NewSampleSet(20, "src", "metric")
+	tagged := NewSampleSet(10, "src", "metric")
+	tagged.Tags = NewTags(Tag{"dc", "ams"})
+	c.Check(untagged.Less(tagged), Equals, true)
+	c.Check(tagged.Less(untagged), Equals, false)
+}
+
+func (s *SampleSetS) TestUseSketch(c *C) {
+	ss := NewSampleSet(10, "src", "metric")
+	ss.UseSketch(0.01, 3)
+	ss.Add(1)
+	ss.Add(2)
+	ss.Add(3)
+	c.Check(ss.Sketch, IsNil)
+	c.Check(ss.Count(), Equals, 3)
+
+	ss.Add(4)
+	c.Assert(ss.Sketch, NotNil)
+	c.Check(len(ss.Values), Equals, 0)
+	c.Check(ss.Count(), Equals, 4)
+	c.Check(ss.Sketch.Sum(), Equals, 10.0)
+}
+
+func (s *SampleSetS) TestUseSketchWithZeroThreshold(c *C) {
+	ss := NewSampleSet(10, "src", "metric")
+	ss.Add(1)
+	ss.UseSketch(0.01, 0)
+	c.Assert(ss.Sketch, NotNil)
+	c.Check(ss.Count(), Equals, 1)
+}
+
 func BenchmarkSampleSetAdd(b *testing.B) {
 	b.StopTimer()
 	ss := NewSampleSet(10, "src", "metric")
 	b.StartTimer()
 
 	for i := 0; i < b.N; i++ {
-		ss.Add(i)
+		ss.Add(float64(i))
 	}
 
 	b.StopTimer()
@@ -0,0 +1,218 @@
+package types
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Values with smaller magnitude are counted as zeros by sketches.
+const SKETCH_MIN_VALUE = 1e-9
+
+// Max number of bins of positive (and negative) values in a sketch. Bins of
+// the smallest magnitude are merged when the limit is reached (with accuracy
+// of 0.01 it happens only when values span more than 17 orders of magnitude).
+const SKETCH_MAX_BINS = 2048
+
+// A Sketch summarizes values of a sample set in a bounded amount of memory,
+// so that quantiles could be calculated with a known relative error
+// (DDSketch, http://www.vldb.org/pvldb/vol12/p2195-masson.pdf).
+//
+// Values are counted in logarithmically sized bins: value v goes to the bin
+// ceil(log(v) / log(gamma)), where gamma = (1 + accuracy) / (1 - accuracy),
+// so any value in a bin is within the relative accuracy from its
+// representative value. Negative values are counted in a separate set of
+// bins. Number of values, their sum, minimum, maximum, and the last value
+// are kept exactly.
+type Sketch struct {
+	// Relative accuracy of quantiles, e.g. 0.01.
+	Accuracy float64
+	gamma    float64
+	logGamma float64
+	positive map[int]uint64
+	negative map[int]uint64
+	zero     uint64
+	count    int64
+	sum      float64
+	min      float64
+	max      float64
+	last     float64
+}
+
+// SketchBin is a bin of a sketch: the representative value and the number
+// of values counted in the bin.
+type SketchBin struct {
+	Value float64
+	Count uint64
+}
+
+// NewSketch returns an empty sketch with the given relative accuracy (should
+// be between 0 and 1).
+func NewSketch(accuracy float64) *Sketch {
+	gamma := (1 + accuracy) / (1 - accuracy)
+	return &Sketch{
+		Accuracy: accuracy,
+		gamma:    gamma,
+		logGamma: math.Log(gamma),
+		positive: make(map[int]uint64),
+		negative: make(map[int]uint64),
+		min:      math.Inf(1),
+		max:      math.Inf(-1),
+	}
+}
+
+// Add counts the value in the sketch.
+func (sketch *Sketch) Add(value float64) {
+	switch {
+	case value >= SKETCH_MIN_VALUE:
+		addToBins(sketch.positive, sketch.index(value))
+	case value <= -SKETCH_MIN_VALUE:
+		addToBins(sketch.negative, sketch.index(-value))
+	default:
+		sketch.zero++
+	}
+	sketch.count++
+	sketch.sum += value
+	sketch.min = math.Fmin(sketch.min, value)
+	sketch.max = math.Fmax(sketch.max, value)
+	sketch.last = value
+}
+
+// Count returns number of values in the sketch.
+func (sketch *Sketch) Count() int64 {
+	return sketch.count
+}
+
+// Sum returns sum of values in the sketch.
+func (sketch *Sketch) Sum() float64 {
+	return sketch.sum
+}
+
+// Min returns the minimum value in the sketch (+Inf when empty).
+func (sketch *Sketch) Min() float64 {
+	return sketch.min
+}
+
+// Max returns the maximum value in the sketch (-Inf when empty).
+func (sketch *Sketch) Max() float64 {
+	return sketch.max
+}
+
+// Last returns the value added last.
+func (sketch *Sketch) Last() float64 {
+	return sketch.last
+}
+
+// Positive returns number of values greater than zero.
+func (sketch *Sketch) Positive() (count uint64) {
+	for _, n := range sketch.positive {
+		count += n
+	}
+	return
+}
+
+// Negative returns number of values less than zero.
+func (sketch *Sketch) Negative() (count uint64) {
+	for _, n := range sketch.negative {
+		count += n
+	}
+	return
+}
+
+// Bins returns non-empty bins of the sketch sorted by value. Representative
+// values are clamped to the minimum and maximum values.
+func (sketch *Sketch) Bins() []SketchBin {
+	bins := make([]SketchBin, 0, len(sketch.positive)+len(sketch.negative)+1)
+	for _, index := range sortedIndexes(sketch.negative, true) {
+		bins = append(bins, SketchBin{-sketch.value(index), sketch.negative[index]})
+	}
+	if sketch.zero > 0 {
+		bins = append(bins, SketchBin{0, sketch.zero})
+	}
+	for _, index := range sortedIndexes(sketch.positive, false) {
+		bins = append(bins, SketchBin{sketch.value(index), sketch.positive[index]})
+	}
+	for i := range bins {
+		bins[i].Value = math.Fmin(math.Fmax(bins[i].Value, sketch.min), sketch.max)
+	}
+	return bins
+}
+
+// Quantile returns the value at the given quantile (between 0 and 1), which
+// is within the relative accuracy from the value of rank q * (count - 1) in
+// the sorted list of values (minimum and maximum values are exact). Returns
+// NaN when the sketch is empty.
+func (sketch *Sketch) Quantile(q float64) float64 {
+	switch {
+	case sketch.count == 0:
+		return math.NaN()
+	case q <= 0:
+		return sketch.min
+	case q >= 1:
+		return sketch.max
+	}
+	rank := q * float64(sketch.count-1)
+	bins := sketch.Bins()
+	var seen uint64
+	for _, bin := range bins {
+		seen += bin.Count
+		if float64(seen) > rank {
+			return bin.Value
+		}
+	}
+	return bins[len(bins)-1].Value
+}
+
+func (sketch *Sketch) String() string {
+	return fmt.Sprintf(
+		"Sketch[accuracy=%v, count=%d, bins=%d]",
+		sketch.Accuracy,
+		sketch.count,
+		len(sketch.positive)+len(sketch.negative),
+	)
+}
+
+// index returns the bin index of the given positive value.
+func (sketch *Sketch) index(value float64) int {
+	return int(math.Ceil(math.Log(value) / sketch.logGamma))
+}
+
+// value returns the representative value of the bin with the given index.
+func (sketch *Sketch) value(index int) float64 {
+	return 2 * math.Pow(sketch.gamma, float64(index)) / (sketch.gamma + 1)
+}
+
+// addToBins increments the bin with the given index. When the number of bins
+// exceeds SKETCH_MAX_BINS, two bins with the lowest indexes are merged.
+func addToBins(bins map[int]uint64, index int) {
+	bins[index]++
+	if len(bins) <= SKETCH_MAX_BINS {
+		return
+	}
+	lowest, next := math.MaxInt32, math.MaxInt32
+	for i := range bins {
+		if i < lowest {
+			lowest, next = i, lowest
+		} else if i < next {
+			next = i
+		}
+	}
+	bins[next] += bins[lowest]
+	bins[lowest] = 0, false
+}
+
+// sortedIndexes returns indexes of the bins in ascending (or descending)
+// order.
+func sortedIndexes(bins map[int]uint64, descending bool) []int {
+	indexes := make([]int, 0, len(bins))
+	for index := range bins {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	if descending {
+		for i, j := 0, len(indexes)-1; i < j; i, j = i+1, j-1 {
+			indexes[i], indexes[j] = indexes[j], indexes[i]
+		}
+	}
+	return indexes
+}
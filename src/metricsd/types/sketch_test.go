@@ -0,0 +1,89 @@
+package types
+
+import (
+	. "launchpad.net/gocheck"
+	"math"
+	"testing"
+)
+
+type SketchS struct{}
+
+var _ = Suite(&SketchS{})
+
+// checkAccuracy checks that the value is within the relative accuracy from
+// the expected one.
+func checkAccuracy(c *C, q, value, expected, accuracy float64) {
+	if math.Fabs(value-expected) > accuracy*math.Fabs(expected) {
+		c.Errorf("Quantile %v: expected %v within %v, got %v", q, expected, accuracy, value)
+	}
+}
+
+func (s *SketchS) TestEmpty(c *C) {
+	sketch := NewSketch(0.01)
+	c.Check(sketch.Count(), Equals, int64(0))
+	c.Check(math.IsNaN(sketch.Quantile(0.5)), Equals, true)
+	c.Check(len(sketch.Bins()), Equals, 0)
+}
+
+func (s *SketchS) TestQuantilesAreWithinAccuracy(c *C) {
+	for _, accuracy := range []float64{0.05, 0.01, 0.001} {
+		sketch := NewSketch(accuracy)
+		for i := 10000; i > 0; i-- {
+			sketch.Add(float64(i))
+		}
+		for _, q := range []float64{0, 0.25, 0.5, 0.75, 0.9, 0.99, 0.999, 1} {
+			// Value of rank q * (count - 1) is 1 + q * 9999
+			checkAccuracy(c, q, sketch.Quantile(q), math.Floor(1+q*9999), accuracy)
+		}
+	}
+}
+
+func (s *SketchS) TestExactValues(c *C) {
+	sketch := NewSketch(0.01)
+	for _, value := range []float64{3.5, -2, 0, 7, 1e-12} {
+		sketch.Add(value)
+	}
+	c.Check(sketch.Count(), Equals, int64(5))
+	c.Check(sketch.Sum(), Equals, 8.5+1e-12)
+	c.Check(sketch.Min(), Equals, -2.0)
+	c.Check(sketch.Max(), Equals, 7.0)
+	c.Check(sketch.Last(), Equals, 1e-12)
+	c.Check(sketch.Positive(), Equals, uint64(2))
+	c.Check(sketch.Negative(), Equals, uint64(1))
+	c.Check(sketch.Quantile(0), Equals, -2.0)
+	c.Check(sketch.Quantile(1), Equals, 7.0)
+}
+
+func (s *SketchS) TestNegativeValues(c *C) {
+	sketch := NewSketch(0.01)
+	for i := -1000; i <= 1000; i++ {
+		sketch.Add(float64(i))
+	}
+	bins := sketch.Bins()
+	for i := 1; i < len(bins); i++ {
+		if bins[i].Value <= bins[i-1].Value {
+			c.Fatalf("Bins are not sorted: %v", bins)
+		}
+	}
+	c.Check(sketch.Quantile(0.5), Equals, 0.0)
+	checkAccuracy(c, 0.1, sketch.Quantile(0.1), -800, 0.01)
+	checkAccuracy(c, 0.9, sketch.Quantile(0.9), 800, 0.01)
+}
+
+func (s *SketchS) TestNumberOfBinsIsLimited(c *C) {
+	sketch := NewSketch(0.001)
+	for value := 1e-6; value < 1e12; value *= 1.01 {
+		sketch.Add(value)
+	}
+	c.Check(len(sketch.positive), Equals, SKETCH_MAX_BINS)
+	// Largest values keep their accuracy (values are spread evenly over 18
+	// orders of magnitude with 1% steps)
+	checkAccuracy(c, 0.999, sketch.Quantile(0.999), math.Pow(10, -6+18*0.999), 0.02)
+}
+
+func BenchmarkSketchAdd(b *testing.B) {
+	sketch := NewSketch(0.01)
+	for i := 0; i < b.N; i++ {
+		sketch.Add(float64(i % 10000))
+	}
+}
@@ -7,6 +7,11 @@ import (
 type Slice struct {
 	Time int64
 	Sets map[string]*SampleSet
+	// Relative accuracy of sketches used by sample sets of timers and untyped
+	// metrics (sketches are not used when zero), and number of values kept
+	// exactly before switching to a sketch (see SampleSet.UseSketch).
+	SketchAccuracy  float64
+	SketchThreshold int
 }
 
 func NewSlice(time int64) *Slice {
@@ -20,11 +25,29 @@ func (slice *Slice) Less(sliceToCompare *Slice) bool {
 	return slice.Time < sliceToCompare.Time
 }
 
-func (slice *Slice) Add(event *Event) {
-	slice.getSampleSet(event.Source, event.Name).Add(event.Value)
-	if event.Source != "all" {
-		slice.getSampleSet("all", event.Name).Add(event.Value)
+// Add appends the given event to the sample sets of its source and of
+// the "all" source, once for each subset of event tags (see Tags.Subsets).
+// The type of a sample set is defined by the first event added to it, so
+// events of other types are rejected (returns false), since writers would
+// treat their values as values of the sample set type.
+func (slice *Slice) Add(event *Event) bool {
+	subsets := event.Tags.Subsets()
+	for _, tags := range subsets {
+		for _, source := range []string{event.Source, "all"} {
+			set, found := slice.Sets[slice.getSampleSetKey(source, event.Name, tags)]
+			if found && set.Type != event.Type {
+				return false
+			}
+		}
 	}
+
+	for _, tags := range subsets {
+		slice.getSampleSet(event.Source, event.Name, tags, event.Type).Add(event.Value)
+		if event.Source != "all" {
+			slice.getSampleSet("all", event.Name, tags, event.Type).Add(event.Value)
+		}
+	}
+	return true
 }
 
 func (slice *Slice) String() string {
@@ -35,14 +58,22 @@ func (slice *Slice) String() string {
 	)
 }
 
-func (slice *Slice) getSampleSet(source, name string) *SampleSet {
-	key := slice.getSampleSetKey(source, name)
+func (slice *Slice) getSampleSet(source, name string, tags Tags, metricType MetricType) *SampleSet {
+	key := slice.getSampleSetKey(source, name, tags)
 	if _, found := slice.Sets[key]; !found {
-		slice.Sets[key] = NewSampleSet(slice.Time, source, name)
+		set := NewTypedSampleSet(slice.Time, source, name, metricType)
+		set.Tags = tags
+		if slice.SketchAccuracy > 0 && (metricType == Untyped || metricType == Timer) {
+			set.UseSketch(slice.SketchAccuracy, slice.SketchThreshold)
+		}
+		slice.Sets[key] = set
 	}
 	return slice.Sets[key]
 }
 
-func (slice *Slice) getSampleSetKey(source, name string) string {
-	return source + "-" + name
+func (slice *Slice) getSampleSetKey(source, name string, tags Tags) string {
+	if len(tags) == 0 {
+		return source + "-" + name
+	}
+	return source + "-" + name + "," + tags.String()
 }
@@ -16,15 +16,68 @@ func (s *SliceS) SetUpTest(c *C) {
 }
 
 func (s *SliceS) TestGetAllSampleSetKey(c *C) {
-	key := s.slice.getSampleSetKey("all", "metric")
+	key := s.slice.getSampleSetKey("all", "metric", nil)
 	c.Check(key, Equals, "all-metric")
 }
 
 func (s *SliceS) TestGetMachineSampleSetKey(c *C) {
-	key := s.slice.getSampleSetKey("src", "metric")
+	key := s.slice.getSampleSetKey("src", "metric", nil)
 	c.Check(key, Equals, "src-metric")
 }
 
+func (s *SliceS) TestGetTaggedSampleSetKey(c *C) {
+	key := s.slice.getSampleSetKey("src", "metric", NewTags(Tag{"role", "api"}, Tag{"dc", "ams"}))
+	c.Check(key, Equals, "src-metric,dc=ams,role=api")
+}
+
+func (s *SliceS) TestAddTaggedEvent(c *C) {
+	event := NewEvent("src", "metric", 1)
+	event.Tags = NewTags(Tag{"dc", "ams"}, Tag{"role", "api"})
+	s.slice.Add(event)
+	c.Check(len(s.slice.Sets), Equals, 8)
+	for _, key := range []string{"metric,dc=ams,role=api", "metric,dc=ams", "metric,role=api", "metric"} {
+		c.Check(s.slice.Sets["src-"+key].FullName(), Equals, key)
+		c.Check(s.slice.Sets["all-"+key].FullName(), Equals, key)
+	}
+}
+
+func (s *SliceS) TestAddKeepsMetricType(c *C) {
+	s.slice.Add(NewTypedEvent("src", "metric", 1, Counter))
+	s.slice.Add(NewTypedEvent("src", "metric", 2, Counter))
+	c.Check(len(s.slice.Sets), Equals, 2)
+	c.Check(s.slice.Sets["src-metric"].Type, Equals, Counter)
+	c.Check(s.slice.Sets["all-metric"].Type, Equals, Counter)
+	c.Check(len(s.slice.Sets["all-metric"].Values), Equals, 2)
+}
+
+func (s *SliceS) TestAddRejectsMismatchedType(c *C) {
+	c.Check(s.slice.Add(NewTypedEvent("src", "metric", 1, Counter)), Equals, true)
+	c.Check(s.slice.Add(NewTypedEvent("src", "metric", 2, Timer)), Equals, false)
+	c.Check(s.slice.Add(NewTypedEvent("other", "metric", 3, Timer)), Equals, false)
+	c.Check(len(s.slice.Sets), Equals, 2)
+	c.Check(s.slice.Sets["src-metric"].Type, Equals, Counter)
+	c.Check(len(s.slice.Sets["all-metric"].Values), Equals, 1)
+}
+
+func (s *SliceS) TestAddRejectsMismatchedTypeOfTaggedEvent(c *C) {
+	s.slice.Add(NewTypedEvent("src", "metric", 1, Gauge))
+	event := NewTypedEvent("src", "metric", 2, Timer)
+	event.Tags = NewTags(Tag{"dc", "ams"})
+	c.Check(s.slice.Add(event), Equals, false)
+	c.Check(len(s.slice.Sets), Equals, 2)
+}
+
+func (s *SliceS) TestAddUsesSketchesForTimers(c *C) {
+	s.slice.SketchAccuracy = 0.01
+	s.slice.Add(NewTypedEvent("src", "time", 1, Timer))
+	s.slice.Add(NewEvent("src", "metric", 1))
+	s.slice.Add(NewTypedEvent("src", "requests", 1, Counter))
+	c.Check(s.slice.Sets["src-time"].Sketch, NotNil)
+	c.Check(s.slice.Sets["src-metric"].Sketch, NotNil)
+	c.Check(s.slice.Sets["src-requests"].Sketch, IsNil)
+	c.Check(len(s.slice.Sets["src-requests"].Values), Equals, 1)
+}
+
 func BenchmarkSliceAdd(b *testing.B) {
 	b.StopTimer()
 	ss := NewSlice(10)
@@ -44,7 +97,7 @@ func BenchmarkSliceGetSampleSetKey(b *testing.B) {
 	b.StartTimer()
 
 	for i := 0; i < b.N; i++ {
-		ss.getSampleSetKey("src", "metric")
+		ss.getSampleSetKey("src", "metric", nil)
 	}
 
 	b.StopTimer()
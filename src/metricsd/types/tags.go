@@ -0,0 +1,89 @@
+package types
+
+import (
+	"sort"
+	"strings"
+)
+
+// A Tag is a key=value pair describing an additional dimension of a metric.
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// String returns the tag in key=value format.
+func (tag Tag) String() string {
+	return tag.Key + "=" + tag.Value
+}
+
+// Tags is a list of tags. Use NewTags to get a list sorted by keys, which is
+// required to get a stable string representation.
+type Tags []Tag
+
+// noTagsSubsets is a list of subsets for an empty tags list (to avoid
+// allocations for untagged events).
+var noTagsSubsets = []Tags{nil}
+
+// NewTags returns a list of the given tags sorted by keys.
+func NewTags(tags ...Tag) Tags {
+	result := Tags(tags)
+	sort.Sort(result)
+	return result
+}
+
+func (tags Tags) Len() int           { return len(tags) }
+func (tags Tags) Less(i, j int) bool { return tags[i].Key < tags[j].Key }
+func (tags Tags) Swap(i, j int)      { tags[i], tags[j] = tags[j], tags[i] }
+
+// String returns the tags in key1=value1,key2=value2 format.
+func (tags Tags) String() string {
+	switch len(tags) {
+	case 0:
+		return ""
+	case 1:
+		return tags[0].String()
+	}
+	parts := make([]string, len(tags))
+	for idx, tag := range tags {
+		parts[idx] = tag.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// Get returns a value of the tag with the given key.
+func (tags Tags) Get(key string) (value string, found bool) {
+	for _, tag := range tags {
+		if tag.Key == key {
+			return tag.Value, true
+		}
+	}
+	return "", false
+}
+
+// Contains returns a value indicating whether all tags from the given
+// filter are present in the list.
+func (tags Tags) Contains(filter Tags) bool {
+	for _, tag := range filter {
+		if value, found := tags.Get(tag.Key); !found || value != tag.Value {
+			return false
+		}
+	}
+	return true
+}
+
+// Subsets returns the lists of tags an event should be aggregated by: the
+// full list, each tag separately (when there are several tags), and an empty
+// list (aggregate for all tag values).
+func (tags Tags) Subsets() []Tags {
+	if len(tags) == 0 {
+		return noTagsSubsets
+	}
+	subsets := make([]Tags, 0, len(tags)+2)
+	subsets = append(subsets, tags)
+	if len(tags) > 1 {
+		for idx := range tags {
+			subsets = append(subsets, tags[idx:idx+1])
+		}
+	}
+	return append(subsets, nil)
+}
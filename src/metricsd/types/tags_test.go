@@ -0,0 +1,42 @@
+package types
+
+import (
+	. "launchpad.net/gocheck"
+)
+
+type TagsS struct{}
+
+var _ = Suite(&TagsS{})
+
+func (s *TagsS) TestNewTagsSortsByKey(c *C) {
+	tags := NewTags(Tag{"role", "api"}, Tag{"dc", "ams"})
+	c.Check(tags.String(), Equals, "dc=ams,role=api")
+}
+
+func (s *TagsS) TestEmptyTagsString(c *C) {
+	c.Check(NewTags().String(), Equals, "")
+}
+
+func (s *TagsS) TestContains(c *C) {
+	tags := NewTags(Tag{"dc", "ams"}, Tag{"role", "api"})
+	c.Check(tags.Contains(nil), Equals, true)
+	c.Check(tags.Contains(NewTags(Tag{"dc", "ams"})), Equals, true)
+	c.Check(tags.Contains(NewTags(Tag{"dc", "sjc"})), Equals, false)
+	c.Check(tags.Contains(NewTags(Tag{"host", "app01"})), Equals, false)
+}
+
+func (s *TagsS) TestSubsets(c *C) {
+	subsets := NewTags(Tag{"dc", "ams"}, Tag{"role", "api"}).Subsets()
+	c.Assert(len(subsets), Equals, 4)
+	c.Check(subsets[0].String(), Equals, "dc=ams,role=api")
+	c.Check(subsets[1].String(), Equals, "dc=ams")
+	c.Check(subsets[2].String(), Equals, "role=api")
+	c.Check(subsets[3].String(), Equals, "")
+}
+
+func (s *TagsS) TestSubsetsOfSingleTag(c *C) {
+	subsets := NewTags(Tag{"dc", "ams"}).Subsets()
+	c.Assert(len(subsets), Equals, 2)
+	c.Check(subsets[0].String(), Equals, "dc=ams")
+	c.Check(subsets[1].String(), Equals, "")
+}
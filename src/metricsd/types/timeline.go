@@ -8,33 +8,129 @@ import (
 
 // A Timeline is used to store events in a list of slices, divided by the
 // time they have been taken at.
+//
+// Events could carry their own timestamps (e.g. when client buffers events
+// or replays a backlog), so they are placed into the slice they belong to.
+// Slice is considered closed when its interval has ended at least Grace
+// seconds ago. Events for slices, which were already extracted, are dropped
+// and counted as late events.
 type Timeline struct {
 	Interval int64
+	Grace    int64
 	Slices   map[int64]*Slice
 	mutex    *sync.Mutex
+	// Number of the last slice which was extracted (or considered closed).
+	closed int64
+	// Number of events dropped because their slices were already closed.
+	lateEvents int64
+	// Number of events dropped because their timestamps are too far in future.
+	futureEvents int64
+	// Number of events dropped because their types differ from the types of
+	// sample sets of the same metric.
+	mismatchedEvents int64
+	// Relative accuracy and threshold of sketches used by new slices (see
+	// Slice).
+	sketchAccuracy  float64
+	sketchThreshold int
+	// Function returning current time in seconds (could be replaced in tests).
+	now func() int64
 }
 
-// NewTimeline returns a new timeline Timeline with the given slice interval.
-func NewTimeline(sliceInterval int) *Timeline {
-	return &Timeline{
+// NewTimeline returns a new timeline Timeline with the given slice interval
+// and grace period (both in seconds).
+func NewTimeline(sliceInterval, grace int) *Timeline {
+	timeline := &Timeline{
 		Slices:   make(map[int64]*Slice),
 		Interval: int64(sliceInterval),
+		Grace:    int64(grace),
 		mutex:    &sync.Mutex{},
+		now:      time.Seconds,
 	}
+	timeline.closed = timeline.getClosedSliceNumber()
+	return timeline
 }
 
-// Add appends the given event to the current slice.
-func (timeline *Timeline) Add(event *Event) {
-	timeline.getCurrentSlice().Add(event)
+// Add appends the given event to the slice it belongs to (current slice if
+// event has no timestamp). Returns false if event was dropped because it is
+// too late (or too far in future), or its type differs from the type of the
+// metric in the slice (see Slice.Add).
+func (timeline *Timeline) Add(event *Event) bool {
+	timeline.mutex.Lock()
+	defer timeline.mutex.Unlock()
+
+	now := timeline.now()
+	number := now / timeline.Interval
+	if event.Time > 0 {
+		if event.Time > now+timeline.maxFutureSeconds() {
+			timeline.futureEvents++
+			return false
+		}
+		number = event.Time / timeline.Interval
+	}
+	if number <= timeline.closed {
+		timeline.lateEvents++
+		return false
+	}
+	if !timeline.getSlice(number).Add(event) {
+		timeline.mismatchedEvents++
+		return false
+	}
+	return true
 }
 
-func (timeline *Timeline) ExtractClosedSlices(force bool) (closedSlices []*Slice) {
-	var current int64
-	if force {
-		current = -1
-	} else {
-		current = timeline.getCurrentSliceNumber()
+// SetSketch makes sample sets of timers and untyped metrics in new slices
+// switch to sketches with the given relative accuracy once they have more than
+// threshold values (see SampleSet.UseSketch). Zero accuracy disables sketches.
+func (timeline *Timeline) SetSketch(accuracy float64, threshold int) {
+	timeline.mutex.Lock()
+	defer timeline.mutex.Unlock()
+	timeline.sketchAccuracy = accuracy
+	timeline.sketchThreshold = threshold
+}
+
+// LateEvents returns total number of events dropped because they arrived
+// after their slices were closed.
+func (timeline *Timeline) LateEvents() int64 {
+	timeline.mutex.Lock()
+	defer timeline.mutex.Unlock()
+	return timeline.lateEvents
+}
+
+// FutureEvents returns total number of events dropped because their
+// timestamps were too far in future.
+func (timeline *Timeline) FutureEvents() int64 {
+	timeline.mutex.Lock()
+	defer timeline.mutex.Unlock()
+	return timeline.futureEvents
+}
+
+// MismatchedEvents returns total number of events dropped because their
+// types differed from the types of sample sets of the same metric.
+func (timeline *Timeline) MismatchedEvents() int64 {
+	timeline.mutex.Lock()
+	defer timeline.mutex.Unlock()
+	return timeline.mismatchedEvents
+}
+
+// SampleSets returns the number of sample sets in all slices of the timeline.
+func (timeline *Timeline) SampleSets() (count int) {
+	timeline.mutex.Lock()
+	defer timeline.mutex.Unlock()
+
+	for _, slice := range timeline.Slices {
+		count += len(slice.Sets)
 	}
+	return
+}
+
+// ExtractClosedSlices finds closed slices, and returns them sorted by time.
+// Processed slices will be removed from the timeline. When force is true, all
+// slices are extracted.
+func (timeline *Timeline) ExtractClosedSlices(force bool) (closedSlices []*Slice) {
+	timeline.mutex.Lock()
+	defer timeline.mutex.Unlock()
+
+	current := timeline.closeSlices(force)
 
 	// Calculate total number of closed timeline (to avoid vector reallocs)
 	totalClosedSlices := 0
@@ -46,9 +142,7 @@ func (timeline *Timeline) ExtractClosedSlices(force bool) (closedSlices []*Slice
 	closedSlices = make([]*Slice, 0, totalClosedSlices)
 	timeline.eachClosedSlice(current, func(number int64, slice *Slice) {
 		closedSlices = append(closedSlices, slice)
-		timeline.mutex.Lock()
 		timeline.Slices[number] = nil, false
-		timeline.mutex.Unlock()
 	})
 	SortSlices(closedSlices)
 	return
@@ -57,12 +151,10 @@ func (timeline *Timeline) ExtractClosedSlices(force bool) (closedSlices []*Slice
 // ExtractClosedSampleSets finds closed timeline, and stores all sample sets from them
 // in an array. Processed timeline will be removed from the list of active timeline.
 func (timeline *Timeline) ExtractClosedSampleSets(force bool) (closedSampleSets []*SampleSet) {
-	var current int64
-	if force {
-		current = -1
-	} else {
-		current = timeline.getCurrentSliceNumber()
-	}
+	timeline.mutex.Lock()
+	defer timeline.mutex.Unlock()
+
+	current := timeline.closeSlices(force)
 
 	// Calculate total number of closed sample sets (to avoid vector reallocs)
 	totalSampleSets := 0
@@ -76,9 +168,7 @@ func (timeline *Timeline) ExtractClosedSampleSets(force bool) (closedSampleSets
 		for _, set := range slice.Sets {
 			closedSampleSets = append(closedSampleSets, set)
 		}
-		timeline.mutex.Lock()
 		timeline.Slices[number] = nil, false
-		timeline.mutex.Unlock()
 	})
 	SortSampleSets(closedSampleSets)
 	return
@@ -86,28 +176,51 @@ func (timeline *Timeline) ExtractClosedSampleSets(force bool) (closedSampleSets
 
 func (timeline *Timeline) String() string {
 	return fmt.Sprintf(
-		"Timeline[interval=%d, size=%d]",
+		"Timeline[interval=%d, grace=%d, size=%d]",
 		timeline.Interval,
+		timeline.Grace,
 		len(timeline.Slices),
 	)
 }
 
-// getCurrentSlice creates (if necessary) and returns the current slice
-// (see getCurrentSliceNumber for details).
-func (timeline *Timeline) getCurrentSlice() *Slice {
-	number := timeline.getCurrentSliceNumber()
+// getSlice creates (if necessary) and returns the slice with the given number.
+// Should be called with mutex locked.
+func (timeline *Timeline) getSlice(number int64) *Slice {
 	if _, found := timeline.Slices[number]; !found {
-		timeline.mutex.Lock()
-		timeline.Slices[number] = NewSlice(number * timeline.Interval)
-		timeline.mutex.Unlock()
+		slice := NewSlice(number * timeline.Interval)
+		slice.SketchAccuracy = timeline.sketchAccuracy
+		slice.SketchThreshold = timeline.sketchThreshold
+		timeline.Slices[number] = slice
 	}
 	return timeline.Slices[number]
 }
 
-// getCurrentSliceNumber returns current slice number (time since epoc in
-// seconds, rounded to the slices interval).
-func (timeline *Timeline) getCurrentSliceNumber() int64 {
-	return time.Seconds() / timeline.Interval
+// closeSlices moves the closed slices boundary forward, and returns the
+// number of the first slice which should not be extracted (or -1 if all
+// slices should be extracted). Should be called with mutex locked.
+func (timeline *Timeline) closeSlices(force bool) int64 {
+	if closed := timeline.getClosedSliceNumber(); closed > timeline.closed {
+		timeline.closed = closed
+	}
+	if force {
+		return -1
+	}
+	return timeline.closed + 1
+}
+
+// getClosedSliceNumber returns the number of the last closed slice (time since
+// epoch in seconds minus grace period, rounded to the slices interval).
+func (timeline *Timeline) getClosedSliceNumber() int64 {
+	return (timeline.now()-timeline.Grace)/timeline.Interval - 1
+}
+
+// maxFutureSeconds returns the number of seconds event timestamp could be
+// ahead of the current time (to tolerate clients clock skew).
+func (timeline *Timeline) maxFutureSeconds() int64 {
+	if timeline.Grace > timeline.Interval {
+		return timeline.Grace
+	}
+	return timeline.Interval
 }
 
 // eachClosedSlice calls function f for each slice with the slice number less
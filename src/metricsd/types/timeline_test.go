@@ -0,0 +1,117 @@
+package types
+
+import (
+	. "launchpad.net/gocheck"
+)
+
+type TimelineS struct {
+	timeline *Timeline
+	now      int64
+}
+
+var _ = Suite(&TimelineS{})
+
+func (s *TimelineS) SetUpTest(c *C) {
+	s.now = 1005
+	s.timeline = NewTimeline(10, 0)
+	s.timeline.now = func() int64 { return s.now }
+	s.timeline.closed = s.timeline.getClosedSliceNumber()
+}
+
+func (s *TimelineS) TestAddWithoutTimestamp(c *C) {
+	c.Check(s.timeline.Add(NewEvent("src", "metric", 1)), Equals, true)
+	c.Assert(s.timeline.Slices[100], NotNil)
+	c.Check(s.timeline.Slices[100].Time, Equals, int64(1000))
+}
+
+func (s *TimelineS) TestAddWithTimestamp(c *C) {
+	s.timeline.Grace = 20
+	s.timeline.closed = s.timeline.getClosedSliceNumber()
+	event := NewEvent("src", "metric", 1)
+	event.Time = 992
+	c.Check(s.timeline.Add(event), Equals, true)
+	c.Assert(s.timeline.Slices[99], NotNil)
+	c.Check(s.timeline.Slices[99].Time, Equals, int64(990))
+}
+
+func (s *TimelineS) TestSampleSets(c *C) {
+	c.Check(s.timeline.SampleSets(), Equals, 0)
+	s.timeline.Add(NewEvent("src", "metric", 1))
+	s.timeline.Add(NewEvent("src", "metric", 2))
+	event := NewEvent("src", "other", 1)
+	event.Time = 1012
+	s.timeline.Add(event)
+	// Events are added to sample sets of their source and of "all"
+	c.Check(s.timeline.SampleSets(), Equals, 4)
+}
+
+func (s *TimelineS) TestSetSketch(c *C) {
+	s.timeline.SetSketch(0.01, 100)
+	s.timeline.Add(NewEvent("src", "metric", 1))
+	c.Assert(s.timeline.Slices[100], NotNil)
+	c.Check(s.timeline.Slices[100].SketchAccuracy, Equals, 0.01)
+	c.Check(s.timeline.Slices[100].SketchThreshold, Equals, 100)
+}
+
+func (s *TimelineS) TestExtractClosedSlices(c *C) {
+	event := NewEvent("src", "metric", 1)
+	s.timeline.Add(event)
+	c.Check(len(s.timeline.ExtractClosedSlices(false)), Equals, 0)
+
+	s.now = 1012
+	slices := s.timeline.ExtractClosedSlices(false)
+	c.Assert(len(slices), Equals, 1)
+	c.Check(slices[0].Time, Equals, int64(1000))
+	c.Check(len(s.timeline.Slices), Equals, 0)
+}
+
+func (s *TimelineS) TestExtractClosedSlicesWaitsForGrace(c *C) {
+	s.timeline.Grace = 5
+	s.timeline.Add(NewEvent("src", "metric", 1))
+
+	s.now = 1012
+	c.Check(len(s.timeline.ExtractClosedSlices(false)), Equals, 0)
+
+	// Event for the previous slice is still accepted within the grace period
+	event := NewEvent("src", "metric", 2)
+	event.Time = 1008
+	c.Check(s.timeline.Add(event), Equals, true)
+
+	s.now = 1015
+	slices := s.timeline.ExtractClosedSlices(false)
+	c.Assert(len(slices), Equals, 1)
+	c.Check(len(slices[0].Sets["src-metric"].Values), Equals, 2)
+}
+
+func (s *TimelineS) TestLateEventsAreDropped(c *C) {
+	s.timeline.Add(NewEvent("src", "metric", 1))
+	s.now = 1012
+	s.timeline.ExtractClosedSlices(false)
+
+	event := NewEvent("src", "metric", 1)
+	event.Time = 1009
+	c.Check(s.timeline.Add(event), Equals, false)
+	c.Check(s.timeline.LateEvents(), Equals, int64(1))
+	c.Check(len(s.timeline.Slices), Equals, 0)
+}
+
+func (s *TimelineS) TestFutureEventsAreDropped(c *C) {
+	event := NewEvent("src", "metric", 1)
+	event.Time = 1100
+	c.Check(s.timeline.Add(event), Equals, false)
+	c.Check(s.timeline.FutureEvents(), Equals, int64(1))
+	c.Check(s.timeline.LateEvents(), Equals, int64(0))
+}
+
+func (s *TimelineS) TestMismatchedEventsAreDropped(c *C) {
+	c.Check(s.timeline.Add(NewTypedEvent("src", "metric", 1, Counter)), Equals, true)
+	c.Check(s.timeline.Add(NewTypedEvent("src", "metric", 1, Timer)), Equals, false)
+	c.Check(s.timeline.MismatchedEvents(), Equals, int64(1))
+	c.Check(s.timeline.LateEvents(), Equals, int64(0))
+}
+
+func (s *TimelineS) TestForcedExtractReturnsAllSlices(c *C) {
+	s.timeline.Add(NewEvent("src", "metric", 1))
+	c.Check(len(s.timeline.ExtractClosedSampleSets(true)), Equals, 2)
+	c.Check(len(s.timeline.Slices), Equals, 0)
+}
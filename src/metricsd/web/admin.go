@@ -0,0 +1,36 @@
+package web
+
+import (
+	"os"
+	"github.com/hoisie/web.go"
+)
+
+/***** Administration *********************************************************/
+
+// ReloadConfig reloads the configuration file and applies it (set by main).
+var ReloadConfig func() os.Error
+
+// admin_reload reloads configuration. Allowed only for requests from the
+// local host, e.g. curl -X POST http://localhost:6311/admin/reload
+func admin_reload(ctx *web.Context) {
+	if !isLocalRequest(ctx) {
+		ctx.Abort(403, "Configuration could be reloaded only from the local host")
+		return
+	}
+	if ReloadConfig == nil {
+		ctx.Abort(501, "Configuration reload is not supported")
+		return
+	}
+	if err := ReloadConfig(); err != nil {
+		ctx.Abort(500, err.String())
+		return
+	}
+	ctx.Write([]byte("Configuration reloaded\n"))
+}
+
+// isLocalRequest returns a value indicating whether the request is sent from
+// the loopback address.
+func isLocalRequest(ctx *web.Context) bool {
+	addr := ctx.Request.RemoteAddr
+	return addr == "127.0.0.1" || addr == "::1"
+}
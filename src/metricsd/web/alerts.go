@@ -0,0 +1,64 @@
+package web
+
+import (
+	"time"
+	"metricsd/alerts"
+	"github.com/hoisie/web.go"
+	"github.com/hoisie/mustache.go"
+)
+
+/***** Alerts *****************************************************************/
+
+// Alerts is the engine alert rules are evaluated by (set by main).
+var Alerts *alerts.Engine
+
+// alerts_page renders alerts firing at the moment, and recently resolved
+// alerts.
+func alerts_page() string {
+	var firing, resolved []*alerts.Alert
+	if Alerts != nil {
+		firing, resolved = Alerts.Firing(), Alerts.Resolved()
+	}
+	return mustache.RenderFile(template("alerts"), map[string]interface{}{
+		"firing":      alertItems(firing),
+		"hasFiring":   len(firing) > 0,
+		"resolved":    alertItems(resolved),
+		"hasResolved": len(resolved) > 0,
+	})
+}
+
+// api_alerts returns alerts firing at the moment, and recently resolved
+// alerts in JSON: {"firing": [...], "resolved": [...]}.
+func api_alerts(ctx *web.Context) {
+	firing, resolved := []*alerts.Alert{}, []*alerts.Alert{}
+	if Alerts != nil {
+		firing, resolved = Alerts.Firing(), Alerts.Resolved()
+	}
+	writeJson(ctx, map[string][]*alerts.Alert{"firing": firing, "resolved": resolved})
+}
+
+// alertItems returns alerts with formatted times for templates.
+func alertItems(list []*alerts.Alert) []map[string]interface{} {
+	items := make([]map[string]interface{}, len(list))
+	for i, alert := range list {
+		items[i] = map[string]interface{}{
+			"name":   alert.Name,
+			"rule":   alert.Rule,
+			"source": alert.Source,
+			"metric": alert.Metric,
+			"series": alert.Series,
+			"value":  alert.Value,
+			"since":  formatAlertTime(alert.Since),
+			"until":  formatAlertTime(alert.Until),
+		}
+	}
+	return items
+}
+
+// formatAlertTime formats the time in seconds since epoch (empty for 0).
+func formatAlertTime(seconds int64) string {
+	if seconds == 0 {
+		return ""
+	}
+	return time.SecondsToLocalTime(seconds).Format("2006-01-02 15:04:05")
+}
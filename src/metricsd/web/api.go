@@ -0,0 +1,239 @@
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"json"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"metricsd/config"
+	"metricsd/rrd"
+	"metricsd/writers"
+	"github.com/hoisie/web.go"
+)
+
+/***** Data API ***************************************************************/
+
+type apiMetric struct {
+	Name    string            `json:"name"`   // full series name (metric name with tags)
+	Metric  string            `json:"metric"` // metric name without tags
+	Group   string            `json:"group"`
+	Tags    map[string]string `json:"tags"`
+	Writers []string          `json:"writers"`
+}
+
+type apiSeries struct {
+	Source      string   `json:"source"`
+	Metric      string   `json:"metric"`
+	Writer      string   `json:"writer"`
+	CF          string   `json:"cf"`
+	Start       int64    `json:"start"`
+	End         int64    `json:"end"`
+	Step        int64    `json:"step"`
+	DataSources []string `json:"data_sources"`
+	// Rows of the timestamp followed by values of each data source, unknown
+	// values are null. Timestamp is the end of the interval.
+	Values [][]interface{} `json:"values"`
+}
+
+// api_sources returns names of all sources with metrics. When the "local"
+// parameter is given, only sources stored on the current node are returned
+// (used by other cluster nodes).
+func api_sources(ctx *web.Context) {
+	if _, local := ctx.Params["local"]; local {
+		writeJson(ctx, scanSources())
+		return
+	}
+
+	sources := browser.ListSources("")
+	names := make([]string, len(sources))
+	for i, source := range sources {
+		names[i] = source.Source
+	}
+	sort.Strings(names)
+	writeJson(ctx, names)
+}
+
+// api_metrics returns all series of the source given in the "source"
+// parameter (default is "all") with the list of their writers. When the
+// "local" parameter is given, only series stored on the current node are
+// returned (used by other cluster nodes).
+func api_metrics(ctx *web.Context) {
+	source, found := ctx.Params["source"]
+	if !found {
+		source = "all"
+	}
+	if !validPathComponent(source) {
+		ctx.Abort(400, fmt.Sprintf("Source %q is invalid", source))
+		return
+	}
+
+	var files graphItemsList
+	if _, local := ctx.Params["local"]; local {
+		files = scanFiles(source)
+	} else {
+		files = browser.List(source, "")
+	}
+	sort.Sort(files)
+
+	metrics := make([]*apiMetric, 0, len(files))
+	for _, file := range files {
+		if len(metrics) > 0 && metrics[len(metrics)-1].Name == file.Name {
+			last := metrics[len(metrics)-1]
+			last.Writers = append(last.Writers, file.Writer)
+			continue
+		}
+		tags := make(map[string]string, len(file.Tags))
+		for _, tag := range file.Tags {
+			tags[tag.Key] = tag.Value
+		}
+		metrics = append(metrics, &apiMetric{file.Name, file.Metric, file.Group, tags, []string{file.Writer}})
+	}
+	writeJson(ctx, metrics)
+}
+
+// api_tree returns the tree of metrics of the source given in the "source"
+// parameter (default is "all") starting from the node with the given "path"
+// (the root by default), with "depth" levels of children (default is 1).
+func api_tree(ctx *web.Context) {
+	params := struct {
+		Source, Path string
+		Depth        int
+	}{"all", "", 1}
+	ctx.Request.UnmarshalParams(&params)
+	if !validPathComponent(params.Source) {
+		ctx.Abort(400, fmt.Sprintf("Source %q is invalid", params.Source))
+		return
+	}
+
+	node := browser.Tree(params.Source).find(params.Path)
+	if node == nil {
+		ctx.Abort(404, fmt.Sprintf("Node %q is not found", params.Path))
+		return
+	}
+	writeJson(ctx, node.truncate(params.Depth))
+}
+
+func api_series_json(ctx *web.Context, source, metric, writer string) {
+	if proxyToOwner(ctx, metric) {
+		return
+	}
+	series := fetchSeries(ctx, source, metric, writer)
+	if series != nil {
+		writeJson(ctx, series)
+	}
+}
+
+func api_series_csv(ctx *web.Context, source, metric, writer string) {
+	if proxyToOwner(ctx, metric) {
+		return
+	}
+	series := fetchSeries(ctx, source, metric, writer)
+	if series == nil {
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("timestamp," + strings.Join(series.DataSources, ",") + "\n")
+	for _, row := range series.Values {
+		buf.WriteString(strconv.Itoa64(row[0].(int64)))
+		for _, value := range row[1:] {
+			buf.WriteString(",")
+			if value != nil {
+				buf.WriteString(strconv.Ftoa64(value.(float64), 'f', -1))
+			}
+		}
+		buf.WriteString("\n")
+	}
+	ctx.SetHeader("Content-Type", "text/csv; charset=utf-8", true)
+	ctx.Write(buf.Bytes())
+}
+
+// prometheus_metrics returns the latest rolled up values of all series stored
+// on the current node in the Prometheus text exposition format.
+func prometheus_metrics(ctx *web.Context) {
+	ctx.SetHeader("Content-Type", "text/plain; version=0.0.4; charset=utf-8", true)
+	ctx.Write(writers.Prometheus())
+}
+
+// fetchSeries fetches values of the writer data. Time range is selected with
+// "rra", "start" and "end" parameters (see timeRange), "step" is the
+// requested resolution in seconds and "cf" is the consolidation function
+// (default is AVERAGE). The archive with the closest resolution is used.
+// Returns nil when request failed.
+func fetchSeries(ctx *web.Context, source, metric, writer string) *apiSeries {
+	for _, name := range []string{source, metric, writer} {
+		if !validPathComponent(name) {
+			ctx.Abort(400, fmt.Sprintf("Series name %q is invalid", name))
+			return nil
+		}
+	}
+
+	cf := "AVERAGE"
+	if value, found := ctx.Params["cf"]; found {
+		cf = strings.ToUpper(value)
+	}
+	var step int64
+	if value, found := ctx.Params["step"]; found {
+		var err os.Error
+		if step, err = strconv.Atoi64(value); err != nil || step < 0 {
+			ctx.Abort(400, fmt.Sprintf("Step %q is invalid", value))
+			return nil
+		}
+	}
+	_, start, end := timeRange(ctx)
+
+	file := fmt.Sprintf("%s/%s/%s-%s.rrd", config.DataDir, source, metric, writer)
+	if _, err := os.Stat(file); err != nil {
+		ctx.Abort(404, fmt.Sprintf("Series %s/%s/%s is not found", source, metric, writer))
+		return nil
+	}
+	result, err := rrd.Fetch(file, cf, start, end, step)
+	if err != nil {
+		ctx.Abort(400, err.String())
+		return nil
+	}
+
+	series := &apiSeries{
+		Source:      source,
+		Metric:      metric,
+		Writer:      writer,
+		CF:          cf,
+		Start:       result.Start,
+		End:         result.End,
+		Step:        result.Step,
+		DataSources: result.DataSources,
+		Values:      make([][]interface{}, len(result.Values)),
+	}
+	for i, values := range result.Values {
+		row := make([]interface{}, len(values)+1)
+		row[0] = result.Start + int64(i+1)*result.Step
+		for j, value := range values {
+			if !math.IsNaN(value) {
+				row[j+1] = value
+			}
+		}
+		series.Values[i] = row
+	}
+	return series
+}
+
+func writeJson(ctx *web.Context, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		log.Error("JSON: %s", err)
+		ctx.Abort(500, err.String())
+		return
+	}
+	ctx.SetHeader("Content-Type", "application/json; charset=utf-8", true)
+	ctx.Write(data)
+}
+
+// validPathComponent returns a value indicating whether the name could be
+// safely used as a part of a data file path.
+func validPathComponent(name string) bool {
+	return len(name) > 0 && !strings.Contains(name, "/") && !strings.HasPrefix(name, ".")
+}
@@ -0,0 +1,188 @@
+package web
+
+import (
+	"fmt"
+	"http"
+	"io/ioutil"
+	"json"
+	"net"
+	"os"
+	"time"
+	"metricsd/cluster"
+	"github.com/hoisie/web.go"
+)
+
+/***** Cluster ****************************************************************/
+
+// Timeout of connecting to other cluster nodes, and of each read and write
+// of requests to them, in nanoseconds.
+const NODE_TIMEOUT = 5e9
+
+// Cluster is the cluster metrics are sharded across (set by main, nil when
+// cluster is not configured). Lists of sources and metrics are merged from
+// all nodes, and requests for data of a metric are sent to its owner.
+var Cluster *cluster.Cluster
+
+// proxyToOwner sends the request to the node owning the metric, and writes
+// its response. Returns false when the metric is owned by the current node
+// (or cluster is not configured), so the request should be handled locally.
+func proxyToOwner(ctx *web.Context, metric string) bool {
+	if Cluster == nil {
+		return false
+	}
+	owner, local := Cluster.Owner(metric)
+	if local {
+		return false
+	}
+
+	path := ctx.Request.URL.Path
+	if len(ctx.Request.URL.RawQuery) > 0 {
+		path += "?" + ctx.Request.URL.RawQuery
+	}
+	response, body, err := fetch(owner.Web, path)
+	if err != nil {
+		log.Error("Cannot send request to node %s: %s", owner.Name, err)
+		ctx.Abort(502, fmt.Sprintf("Node %s owning the metric is not available", owner.Name))
+		return true
+	}
+
+	if response.StatusCode != 200 {
+		ctx.Abort(response.StatusCode, string(body))
+		return true
+	}
+	ctx.SetHeader("Content-Type", response.Header.Get("Content-Type"), true)
+	ctx.Write(body)
+	return true
+}
+
+// scanClusterSources returns names of sources stored on all nodes.
+func scanClusterSources() []string {
+	sources := scanSources()
+	if Cluster == nil {
+		return sources
+	}
+
+	found := make(map[string]bool, len(sources))
+	for _, source := range sources {
+		found[source] = true
+	}
+	for _, node := range Cluster.Peers() {
+		var names []string
+		if err := fetchJson(node, "/api/sources?local=1", &names); err != nil {
+			log.Warn("Cannot list sources of node %s: %s", node.Name, err)
+			continue
+		}
+		for _, source := range names {
+			if !found[source] {
+				found[source] = true
+				sources = append(sources, source)
+			}
+		}
+	}
+	return sources
+}
+
+// scanClusterFiles returns data files of the source stored on all nodes.
+// Files stored on nodes which do not own them anymore (not rebalanced after
+// membership change) are skipped.
+func scanClusterFiles(source string) graphItemsList {
+	local := scanFiles(source)
+	if Cluster == nil {
+		return local
+	}
+
+	files := make(graphItemsList, 0, len(local))
+	for _, file := range local {
+		if _, owned := Cluster.Owner(file.Metric); owned {
+			files = append(files, file)
+		}
+	}
+	for _, node := range Cluster.Peers() {
+		var metrics []*apiMetric
+		if err := fetchJson(node, "/api/metrics?local=1&source="+http.URLEscape(source), &metrics); err != nil {
+			log.Warn("Cannot list metrics of node %s: %s", node.Name, err)
+			continue
+		}
+		for _, metric := range metrics {
+			if owner, _ := Cluster.Owner(metric.Metric); owner != node {
+				continue
+			}
+			for _, writer := range metric.Writers {
+				if file := newGraphItem(metric.Name, writer); file != nil {
+					files = append(files, file)
+				}
+			}
+		}
+	}
+	return files
+}
+
+// fetchJson sends request to the web interface of the node, and decodes its
+// JSON response into the value.
+func fetchJson(node *cluster.Node, path string, value interface{}) os.Error {
+	response, body, err := fetch(node.Web, path)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != 200 {
+		return os.NewError(fmt.Sprintf("Request %s failed: %s", path, response.Status))
+	}
+	return json.Unmarshal(body, value)
+}
+
+// fetch sends GET request for the path to the web interface at the given
+// address, and reads the response body. Connecting, and each read and write
+// fail after NODE_TIMEOUT, so a slow or dead node does not block requests.
+func fetch(address, path string) (*http.Response, []byte, os.Error) {
+	conn, err := dial(address, NODE_TIMEOUT)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	conn.SetTimeout(NODE_TIMEOUT)
+
+	request, err := http.NewRequest("GET", "http://"+address+path, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	request.Close = true
+	response, err := http.NewClientConn(conn, nil).Do(request)
+	// Connection is not reused, so it is not an error
+	if err != nil && err != http.ErrPersistEOF {
+		return nil, nil, err
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	return response, body, nil
+}
+
+// dialResult is a connection established in background by dial.
+type dialResult struct {
+	conn net.Conn
+	err  os.Error
+}
+
+// dial connects to the TCP address, failing after the timeout. Connection
+// established after the timeout is closed.
+func dial(address string, timeout int64) (net.Conn, os.Error) {
+	done := make(chan *dialResult, 1)
+	go func() {
+		conn, err := net.Dial("tcp", address)
+		done <- &dialResult{conn, err}
+	}()
+
+	select {
+	case result := <-done:
+		return result.conn, result.err
+	case <-time.After(timeout):
+	}
+	go func() {
+		if result := <-done; result.conn != nil {
+			result.conn.Close()
+		}
+	}()
+	return nil, os.NewError(fmt.Sprintf("Connection to %s timed out after %d seconds", address, int(timeout/1e9)))
+}
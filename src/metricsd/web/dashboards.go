@@ -0,0 +1,135 @@
+package web
+
+import (
+	"fmt"
+	"io/ioutil"
+	"json"
+	"os"
+	"path"
+	"strings"
+	"metricsd/config"
+)
+
+// Dashboard is a page with graphs defined in a JSON file in the dashboards
+// directory, e.g. dashboards/frontend.json:
+//     {
+//         "Title": "Frontend",
+//         "Panels": [
+//             {"Metric": "app.requests", "Writer": "count", "Sources": ["all", "web1"]},
+//             {"Metric": "app.time", "Writer": "percentiles", "Rra": "weekly", "Width": 800, "Height": 300}
+//         ]
+//     }
+type Dashboard struct {
+	Name   string // file name without extension
+	Title  string
+	Panels []*Panel
+}
+
+// Panel is a graph of the metric for each of the sources.
+type Panel struct {
+	Title         string
+	Metric        string
+	Writer        string
+	Sources       []string // default is "all"
+	Rra           string   // time range (hourly, daily, weekly, monthly, yearly)
+	Start, End    int      // custom time range, relative to the current time when negative
+	Width, Height int
+}
+
+// Default size of dashboard graphs.
+const (
+	DEFAULT_PANEL_WIDTH  = 400
+	DEFAULT_PANEL_HEIGHT = 150
+)
+
+// loadDashboard loads dashboard with the given name from the dashboards
+// directory.
+func loadDashboard(name string) (*Dashboard, os.Error) {
+	if !validPathComponent(name) {
+		return nil, os.NewError(fmt.Sprintf("Dashboard name %q is invalid", name))
+	}
+	data, err := ioutil.ReadFile(path.Join(config.DashboardsDir, name+".json"))
+	if err != nil {
+		return nil, err
+	}
+
+	dashboard := &Dashboard{}
+	if err = json.Unmarshal(data, dashboard); err != nil {
+		return nil, os.NewError(fmt.Sprintf("Dashboard %q is invalid: %s", name, err))
+	}
+	dashboard.Name = name
+	if len(dashboard.Title) == 0 {
+		dashboard.Title = name
+	}
+
+	for i, panel := range dashboard.Panels {
+		if !validPathComponent(panel.Metric) || !validPathComponent(panel.Writer) {
+			return nil, os.NewError(fmt.Sprintf("Dashboard %q panel %d should have valid metric and writer", name, i+1))
+		}
+		if len(panel.Sources) == 0 {
+			panel.Sources = []string{"all"}
+		}
+		for _, source := range panel.Sources {
+			if !validPathComponent(source) {
+				return nil, os.NewError(fmt.Sprintf("Dashboard %q panel %d source %q is invalid", name, i+1, source))
+			}
+		}
+		if len(panel.Title) == 0 {
+			panel.Title = fmt.Sprintf("%s :: %s", panel.Metric, panel.Writer)
+		}
+		if panel.Width <= 0 {
+			panel.Width = DEFAULT_PANEL_WIDTH
+		}
+		if panel.Height <= 0 {
+			panel.Height = DEFAULT_PANEL_HEIGHT
+		}
+	}
+	return dashboard, nil
+}
+
+// listDashboards returns all valid dashboards sorted by name.
+func listDashboards() (dashboards []*Dashboard) {
+	dashboards = make([]*Dashboard, 0, 10)
+	dir, err := ioutil.ReadDir(config.DashboardsDir)
+	if err != nil {
+		return
+	}
+	for _, fi := range dir {
+		if fi.IsDirectory() || !strings.HasSuffix(fi.Name, ".json") {
+			continue
+		}
+		dashboard, err := loadDashboard(fi.Name[:len(fi.Name)-len(".json")])
+		if err != nil {
+			log.Warn("%s", err)
+			continue
+		}
+		dashboards = append(dashboards, dashboard)
+	}
+	return
+}
+
+// graphs returns graph of the panel for each of its sources.
+func (panel *Panel) graphs() []map[string]interface{} {
+	query := fmt.Sprintf("width=%d&height=%d", panel.Width, panel.Height)
+	if len(panel.Rra) > 0 {
+		query += "&rra=" + panel.Rra
+	}
+	if panel.Start != 0 {
+		query += fmt.Sprintf("&start=%d", panel.Start)
+	}
+	if panel.End != 0 {
+		query += fmt.Sprintf("&end=%d", panel.End)
+	}
+
+	graphs := make([]map[string]interface{}, len(panel.Sources))
+	for i, source := range panel.Sources {
+		graphs[i] = map[string]interface{}{
+			"source": source,
+			"metric": panel.Metric,
+			"writer": panel.Writer,
+			"title":  panel.Title,
+			"query":  query,
+		}
+	}
+	return graphs
+}
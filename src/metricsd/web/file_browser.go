@@ -5,14 +5,21 @@ import (
 	"path"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 	"metricsd/config"
+	"metricsd/parser"
+	"metricsd/types"
 )
 
 type graphItem struct {
-	Name   string
-	Writer string
-	Group  string
-	Title  string
+	Name    string // full series name (metric name with tags)
+	Writer  string
+	Group   string
+	Title   string
+	Metric  string     // metric name without tags
+	Tags    types.Tags // series tags
+	HasTags bool
 }
 
 func (graph *graphItem) Less(graphToCompare interface{}) bool {
@@ -38,14 +45,14 @@ func (l graphItemsList) Less(i, j int) bool {
 	return l[i].Less(l[j])
 }
 
-type graphItemGroup struct {
-	Group    string
-	HasGroup bool
-	Graphs   graphItemsList
+type tagValueItem struct {
+	Key   string
+	Value string
 }
 
-func (group *graphItemGroup) Less(groupToCompare *graphItemGroup) bool {
-	return len(groupToCompare.Group) == 0 || (len(group.Group) > 0 && group.Group < groupToCompare.Group)
+type tagKeyItem struct {
+	Key    string
+	Values []*tagValueItem
 }
 
 type graphItemSource struct {
@@ -58,69 +65,229 @@ func (source *graphItemSource) Less(sourceToCompare interface{}) bool {
 	return source.Source == "all" || (s.Source != "all" && source.Source < s.Source)
 }
 
-type graphItemGroupsList []*graphItemGroup
+type tagValueItemsList []*tagValueItem
 
 // Swap exchanges the elements at indexes i and j.
-func (l graphItemGroupsList) Swap(i, j int) {
+func (l tagValueItemsList) Swap(i, j int) {
 	l[i], l[j] = l[j], l[i]
 }
 
-// Swap exchanges the elements at indexes i and j.
-func (l graphItemGroupsList) Len() int {
+// Len returns the number of elements in the list.
+func (l tagValueItemsList) Len() int {
 	return len(l)
 }
 
-// Swap exchanges the elements at indexes i and j.
-func (l graphItemGroupsList) Less(i, j int) bool {
-	return l[i].Less(l[j])
+// Less returns a value indicating whether the element at index i should sort
+// before the element at index j.
+func (l tagValueItemsList) Less(i, j int) bool {
+	return l[i].Value < l[j].Value
+}
+
+// Browser lists metrics available in the data directory. Directory listings
+// are cached for the write interval, because new data files appear only when
+// writers flush their data. Directories (and other cluster nodes) are scanned
+// without holding the mutex, so a slow node does not block requests served
+// from the cache.
+type Browser struct {
+	mutex   sync.Mutex
+	sources *browserCache            // list of sources
+	files   map[string]*browserCache // data files by source
 }
 
-type Browser struct{}
+type browserCache struct {
+	expires int64
+	sources []string
+	files   graphItemsList
+	tree    *treeNode // built on first request
+}
+
+var browser = &Browser{files: make(map[string]*browserCache)}
 
-var browser = &Browser{}
+// ListMetrics returns one graph per untagged metric for the given source
+// (metrics of different types are aggregated by different writers, so the
+// first writer in alphabetical order is used).
+func (browser *Browser) ListMetrics(source string) graphItemsList {
+	return uniqueMetrics(browser.List(source, ""))
+}
 
-func (browser *Browser) ListCountGraphsGrouped() (groups graphItemGroupsList) {
-	groups = make(graphItemGroupsList, 0, 10)
-	for _, file := range browser.List("all", "", "-count.rrd") {
-		found := false
-		for _, group := range groups {
-			if file.Group == group.Group {
-				group.Graphs = append(group.Graphs, file)
-				found = true
+// Tree returns the tree of untagged metrics of the given source.
+func (browser *Browser) Tree(source string) *treeNode {
+	cache := browser.cachedFiles(source)
+
+	browser.mutex.Lock()
+	defer browser.mutex.Unlock()
+	if cache.tree == nil {
+		files := make(graphItemsList, len(cache.files))
+		copy(files, cache.files)
+		cache.tree = buildTree(uniqueMetrics(files))
+	}
+	return cache.tree
+}
+
+// ListTags returns tag keys with all their values available for the given
+// metric and source.
+func (browser *Browser) ListTags(source, metric string) (keys []*tagKeyItem) {
+	values := make(map[string]map[string]bool)
+	for _, file := range browser.List(source, "") {
+		if file.Metric != metric {
+			continue
+		}
+		for _, tag := range file.Tags {
+			if _, found := values[tag.Key]; !found {
+				values[tag.Key] = make(map[string]bool)
 			}
+			values[tag.Key][tag.Value] = true
 		}
-		if !found {
-			group := &graphItemGroup{file.Group, len(file.Group) > 0, make(graphItemsList, 0, 10)}
-			group.Graphs = append(group.Graphs, file)
-			groups = append(groups, group)
+	}
+
+	names := make([]string, 0, len(values))
+	for key := range values {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+
+	keys = make([]*tagKeyItem, 0, len(names))
+	for _, key := range names {
+		item := &tagKeyItem{key, make([]*tagValueItem, 0, len(values[key]))}
+		for value := range values[key] {
+			item.Values = append(item.Values, &tagValueItem{key, value})
 		}
+		sort.Sort(tagValueItemsList(item.Values))
+		keys = append(keys, item)
 	}
-	sort.Sort(groups)
-	for _, group := range groups {
-		sort.Sort(group.Graphs)
+	return
+}
+
+// ListTagged returns graphs of the tagged series of the given metric, which
+// have all tags from the filter. If writer is empty, graphs for all writers
+// are returned.
+func (browser *Browser) ListTagged(source, metric, writer string, filter types.Tags) (files graphItemsList) {
+	files = make(graphItemsList, 0, 10)
+	for _, file := range browser.List(source, "") {
+		if file.Metric != metric || !file.HasTags || !file.Tags.Contains(filter) {
+			continue
+		}
+		if len(writer) > 0 && file.Writer != writer {
+			continue
+		}
+		files = append(files, file)
 	}
+	sort.Sort(files)
+	return
+}
 
+// ListGroupedBy returns graphs of the given metric aggregated by each value of
+// the tag with the given key. If writer is empty, graphs for all writers are
+// returned.
+func (browser *Browser) ListGroupedBy(source, metric, writer, key string) (files graphItemsList) {
+	files = make(graphItemsList, 0, 10)
+	for _, file := range browser.List(source, "") {
+		if file.Metric != metric || len(file.Tags) != 1 || file.Tags[0].Key != key {
+			continue
+		}
+		if len(writer) > 0 && file.Writer != writer {
+			continue
+		}
+		files = append(files, file)
+	}
+	sort.Sort(files)
 	return
 }
 
 func (browser *Browser) ListSources(metric string) (sources []*graphItemSource) {
 	sources = make([]*graphItemSource, 0, 10)
-	dir, err := ioutil.ReadDir(path.Join(config.DataDir))
+	for _, source := range browser.listSourceNames() {
+		if graphs := browser.List(source, metric); len(graphs) > 0 {
+			sources = append(sources, &graphItemSource{source, graphs})
+		}
+	}
+	return
+}
+
+// List returns graphs of the given metric for the source (all graphs of the
+// source if metric is empty).
+func (browser *Browser) List(source, metric string) (files graphItemsList) {
+	all := browser.listFiles(source)
+	files = make(graphItemsList, 0, len(all))
+	for _, file := range all {
+		if len(metric) == 0 || file.Name == metric {
+			files = append(files, file)
+		}
+	}
+	return
+}
+
+// listSourceNames returns names of all sources.
+func (browser *Browser) listSourceNames() []string {
+	now := time.Seconds()
+	browser.mutex.Lock()
+	cache := browser.sources
+	browser.mutex.Unlock()
+	if cache != nil && cache.expires > now {
+		return cache.sources
+	}
+
+	cache = &browserCache{expires: now + int64(config.WriteInterval), sources: scanClusterSources()}
+	browser.mutex.Lock()
+	browser.sources = cache
+	browser.mutex.Unlock()
+	return cache.sources
+}
+
+// listFiles returns all data files of the source.
+func (browser *Browser) listFiles(source string) graphItemsList {
+	return browser.cachedFiles(source).files
+}
+
+// cachedFiles returns cached data files of the source, rescanning the
+// directory when cache is expired.
+func (browser *Browser) cachedFiles(source string) *browserCache {
+	now := time.Seconds()
+	browser.mutex.Lock()
+	cache, found := browser.files[source]
+	browser.mutex.Unlock()
+	if found && cache.expires > now {
+		return cache
+	}
+
+	cache = &browserCache{expires: now + int64(config.WriteInterval), files: scanClusterFiles(source)}
+	browser.mutex.Lock()
+	browser.files[source] = cache
+	browser.mutex.Unlock()
+	return cache
+}
+
+// uniqueMetrics returns one graph per untagged metric from the given list
+// (the first writer in alphabetical order is used). The list is sorted.
+func uniqueMetrics(all graphItemsList) (files graphItemsList) {
+	sort.Sort(all)
+	files = make(graphItemsList, 0, len(all))
+	for _, file := range all {
+		if file.HasTags || (len(files) > 0 && files[len(files)-1].Name == file.Name) {
+			continue
+		}
+		files = append(files, file)
+	}
+	return
+}
+
+// scanSources returns names of all source directories.
+func scanSources() (sources []string) {
+	sources = make([]string, 0, 10)
+	dir, err := ioutil.ReadDir(config.DataDir)
 	if err != nil {
 		return
 	}
 	for _, fi := range dir {
-		if !fi.IsDirectory() {
-			continue
-		}
-		if graphs := browser.List(fi.Name, metric, ".rrd"); len(graphs) > 0 {
-			sources = append(sources, &graphItemSource{fi.Name, graphs})
+		if fi.IsDirectory() {
+			sources = append(sources, fi.Name)
 		}
 	}
 	return
 }
 
-func (*Browser) List(source, metric, suffix string) (files graphItemsList) {
+// scanFiles returns all data files of the source.
+func scanFiles(source string) (files graphItemsList) {
 	files = make(graphItemsList, 0, 10)
 	dir, err := ioutil.ReadDir(path.Join(config.DataDir, source))
 	if err != nil {
@@ -132,29 +299,45 @@ func (*Browser) List(source, metric, suffix string) (files graphItemsList) {
 			continue
 		}
 
-		if strings.HasSuffix(fi.Name, suffix) {
-			var name, writer, group, title string
-
+		if strings.HasSuffix(fi.Name, ".rrd") {
 			split := strings.LastIndex(fi.Name, "-")
-			name = fi.Name[:split]
-			if len(metric) > 0 && name != metric {
-				continue
-			}
-			writer = fi.Name[split+1 : len(fi.Name)-len(".rrd")]
-
-			split = strings.Index(name, "$")
 			if split < 0 {
-				split = strings.Index(name, ".")
+				continue
 			}
-			if split >= 0 {
-				group = name[:split]
-				title = name[split+1:]
-			} else {
-				group = ""
-				title = name
+			if file := newGraphItem(fi.Name[:split], fi.Name[split+1:len(fi.Name)-len(".rrd")]); file != nil {
+				files = append(files, file)
 			}
-			files = append(files, &graphItem{name, writer, group, title})
 		}
 	}
 	return
 }
+
+// newGraphItem returns a graph of the writer data of the series with the
+// given name, nil if the name is invalid.
+func newGraphItem(name, writer string) *graphItem {
+	var group, title, base string
+	var tags types.Tags
+
+	// Tagged series: name,key1=value1,key2=value2
+	base = name
+	if split := strings.Index(name, ","); split >= 0 {
+		parsed, err := parser.ParseTags(name[split+1:])
+		if err != nil {
+			return nil
+		}
+		base, tags = name[:split], parsed
+	}
+
+	split := strings.Index(base, "$")
+	if split < 0 {
+		split = strings.Index(base, ".")
+	}
+	if split >= 0 {
+		group = base[:split]
+		title = base[split+1:]
+	} else {
+		group = ""
+		title = base
+	}
+	return &graphItem{name, writer, group, title, base, tags, len(tags) > 0}
+}
@@ -0,0 +1,162 @@
+package web
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"metricsd/config"
+	"metricsd/graph"
+	"metricsd/rrd"
+)
+
+// graphData fetches values of a graph from the RRD file. The first error is
+// kept, so definitions do not need to check each fetch.
+type graphData struct {
+	file       string
+	start, end int64
+	step       int64
+	results    map[string]*rrd.FetchResult // by consolidation function
+	err        os.Error
+}
+
+// graphDefinition adds series and legend of a writer to the graph.
+type graphDefinition func(g *graph.Graph, data *graphData, metric string)
+
+// Graph definitions by writer name.
+var graphDefinitions = map[string]graphDefinition{
+	"count":       countGraph,
+	"quartiles":   quartilesGraph,
+	"percentiles": percentilesGraph,
+	"counter":     valueGraph("value", "Rate", "per second"),
+	"gauge":       valueGraph("value", "Value", "value"),
+	"set":         setGraph,
+}
+
+// defineGraph adds series and legend of the given writer data to the graph.
+func defineGraph(g *graph.Graph, source, metric, writer string) os.Error {
+	define, found := graphDefinitions[writer]
+	if !found {
+		return os.NewError(fmt.Sprintf("Graph for writer %q is not defined", writer))
+	}
+
+	data := &graphData{
+		file:    fmt.Sprintf("%s/%s/%s-%s.rrd", config.DataDir, source, metric, writer),
+		start:   g.Start,
+		end:     g.End,
+		step:    (g.End - g.Start) / int64(g.Width),
+		results: make(map[string]*rrd.FetchResult),
+	}
+	define(g, data, metric)
+	return data.err
+}
+
+// fetch returns values of the data source consolidated with the given
+// function. Unknown values are returned on error.
+func (data *graphData) fetch(cf, ds string) *graph.Data {
+	result, found := data.results[cf]
+	if !found && data.err == nil {
+		result, data.err = rrd.Fetch(data.file, cf, data.start, data.end, data.step)
+		data.results[cf] = result
+	}
+	if data.err != nil {
+		return data.unknown()
+	}
+
+	for index, name := range result.DataSources {
+		if name == ds {
+			values := make([]float64, len(result.Values))
+			for i, row := range result.Values {
+				values[i] = row[index]
+			}
+			return &graph.Data{Values: values, Start: result.Start, Step: result.Step}
+		}
+	}
+	data.err = &rrd.UnknownDataSourceError{File: data.file, Name: ds}
+	return data.unknown()
+}
+
+// unknown returns data with all values unknown.
+func (data *graphData) unknown() *graph.Data {
+	return &graph.Data{Values: []float64{math.NaN()}, Start: data.start, Step: data.end - data.start}
+}
+
+func countGraph(g *graph.Graph, data *graphData, metric string) {
+	g.VerticalLabel = "events per second"
+	ok := data.fetch("AVERAGE", "ok")
+	fail := data.fetch("AVERAGE", "fail")
+	failure := fail.Negate()
+
+	g.AddArea(ok, "00CF00")
+	g.AddLine(ok, "157419", 1)
+	g.AddArea(failure, "FF897C")
+	g.AddLine(failure, "CC3525", 1)
+	g.AddLegend("00CF00", "Success", currentAverageMaximum(ok, ok)...)
+	g.AddLegend("FF897C", "Failure", currentAverageMaximum(fail, fail)...)
+}
+
+func quartilesGraph(g *graph.Graph, data *graphData, metric string) {
+	g.VerticalLabel = fmt.Sprintf("analyzed per %d seconds", config.SliceInterval)
+	g.LowerLimit = 0
+	q3 := data.fetch("AVERAGE", "q3")
+	q2 := data.fetch("AVERAGE", "q2")
+	q1 := data.fetch("AVERAGE", "q1")
+
+	g.AddArea(q3, "FF897C")
+	g.AddArea(q2, "00CF00")
+	g.AddLine(q1, "96E78A", 1)
+	g.AddLine(q2, "157419", 1)
+	g.AddLegend("FF897C", "Q3 (75%)", currentAverageMaximum(q3, q3)...)
+	g.AddLegend("00CF00", "Q2 (50%)", currentAverageMaximum(q2, q2)...)
+	g.AddLegend("96E78A", "Q1 (25%)", currentAverageMaximum(q1, q1)...)
+	g.AddLegend("", "",
+		graph.Stat{"Lowest", data.fetch("AVERAGE", "lo").Minimum()},
+		graph.Stat{"Highest", data.fetch("AVERAGE", "hi").Average()},
+		graph.Stat{"Total", data.fetch("AVERAGE", "total").Average()})
+}
+
+func percentilesGraph(g *graph.Graph, data *graphData, metric string) {
+	g.VerticalLabel = fmt.Sprintf("analyzed per %d seconds", config.SliceInterval)
+	g.LowerLimit = 0
+	for _, item := range percentileGraphItems(metric) {
+		ds := item["ds"].(string)
+		label := item["label"].(string)
+		areaColor, lineColor := item["area_color"].(string), item["line_color"].(string)
+		max := data.fetch("AVERAGE", ds)
+		mean := data.fetch("AVERAGE", ds+"mean")
+		dev := data.fetch("AVERAGE", ds+"dev")
+
+		g.AddArea(mean, areaColor)
+		g.AddLine(max, lineColor, 1)
+		g.AddLegend(areaColor, label+" mean", currentAverageMaximum(mean, mean)...)
+		g.AddLegend(lineColor, label+" max",
+			graph.Stat{"Current", max.Last()},
+			graph.Stat{"Average", max.Average()},
+			graph.Stat{"StdDev", dev.Average()})
+	}
+}
+
+// valueGraph returns definition of a graph with a single data source,
+// maximum is taken from the MAX archive.
+func valueGraph(ds, label, verticalLabel string) graphDefinition {
+	return func(g *graph.Graph, data *graphData, metric string) {
+		g.VerticalLabel = verticalLabel
+		value := data.fetch("AVERAGE", ds)
+
+		g.AddArea(value, "00CF00")
+		g.AddLine(value, "157419", 1)
+		g.AddLegend("00CF00", label, currentAverageMaximum(value, data.fetch("MAX", ds))...)
+	}
+}
+
+func setGraph(g *graph.Graph, data *graphData, metric string) {
+	valueGraph("unique", "Unique", fmt.Sprintf("unique per %d seconds", config.SliceInterval))(g, data, metric)
+	g.LowerLimit = 0
+}
+
+func currentAverageMaximum(data, max *graph.Data) []graph.Stat {
+	return []graph.Stat{
+		{"Current", data.Last()},
+		{"Average", data.Average()},
+		{"Maximum", max.Maximum()},
+	}
+}
@@ -0,0 +1,47 @@
+package web
+
+import (
+	"strings"
+	"github.com/hoisie/web.go"
+)
+
+/***** Health and status ******************************************************/
+
+// Readiness returns the list of problems preventing MetricsD from processing
+// events, empty when it is ready (set by main).
+var Readiness func() []string
+
+// Status returns the state of MetricsD (set by main).
+var Status func() interface{}
+
+// healthz responds with 200 while the web server is running (liveness probe).
+func healthz(ctx *web.Context) {
+	ctx.SetHeader("Content-Type", "text/plain; charset=utf-8", true)
+	ctx.Write([]byte("OK\n"))
+}
+
+// readyz responds with 200 when MetricsD is ready to process events, or with
+// 503 and the list of problems otherwise (readiness probe).
+func readyz(ctx *web.Context) {
+	var problems []string
+	if Readiness != nil {
+		problems = Readiness()
+	}
+	if len(problems) > 0 {
+		ctx.Abort(503, strings.Join(problems, "\n")+"\n")
+		return
+	}
+	ctx.SetHeader("Content-Type", "text/plain; charset=utf-8", true)
+	ctx.Write([]byte("OK\n"))
+}
+
+// server_status returns the state of MetricsD in JSON: version, uptime,
+// readiness, configuration, totals of received events and bytes, the last
+// rollup, and RRD update errors of each writer.
+func server_status(ctx *web.Context) {
+	if Status == nil {
+		ctx.Abort(501, "Status is not supported")
+		return
+	}
+	writeJson(ctx, Status())
+}
@@ -0,0 +1,113 @@
+package web
+
+import (
+	"sort"
+)
+
+// treeNode is a node of the metrics tree built from metric names split by
+// dots (or dollar signs used in older versions), e.g. "app.api.time" is
+// stored as app -> api -> time.
+type treeNode struct {
+	Name        string      `json:"name"`         // last component of the path
+	Path        string      `json:"path"`         // full path (metric name for leaves)
+	Count       int         `json:"count"`        // number of metrics in the subtree
+	Leaf        bool        `json:"leaf"`         // node is a metric (it could have children too)
+	HasChildren bool        `json:"has_children"` // node has children (even if they are not loaded)
+	Children    []*treeNode `json:"children"`
+	index       map[string]*treeNode
+}
+
+type treeNodesList []*treeNode
+
+// Swap exchanges the elements at indexes i and j.
+func (l treeNodesList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+// Len returns the number of elements in the list.
+func (l treeNodesList) Len() int {
+	return len(l)
+}
+
+// Less returns a value indicating whether the element at index i should sort
+// before the element at index j.
+func (l treeNodesList) Less(i, j int) bool {
+	return l[i].Name < l[j].Name
+}
+
+// buildTree returns the root node of the tree of the given metrics.
+func buildTree(metrics graphItemsList) *treeNode {
+	root := &treeNode{}
+	for _, metric := range metrics {
+		node := root
+		node.Count++
+		name, start := metric.Name, 0
+		for i := 0; i <= len(name); i++ {
+			if i < len(name) && !isTreeSeparator(name[i]) {
+				continue
+			}
+			node = node.child(name[start:i], name[:i])
+			node.Count++
+			start = i + 1
+		}
+		node.Leaf = true
+	}
+	root.sort()
+	return root
+}
+
+// child returns child node with the given name, creating it if necessary.
+func (node *treeNode) child(name, path string) *treeNode {
+	if node.index == nil {
+		node.index = make(map[string]*treeNode)
+	}
+	child, found := node.index[name]
+	if !found {
+		child = &treeNode{Name: name, Path: path}
+		node.index[name] = child
+		node.Children = append(node.Children, child)
+		node.HasChildren = true
+	}
+	return child
+}
+
+func (node *treeNode) sort() {
+	sort.Sort(treeNodesList(node.Children))
+	for _, child := range node.Children {
+		child.sort()
+	}
+}
+
+// find returns the node with the given path, nil if it does not exist.
+func (node *treeNode) find(path string) *treeNode {
+	if node.Path == path {
+		return node
+	}
+	for _, child := range node.Children {
+		if child.Path == path {
+			return child
+		}
+		if len(path) > len(child.Path) && path[:len(child.Path)] == child.Path && isTreeSeparator(path[len(child.Path)]) {
+			return child.find(path)
+		}
+	}
+	return nil
+}
+
+// truncate returns a copy of the subtree with the given depth, nodes on
+// the last level have no children loaded.
+func (node *treeNode) truncate(depth int) *treeNode {
+	truncated := *node
+	truncated.Children = nil
+	if depth > 0 {
+		truncated.Children = make([]*treeNode, len(node.Children))
+		for i, child := range node.Children {
+			truncated.Children[i] = child.truncate(depth - 1)
+		}
+	}
+	return &truncated
+}
+
+func isTreeSeparator(c byte) bool {
+	return c == '.' || c == '$'
+}
@@ -2,39 +2,139 @@ package web
 
 import (
 	"fmt"
-	"io"
 	"os"
 	"path"
 	"strings"
+	"time"
 	"metricsd/config"
+	"metricsd/graph"
+	"metricsd/logger"
+	"metricsd/types"
+	"metricsd/writers"
 	"github.com/hoisie/web.go"
 	"github.com/hoisie/mustache.go"
 )
 
 /***** Web routines ***********************************************************/
 
+var log logger.Logger // logger of the web component
+
+// Range of graph width and height in pixels.
+const (
+	GRAPH_MIN_SIZE   = 10
+	GRAPH_MAX_WIDTH  = 4000
+	GRAPH_MAX_HEIGHT = 2000
+)
+
 func Start() {
+	log = config.Logger.WithComponent("web")
 	web.Config.StaticDir = path.Join(config.RootDir, "public")
 	web.Get("/", summary)
 	web.Get("/metric/(.*)/(.*)/(.*)", metric_graph)
 	web.Get("/metric/(.*)/(.*)", host_metric)
 	web.Get("/metric/(.*)", metric)
-	web.Get("/graph/(.*)/(.*)/(.*)\\.png", graph)
-	web.Get("/graph/(.*)/(.*)/(.*)", graph)
+	web.Get("/graph/(.*)/(.*)/(.*)\\.png", graph_png)
+	web.Get("/graph/(.*)/(.*)/(.*)\\.svg", graph_svg)
+	web.Get("/graph/(.*)/(.*)/(.*)", graph_png)
 	web.Get("/host/(.*)", host)
+	web.Get("/tags/(.*)", tags)
+	web.Get("/dashboards", dashboards)
+	web.Get("/dashboard/(.*)", dashboard)
+	web.Get("/alerts", alerts_page)
+	web.Get("/api/sources", api_sources)
+	web.Get("/api/metrics", api_metrics)
+	web.Get("/api/tree", api_tree)
+	web.Get("/api/series/(.*)/(.*)/(.*)\\.json", api_series_json)
+	web.Get("/api/series/(.*)/(.*)/(.*)\\.csv", api_series_csv)
+	web.Get("/api/alerts", api_alerts)
+	web.Get("/metrics", prometheus_metrics)
+	web.Get("/healthz", healthz)
+	web.Get("/readyz", readyz)
+	web.Get("/status", server_status)
+	web.Post("/admin/reload", admin_reload)
 	web.Run(config.Listen)
 }
 
 func summary() string {
 	return mustache.RenderFile(template("summary"), map[string]interface{}{
-		"metrics": browser.ListCountGraphsGrouped(),
+		"nodes": browser.Tree("all").Children,
 	})
 }
 
 func metric(metric string) string {
+	tags := browser.ListTags("all", metric)
 	return mustache.RenderFile(template("metric"), map[string]interface{}{
-		"metric": metric,
-		"hosts":  browser.ListSources(metric),
+		"metric":  metric,
+		"hosts":   browser.ListSources(metric),
+		"tags":    tags,
+		"hasTags": len(tags) > 0,
+	})
+}
+
+// tags renders graphs of the tagged series of the metric. Query parameters
+// "source" (default is "all") and "writer" select the series, "by" shows
+// the metric aggregated by each value of the given tag, and all other
+// parameters are used as a tags filter (e.g. ?dc=ams&role=api).
+func tags(ctx *web.Context, metric string) string {
+	source, writer, by := "all", "", ""
+	filter := make(types.Tags, 0, len(ctx.Params))
+	for key, value := range ctx.Params {
+		switch key {
+		case "source":
+			source = value
+		case "writer":
+			writer = value
+		case "by":
+			by = value
+		default:
+			filter = append(filter, types.Tag{Key: key, Value: value})
+		}
+	}
+	filter = types.NewTags(filter...)
+
+	var graphs graphItemsList
+	if len(by) > 0 {
+		graphs = browser.ListGroupedBy(source, metric, writer, by)
+	} else {
+		graphs = browser.ListTagged(source, metric, writer, filter)
+	}
+
+	return mustache.RenderFile(template("tags"), map[string]interface{}{
+		"metric":    metric,
+		"source":    source,
+		"writer":    writer,
+		"by":        by,
+		"filter":    filter.String(),
+		"hasFilter": len(filter) > 0,
+		"tags":      browser.ListTags(source, metric),
+		"graphs":    graphs,
+	})
+}
+
+func dashboards() string {
+	return mustache.RenderFile(template("dashboards"), map[string]interface{}{
+		"dashboards": listDashboards(),
+	})
+}
+
+func dashboard(ctx *web.Context, name string) string {
+	dashboard, err := loadDashboard(name)
+	if err != nil {
+		ctx.Abort(404, err.String())
+		return ""
+	}
+
+	panels := make([]map[string]interface{}, len(dashboard.Panels))
+	for i, panel := range dashboard.Panels {
+		panels[i] = map[string]interface{}{
+			"title":  panel.Title,
+			"graphs": panel.graphs(),
+		}
+	}
+	return mustache.RenderFile(template("dashboard"), map[string]interface{}{
+		"name":   dashboard.Name,
+		"title":  dashboard.Title,
+		"panels": panels,
 	})
 }
 
@@ -42,14 +142,14 @@ func host_metric(metric, source string) string {
 	return mustache.RenderFile(template("host_metric"), map[string]interface{}{
 		"source":  source,
 		"metric":  metric,
-		"metrics": browser.List("all", metric, ".rrd"),
+		"metrics": browser.List("all", metric),
 	})
 }
 
 func host(source string) string {
 	return mustache.RenderFile(template("host"), map[string]interface{}{
 		"source":  source,
-		"metrics": browser.List(source, "", "-count.rrd"),
+		"metrics": browser.ListMetrics(source),
 	})
 }
 
@@ -61,22 +161,76 @@ func metric_graph(metric, source, writer string) string {
 	})
 }
 
-func graph(ctx *web.Context, source, metric, writer string) {
-	ctx.SetHeader("Content-Type", "image/png", true)
+func graph_png(ctx *web.Context, source, metric, writer string) {
+	render_graph(ctx, source, metric, writer, "png")
+}
+
+func graph_svg(ctx *web.Context, source, metric, writer string) {
+	render_graph(ctx, source, metric, writer, "svg")
+}
+
+// render_graph renders graph of the writer data in the given format.
+func render_graph(ctx *web.Context, source, metric, writer, format string) {
+	for _, name := range []string{source, metric, writer} {
+		if !validPathComponent(name) {
+			ctx.Abort(400, fmt.Sprintf("Series name %q is invalid", name))
+			return
+		}
+	}
+	if proxyToOwner(ctx, metric) {
+		return
+	}
 
 	params := struct {
-		Rra           string
 		Width, Height int
 		Dark          bool
-		Start, End    int
-	}{"daily", 620, 240, false, 0, 0}
+	}{620, 240, false}
+	ctx.Request.UnmarshalParams(&params)
+	if params.Width < GRAPH_MIN_SIZE || params.Width > GRAPH_MAX_WIDTH || params.Height < GRAPH_MIN_SIZE || params.Height > GRAPH_MAX_HEIGHT {
+		ctx.Abort(400, fmt.Sprintf("Graph size %dx%d is invalid (should be from %dx%d to %dx%d)", params.Width, params.Height, GRAPH_MIN_SIZE, GRAPH_MIN_SIZE, GRAPH_MAX_WIDTH, GRAPH_MAX_HEIGHT))
+		return
+	}
+	rra, start, end := timeRange(ctx)
+
+	title := fmt.Sprintf("%s :: %s :: %s (%s)", metric, writer, rra, source)
+	g := graph.NewGraph(title, start, end, params.Width, params.Height)
+	g.Dark = params.Dark
+	if err := defineGraph(g, source, metric, writer); err != nil {
+		log.Error("Graph: %s", err)
+		ctx.Abort(500, err.String())
+		return
+	}
+
+	var err os.Error
+	switch format {
+	case "svg":
+		ctx.SetHeader("Content-Type", "image/svg+xml", true)
+		err = g.RenderSVG(ctx)
+	default:
+		ctx.SetHeader("Content-Type", "image/png", true)
+		err = g.RenderPNG(ctx)
+	}
+	if err != nil {
+		log.Error("Graph: %s", err)
+	}
+}
+
+/***** Helper functions *******************************************************/
+
+// timeRange returns the time range selected with the "rra" parameter (or
+// "custom" when "start" or "end" are specified) and its start and end
+// times. Start and end are relative to the current time when not positive.
+func timeRange(ctx *web.Context) (rra string, start, end int64) {
+	params := struct {
+		Rra        string
+		Start, End int
+	}{"daily", 0, 0}
 	ctx.Request.UnmarshalParams(&params)
 
 	if params.Start != 0 || params.End != 0 {
 		params.Rra = "custom"
 	}
 
-	var start, end int
 	switch params.Rra {
 	case "hourly":
 		start = -14400
@@ -99,55 +253,59 @@ func graph(ctx *web.Context, source, metric, writer string) {
 		params.Rra = "custom"
 	}
 
-	if params.Start == 0 {
-		params.Start = start
+	if params.Start != 0 {
+		start = int64(params.Start)
 	}
 
-	if params.End == 0 {
-		params.End = end
+	if params.End != 0 {
+		end = int64(params.End)
 	}
 
-	rrd_file := fmt.Sprintf("%s/%s/%s-%s.rrd", config.DataDir, source, metric, writer)
-	args := mustache.RenderFile(template("writers/"+writer), map[string]interface{}{
-		"source":   source,
-		"metric":   metric,
-		"writer":   writer,
-		"rrd_file": rrd_file,
-		"start":    params.Start,
-		"end":      params.End,
-		"width":    params.Width,
-		"height":   params.Height,
-		"rra":      params.Rra,
-		"interval": config.SliceInterval,
-		"dark":     params.Dark,
-	})
-	r, w, err := os.Pipe()
-	if err != nil {
-		config.Logger.Error("Pipe: %s", err)
-		return
+	now := time.Seconds()
+	if start <= 0 {
+		start += now
+	}
+	if end <= 0 {
+		end += now
 	}
+	return params.Rra, start, end
+}
 
-	// config.Logger.Debug("started, %s", strings.Split(args, "\n", -1))
-	attr := &os.ProcAttr{Dir: "", Env: os.Environ(), Files: []*os.File{nil, w, w}}
-	process, err := os.StartProcess("/usr/bin/rrdtool", strings.Split(args, "\n"), attr)
-	defer process.Release()
-	w.Close()
-	io.Copy(ctx, r)
-	r.Close()
+// Area and line colors used to draw percentiles, from the highest one.
+var percentileColors = [][2]string{
+	{"FF897C", "CC3525"},
+	{"00CF00", "96E78A"},
+	{"7CB3F1", "2175D9"},
+	{"F9FD5F", "C9B215"},
+	{"D278F0", "8E31B0"},
+}
 
-	wait, err := process.Wait(0)
-	if err != nil {
-		config.Logger.Error("wait: %s\n", err)
-		return
+// percentileGraphItems returns percentiles calculated for the given metric
+// by the percentiles writer, from the highest to the lowest.
+func percentileGraphItems(metric string) []map[string]interface{} {
+	// Tags do not affect the list of percentiles
+	if idx := strings.Index(metric, ","); idx >= 0 {
+		metric = metric[:idx]
 	}
-	if !wait.Exited() || wait.ExitStatus() != 0 {
-		config.Logger.Error("date: %v\n", wait)
-		return
+
+	percentiles := writers.DefaultPercentiles
+	if writer, ok := writers.Find("percentiles").(*writers.Percentiles); ok {
+		percentiles = writer.PercentilesFor(metric)
 	}
-	return
-}
 
-/***** Helper functions *******************************************************/
+	items := make([]map[string]interface{}, len(percentiles))
+	for i := range percentiles {
+		p := percentiles[len(percentiles)-i-1]
+		colors := percentileColors[i%len(percentileColors)]
+		items[i] = map[string]interface{}{
+			"ds":         writers.PercentileDataSource(p),
+			"label":      fmt.Sprintf("%v%%", p),
+			"area_color": colors[0],
+			"line_color": colors[1],
+		}
+	}
+	return items
+}
 
 func template(name string) string {
 	return path.Join(config.RootDir, fmt.Sprintf("templates/%s.mustache", name))
@@ -0,0 +1,61 @@
+package writers
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"metricsd/alerts"
+	"metricsd/types"
+)
+
+// Alerts engine rolled up values are checked by (nil if disabled)
+var alertsEngine *alerts.Engine
+
+// SetAlerts sets the engine alert rules are evaluated by against rolled up
+// values (nil to disable it).
+func SetAlerts(engine *alerts.Engine) {
+	alertsEngine = engine
+}
+
+// checkAlerts passes data items of the given sample set to the alerts engine
+// (when enabled and rules are defined for the series).
+func checkAlerts(writer Writer, set *types.SampleSet, data ...dataItem) {
+	if alertsEngine == nil || !alertsEngine.Watches(writer.Name(), set.Source, set.Name) {
+		return
+	}
+	series := set.FullName()
+	for _, item := range data {
+		time, fields := itemFields(item)
+		alertsEngine.Observe(&alerts.Observation{
+			Writer: writer.Name(),
+			Source: set.Source,
+			Metric: set.Name,
+			Series: series,
+			Time:   time,
+			Fields: fields,
+		})
+	}
+}
+
+// itemFields returns the time and values of the data item fields. Field
+// names match data sources of the RRD file (unknown values are skipped),
+// count items have an additional "fail_ratio" field: fail / (ok + fail),
+// missing when there are no values.
+func itemFields(item dataItem) (time int64, fields map[string]float64) {
+	names := strings.Split(item.rrdTemplate(), ":")
+	values := strings.Split(item.rrdString(), ":")
+	fields = make(map[string]float64, len(names)+1)
+	if len(values) != len(names)+1 {
+		return
+	}
+	time, _ = strconv.Atoi64(values[0])
+	for i, name := range names {
+		if value, err := strconv.Atof64(values[i+1]); err == nil && !math.IsNaN(value) {
+			fields[name] = value
+		}
+	}
+	if count, ok := item.(*countItem); ok && count.ok+count.fail > 0 {
+		fields["fail_ratio"] = float64(count.fail) / float64(count.ok+count.fail)
+	}
+	return
+}
@@ -0,0 +1,46 @@
+package writers
+
+import (
+	. "launchpad.net/gocheck"
+	"metricsd/alerts"
+	"metricsd/logger"
+)
+
+type AlertsS struct{}
+
+var _ = Suite(&AlertsS{})
+
+func (s *AlertsS) TestItemFields(c *C) {
+	set := createSampleSet(10, 1, 1, 1, -1)
+	time, fields := itemFields((&Count{}).rollupData(set))
+	c.Check(time, Equals, int64(10))
+	c.Check(fields, DeepEquals, map[string]float64{"ok": 3, "fail": 1, "fail_ratio": 0.25})
+
+	writer := &Percentiles{Percentiles: []float64{50}}
+	set = createSampleSet(20, 1, 2, 3)
+	time, fields = itemFields(writer.rollupData(set))
+	c.Check(time, Equals, int64(20))
+	c.Check(fields["pct50"], Equals, 2.0)
+}
+
+func (s *AlertsS) TestCheckAlerts(c *C) {
+	engine := alerts.New(logger.NewConsoleLogger(logger.UNKNOWN))
+	defer engine.Close()
+	rule, err := alerts.ParseRule("errors", "src", "metric count.fail_ratio > 25%")
+	c.Assert(err, IsNil)
+	engine.Configure([]*alerts.Rule{rule}, nil)
+	SetAlerts(engine)
+	defer SetAlerts(nil)
+
+	set := createSampleSet(10, 1, -1)
+	checkAlerts(&Count{}, set, (&Count{}).rollupData(set))
+	set = createSampleSet(20, 1, 1, 1, -1)
+	checkAlerts(&Quartiles{}, set, (&Quartiles{}).rollupData(set))
+
+	fired := engine.Flush()
+	c.Assert(len(fired), Equals, 1)
+	c.Check(fired[0].Source, Equals, "src")
+	c.Check(fired[0].Series, Equals, "metric")
+	c.Check(fired[0].Value, Equals, 0.5)
+	c.Check(fired[0].Since, Equals, int64(10))
+}
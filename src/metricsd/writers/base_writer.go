@@ -38,5 +38,7 @@ type dataItem interface {
 	rrdInfo() []string
 	rrdTemplate() string
 	rrdString() string
+	promType() string
+	promSamples() []promSample
 	String() string
 }
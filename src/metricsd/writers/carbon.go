@@ -0,0 +1,188 @@
+package writers
+
+import (
+	"strings"
+	"sync"
+	"time"
+	"metricsd/logger"
+	"metricsd/sender"
+	"metricsd/types"
+)
+
+// Carbon sends rolled up values to a Graphite-compatible backend using the
+// plaintext protocol. Each field of a data item is sent as a separate line:
+//     source.metric.writer.field value timestamp
+// Lines are queued in memory and sent in batches by a background Go routine.
+// When the backend is not available, the oldest lines are dropped once the
+// queue is full.
+type Carbon struct {
+	address   string
+	batchSize int
+	queueSize int
+	log       logger.Logger
+	mutex     sync.Mutex
+	queue     []string // lines waiting to be sent
+	dropped   int64    // number of lines dropped because the queue is full
+	wake      chan bool
+	quit      chan bool
+	done      chan bool
+	sender    *sender.Sender // used by the sending Go routine only
+}
+
+// Carbon output used by Rollup and BatchRollup (nil if disabled)
+var carbon *Carbon
+
+// NewCarbon creates a Carbon output sending lines to the given address in
+// batches of batchSize lines, at most queueSize lines are kept in memory.
+func NewCarbon(address string, batchSize, queueSize int, log logger.Logger) *Carbon {
+	carbon := &Carbon{
+		address:   address,
+		batchSize: batchSize,
+		queueSize: queueSize,
+		log:       log,
+		wake:      make(chan bool, 1),
+		quit:      make(chan bool),
+		done:      make(chan bool),
+		sender:    sender.New("Carbon "+address, address, log),
+	}
+	go carbon.run()
+	return carbon
+}
+
+// SetCarbon sets the Carbon output rolled up values are sent to in addition
+// to RRD files (nil to disable it).
+func SetCarbon(output *Carbon) {
+	carbon = output
+}
+
+// Send adds lines to the queue. When the queue is full, the oldest lines
+// are dropped.
+func (carbon *Carbon) Send(lines []string) {
+	carbon.mutex.Lock()
+	carbon.queue = append(carbon.queue, lines...)
+	carbon.trimQueue()
+	carbon.mutex.Unlock()
+
+	select {
+	case carbon.wake <- true:
+	default:
+	}
+}
+
+// Close sends queued lines (if connected), and stops the output.
+func (carbon *Carbon) Close() {
+	carbon.quit <- true
+	<-carbon.done
+}
+
+// run sends queued lines until the output is closed.
+func (carbon *Carbon) run() {
+	ticker := time.NewTicker(1e9)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-carbon.quit:
+			// Do not wait for connection on shutdown
+			if carbon.sender.Connected() {
+				carbon.send()
+			}
+			carbon.sender.Close()
+			carbon.done <- true
+			return
+		case <-carbon.wake:
+		case <-ticker.C:
+		}
+		carbon.send()
+	}
+}
+
+// send sends queued lines in batches (connecting to Carbon if needed).
+func (carbon *Carbon) send() {
+	for {
+		carbon.mutex.Lock()
+		empty := len(carbon.queue) == 0
+		carbon.mutex.Unlock()
+		if empty || !carbon.sender.Connect() {
+			return
+		}
+
+		carbon.mutex.Lock()
+		count := len(carbon.queue)
+		if count > carbon.batchSize {
+			count = carbon.batchSize
+		}
+		lines := carbon.queue[:count]
+		carbon.queue = carbon.queue[count:]
+		carbon.mutex.Unlock()
+
+		if err := carbon.sender.Send(lines); err != nil {
+			// Lines could be sent partially, so the batch is sent again
+			// (Carbon could receive some of them twice)
+			carbon.mutex.Lock()
+			carbon.queue = append(append([]string(nil), lines...), carbon.queue...)
+			carbon.trimQueue()
+			carbon.mutex.Unlock()
+			return
+		}
+	}
+}
+
+// trimQueue drops the oldest lines when the queue is full. Should be called
+// with mutex locked.
+func (carbon *Carbon) trimQueue() {
+	overflow := len(carbon.queue) - carbon.queueSize
+	if overflow <= 0 {
+		return
+	}
+	carbon.queue = append([]string(nil), carbon.queue[overflow:]...)
+	carbon.dropped += int64(overflow)
+	carbon.log.Warn("Dropped %d lines for Carbon %s: queue is full (%d lines dropped in total)", overflow, carbon.address, carbon.dropped)
+}
+
+// sendToCarbon queues data items of the given sample set to the Carbon
+// output (when enabled).
+func sendToCarbon(writer Writer, set *types.SampleSet, data ...dataItem) {
+	if carbon == nil {
+		return
+	}
+	lines := make([]string, 0, len(data)*6)
+	for _, item := range data {
+		lines = append(lines, carbonLines(writer, set, item)...)
+	}
+	carbon.Send(lines)
+}
+
+// carbonLines returns plaintext protocol lines for each field of the data
+// item. Field names and values are taken from the RRD template and update
+// string, so they match data sources of the RRD file.
+func carbonLines(writer Writer, set *types.SampleSet, item dataItem) []string {
+	names := strings.Split(item.rrdTemplate(), ":")
+	values := strings.Split(item.rrdString(), ":")
+	if len(values) != len(names)+1 {
+		return nil
+	}
+
+	path := carbonPath(writer, set)
+	var tags string
+	for _, tag := range set.Tags {
+		tags += ";" + tag.String()
+	}
+	lines := make([]string, len(names))
+	for i, name := range names {
+		lines[i] = path + "." + name + tags + " " + values[i+1] + " " + values[0]
+	}
+	return lines
+}
+
+// carbonPath returns the Graphite path of the given writer's data, e.g.
+// "web01.app.requests.quartiles" (tags are appended to the field path in the
+// Graphite tagged series format: "app.requests.quartiles.q1;dc=ams"). Dots in
+// the source are replaced with underscores to keep it a single path segment.
+func carbonPath(writer Writer, set *types.SampleSet) string {
+	path := strings.Replace(set.Name, "$", ".", -1) + "." + writer.Name()
+	if len(set.Source) > 0 {
+		path = strings.Replace(set.Source, ".", "_", -1) + "." + path
+	}
+	return path
+}
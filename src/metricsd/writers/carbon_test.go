@@ -0,0 +1,96 @@
+package writers
+
+import (
+	. "launchpad.net/gocheck"
+	"bufio"
+	"net"
+	"os"
+	"strings"
+	"metricsd/logger"
+	"metricsd/types"
+)
+
+type CarbonS struct {
+	listener net.Listener
+}
+
+var _ = Suite(&CarbonS{})
+
+func (s *CarbonS) SetUpTest(c *C) {
+	var err os.Error
+	s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+}
+
+func (s *CarbonS) TearDownTest(c *C) {
+	s.listener.Close()
+}
+
+func (s *CarbonS) carbon(batchSize, queueSize int) *Carbon {
+	return NewCarbon(s.listener.Addr().String(), batchSize, queueSize, logger.NewConsoleLogger(logger.UNKNOWN))
+}
+
+// receive accepts the Carbon connection and reads count lines from it.
+func (s *CarbonS) receive(c *C, count int) (lines []string) {
+	conn, err := s.listener.Accept()
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	for i := 0; i < count; i++ {
+		line, err := reader.ReadString('\n')
+		c.Assert(err, IsNil)
+		lines = append(lines, strings.TrimRight(line, "\n"))
+	}
+	return
+}
+
+func (s *CarbonS) TestCarbonLines(c *C) {
+	set := createSampleSet(1318000000, 1, 2, 3, 4, 5)
+	set.Source = "web01.example.com"
+	lines := carbonLines(&Quartiles{}, set, (&Quartiles{}).rollupData(set))
+	c.Check(lines, DeepEquals, []string{
+		"web01_example_com.metric.quartiles.q1 2 1318000000",
+		"web01_example_com.metric.quartiles.q2 3 1318000000",
+		"web01_example_com.metric.quartiles.q3 4 1318000000",
+		"web01_example_com.metric.quartiles.lo 1 1318000000",
+		"web01_example_com.metric.quartiles.hi 5 1318000000",
+		"web01_example_com.metric.quartiles.total 5 1318000000",
+	})
+}
+
+func (s *CarbonS) TestCarbonLinesWithoutSource(c *C) {
+	set := types.NewSampleSet(1318000000, "", "app$requests")
+	set.Tags = types.NewTags(types.Tag{Key: "dc", Value: "ams"})
+	fillSampleSet(set, 1, -1, 1)
+	lines := carbonLines(&Count{}, set, (&Count{}).rollupData(set))
+	c.Check(lines, DeepEquals, []string{
+		"app.requests.count.ok;dc=ams 2 1318000000",
+		"app.requests.count.fail;dc=ams 1 1318000000",
+	})
+}
+
+func (s *CarbonS) TestSendInBatches(c *C) {
+	carbon := s.carbon(2, 100)
+	defer carbon.Close()
+
+	carbon.Send([]string{"a 1 10", "b 2 10", "c 3 10"})
+	carbon.Send([]string{"d 4 20"})
+	c.Check(s.receive(c, 4), DeepEquals, []string{"a 1 10", "b 2 10", "c 3 10", "d 4 20"})
+}
+
+func (s *CarbonS) TestQueueDropsOldestLines(c *C) {
+	// Carbon is not available
+	address := s.listener.Addr().String()
+	s.listener.Close()
+	carbon := NewCarbon(address, 2, 3, logger.NewConsoleLogger(logger.UNKNOWN))
+	defer carbon.Close()
+
+	carbon.Send([]string{"a 1 10", "b 2 10"})
+	carbon.Send([]string{"c 3 10", "d 4 10", "e 5 10"})
+
+	carbon.mutex.Lock()
+	defer carbon.mutex.Unlock()
+	c.Check(carbon.queue, DeepEquals, []string{"c 3 10", "d 4 10", "e 5 10"})
+	c.Check(carbon.dropped, Equals, int64(2))
+}
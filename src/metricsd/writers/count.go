@@ -20,6 +20,10 @@ type countItem struct {
 	fail uint64
 }
 
+func init() {
+	Register("count", simpleFactory("count", func() Writer { return &Count{} }))
+}
+
 // Name returns the name of the writer.
 func (*Count) Name() string {
 	return "count"
@@ -28,6 +32,9 @@ func (*Count) Name() string {
 // rollupData performs summarization on the given sample set and returns
 // countItem with statistics.
 func (self *Count) rollupData(set *types.SampleSet) (data dataItem) {
+	if set.Sketch != nil {
+		return &countItem{time: set.Time, ok: set.Sketch.Positive(), fail: set.Sketch.Negative()}
+	}
 	var ok, fail uint64
 	for _, elem := range set.Values {
 		if elem > 0 {
@@ -66,3 +73,16 @@ func (*countItem) rrdTemplate() string {
 func (self *countItem) rrdString() string {
 	return fmt.Sprintf("%d:%d:%d", self.time, self.ok, self.fail)
 }
+
+// promType returns the type of Prometheus metrics.
+func (*countItem) promType() string {
+	return promCounter
+}
+
+// promSamples returns values exposed in the Prometheus text format.
+func (self *countItem) promSamples() []promSample {
+	return []promSample{
+		promSample{suffix: "_ok_total", value: float64(self.ok), cumulative: true},
+		promSample{suffix: "_fail_total", value: float64(self.fail), cumulative: true},
+	}
+}
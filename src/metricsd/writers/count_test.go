@@ -37,3 +37,17 @@ func (s *CountS) TestRollupDataWithComplexSampleSet(c *C) {
 	data := s.count.rollupData(ss)
 	c.Check(data, Equals, &countItem{time: 4000, ok: 3, fail: 1})
 }
+
+func (s *CountS) TestRollupDataWithFractionalSampleSet(c *C) {
+	ss := createSampleSet(5000, 0.5, -0.25, 0)
+	data := s.count.rollupData(ss)
+	c.Check(data, Equals, &countItem{time: 5000, ok: 1, fail: 1})
+}
+
+func (s *CountS) TestRollupDataWithSketch(c *C) {
+	ss := createSampleSet(6000)
+	ss.UseSketch(0.01, 0)
+	fillSampleSet(ss, 1, 0.5, -0.25, 0, 10)
+	data := s.count.rollupData(ss)
+	c.Check(data, Equals, &countItem{time: 6000, ok: 3, fail: 1})
+}
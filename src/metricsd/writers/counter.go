@@ -0,0 +1,85 @@
+package writers
+
+import (
+	"fmt"
+	"metricsd/types"
+)
+
+// Counter writer is used to calculate sum of StatsD counter values (already
+// scaled by the sample rate).
+type Counter struct {
+	*BaseWriter
+}
+
+// counterItem stores summary information about sample set.
+type counterItem struct {
+	// Timestamp of the sample set.
+	time int64
+	// Sum of the counter values.
+	value float64
+}
+
+func init() {
+	Register("counter", simpleFactory("counter", func() Writer { return &Counter{} }))
+}
+
+// Name returns the name of the writer.
+func (*Counter) Name() string {
+	return "counter"
+}
+
+// rollupData performs summarization on the given sample set and returns
+// counterItem with statistics.
+func (self *Counter) rollupData(set *types.SampleSet) (data dataItem) {
+	if set.Count() == 0 {
+		return
+	}
+	if set.Sketch != nil {
+		return &counterItem{time: set.Time, value: set.Sketch.Sum()}
+	}
+	var sum float64
+	for _, elem := range set.Values {
+		sum += elem
+	}
+	data = &counterItem{time: set.Time, value: sum}
+	return
+}
+
+// String returns string representation of the given counterItem.
+func (self *counterItem) String() string {
+	return fmt.Sprintf("counterItem[time=%d, value=%v]", self.time, self.value)
+}
+
+// rrdInfo returns the list of parameters used to create RRD file.
+func (*counterItem) rrdInfo() []string {
+	return []string{
+		"DS:value:ABSOLUTE:600:U:U",
+		"RRA:AVERAGE:0.5:1:25920",   // 72 hours at 1 sample per 10 secs
+		"RRA:AVERAGE:0.5:60:4320",   // 1 month at 1 sample per 10 mins
+		"RRA:AVERAGE:0.5:2880:5475", // 5 years at 1 sample per 8 hours
+		"RRA:MAX:0.5:1:25920",       // 72 hours at 1 sample per 10 secs
+		"RRA:MAX:0.5:60:4320",       // 1 month at 1 sample per 10 mins
+		"RRA:MAX:0.5:2880:5475",     // 5 years at 1 sample per 8 hours
+	}
+}
+
+// rrdTemplate returns template for RRDTool used to update data.
+func (*counterItem) rrdTemplate() string {
+	return "value"
+}
+
+// rrdString returns a string matching template format with the data to
+// update RRD files.
+func (self *counterItem) rrdString() string {
+	return fmt.Sprintf("%d:%v", self.time, self.value)
+}
+
+// promType returns the type of Prometheus metrics.
+func (*counterItem) promType() string {
+	return promCounter
+}
+
+// promSamples returns values exposed in the Prometheus text format.
+func (self *counterItem) promSamples() []promSample {
+	return []promSample{promSample{suffix: "_total", value: self.value, cumulative: true}}
+}
@@ -0,0 +1,35 @@
+package writers
+
+import (
+	. "launchpad.net/gocheck"
+)
+
+type CounterS struct {
+	counter *Counter
+}
+
+var _ = Suite(&CounterS{})
+
+func (s *CounterS) SetUpTest(c *C) {
+	s.counter = &Counter{}
+}
+
+func (s *CounterS) TestRollupDataWithEmptySampleSet(c *C) {
+	ss := createSampleSet(1000)
+	data := s.counter.rollupData(ss)
+	c.Check(data, IsNil)
+}
+
+func (s *CounterS) TestRollupDataWithSimpleSampleSet(c *C) {
+	ss := createSampleSet(2000, 1, 10, -1, 0.5)
+	data := s.counter.rollupData(ss)
+	c.Check(data, Equals, &counterItem{time: 2000, value: 10.5})
+}
+
+func (s *CounterS) TestRollupDataWithSketch(c *C) {
+	ss := createSampleSet(3000)
+	ss.UseSketch(0.01, 0)
+	fillSampleSet(ss, 1, 10, -1, 0.5)
+	data := s.counter.rollupData(ss)
+	c.Check(data, Equals, &counterItem{time: 3000, value: 10.5})
+}
@@ -0,0 +1,80 @@
+package writers
+
+import (
+	"fmt"
+	"metricsd/types"
+)
+
+// Gauge writer is used to store the last reported value of a StatsD gauge.
+type Gauge struct {
+	*BaseWriter
+}
+
+// gaugeItem stores summary information about sample set.
+type gaugeItem struct {
+	// Timestamp of the sample set.
+	time int64
+	// The last value in the sample set.
+	value float64
+}
+
+func init() {
+	Register("gauge", simpleFactory("gauge", func() Writer { return &Gauge{} }))
+}
+
+// Name returns the name of the writer.
+func (*Gauge) Name() string {
+	return "gauge"
+}
+
+// rollupData performs summarization on the given sample set and returns
+// gaugeItem with statistics.
+func (self *Gauge) rollupData(set *types.SampleSet) (data dataItem) {
+	if set.Count() == 0 {
+		return
+	}
+	if set.Sketch != nil {
+		return &gaugeItem{time: set.Time, value: set.Sketch.Last()}
+	}
+	data = &gaugeItem{time: set.Time, value: set.Values[len(set.Values)-1]}
+	return
+}
+
+// String returns string representation of the given gaugeItem.
+func (self *gaugeItem) String() string {
+	return fmt.Sprintf("gaugeItem[time=%d, value=%v]", self.time, self.value)
+}
+
+// rrdInfo returns the list of parameters used to create RRD file.
+func (*gaugeItem) rrdInfo() []string {
+	return []string{
+		"DS:value:GAUGE:600:U:U",
+		"RRA:AVERAGE:0.5:1:25920",   // 72 hours at 1 sample per 10 secs
+		"RRA:AVERAGE:0.5:60:4320",   // 1 month at 1 sample per 10 mins
+		"RRA:AVERAGE:0.5:2880:5475", // 5 years at 1 sample per 8 hours
+		"RRA:MAX:0.5:1:25920",       // 72 hours at 1 sample per 10 secs
+		"RRA:MAX:0.5:60:4320",       // 1 month at 1 sample per 10 mins
+		"RRA:MAX:0.5:2880:5475",     // 5 years at 1 sample per 8 hours
+	}
+}
+
+// rrdTemplate returns template for RRDTool used to update data.
+func (*gaugeItem) rrdTemplate() string {
+	return "value"
+}
+
+// rrdString returns a string matching template format with the data to
+// update RRD files.
+func (self *gaugeItem) rrdString() string {
+	return fmt.Sprintf("%d:%v", self.time, self.value)
+}
+
+// promType returns the type of Prometheus metrics.
+func (*gaugeItem) promType() string {
+	return promGauge
+}
+
+// promSamples returns values exposed in the Prometheus text format.
+func (self *gaugeItem) promSamples() []promSample {
+	return []promSample{promSample{value: self.value}}
+}
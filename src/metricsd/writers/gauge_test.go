@@ -0,0 +1,35 @@
+package writers
+
+import (
+	. "launchpad.net/gocheck"
+)
+
+type GaugeS struct {
+	gauge *Gauge
+}
+
+var _ = Suite(&GaugeS{})
+
+func (s *GaugeS) SetUpTest(c *C) {
+	s.gauge = &Gauge{}
+}
+
+func (s *GaugeS) TestRollupDataWithEmptySampleSet(c *C) {
+	ss := createSampleSet(1000)
+	data := s.gauge.rollupData(ss)
+	c.Check(data, IsNil)
+}
+
+func (s *GaugeS) TestRollupDataTakesLastValue(c *C) {
+	ss := createSampleSet(2000, 42, 15, 37.5)
+	data := s.gauge.rollupData(ss)
+	c.Check(data, Equals, &gaugeItem{time: 2000, value: 37.5})
+}
+
+func (s *GaugeS) TestRollupDataWithSketch(c *C) {
+	ss := createSampleSet(3000)
+	ss.UseSketch(0.01, 0)
+	fillSampleSet(ss, 42, 15, 37.5)
+	data := s.gauge.rollupData(ss)
+	c.Check(data, Equals, &gaugeItem{time: 3000, value: 37.5})
+}
@@ -3,36 +3,83 @@ package writers
 import (
 	"fmt"
 	"math"
+	"os"
+	"path"
 	"sort"
+	"strconv"
+	"strings"
 	"metricsd/types"
 )
 
-// Percentiles writer is used to calculate 90th and 95th percentiles, mean
-// values, and standard deviations under percentiles.
+// Percentiles writer is used to calculate percentiles (90th and 95th by
+// default), mean values, and standard deviations under percentiles.
 //
 // NIST recommended method is used to calculate percentiles:
 // http://www.itl.nist.gov/div898/handbook/prc/section2/prc252.htm
 type Percentiles struct {
 	*BaseWriter
+	// Percentiles to calculate (DefaultPercentiles when empty), sorted.
+	Percentiles []float64
+	// Percentiles to calculate for metrics matching patterns (the first
+	// matching rule wins).
+	Metrics []PercentilesRule
 }
 
+// PercentilesRule overrides the list of percentiles for metrics with names
+// matching the pattern (see path.Match for the syntax).
+type PercentilesRule struct {
+	Match       string
+	Percentiles []float64
+}
+
+// DefaultPercentiles lists percentiles calculated when writer is created
+// without options.
+var DefaultPercentiles = []float64{90, 95}
+
 // percentilesItem stores statistics information calculated by Percentiles
 // writer.
 type percentilesItem struct {
 	// Timestamp of the sample set.
 	time int64
-	// 90th percentile.
-	pct90 int64
-	// Mean value for metrics below the 90th percentile.
-	pct90mean int64
-	// Standard deviation for metrics below the 90th percentile.
-	pct90dev int64
-	// 95th percentile.
-	pct95 int64
-	// Mean value for metrics below the 95th percentile.
-	pct95mean int64
-	// Standard deviation for metrics below the 95th percentile.
-	pct95dev int64
+	// Calculated percentiles, sorted.
+	percentiles []float64
+	// Statistics for each percentile.
+	values []percentileValue
+}
+
+// percentileValue stores statistics for a single percentile.
+type percentileValue struct {
+	// Percentile value.
+	pct float64
+	// Mean value for metrics below the percentile.
+	mean float64
+	// Standard deviation for metrics below the percentile.
+	dev float64
+}
+
+func init() {
+	Register("percentiles", newPercentiles)
+}
+
+// newPercentiles creates Percentiles writer with the given options:
+//     {"Percentiles": [50, 99, 99.9], "Metrics": [{"Match": "*.time", "Percentiles": [99]}]}
+func newPercentiles(options map[string]interface{}) (Writer, os.Error) {
+	writer := &Percentiles{}
+	for key, value := range options {
+		var err os.Error
+		switch key {
+		case "Percentiles":
+			writer.Percentiles, err = parsePercentiles(value)
+		case "Metrics":
+			writer.Metrics, err = parsePercentilesRules(value)
+		default:
+			err = os.NewError(fmt.Sprintf("Writer \"percentiles\" option %q is unknown", key))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return writer, nil
 }
 
 // Name returns the name of the writer.
@@ -40,99 +87,130 @@ func (self *Percentiles) Name() string {
 	return "percentiles"
 }
 
+// PercentilesFor returns percentiles calculated for the metric with the given
+// name.
+func (self *Percentiles) PercentilesFor(name string) []float64 {
+	for _, rule := range self.Metrics {
+		if matched, _ := path.Match(rule.Match, name); matched {
+			return rule.Percentiles
+		}
+	}
+	if len(self.Percentiles) > 0 {
+		return self.Percentiles
+	}
+	return DefaultPercentiles
+}
+
 // rollupData performs summarization on the given sample set and returns
 // percentilesItem with statistics.
 func (self *Percentiles) rollupData(set *types.SampleSet) (data dataItem) {
-	if len(set.Values) == 0 {
+	if set.Count() == 0 {
 		return
 	}
-	sort.Ints(set.Values)
+	percentiles := self.PercentilesFor(set.Name)
+	values := make([]percentileValue, len(percentiles))
+	if set.Sketch != nil {
+		bins := set.Sketch.Bins()
+		for i, p := range percentiles {
+			values[i] = sketchPercentile(p/100, set.Sketch, bins)
+		}
+		return &percentilesItem{time: set.Time, percentiles: percentiles, values: values}
+	}
 
-	pct90index, pct90 := pecentile(0.90, set)
-	pct95index, pct95 := pecentile(0.95, set)
+	sort.Float64s(set.Values)
+	for i, p := range percentiles {
+		index, pct := pecentile(p/100, set)
 
-	var pct90sum float64 = 0
-	var pct95sum float64 = 0
-	for idx, elem := range set.Values[0:pct95index] {
-		if int64(idx) < pct90index {
-			pct90sum += float64(elem)
+		var sum float64 = 0
+		for _, elem := range set.Values[0:index] {
+			sum += elem
 		}
-		pct95sum += float64(elem)
-	}
-	var pct90mean float64 = pct90sum / float64(pct90index)
-	var pct95mean float64 = pct95sum / float64(pct95index)
+		var mean float64 = sum / float64(index)
 
-	var pct90sqdiff float64 = 0
-	var pct95sqdiff float64 = 0
-	for idx, elem := range set.Values[0:pct95index] {
-		if int64(idx) <= pct90index {
-			pct90sqdiff += math.Pow(float64(pct90mean)-float64(elem), 2)
+		var sqdiff float64 = 0
+		for _, elem := range set.Values[0:index] {
+			sqdiff += math.Pow(mean-elem, 2)
 		}
-		pct95sqdiff += math.Pow(float64(pct95mean)-float64(elem), 2)
-	}
 
-	data = &percentilesItem{
-		time:      set.Time,
-		pct90:     int64(pct90 + 0.5),
-		pct90mean: int64(pct90mean + 0.5),
-		pct90dev:  int64(math.Sqrt(pct90sqdiff/float64(pct90index)) + 0.5),
-		pct95:     int64(pct95 + 0.5),
-		pct95mean: int64(pct95mean + 0.5),
-		pct95dev:  int64(math.Sqrt(pct95sqdiff/float64(pct95index)) + 0.5),
+		values[i] = percentileValue{pct: pct, mean: mean, dev: math.Sqrt(sqdiff / float64(index))}
 	}
+
+	data = &percentilesItem{time: set.Time, percentiles: percentiles, values: values}
 	return
 }
 
 // String returns string representation of the given percentilesItem.
 func (self *percentilesItem) String() string {
-	return fmt.Sprintf(
-		"percentilesItem[time=%d, pct90=%d, pct90mean=%d, pct90dev=%d, pct95=%d, pct95mean=%d, pct95dev=%d]",
-		self.time,
-		self.pct90,
-		self.pct90mean,
-		self.pct90dev,
-		self.pct95,
-		self.pct95mean,
-		self.pct95dev,
-	)
+	fields := make([]string, 0, len(self.percentiles)*3+1)
+	fields = append(fields, fmt.Sprintf("time=%d", self.time))
+	for i, p := range self.percentiles {
+		name := PercentileDataSource(p)
+		value := self.values[i]
+		fields = append(fields, fmt.Sprintf("%s=%v, %smean=%v, %sdev=%v", name, value.pct, name, value.mean, name, value.dev))
+	}
+	return fmt.Sprintf("percentilesItem[%s]", strings.Join(fields, ", "))
 }
 
 // rrdInfo returns the list of parameters used to create RRD file.
-func (*percentilesItem) rrdInfo() []string {
-	return []string{
-		"DS:pct90:GAUGE:600:0:U",
-		"DS:pct90mean:GAUGE:600:0:U",
-		"DS:pct90dev:GAUGE:600:0:U",
-		"DS:pct95:GAUGE:600:0:U",
-		"DS:pct95mean:GAUGE:600:0:U",
-		"DS:pct95dev:GAUGE:600:0:U",
+func (self *percentilesItem) rrdInfo() []string {
+	info := make([]string, 0, len(self.percentiles)*3+6)
+	for _, p := range self.percentiles {
+		name := PercentileDataSource(p)
+		info = append(info,
+			fmt.Sprintf("DS:%s:GAUGE:600:0:U", name),
+			fmt.Sprintf("DS:%smean:GAUGE:600:0:U", name),
+			fmt.Sprintf("DS:%sdev:GAUGE:600:0:U", name),
+		)
+	}
+	return append(info,
 		"RRA:AVERAGE:0.5:1:25920",   // 72 hours at 1 sample per 10 secs
 		"RRA:AVERAGE:0.5:60:4320",   // 1 month at 1 sample per 10 mins
 		"RRA:AVERAGE:0.5:2880:5475", // 5 years at 1 sample per 8 hours
 		"RRA:MAX:0.5:1:25920",       // 72 hours at 1 sample per 10 secs
 		"RRA:MAX:0.5:60:4320",       // 1 month at 1 sample per 10 mins
 		"RRA:MAX:0.5:2880:5475",     // 5 years at 1 sample per 8 hours
-	}
+	)
 }
 
 // rrdTemplate returns template for RRDTool used to update data.
-func (*percentilesItem) rrdTemplate() string {
-	return "pct90:pct90mean:pct90dev:pct95:pct95mean:pct95dev"
+func (self *percentilesItem) rrdTemplate() string {
+	names := make([]string, 0, len(self.percentiles)*3)
+	for _, p := range self.percentiles {
+		name := PercentileDataSource(p)
+		names = append(names, name, name+"mean", name+"dev")
+	}
+	return strings.Join(names, ":")
 }
 
 // rrdString returns a string matching template format with the data to
 // update RRD files.
 func (self *percentilesItem) rrdString() string {
-	return fmt.Sprintf(
-		"%d:%d:%d:%d:%d:%d:%d",
-		self.time,
-		self.pct90,
-		self.pct90mean,
-		self.pct90dev,
-		self.pct95,
-		self.pct95mean,
-		self.pct95dev,
-	)
+	fields := make([]string, 0, len(self.values)*3+1)
+	fields = append(fields, strconv.Itoa64(self.time))
+	for _, value := range self.values {
+		fields = append(fields, fmt.Sprintf("%v:%v:%v", value.pct, value.mean, value.dev))
+	}
+	return strings.Join(fields, ":")
+}
+
+// promType returns the type of Prometheus metrics.
+func (*percentilesItem) promType() string {
+	return promSummary
+}
+
+// promSamples returns values exposed in the Prometheus text format.
+func (self *percentilesItem) promSamples() []promSample {
+	samples := make([]promSample, len(self.values))
+	for i, value := range self.values {
+		samples[i] = promSample{quantile: promQuantile(self.percentiles[i]), value: value.pct}
+	}
+	return samples
+}
+
+// PercentileDataSource returns the name of RRD data source for the given
+// percentile, e.g. "pct95" for 95, or "pct99_9" for 99.9.
+func PercentileDataSource(p float64) string {
+	return "pct" + strings.Replace(strconv.Ftoa64(p, 'f', -1), ".", "_", -1)
 }
 
 // percentile calculates pth percentile for the given sample set.
@@ -142,10 +220,103 @@ func pecentile(p float64, set *types.SampleSet) (index int64, pct float64) {
 	var n float64 = p * (float64(number) + 1)
 	k, d := math.Modf(n)
 	index = int64(k)
-	pct = float64(set.Values[index-1])
+	// Percentile is below the first value
+	if index < 1 {
+		return 1, set.Values[0]
+	}
+	pct = set.Values[index-1]
 	if index > 1 && index < number {
-		pct += d * float64(set.Values[index]-set.Values[index-1])
+		pct += d * (set.Values[index] - set.Values[index-1])
 	}
 
 	return
 }
+
+// sketchPercentile calculates pth percentile, mean value and standard
+// deviation under it for the sample set switched to a sketch (bins are sorted
+// bins of the sketch). Percentile and mean are within the relative accuracy
+// of the sketch, error of the deviation is within the accuracy of the
+// percentile.
+func sketchPercentile(p float64, sketch *types.Sketch, bins []types.SketchBin) percentileValue {
+	count := sketch.Count()
+	index := int64(p * float64(count+1))
+	if index < 1 {
+		index = 1
+	} else if index > count {
+		index = count
+	}
+
+	var sum, sqsum float64
+	left := uint64(index)
+	for _, bin := range bins {
+		n := bin.Count
+		if n > left {
+			n = left
+		}
+		sum += bin.Value * float64(n)
+		sqsum += bin.Value * bin.Value * float64(n)
+		if left -= n; left == 0 {
+			break
+		}
+	}
+	mean := sum / float64(index)
+	return percentileValue{
+		pct:  sketch.Quantile(p),
+		mean: mean,
+		dev:  math.Sqrt(math.Fmax(sqsum/float64(index)-mean*mean, 0)),
+	}
+}
+
+// parsePercentiles parses a list of percentiles from writer options, and
+// returns them sorted.
+func parsePercentiles(value interface{}) ([]float64, os.Error) {
+	list, ok := value.([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, os.NewError(fmt.Sprintf("Percentiles should be a non-empty list: %v", value))
+	}
+	percentiles := make([]float64, len(list))
+	for i, item := range list {
+		p, ok := item.(float64)
+		if !ok || !(p > 0 && p < 100) {
+			return nil, os.NewError(fmt.Sprintf("Percentile is invalid: %v", item))
+		}
+		// RRD data source names are limited to 19 characters (pct99_99mean)
+		if len(PercentileDataSource(p)) > 15 {
+			return nil, os.NewError(fmt.Sprintf("Percentile has too many digits: %v", item))
+		}
+		percentiles[i] = p
+	}
+	sort.Float64s(percentiles)
+	for i := 1; i < len(percentiles); i++ {
+		if percentiles[i] == percentiles[i-1] {
+			return nil, os.NewError(fmt.Sprintf("Percentile is duplicated: %v", percentiles[i]))
+		}
+	}
+	return percentiles, nil
+}
+
+// parsePercentilesRules parses a list of per-metric percentiles in the
+// {"Match": "*.time", "Percentiles": [99, 99.9]} format.
+func parsePercentilesRules(value interface{}) ([]PercentilesRule, os.Error) {
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, os.NewError(fmt.Sprintf("Percentiles metrics should be a list: %v", value))
+	}
+	rules := make([]PercentilesRule, len(list))
+	for i, item := range list {
+		rule, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, os.NewError(fmt.Sprintf("Percentiles rule is invalid: %v", item))
+		}
+		match, ok := rule["Match"].(string)
+		if _, err := path.Match(match, ""); !ok || err != nil {
+			return nil, os.NewError(fmt.Sprintf("Percentiles rule pattern is invalid: %v", item))
+		}
+		percentiles, err := parsePercentiles(rule["Percentiles"])
+		if err != nil {
+			return nil, err
+		}
+		rules[i] = PercentilesRule{Match: match, Percentiles: percentiles}
+	}
+	return rules, nil
+}
@@ -1,7 +1,10 @@
 package writers
 
 import (
+	"fmt"
 	. "launchpad.net/gocheck"
+	"math"
+	"strings"
 )
 
 type PercentilesS struct {
@@ -23,32 +26,114 @@ func (s *PercentilesS) TestRollupDataWithEmptySampleSet(c *C) {
 func (s *PercentilesS) TestRollupDataWithSampleSetWith1Item(c *C) {
 	ss := createSampleSet(2000, 10)
 	data := s.percentiles.rollupData(ss)
-	c.Check(data, Equals, &percentilesItem{time: 2000, pct90: 10, pct90mean: 10, pct90dev: 0, pct95: 10, pct95mean: 10, pct95dev: 0})
+	c.Check(data, Equals, &percentilesItem{time: 2000, percentiles: DefaultPercentiles, values: []percentileValue{{10, 10, 0}, {10, 10, 0}}})
 }
 
 func (s *PercentilesS) TestRollupDataWithSampleSetWith2Items(c *C) {
 	ss := createSampleSet(3000, 10, 20)
 	data := s.percentiles.rollupData(ss)
-	c.Check(data, Equals, &percentilesItem{time: 3000, pct90: 20, pct90mean: 15, pct90dev: 5, pct95: 20, pct95mean: 15, pct95dev: 5})
+	c.Check(data, Equals, &percentilesItem{time: 3000, percentiles: DefaultPercentiles, values: []percentileValue{{20, 15, 5}, {20, 15, 5}}})
 }
 
 func (s *PercentilesS) TestRollupDataWithSampleSetWith3Items(c *C) {
 	ss := createSampleSet(4000, 10, 20, 30)
 	data := s.percentiles.rollupData(ss)
-	c.Check(data, Equals, &percentilesItem{time: 4000, pct90: 30, pct90mean: 20, pct90dev: 8, pct95: 30, pct95mean: 20, pct95dev: 8})
+	c.Check(data, Equals, &percentilesItem{time: 4000, percentiles: DefaultPercentiles, values: []percentileValue{{30, 20, 8.16496580927726}, {30, 20, 8.16496580927726}}})
 }
 
 func (s *PercentilesS) TestRollupDataWithSimpleSampleSet(c *C) {
 	ss := createSampleSet(5000, 15, 20, 35, 40, 50)
 	data := s.percentiles.rollupData(ss)
-	c.Check(data, Equals, &percentilesItem{time: 5000, pct90: 50, pct90mean: 32, pct90dev: 13, pct95: 50, pct95mean: 32, pct95dev: 13})
+	c.Check(data, Equals, &percentilesItem{time: 5000, percentiles: DefaultPercentiles, values: []percentileValue{{50, 32, 12.884098726725126}, {50, 32, 12.884098726725126}}})
 }
 
 func (s *PercentilesS) TestRollupDataWithComplexSampleSet(c *C) {
 	ss := createSampleSet(6000)
 	for i := 1; i < 100; i++ {
-		ss.Add(i * 10)
+		ss.Add(float64(i * 10))
 	}
 	data := s.percentiles.rollupData(ss)
-	c.Check(data, Equals, &percentilesItem{time: 6000, pct90: 900, pct90mean: 455, pct90dev: 264, pct95: 950, pct95mean: 480, pct95dev: 274})
+	c.Check(data, Equals, &percentilesItem{time: 6000, percentiles: DefaultPercentiles, values: []percentileValue{{900, 455, 259.79158313283875}, {950, 480, 274.22618401604177}}})
+}
+
+func (s *PercentilesS) TestRollupDataWithConfiguredPercentiles(c *C) {
+	s.percentiles.Percentiles = []float64{50, 99, 99.9}
+	ss := createSampleSet(7000, 15, 20, 35, 40, 50)
+	data := s.percentiles.rollupData(ss)
+	c.Check(data, Equals, &percentilesItem{time: 7000, percentiles: []float64{50, 99, 99.9}, values: []percentileValue{{35, 23.333333333333332, 8.498365855987975}, {50, 32, 12.884098726725126}, {50, 32, 12.884098726725126}}})
+	c.Check(data.rrdTemplate(), Equals, "pct50:pct50mean:pct50dev:pct99:pct99mean:pct99dev:pct99_9:pct99_9mean:pct99_9dev")
+	c.Check(data.rrdString(), Equals, "7000:35:23.333333333333332:8.498365855987975:50:32:12.884098726725126:50:32:12.884098726725126")
+	c.Check(strings.Join(data.rrdInfo()[0:3], " "), Equals, "DS:pct50:GAUGE:600:0:U DS:pct50mean:GAUGE:600:0:U DS:pct50dev:GAUGE:600:0:U")
+}
+
+func (s *PercentilesS) TestRollupDataWithLowPercentile(c *C) {
+	s.percentiles.Percentiles = []float64{10}
+	ss := createSampleSet(8000, 10, 20)
+	data := s.percentiles.rollupData(ss)
+	c.Check(data, Equals, &percentilesItem{time: 8000, percentiles: []float64{10}, values: []percentileValue{{10, 10, 0}}})
+}
+
+func (s *PercentilesS) TestRollupDataWithSketch(c *C) {
+	exact, sketched := createSampleSet(9000), createSampleSet(9000)
+	sketched.UseSketch(0.01, 0)
+	for i := 1; i < 1000; i++ {
+		exact.Add(float64(i * 10))
+		sketched.Add(float64(i * 10))
+	}
+	expected := s.percentiles.rollupData(exact).(*percentilesItem)
+	data := s.percentiles.rollupData(sketched).(*percentilesItem)
+	c.Assert(len(data.values), Equals, 2)
+	for i, value := range data.values {
+		// Standard deviation error is bounded by the accuracy of the percentile
+		for _, v := range []struct{ value, expected, bound float64 }{
+			{value.pct, expected.values[i].pct, expected.values[i].pct},
+			{value.mean, expected.values[i].mean, expected.values[i].mean},
+			{value.dev, expected.values[i].dev, expected.values[i].pct},
+		} {
+			if math.Fabs(v.value-v.expected) > 0.01*v.bound {
+				c.Errorf("Expected %v within %v, got %v", v.expected, 0.01*v.bound, v.value)
+			}
+		}
+	}
+}
+
+func (s *PercentilesS) TestPercentilesFor(c *C) {
+	c.Check(fmt.Sprint(s.percentiles.PercentilesFor("metric")), Equals, "[90 95]")
+
+	s.percentiles.Percentiles = []float64{50}
+	s.percentiles.Metrics = []PercentilesRule{PercentilesRule{Match: "*.time", Percentiles: []float64{99, 99.9}}}
+	c.Check(fmt.Sprint(s.percentiles.PercentilesFor("metric")), Equals, "[50]")
+	c.Check(fmt.Sprint(s.percentiles.PercentilesFor("db.time")), Equals, "[99 99.9]")
+}
+
+func (s *PercentilesS) TestNewWithOptions(c *C) {
+	writer, err := New("percentiles", map[string]interface{}{
+		"Percentiles": []interface{}{99.9, 50.0, 99.0},
+		"Metrics": []interface{}{
+			map[string]interface{}{"Match": "*.time", "Percentiles": []interface{}{95.0}},
+		},
+	})
+	c.Assert(err, IsNil)
+	percentiles := writer.(*Percentiles)
+	c.Check(fmt.Sprint(percentiles.Percentiles), Equals, "[50 99 99.9]")
+	c.Check(fmt.Sprint(percentiles.PercentilesFor("db.time")), Equals, "[95]")
+}
+
+func (s *PercentilesS) TestNewWithInvalidOptions(c *C) {
+	_, err := New("percentiles", map[string]interface{}{"Percentiles": []interface{}{100.0}})
+	c.Check(err.String(), Equals, "Percentile is invalid: 100")
+
+	_, err = New("percentiles", map[string]interface{}{"Percentiles": []interface{}{50.0, 50.0}})
+	c.Check(err.String(), Equals, "Percentile is duplicated: 50")
+
+	_, err = New("percentiles", map[string]interface{}{"Percentiles": []interface{}{99.9999999999}})
+	c.Check(err.String(), Equals, "Percentile has too many digits: 99.9999999999")
+
+	_, err = New("percentiles", map[string]interface{}{"Unknown": true})
+	c.Check(err.String(), Equals, `Writer "percentiles" option "Unknown" is unknown`)
+}
+
+func (s *PercentilesS) TestPercentileDataSource(c *C) {
+	c.Check(PercentileDataSource(95), Equals, "pct95")
+	c.Check(PercentileDataSource(99.9), Equals, "pct99_9")
 }
@@ -0,0 +1,207 @@
+package writers
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"metricsd/config"
+	"metricsd/types"
+)
+
+// Number of write intervals after which series not updated anymore are
+// removed from the Prometheus exposition.
+const PROMETHEUS_STALE_INTERVALS = 3
+
+// Prometheus metric types.
+const (
+	promCounter = "counter"
+	promGauge   = "gauge"
+	promSummary = "summary"
+)
+
+// promSample is a value of a data item exposed in the Prometheus text format.
+type promSample struct {
+	// Suffix of the metric name, e.g. "_ok_total" (could be empty).
+	suffix string
+	// Value of the quantile label for summaries (empty for other types).
+	quantile string
+	// Value of the sample.
+	value float64
+	// Value indicating whether the value is an increment of a cumulative
+	// total (counters and summary counts).
+	cumulative bool
+}
+
+// promSeries stores the latest data item of a series written by a writer.
+type promSeries struct {
+	name    string             // metric name in the Prometheus format
+	labels  []string           // labels of the series in name="value" format
+	item    dataItem           // the latest data item
+	totals  map[string]float64 // cumulative totals by sample suffix
+	updated int64              // time of the last update
+}
+
+var (
+	// The latest data items by writer, source, and series name
+	promLatest = make(map[string]*promSeries)
+	// Prometheus series lock (written during rollup, read by web server)
+	promMutex sync.Mutex
+)
+
+// rememberLatest stores the latest data item of the given sample set to be
+// exposed in the Prometheus text format, cumulative values are added to the
+// totals of the series.
+func rememberLatest(writer Writer, set *types.SampleSet, data ...dataItem) {
+	if len(data) == 0 {
+		return
+	}
+	key := writer.Name() + "|" + set.Source + "|" + set.FullName()
+
+	promMutex.Lock()
+	defer promMutex.Unlock()
+
+	series, found := promLatest[key]
+	if !found {
+		series = &promSeries{
+			name:   promName(strings.Replace(set.Name, "$", ".", -1) + "." + writer.Name()),
+			labels: promLabels(set),
+			totals: make(map[string]float64),
+		}
+		promLatest[key] = series
+	}
+	for _, item := range data {
+		for _, sample := range item.promSamples() {
+			if sample.cumulative {
+				series.totals[sample.suffix] += sample.value
+			}
+		}
+	}
+	series.item = data[len(data)-1]
+	series.updated = time.Seconds()
+}
+
+// Prometheus returns the latest rolled up values of all series in the
+// Prometheus text exposition format: values of count and counter writers are
+// exposed as counters (e.g. app_requests_count_ok_total), quartiles and
+// percentiles as summaries with quantile labels, gauges and sets as gauges.
+// Each series has the source label (when not empty) and labels of its tags.
+// Counter totals are accumulated since start.
+func Prometheus() []byte {
+	promMutex.Lock()
+	defer promMutex.Unlock()
+
+	type family struct {
+		kind  string
+		lines []string
+	}
+	families := make(map[string]*family)
+	stale := time.Seconds() - int64(PROMETHEUS_STALE_INTERVALS*config.WriteInterval)
+	for key, series := range promLatest {
+		if series.updated < stale {
+			promLatest[key] = nil, false
+			continue
+		}
+
+		kind := series.item.promType()
+		for _, sample := range series.item.promSamples() {
+			name := series.name + sample.suffix
+			familyName := name
+			if kind == promSummary {
+				familyName = series.name
+			}
+			f, found := families[familyName]
+			if !found {
+				f = &family{kind: kind}
+				families[familyName] = f
+			}
+
+			labels := series.labels
+			if len(sample.quantile) > 0 {
+				labels = append(append(make([]string, 0, len(labels)+1), labels...), `quantile="`+sample.quantile+`"`)
+			}
+			value := sample.value
+			if sample.cumulative {
+				value = series.totals[sample.suffix]
+			}
+			line := name
+			if len(labels) > 0 {
+				line += "{" + strings.Join(labels, ",") + "}"
+			}
+			f.lines = append(f.lines, line+" "+promValue(value))
+		}
+	}
+
+	names := make([]string, 0, len(families))
+	for name, _ := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		f := families[name]
+		sort.Strings(f.lines)
+		buf.WriteString("# TYPE " + name + " " + f.kind + "\n")
+		for _, line := range f.lines {
+			buf.WriteString(line)
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes()
+}
+
+// promName converts a metric name to a valid Prometheus metric name:
+// characters other than letters, digits, underscores, and colons are replaced
+// with underscores, e.g. "app.requests.count" becomes "app_requests_count".
+func promName(name string) string {
+	name = strings.Map(func(rune int) int {
+		if (rune >= 'a' && rune <= 'z') || (rune >= 'A' && rune <= 'Z') || (rune >= '0' && rune <= '9') || rune == '_' || rune == ':' {
+			return rune
+		}
+		return '_'
+	}, name)
+	if len(name) == 0 || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+// promLabels returns labels of the sample set: the source label (when not
+// empty), and a label for each tag. Tags named "source" or "quantile" are
+// prefixed with "tag_" to avoid conflicts.
+func promLabels(set *types.SampleSet) []string {
+	labels := make([]string, 0, len(set.Tags)+1)
+	if len(set.Source) > 0 {
+		labels = append(labels, `source="`+promEscape(set.Source)+`"`)
+	}
+	for _, tag := range set.Tags {
+		key := strings.Replace(promName(tag.Key), ":", "_", -1)
+		if key == "source" || key == "quantile" || strings.HasPrefix(key, "__") {
+			key = "tag_" + key
+		}
+		labels = append(labels, key+`="`+promEscape(tag.Value)+`"`)
+	}
+	return labels
+}
+
+// promEscape escapes backslashes, double quotes, and line feeds in a label
+// value.
+func promEscape(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	return strings.Replace(value, "\n", `\n`, -1)
+}
+
+// promValue formats the sample value.
+func promValue(value float64) string {
+	return strconv.Ftoa64(value, 'g', -1)
+}
+
+// promQuantile formats the quantile label for the given percentile, e.g.
+// "0.999" for 99.9.
+func promQuantile(percentile float64) string {
+	return strconv.Ftoa64(percentile/100, 'g', 12)
+}
@@ -0,0 +1,73 @@
+package writers
+
+import (
+	. "launchpad.net/gocheck"
+	"strings"
+	"metricsd/types"
+)
+
+type PrometheusS struct{}
+
+var _ = Suite(&PrometheusS{})
+
+func (s *PrometheusS) SetUpTest(c *C) {
+	promLatest = make(map[string]*promSeries)
+}
+
+func (s *PrometheusS) TestCountersAreAccumulated(c *C) {
+	set := createSampleSet(10, 1, 1, -1)
+	rememberLatest(&Count{}, set, (&Count{}).rollupData(set))
+	set = createSampleSet(20, 1, -1)
+	rememberLatest(&Count{}, set, (&Count{}).rollupData(set))
+
+	c.Check(string(Prometheus()), Equals, strings.Join([]string{
+		"# TYPE metric_count_fail_total counter",
+		`metric_count_fail_total{source="src"} 2`,
+		"# TYPE metric_count_ok_total counter",
+		`metric_count_ok_total{source="src"} 3`,
+		"",
+	}, "\n"))
+}
+
+func (s *PrometheusS) TestSummaries(c *C) {
+	set := createSampleSet(10, 1, 2, 3, 4, 5)
+	rememberLatest(&Quartiles{}, set, (&Quartiles{}).rollupData(set))
+	writer := &Percentiles{Percentiles: []float64{50, 99.9}}
+	rememberLatest(writer, set, writer.rollupData(set))
+
+	c.Check(string(Prometheus()), Equals, strings.Join([]string{
+		"# TYPE metric_percentiles summary",
+		`metric_percentiles{source="src",quantile="0.5"} 3`,
+		`metric_percentiles{source="src",quantile="0.999"} 5`,
+		"# TYPE metric_quartiles summary",
+		`metric_quartiles_count{source="src"} 5`,
+		`metric_quartiles{source="src",quantile="0"} 1`,
+		`metric_quartiles{source="src",quantile="0.25"} 2`,
+		`metric_quartiles{source="src",quantile="0.5"} 3`,
+		`metric_quartiles{source="src",quantile="0.75"} 4`,
+		`metric_quartiles{source="src",quantile="1"} 5`,
+		"",
+	}, "\n"))
+}
+
+func (s *PrometheusS) TestNamesAndLabels(c *C) {
+	set := types.NewTypedSampleSet(10, "", "app.memory-used", types.Gauge)
+	set.Tags = types.NewTags(types.Tag{Key: "source", Value: "a\"b"}, types.Tag{Key: "dc", Value: "ams"})
+	fillSampleSet(set, 10, 5)
+	rememberLatest(&Gauge{}, set, (&Gauge{}).rollupData(set))
+
+	c.Check(string(Prometheus()), Equals, strings.Join([]string{
+		"# TYPE app_memory_used_gauge gauge",
+		`app_memory_used_gauge{dc="ams",tag_source="a\"b"} 5`,
+		"",
+	}, "\n"))
+}
+
+func (s *PrometheusS) TestStaleSeriesAreRemoved(c *C) {
+	set := createSampleSet(10, 1)
+	rememberLatest(&Count{}, set, (&Count{}).rollupData(set))
+	promLatest["count|src|metric"].updated = 0
+
+	c.Check(string(Prometheus()), Equals, "")
+	c.Check(len(promLatest), Equals, 0)
+}
@@ -17,19 +17,23 @@ type quartilesItem struct {
 	// Timestamp of the sample set.
 	time int64
 	// Minimum value in the sample set.
-	lo int64
+	lo float64
 	// Q1 (25%)
-	q1 int64
+	q1 float64
 	// Q2 (50%)
-	q2 int64
+	q2 float64
 	// Q3 (75%)
-	q3 int64
+	q3 float64
 	// Maximum value in the sample set.
-	hi int64
+	hi float64
 	// Number of values used to generate statistics.
 	total int64
 }
 
+func init() {
+	Register("quartiles", simpleFactory("quartiles", func() Writer { return &Quartiles{} }))
+}
+
 // Name returns the name of the writer.
 func (self *Quartiles) Name() string {
 	return "quartiles"
@@ -38,22 +42,25 @@ func (self *Quartiles) Name() string {
 // rollupData performs summarization on the given sample set and returns
 // quartilesItem with statistics.
 func (self *Quartiles) rollupData(set *types.SampleSet) (data dataItem) {
-	if len(set.Values) == 0 {
+	if set.Count() == 0 {
 		return
 	}
-	sort.Ints(set.Values)
+	if set.Sketch != nil {
+		return sketchQuartiles(set)
+	}
+	sort.Float64s(set.Values)
 	number := int64(len(set.Values))
-	lo := int64(set.Values[0])
-	hi := int64(set.Values[number-1])
+	lo := set.Values[0]
+	hi := set.Values[number-1]
 
 	q1, q2, q3 := quartiles(set)
 
 	data = &quartilesItem{
 		time:  set.Time,
 		lo:    lo,
-		q1:    int64(q1 + 0.5),
-		q2:    int64(q2 + 0.5),
-		q3:    int64(q3 + 0.5),
+		q1:    q1,
+		q2:    q2,
+		q3:    q3,
 		hi:    hi,
 		total: number,
 	}
@@ -64,7 +71,7 @@ func (self *Quartiles) rollupData(set *types.SampleSet) (data dataItem) {
 // String returns string representation of the given quartilesItem.
 func (self *quartilesItem) String() string {
 	return fmt.Sprintf(
-		"quartilesItem[time=%d, lo=%d, q1=%d, q2=%d, q3=%d, hi=%d, total=%d]",
+		"quartilesItem[time=%d, lo=%v, q1=%v, q2=%v, q3=%v, hi=%v, total=%d]",
 		self.time,
 		self.lo,
 		self.q1,
@@ -102,7 +109,7 @@ func (*quartilesItem) rrdTemplate() string {
 // update RRD files.
 func (self *quartilesItem) rrdString() string {
 	return fmt.Sprintf(
-		"%d:%d:%d:%d:%d:%d:%d",
+		"%d:%v:%v:%v:%v:%v:%d",
 		self.time,
 		self.q1,
 		self.q2,
@@ -113,6 +120,23 @@ func (self *quartilesItem) rrdString() string {
 	)
 }
 
+// promType returns the type of Prometheus metrics.
+func (*quartilesItem) promType() string {
+	return promSummary
+}
+
+// promSamples returns values exposed in the Prometheus text format.
+func (self *quartilesItem) promSamples() []promSample {
+	return []promSample{
+		promSample{quantile: "0", value: self.lo},
+		promSample{quantile: "0.25", value: self.q1},
+		promSample{quantile: "0.5", value: self.q2},
+		promSample{quantile: "0.75", value: self.q3},
+		promSample{quantile: "1", value: self.hi},
+		promSample{suffix: "_count", value: float64(self.total), cumulative: true},
+	}
+}
+
 // quartiles calculates quartiles for the given sample set.
 func quartiles(set *types.SampleSet) (q1, q2, q3 float64) {
 	number := int64(len(set.Values))
@@ -122,15 +146,31 @@ func quartiles(set *types.SampleSet) (q1, q2, q3 float64) {
 	return
 }
 
+// sketchQuartiles calculates quartiles for the sample set switched to a
+// sketch. Quartiles are within the relative accuracy of the sketch, minimum
+// and maximum values are exact.
+func sketchQuartiles(set *types.SampleSet) *quartilesItem {
+	sketch := set.Sketch
+	return &quartilesItem{
+		time:  set.Time,
+		lo:    sketch.Min(),
+		q1:    sketch.Quantile(0.25),
+		q2:    sketch.Quantile(0.5),
+		q3:    sketch.Quantile(0.75),
+		hi:    sketch.Max(),
+		total: sketch.Count(),
+	}
+}
+
 // median calculates value and index of the median for the given sample set.
-func median(set []int) (index int64, median float64) {
+func median(set []float64) (index int64, median float64) {
 	number := int64(len(set))
 	var n float64 = float64(number-1) / 2.0
 	k, d := math.Modf(n)
 	index = int64(k)
-	median = float64(set[index])
+	median = set[index]
 	if index+1 < number {
-		median += d * float64(set[index+1]-set[index])
+		median += d * (set[index+1] - set[index])
 	}
 	return
 }
@@ -2,6 +2,7 @@ package writers
 
 import (
 	. "launchpad.net/gocheck"
+	"math"
 )
 
 type QuartilesS struct {
@@ -41,11 +42,39 @@ func (s *QuartilesS) TestRollupDataWithSampleSetWith3Items(c *C) {
 func (s *QuartilesS) TestRollupDataWithSampleSetWith5Items(c *C) {
 	ss := createSampleSet(5000, 36, 7, 15, 40, 41, 39)
 	data := s.quartiles.rollupData(ss)
-	c.Check(data, Equals, &quartilesItem{time: 5000, lo: 7, q1: 15, q2: 38, q3: 40, hi: 41, total: 6})
+	c.Check(data, Equals, &quartilesItem{time: 5000, lo: 7, q1: 15, q2: 37.5, q3: 40, hi: 41, total: 6})
 }
 
 func (s *QuartilesS) TestRollupDataWithLargeSampleSet(c *C) {
 	ss := createSampleSet(6000, 6, 47, 49, 15, 42, 41, 7, 39, 43, 40, 36)
 	data := s.quartiles.rollupData(ss)
-	c.Check(data, Equals, &quartilesItem{time: 6000, lo: 6, q1: 26, q2: 40, q3: 43, hi: 49, total: 11})
+	c.Check(data, Equals, &quartilesItem{time: 6000, lo: 6, q1: 25.5, q2: 40, q3: 42.5, hi: 49, total: 11})
+}
+
+func (s *QuartilesS) TestRollupDataWithFractionalSampleSet(c *C) {
+	ss := createSampleSet(7000, 0.25, 1.5, 0.75, 2.5)
+	data := s.quartiles.rollupData(ss)
+	c.Check(data, Equals, &quartilesItem{time: 7000, lo: 0.25, q1: 0.5, q2: 1.125, q3: 2, hi: 2.5, total: 4})
+}
+
+func (s *QuartilesS) TestRollupDataWithSketch(c *C) {
+	ss := createSampleSet(9000)
+	ss.UseSketch(0.01, 0)
+	for i := 1; i <= 1001; i++ {
+		ss.Add(float64(i))
+	}
+	data := s.quartiles.rollupData(ss).(*quartilesItem)
+	c.Check(data.lo, Equals, 1.0)
+	c.Check(data.hi, Equals, 1001.0)
+	c.Check(data.total, Equals, int64(1001))
+	for _, q := range []struct{ value, expected float64 }{{data.q1, 251}, {data.q2, 501}, {data.q3, 751}} {
+		if math.Fabs(q.value-q.expected) > 0.01*q.expected {
+			c.Errorf("Expected %v within 1%%, got %v", q.expected, q.value)
+		}
+	}
+}
+
+func (s *QuartilesS) TestRrdStringKeepsFractions(c *C) {
+	item := &quartilesItem{time: 8000, lo: 0.25, q1: 0.5, q2: 1.125, q3: 2, hi: 2.5, total: 4}
+	c.Check(item.rrdString(), Equals, "8000:0.5:1.125:2:0.25:2.5:4")
 }
@@ -0,0 +1,153 @@
+package writers
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"metricsd/config"
+	"metricsd/types"
+)
+
+// Factory creates a new writer with the given options (could be nil).
+type Factory func(options map[string]interface{}) (Writer, os.Error)
+
+var (
+	// Registered writer factories by writer name
+	factories = make(map[string]Factory)
+	// Writers created when no writers specified in config
+	defaultWriters = []string{"count", "quartiles", "percentiles", "counter", "gauge", "set"}
+	// Writers created by Load by writer name
+	loaded = make(map[string]Writer)
+	// Rules to select writers by metric name
+	rules []config.WriterRule
+	// Names of writers selected for metric name and type
+	rulesCache = make(map[string][]string)
+	// Lock for loaded writers, rules, and rules cache
+	rulesMutex sync.Mutex
+)
+
+// Register makes a writer available by the provided name. Panics if Register
+// is called twice with the same name.
+func Register(name string, factory Factory) {
+	if _, found := factories[name]; found {
+		panic(fmt.Sprintf("Writer %q is already registered", name))
+	}
+	factories[name] = factory
+}
+
+// Registered returns sorted names of all registered writers.
+func Registered() []string {
+	names := make([]string, 0, len(factories))
+	for name, _ := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New creates a writer registered by the given name.
+func New(name string, options map[string]interface{}) (Writer, os.Error) {
+	factory, found := factories[name]
+	if !found {
+		return nil, os.NewError(fmt.Sprintf("Writer %q is not registered", name))
+	}
+	return factory(options)
+}
+
+// Load creates writers from the given config (or default writers when the
+// list is empty), and installs rules to select writers by metric name.
+func Load(writerConfigs []config.WriterConfig, writerRules []config.WriterRule) (writers []Writer, err os.Error) {
+	if len(writerConfigs) == 0 {
+		writerConfigs = make([]config.WriterConfig, len(defaultWriters))
+		for i, name := range defaultWriters {
+			writerConfigs[i] = config.WriterConfig{Name: name}
+		}
+	}
+
+	configured := make(map[string]bool)
+	writers = make([]Writer, 0, len(writerConfigs))
+	for _, writerConfig := range writerConfigs {
+		if configured[writerConfig.Name] {
+			return nil, os.NewError(fmt.Sprintf("Writer %q is configured twice", writerConfig.Name))
+		}
+		writer, err := New(writerConfig.Name, writerConfig.Options)
+		if err != nil {
+			return nil, err
+		}
+		configured[writerConfig.Name] = true
+		writers = append(writers, writer)
+	}
+
+	for _, rule := range writerRules {
+		if _, err := path.Match(rule.Match, ""); err != nil {
+			return nil, os.NewError(fmt.Sprintf("Writer rule pattern is invalid: %q", rule.Match))
+		}
+		for _, name := range rule.Writers {
+			if !configured[name] {
+				return nil, os.NewError(fmt.Sprintf("Writer %q used in rule %q is not configured", name, rule.Match))
+			}
+		}
+	}
+	setRules(writerRules)
+
+	rulesMutex.Lock()
+	defer rulesMutex.Unlock()
+	loaded = make(map[string]Writer)
+	for _, writer := range writers {
+		loaded[writer.Name()] = writer
+	}
+	return
+}
+
+// Find returns the writer with the given name created by Load, or nil when
+// it is not configured.
+func Find(name string) Writer {
+	rulesMutex.Lock()
+	defer rulesMutex.Unlock()
+
+	return loaded[name]
+}
+
+// setRules replaces rules used to select writers, and resets the cache.
+func setRules(writerRules []config.WriterRule) {
+	rulesMutex.Lock()
+	defer rulesMutex.Unlock()
+
+	rules = writerRules
+	rulesCache = make(map[string][]string)
+}
+
+// selectWriters returns names of writers used to aggregate the metric with
+// the given name and type. The first rule matching metric name wins, metrics
+// not matching any rule are aggregated by writers used for their type.
+func selectWriters(name string, metricType types.MetricType) []string {
+	rulesMutex.Lock()
+	defer rulesMutex.Unlock()
+
+	key := name + "|" + metricType.String()
+	if names, found := rulesCache[key]; found {
+		return names
+	}
+
+	names := writersByType[metricType]
+	for _, rule := range rules {
+		if matched, _ := path.Match(rule.Match, name); matched {
+			names = rule.Writers
+			break
+		}
+	}
+	rulesCache[key] = names
+	return names
+}
+
+// simpleFactory returns a factory for writers without options.
+func simpleFactory(name string, create func() Writer) Factory {
+	return func(options map[string]interface{}) (Writer, os.Error) {
+		if len(options) > 0 {
+			return nil, os.NewError(fmt.Sprintf("Writer %q does not accept options", name))
+		}
+		return create(), nil
+	}
+}
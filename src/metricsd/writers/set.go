@@ -0,0 +1,82 @@
+package writers
+
+import (
+	"fmt"
+	"metricsd/types"
+)
+
+// Set writer is used to calculate number of unique members of a StatsD set.
+type Set struct {
+	*BaseWriter
+}
+
+// setItem stores summary information about sample set.
+type setItem struct {
+	// Timestamp of the sample set.
+	time int64
+	// Number of unique values in the sample set.
+	unique uint64
+}
+
+func init() {
+	Register("set", simpleFactory("set", func() Writer { return &Set{} }))
+}
+
+// Name returns the name of the writer.
+func (*Set) Name() string {
+	return "set"
+}
+
+// rollupData performs summarization on the given sample set and returns
+// setItem with statistics. Members of sample sets switched to sketches are
+// not known, so they are skipped.
+func (self *Set) rollupData(set *types.SampleSet) (data dataItem) {
+	if len(set.Values) == 0 {
+		return
+	}
+	members := make(map[float64]bool, len(set.Values))
+	for _, elem := range set.Values {
+		members[elem] = true
+	}
+	data = &setItem{time: set.Time, unique: uint64(len(members))}
+	return
+}
+
+// String returns string representation of the given setItem.
+func (self *setItem) String() string {
+	return fmt.Sprintf("setItem[time=%d, unique=%d]", self.time, self.unique)
+}
+
+// rrdInfo returns the list of parameters used to create RRD file.
+func (*setItem) rrdInfo() []string {
+	return []string{
+		"DS:unique:GAUGE:600:0:U",
+		"RRA:AVERAGE:0.5:1:25920",   // 72 hours at 1 sample per 10 secs
+		"RRA:AVERAGE:0.5:60:4320",   // 1 month at 1 sample per 10 mins
+		"RRA:AVERAGE:0.5:2880:5475", // 5 years at 1 sample per 8 hours
+		"RRA:MAX:0.5:1:25920",       // 72 hours at 1 sample per 10 secs
+		"RRA:MAX:0.5:60:4320",       // 1 month at 1 sample per 10 mins
+		"RRA:MAX:0.5:2880:5475",     // 5 years at 1 sample per 8 hours
+	}
+}
+
+// rrdTemplate returns template for RRDTool used to update data.
+func (*setItem) rrdTemplate() string {
+	return "unique"
+}
+
+// rrdString returns a string matching template format with the data to
+// update RRD files.
+func (self *setItem) rrdString() string {
+	return fmt.Sprintf("%d:%d", self.time, self.unique)
+}
+
+// promType returns the type of Prometheus metrics.
+func (*setItem) promType() string {
+	return promGauge
+}
+
+// promSamples returns values exposed in the Prometheus text format.
+func (self *setItem) promSamples() []promSample {
+	return []promSample{promSample{suffix: "_unique", value: float64(self.unique)}}
+}
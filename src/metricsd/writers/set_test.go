@@ -0,0 +1,35 @@
+package writers
+
+import (
+	. "launchpad.net/gocheck"
+)
+
+type SetS struct {
+	set *Set
+}
+
+var _ = Suite(&SetS{})
+
+func (s *SetS) SetUpTest(c *C) {
+	s.set = &Set{}
+}
+
+func (s *SetS) TestRollupDataWithEmptySampleSet(c *C) {
+	ss := createSampleSet(1000)
+	data := s.set.rollupData(ss)
+	c.Check(data, IsNil)
+}
+
+func (s *SetS) TestRollupDataCountsUniqueMembers(c *C) {
+	ss := createSampleSet(2000, 1, 2, 1, 3, 2)
+	data := s.set.rollupData(ss)
+	c.Check(data, Equals, &setItem{time: 2000, unique: 3})
+}
+
+func (s *SetS) TestRollupDataSkipsSketches(c *C) {
+	ss := createSampleSet(3000)
+	ss.UseSketch(0.01, 0)
+	fillSampleSet(ss, 1, 2, 1)
+	data := s.set.rollupData(ss)
+	c.Check(data, IsNil)
+}
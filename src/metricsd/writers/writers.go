@@ -6,9 +6,10 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"time"
 	"metricsd/config"
+	"metricsd/rrd"
 	"metricsd/types"
-	"github.com/kpumuk/gorrd"
 )
 
 type rrdUpdateTask struct {
@@ -24,13 +25,78 @@ var (
 	rrdUpdateTasks chan *rrdUpdateTask
 	// Indicating whether RRD update threads were created
 	rrdUpdateThreadsPrepared bool = false
+	// RRD update stats by writer name
+	rrdStats = make(map[string]*RrdStats)
+	// RRD update stats lock (updated by RRD update threads)
+	rrdStatsMutex sync.Mutex
 )
 
+// RrdStats describes RRD updates performed by a writer since start.
+type RrdStats struct {
+	Updates int64 // number of RRD file updates
+	Errors  int64 // number of failed updates
+	Time    int64 // total time of updates in nanoseconds
+}
+
+// writersByType lists names of the writers used to aggregate metrics of each
+// type (unless overridden by writer rules).
+var writersByType = map[types.MetricType][]string{
+	types.Untyped: []string{"count", "quartiles", "percentiles"},
+	types.Counter: []string{"counter"},
+	types.Timer:   []string{"quartiles", "percentiles"},
+	types.Gauge:   []string{"gauge"},
+	types.Set:     []string{"set"},
+}
+
+// UpdateStats returns RRD update stats by writer name.
+func UpdateStats() map[string]RrdStats {
+	rrdStatsMutex.Lock()
+	defer rrdStatsMutex.Unlock()
+
+	stats := make(map[string]RrdStats, len(rrdStats))
+	for name, writerStats := range rrdStats {
+		stats[name] = *writerStats
+	}
+	return stats
+}
+
+// QueueLength returns the number of RRD update tasks waiting for update
+// threads.
+func QueueLength() int {
+	return len(rrdUpdateTasks)
+}
+
+// Accepts returns a value indicating whether the given writer should be used
+// to aggregate the given sample set (based on writer rules and metric type).
+func Accepts(writer Writer, set *types.SampleSet) bool {
+	for _, name := range selectWriters(set.Name, set.Type) {
+		if name == writer.Name() {
+			return true
+		}
+	}
+	return false
+}
+
+// Select returns sample sets from the given list, which should be aggregated
+// by the given writer. Order of sample sets is preserved.
+func Select(writer Writer, sets []*types.SampleSet) (selected []*types.SampleSet) {
+	selected = make([]*types.SampleSet, 0, len(sets))
+	for _, set := range sets {
+		if Accepts(writer, set) {
+			selected = append(selected, set)
+		}
+	}
+	return
+}
+
 func Rollup(writer Writer, set *types.SampleSet) {
 	prepareRrdUpdateThreads()
 	wg := &sync.WaitGroup{}
 
 	if data := writer.rollupData(set); data != nil {
+		sendToCarbon(writer, set, data)
+		rememberLatest(writer, set, data)
+		checkAlerts(writer, set, data)
 		updateRrd(writer, set, data, wg, func(args []string) []string {
 			return append(args, data.rrdString())
 		})
@@ -50,14 +116,15 @@ func BatchRollup(writer Writer, sets []*types.SampleSet) {
 
 	for cur, set := range sets {
 		// config.Logger.Debug("... source=%s, name=%s, prevSource=%s, prevName=%s", set.Source, set.Name, prevSource, prevName)
+		name := set.FullName()
 		if cur == 0 {
 			prevSource = set.Source
-			prevName = set.Name
+			prevName = name
 		}
 
 		// Next item in the sequence of samples
 		pushed := false
-		if prevSource == set.Source && prevName == set.Name {
+		if prevSource == set.Source && prevName == name {
 			if item := writer.rollupData(set); item != nil {
 				data = append(data, item)
 			}
@@ -65,12 +132,12 @@ func BatchRollup(writer Writer, sets []*types.SampleSet) {
 		}
 
 		// Reached a new sequence or the end of samples list
-		if prevSource != set.Source || prevName != set.Name || cur == len(sets)-1 {
+		if prevSource != set.Source || prevName != name || cur == len(sets)-1 {
 			batchRollup(writer, sets[from], data, wg)
 
 			from = cur
 			prevSource = set.Source
-			prevName = set.Name
+			prevName = name
 			data = make([]dataItem, 0, 10)
 		}
 
@@ -96,6 +163,10 @@ func batchRollup(writer Writer, firstSampleSet *types.SampleSet, data []dataItem
 		return
 	}
 
+	sendToCarbon(writer, firstSampleSet, data...)
+	rememberLatest(writer, firstSampleSet, data...)
+	checkAlerts(writer, firstSampleSet, data...)
+
 	// Update RRD database
 	updateRrd(writer, firstSampleSet, data[0], wg, func(args []string) []string {
 		// Serialize all data items to the arguments array
@@ -133,36 +204,82 @@ func updateRrd(writer Writer, firstSampleSet *types.SampleSet, firstDataItem dat
 	rrdUpdateTasks <- &rrdUpdateTask{writer: writer, firstSampleSet: firstSampleSet, firstDataItem: firstDataItem, f: f, wg: wg}
 }
 
+// doUpdateRrd updates (or creates) the RRD file, and records the update
+// stats of the writer.
 func doUpdateRrd(writer Writer, firstSampleSet *types.SampleSet, firstDataItem dataItem, args []string) {
+	startTime := time.Nanoseconds()
 	file := getRrdFile(writer, firstSampleSet)
+	err := updateRrdFile(file, firstSampleSet, firstDataItem, args)
+	recordRrdUpdate(writer.Name(), time.Nanoseconds()-startTime, err)
+	if err != nil {
+		config.Logger.Warn("Cannot update %s: %s", file, err)
+	}
+}
+
+// recordRrdUpdate adds the RRD update to stats of the writer.
+func recordRrdUpdate(name string, duration int64, err os.Error) {
+	rrdStatsMutex.Lock()
+	defer rrdStatsMutex.Unlock()
+
+	stats, found := rrdStats[name]
+	if !found {
+		stats = &RrdStats{}
+		rrdStats[name] = stats
+	}
+	stats.Updates++
+	stats.Time += duration
+	if err != nil {
+		stats.Errors++
+	}
+}
+
+// updateRrdFile updates the RRD file, it is created (or recreated, when data
+// sources have been changed) if needed.
+func updateRrdFile(file string, firstSampleSet *types.SampleSet, firstDataItem dataItem, args []string) os.Error {
 	if _, err := os.Stat(file); err != nil {
 		err := rrd.Create(file, int64(config.SliceInterval), firstSampleSet.Time-int64(config.SliceInterval), firstDataItem.rrdInfo())
 		if err != nil {
-			config.Logger.Debug("Error occurred: %s", err)
-			return
+			return err
 		}
 	}
 	// config.Logger.Debug("... file=%s", file)
 	err := rrd.Update(file, firstDataItem.rrdTemplate(), args)
-	if err != nil {
-		config.Logger.Debug("Error occurred: %s", err)
+	if _, ok := err.(*rrd.UnknownDataSourceError); ok {
+		// Data sources have been changed (e.g. a different list of
+		// percentiles configured), keep the old file and start a new one
+		err = recreateRrd(file, firstSampleSet, firstDataItem)
+		if err == nil {
+			err = rrd.Update(file, firstDataItem.rrdTemplate(), args)
+		}
 	}
+	return err
+}
+
+// recreateRrd renames RRD file created with a different set of data sources
+// to file.rrd.<timestamp>.old, and creates a new one in place of it.
+func recreateRrd(file string, firstSampleSet *types.SampleSet, firstDataItem dataItem) os.Error {
+	oldFile := fmt.Sprintf("%s.%d.old", file, time.Seconds())
+	config.Logger.Warn("Data sources of %s have been changed, renaming it to %s", file, oldFile)
+	if err := os.Rename(file, oldFile); err != nil {
+		return err
+	}
+	return rrd.Create(file, int64(config.SliceInterval), firstSampleSet.Time-int64(config.SliceInterval), firstDataItem.rrdInfo())
 }
 
 func getRrdFile(writer Writer, set *types.SampleSet) string {
 	dir := fmt.Sprintf("%s/%s", config.DataDir, set.Source)
 	os.MkdirAll(dir, 0755)
 	// This is temporary solution while we migrate from $ grouping to .
-	metricName := strings.Replace(set.Name, "$", ".", -1)
-	if strings.HasSuffix(metricName, "_time") {
-		metricName = metricName[0:len(metricName)-len("_time")] + ".time"
-	}
-	if strings.HasSuffix(metricName, "_count") {
-		metricName = metricName[0:len(metricName)-len("_count")] + ".status"
+	metricName := types.StoredName(set.Name)
+	// Tagged series are stored next to the metric: name,key1=value1,key2=value2-writer.rrd
+	if len(set.Tags) > 0 {
+		metricName += "," + set.Tags.String()
 	}
 	file := fmt.Sprintf("%s-%s", metricName, writer.Name())
 	path := fmt.Sprintf("%s/%s.rrd", dir, file)
-	migrateDollarGroupsToDots(dir, file, path)
+	if len(set.Tags) == 0 {
+		migrateDollarGroupsToDots(dir, file, path)
+	}
 	return path
 }
 
@@ -2,21 +2,147 @@ package writers
 
 import (
 	. "launchpad.net/gocheck"
+	"os"
+	"strings"
 	"testing"
+	"metricsd/config"
 	"metricsd/types"
 )
 
 // Hook up gocheck into the gotest runner.
 func Test(t *testing.T) { TestingT(t) }
 
-func createSampleSet(time int64, values ...int) (ss *types.SampleSet) {
+func createSampleSet(time int64, values ...float64) (ss *types.SampleSet) {
 	ss = types.NewSampleSet(time, "src", "metric")
 	fillSampleSet(ss, values...)
 	return
 }
 
-func fillSampleSet(ss *types.SampleSet, values ...int) {
+func fillSampleSet(ss *types.SampleSet, values ...float64) {
 	for _, value := range values {
 		ss.Add(value)
 	}
 }
+
+type WritersS struct{}
+
+var _ = Suite(&WritersS{})
+
+func (s *WritersS) TearDownTest(c *C) {
+	setRules(nil)
+}
+
+func typedSampleSet(name string, metricType types.MetricType) *types.SampleSet {
+	return types.NewTypedSampleSet(10, "src", name, metricType)
+}
+
+func (s *WritersS) TestAcceptsUntypedMetrics(c *C) {
+	set := typedSampleSet("metric", types.Untyped)
+	c.Check(Accepts(&Count{}, set), Equals, true)
+	c.Check(Accepts(&Quartiles{}, set), Equals, true)
+	c.Check(Accepts(&Percentiles{}, set), Equals, true)
+	c.Check(Accepts(&Counter{}, set), Equals, false)
+}
+
+func (s *WritersS) TestAcceptsTypedMetrics(c *C) {
+	c.Check(Accepts(&Counter{}, typedSampleSet("metric", types.Counter)), Equals, true)
+	c.Check(Accepts(&Count{}, typedSampleSet("metric", types.Counter)), Equals, false)
+	c.Check(Accepts(&Percentiles{}, typedSampleSet("metric", types.Timer)), Equals, true)
+	c.Check(Accepts(&Gauge{}, typedSampleSet("metric", types.Gauge)), Equals, true)
+	c.Check(Accepts(&Set{}, typedSampleSet("metric", types.Set)), Equals, true)
+	c.Check(Accepts(&Gauge{}, typedSampleSet("metric", types.Set)), Equals, false)
+}
+
+func (s *WritersS) TestAcceptsWithRules(c *C) {
+	setRules([]config.WriterRule{
+		config.WriterRule{Match: "*.status", Writers: []string{"count"}},
+		config.WriterRule{Match: "*.time", Writers: []string{"percentiles"}},
+		config.WriterRule{Match: "app.*", Writers: []string{"quartiles"}},
+	})
+
+	status := typedSampleSet("user.login.status", types.Untyped)
+	c.Check(Accepts(&Count{}, status), Equals, true)
+	c.Check(Accepts(&Quartiles{}, status), Equals, false)
+	c.Check(Accepts(&Percentiles{}, status), Equals, false)
+
+	// The first matching rule wins
+	time := typedSampleSet("app.time", types.Timer)
+	c.Check(Accepts(&Percentiles{}, time), Equals, true)
+	c.Check(Accepts(&Quartiles{}, time), Equals, false)
+
+	// Metrics not matching any rule are aggregated by writers for their type
+	other := typedSampleSet("requests", types.Counter)
+	c.Check(Accepts(&Counter{}, other), Equals, true)
+	c.Check(Accepts(&Count{}, other), Equals, false)
+}
+
+func (s *WritersS) TestLoadDefaultWriters(c *C) {
+	writers, err := Load(nil, nil)
+	c.Assert(err, IsNil)
+	names := make([]string, len(writers))
+	for i, writer := range writers {
+		names[i] = writer.Name()
+	}
+	c.Check(strings.Join(names, ","), Equals, strings.Join(defaultWriters, ","))
+}
+
+func (s *WritersS) TestLoadWriters(c *C) {
+	writers, err := Load(
+		[]config.WriterConfig{config.WriterConfig{Name: "count"}, config.WriterConfig{Name: "percentiles"}},
+		[]config.WriterRule{config.WriterRule{Match: "*.time", Writers: []string{"percentiles"}}},
+	)
+	c.Assert(err, IsNil)
+	c.Check(len(writers), Equals, 2)
+	c.Check(writers[0].Name(), Equals, "count")
+	c.Check(writers[1].Name(), Equals, "percentiles")
+	c.Check(Accepts(writers[1], typedSampleSet("db.time", types.Untyped)), Equals, true)
+	c.Check(Accepts(writers[0], typedSampleSet("db.time", types.Untyped)), Equals, false)
+}
+
+func (s *WritersS) TestLoadErrors(c *C) {
+	_, err := Load([]config.WriterConfig{config.WriterConfig{Name: "unknown"}}, nil)
+	c.Check(err.String(), Equals, `Writer "unknown" is not registered`)
+
+	_, err = Load([]config.WriterConfig{config.WriterConfig{Name: "count"}, config.WriterConfig{Name: "count"}}, nil)
+	c.Check(err.String(), Equals, `Writer "count" is configured twice`)
+
+	_, err = Load([]config.WriterConfig{config.WriterConfig{Name: "count", Options: map[string]interface{}{"a": 1.0}}}, nil)
+	c.Check(err.String(), Equals, `Writer "count" does not accept options`)
+
+	_, err = Load(
+		[]config.WriterConfig{config.WriterConfig{Name: "count"}},
+		[]config.WriterRule{config.WriterRule{Match: "*.time", Writers: []string{"percentiles"}}},
+	)
+	c.Check(err.String(), Equals, `Writer "percentiles" used in rule "*.time" is not configured`)
+
+	_, err = Load(nil, []config.WriterRule{config.WriterRule{Match: "[", Writers: []string{"count"}}})
+	c.Check(err.String(), Equals, `Writer rule pattern is invalid: "["`)
+}
+
+func (s *WritersS) TestRegistered(c *C) {
+	c.Check(strings.Join(Registered(), ","), Equals, "count,counter,gauge,percentiles,quartiles,set")
+}
+
+func (s *WritersS) TestUpdateStats(c *C) {
+	rrdStats = make(map[string]*RrdStats)
+	recordRrdUpdate("count", 1000, nil)
+	recordRrdUpdate("count", 3000, os.NewError("disk is full"))
+	recordRrdUpdate("gauge", 500, nil)
+
+	stats := UpdateStats()
+	c.Check(stats["count"], Equals, RrdStats{Updates: 2, Errors: 1, Time: 4000})
+	c.Check(stats["gauge"], Equals, RrdStats{Updates: 1, Errors: 0, Time: 500})
+	c.Check(len(stats), Equals, 2)
+}
+
+func (s *WritersS) TestSelect(c *C) {
+	sets := []*types.SampleSet{
+		types.NewTypedSampleSet(10, "src", "a", types.Counter),
+		types.NewTypedSampleSet(10, "src", "b", types.Gauge),
+		types.NewTypedSampleSet(20, "src", "a", types.Counter),
+	}
+	selected := Select(&Counter{}, sets)
+	c.Check(len(selected), Equals, 2)
+	c.Check(selected[0], Equals, sets[0])
+	c.Check(selected[1], Equals, sets[2])
+}